@@ -0,0 +1,514 @@
+package decoder
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hdt3213/rdb/parser"
+)
+
+// AOF file types in a manifest
+const (
+	aofTypeBase    = "b"
+	aofTypeHistory = "h"
+	aofTypeIncr    = "i"
+)
+
+// AOFManifest lists the files of a multi-part AOF directory (Redis 7+)
+type AOFManifest struct {
+	Base  string   // base file, an RDB or a plain AOF, empty if there is none
+	Incrs []string // incremental AOF files in replay order
+}
+
+// ReadAOFManifest reads the *.manifest file of an appendonlydir. History
+// files are left out, they were already merged into the base.
+func ReadAOFManifest(dir string) (*AOFManifest, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.manifest"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) != 1 {
+		return nil, fmt.Errorf("%w: %d manifest files in %s", ErrNotAOF, len(matches), dir)
+	}
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		return nil, err
+	}
+
+	type incr struct {
+		name string
+		seq  int64
+	}
+	var incrs []incr
+	m := &AOFManifest{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitManifestLine(line)
+		if err != nil || len(fields)%2 != 0 {
+			return nil, fmt.Errorf("%w: invalid manifest line %d: %q", ErrNotAOF, n+1, line)
+		}
+		info := map[string]string{}
+		for i := 0; i < len(fields); i += 2 {
+			info[fields[i]] = fields[i+1]
+		}
+		name := info["file"]
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("%w: invalid file name on manifest line %d", ErrNotAOF, n+1)
+		}
+		switch info["type"] {
+		case aofTypeBase:
+			m.Base = name
+		case aofTypeIncr:
+			seq, _ := strconv.ParseInt(info["seq"], 10, 64)
+			incrs = append(incrs, incr{name: name, seq: seq})
+		case aofTypeHistory:
+		default:
+			return nil, fmt.Errorf("%w: unknown file type %q on manifest line %d", ErrNotAOF, info["type"], n+1)
+		}
+	}
+	sort.SliceStable(incrs, func(i, j int) bool { return incrs[i].seq < incrs[j].seq })
+	for _, i := range incrs {
+		m.Incrs = append(m.Incrs, i.name)
+	}
+	if m.Base == "" && len(m.Incrs) == 0 {
+		return nil, fmt.Errorf("%w: empty manifest", ErrNotAOF)
+	}
+	return m, nil
+}
+
+// splitManifestLine splits a manifest line on spaces, names with spaces
+// are double quoted
+func splitManifestLine(line string) ([]string, error) {
+	var fields []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] != '"' {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+		end := 1
+		for ; end < len(line) && line[end] != '"'; end++ {
+			if line[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(line) {
+			return nil, errors.New("unterminated quote")
+		}
+		s, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, s)
+		line = line[end+1:]
+	}
+	return fields, nil
+}
+
+// IsAOFDir reports whether dir looks like an appendonlydir
+func IsAOFDir(dir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.manifest"))
+	return len(matches) > 0
+}
+
+// respMaxBulkLen is the longest argument an AOF may hold, Redis's default
+// proto-max-bulk-len
+const respMaxBulkLen = 512 << 20
+
+// respMaxPrealloc bounds the arguments allocated ahead of reading them, so
+// a corrupt argument count does not allocate gigabytes
+const respMaxPrealloc = 1024
+
+// respReader reads the commands of an AOF
+type respReader struct {
+	br     *bufio.Reader
+	offset int64 // bytes read before the current command
+	read   int64
+	ts     int64 // last #TS annotation, unix seconds
+}
+
+func newRESPReader(r io.Reader) *respReader {
+	return &respReader{br: bufio.NewReaderSize(r, 64*1024)}
+}
+
+func (r *respReader) line() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	r.read += int64(len(line))
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", ErrCorrupt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// next returns the next command, io.EOF at the end and ErrTruncated when the
+// file ends inside a command
+func (r *respReader) next() ([][]byte, error) {
+	for {
+		r.offset = r.read
+		line, err := r.line()
+		if err == io.EOF && r.read == r.offset {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, truncated(err)
+		}
+		if len(line) == 0 {
+			continue
+		}
+		switch line[0] {
+		case '#':
+			// annotations, "#TS:<unix seconds>" with aof-timestamp-enabled
+			if ts, ok := bytes.CutPrefix(line, []byte("#TS:")); ok {
+				r.ts, _ = strconv.ParseInt(string(ts), 10, 64)
+			}
+			continue
+		case '*':
+		default:
+			return nil, fmt.Errorf("%w: expected a command, got %q", ErrCorrupt, line)
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: invalid argument count %q", ErrCorrupt, line)
+		}
+		args := make([][]byte, 0, min(n, respMaxPrealloc))
+		for i := 0; i < n; i++ {
+			line, err := r.line()
+			if err != nil {
+				return nil, truncated(err)
+			}
+			if len(line) == 0 || line[0] != '$' {
+				return nil, fmt.Errorf("%w: expected a bulk string, got %q", ErrCorrupt, line)
+			}
+			size, err := strconv.Atoi(string(line[1:]))
+			if err != nil || size < 0 || size > respMaxBulkLen {
+				return nil, fmt.Errorf("%w: invalid bulk length %q", ErrCorrupt, line)
+			}
+			arg := make([]byte, size+2)
+			read, err := io.ReadFull(r.br, arg)
+			r.read += int64(read)
+			if err != nil {
+				return nil, truncated(err)
+			}
+			args = append(args, arg[:size])
+		}
+		if len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// countingReader reports the bytes read to progress
+type countingReader struct {
+	r        io.Reader
+	done     *int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.done += int64(n)
+	if c.progress != nil {
+		c.progress(*c.done, c.total)
+	}
+	return n, err
+}
+
+// DecodeAOFDir decodes a multi-part AOF directory: the base RDB is decoded
+// and the incremental AOFs are replayed on top of it, so the entries are
+// those an RDB saved after the last command would hold. progress, if not
+// nil, gets the bytes read so far and the total, the incremental files are
+// read twice.
+//
+// Only the keys the AOFs touch are kept in memory. Keys changed by a
+// command the replay does not model are skipped with ErrUnsupportedCommand.
+func (d *Decoder) DecodeAOFDir(dir string, progress func(done, total int64)) (err error) {
+	defer d.closeEntries()
+	fail := func(file string, offset int64, reason error, detail string) error {
+		if de, ok := reason.(*DecodeError); ok {
+			d.err = de
+		} else {
+			d.err = &DecodeError{Offset: offset, Err: reason, Detail: file + ": " + detail}
+		}
+		return d.err
+	}
+
+	m, err := ReadAOFManifest(dir)
+	if err != nil {
+		return fail(dir, 0, ErrNotAOF, err.Error())
+	}
+	var done, total int64
+	open := func(name string) (*os.File, io.Reader, error) {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, &countingReader{r: f, done: &done, total: total, progress: progress}, nil
+	}
+	for i, name := range append([]string{m.Base}, m.Incrs...) {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return fail(name, 0, ErrNotAOF, err.Error())
+		}
+		total += fi.Size()
+		if i > 0 {
+			total += fi.Size()
+		}
+	}
+
+	// a base without an RDB preamble is replayed like the incremental files
+	incrs := m.Incrs
+	baseRDB := m.Base != ""
+	if baseRDB {
+		head := make([]byte, 6)
+		f, err := os.Open(filepath.Join(dir, m.Base))
+		if err != nil {
+			return fail(m.Base, 0, ErrNotAOF, err.Error())
+		}
+		_, err = io.ReadFull(f, head)
+		f.Close()
+		if err != nil || !IsRDBHeader(head) {
+			baseRDB = false
+			incrs = append([]string{m.Base}, incrs...)
+			total += fileSize(dir, m.Base)
+		}
+	}
+
+	// first pass: the keys the commands touch, and the time of the last one
+	touched := newAOFTouched()
+	for i, name := range incrs {
+		f, r, err := open(name)
+		if err != nil {
+			return fail(name, 0, ErrNotAOF, err.Error())
+		}
+		rr := newRESPReader(r)
+		for {
+			args, err := rr.next()
+			if err == io.EOF || (err == ErrTruncated && i == len(incrs)-1) {
+				// like aof-load-truncated, a partial last command is ignored
+				break
+			}
+			if err != nil {
+				f.Close()
+				return fail(name, rr.offset, err, fmt.Sprintf("at byte %d", rr.offset))
+			}
+			touched.add(args)
+		}
+		if rr.ts > touched.ts {
+			touched.ts = rr.ts
+		}
+		if fi, err := f.Stat(); err == nil && fi.ModTime().Unix() > touched.mtime {
+			touched.mtime = fi.ModTime().Unix()
+		}
+		f.Close()
+	}
+
+	// the point in time of the analysis is the last command, for the keys
+	// of the base as well as the replayed ones
+	switch {
+	case touched.ts > 0:
+		d.at = touched.ts
+	case touched.mtime > 0:
+		d.at = touched.mtime
+	}
+
+	ks := newAOFKeyspace()
+	if baseRDB {
+		f, r, err := open(m.Base)
+		if err != nil {
+			return fail(m.Base, 0, ErrNotAOF, err.Error())
+		}
+		err = d.decodeRDB(r, func(obj parser.RedisObject, serialized uint64) bool {
+			if touched.all || touched.keys[obj.GetKey()] {
+				ks.load(obj, serialized)
+				return true
+			}
+			// untouched keys of a flushed database are gone
+			return touched.flushedAll || touched.flushed[obj.GetDBIndex()]
+		})
+		f.Close()
+		if err != nil {
+			return fail(m.Base, 0, err, "")
+		}
+	}
+
+	ks.now = d.snapshotTime() * 1000
+
+	// second pass: replay
+	for i, name := range incrs {
+		f, r, err := open(name)
+		if err != nil {
+			return fail(name, 0, ErrNotAOF, err.Error())
+		}
+		rr := newRESPReader(r)
+		for {
+			args, err := rr.next()
+			if err == io.EOF || (err == ErrTruncated && i == len(incrs)-1) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return fail(name, rr.offset, err, fmt.Sprintf("at byte %d", rr.offset))
+			}
+			if rr.ts > 0 {
+				ks.now = rr.ts * 1000
+			}
+			ks.apply(args)
+		}
+		f.Close()
+	}
+	ks.now = d.snapshotTime() * 1000
+
+	for _, db := range ks.sortedDBs() {
+		for key, v := range ks.dbs[db] {
+			if v.unsupported != "" {
+				d.skip(v.typeName(), key, db, -1, 0, fmt.Errorf("%w: %s", ErrUnsupportedCommand, v.unsupported))
+				continue
+			}
+			d.send(d.newEntry(v.object(db, key), v.serializedSize()))
+		}
+	}
+	return nil
+}
+
+// fileSize returns the size of a file, 0 if it cannot be read
+func fileSize(dir, name string) int64 {
+	info, err := os.Stat(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// aofTouched collects the keys the commands of an AOF touch
+type aofTouched struct {
+	keys       map[string]bool
+	flushed    map[int]bool
+	flushedAll bool
+	all        bool // SWAPDB mixes databases, every key is replayed
+	db         int
+	ts         int64 // last #TS annotation
+	mtime      int64 // newest incremental file
+}
+
+func newAOFTouched() *aofTouched {
+	return &aofTouched{keys: map[string]bool{}, flushed: map[int]bool{}}
+}
+
+func (t *aofTouched) add(args [][]byte) {
+	cmd := strings.ToLower(string(args[0]))
+	switch cmd {
+	case "select":
+		if len(args) > 1 {
+			t.db, _ = strconv.Atoi(string(args[1]))
+		}
+		return
+	case "flushdb":
+		t.flushed[t.db] = true
+		return
+	case "flushall":
+		t.flushedAll = true
+		return
+	case "swapdb":
+		t.all = true
+		return
+	}
+	for _, k := range commandKeys(cmd, args) {
+		t.keys[string(k)] = true
+	}
+}
+
+// keySpec gives the argument positions of the keys of a command: from first
+// to last (negative counts from the end) every step arguments
+type keySpec struct {
+	first, last, step int
+}
+
+var commandKeySpecs = map[string]keySpec{
+	"del": {1, -1, 1}, "unlink": {1, -1, 1},
+	"mset": {1, -1, 2}, "msetnx": {1, -1, 2},
+	"rename": {1, 2, 1}, "renamenx": {1, 2, 1}, "copy": {1, 2, 1},
+	"smove": {1, 2, 1}, "lmove": {1, 2, 1}, "rpoplpush": {1, 2, 1},
+	"sinterstore": {1, -1, 1}, "sunionstore": {1, -1, 1}, "sdiffstore": {1, -1, 1},
+	// numkeys, weights and the like are taken as keys too, which only
+	// keeps a few more keys in memory
+	"zunionstore": {1, -1, 1}, "zinterstore": {1, -1, 1}, "zdiffstore": {1, -1, 1},
+	"zrangestore": {1, 2, 1}, "pfmerge": {1, -1, 1}, "bitop": {2, -1, 1},
+	"multi": {0, -1, 1}, "exec": {0, -1, 1}, "discard": {0, -1, 1}, "ping": {0, -1, 1},
+	"function": {0, -1, 1}, "script": {0, -1, 1},
+}
+
+// commandKeys returns the keys of a command, the first argument for
+// commands not in commandKeySpecs
+func commandKeys(cmd string, args [][]byte) [][]byte {
+	spec, ok := commandKeySpecs[cmd]
+	if !ok {
+		spec = keySpec{1, 1, 1}
+	}
+	if spec.first == 0 {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys [][]byte
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// parseExpire returns the absolute unix ms of a relative or absolute
+// expire in seconds or milliseconds
+func parseExpire(arg []byte, now int64, ms, absolute bool) (int64, bool) {
+	v, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if !ms {
+		v *= 1000
+	}
+	if !absolute {
+		v += now
+	}
+	return v, true
+}
+
+// expiration converts unix ms to the expiration of a parsed object
+func expiration(ms int64) *time.Time {
+	if ms <= 0 {
+		return nil
+	}
+	t := time.UnixMilli(ms)
+	return &t
+}
@@ -0,0 +1,1171 @@
+package decoder
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hdt3213/rdb/model"
+	"github.com/hdt3213/rdb/parser"
+)
+
+// aofValue is a key kept in memory while an AOF is replayed
+type aofValue struct {
+	typ    string // string, hash, list, set or zset, else obj holds the value
+	str    []byte
+	hash   map[string][]byte
+	hexp   map[string]int64 // field TTLs, unix ms
+	list   aofList
+	set    map[string]struct{}
+	zset   map[string]float64
+	expire int64 // unix ms, 0 without a TTL
+
+	// obj is a value the replay cannot change (streams, modules), with its
+	// size in the base RDB
+	obj        parser.RedisObject
+	serialized uint64
+
+	// unsupported is the first command the replay could not apply
+	unsupported string
+}
+
+func (v *aofValue) typeName() string {
+	if v.obj != nil {
+		return v.obj.GetType()
+	}
+	return v.typ
+}
+
+// clone returns a deep copy, for COPY
+func (v *aofValue) clone() *aofValue {
+	c := *v
+	c.str = append([]byte(nil), v.str...)
+	if v.hash != nil {
+		c.hash = make(map[string][]byte, len(v.hash))
+		for k, val := range v.hash {
+			c.hash[k] = append([]byte(nil), val...)
+		}
+		c.hexp = make(map[string]int64, len(v.hexp))
+		for k, at := range v.hexp {
+			c.hexp[k] = at
+		}
+	}
+	if v.list.len() > 0 {
+		values := v.list.values()
+		c.list = aofList{tail: make([][]byte, len(values))}
+		for i, val := range values {
+			c.list.tail[i] = append([]byte(nil), val...)
+		}
+	}
+	if v.set != nil {
+		c.set = make(map[string]struct{}, len(v.set))
+		for m := range v.set {
+			c.set[m] = struct{}{}
+		}
+	}
+	if v.zset != nil {
+		c.zset = make(map[string]float64, len(v.zset))
+		for m, s := range v.zset {
+			c.zset[m] = s
+		}
+	}
+	return &c
+}
+
+// empty reports whether a collection lost its last element, Redis deletes the key then
+func (v *aofValue) empty() bool {
+	switch v.typ {
+	case "hash":
+		return len(v.hash) == 0
+	case "list":
+		return v.list.len() == 0
+	case "set":
+		return len(v.set) == 0
+	case "zset":
+		return len(v.zset) == 0
+	}
+	return false
+}
+
+// serializedSize approximates the size of the value in an RDB, only used
+// for modules which keep the size of the base
+func (v *aofValue) serializedSize() uint64 {
+	if v.obj != nil {
+		return v.serialized
+	}
+	size := uint64(len(v.str))
+	for k, val := range v.hash {
+		size += uint64(len(k) + len(val))
+	}
+	for _, val := range v.list.values() {
+		size += uint64(len(val))
+	}
+	for m := range v.set {
+		size += uint64(len(m))
+	}
+	for m := range v.zset {
+		size += uint64(len(m)) + 8
+	}
+	return size
+}
+
+// object converts the value to the object the RDB parser would return
+func (v *aofValue) object(db int, key string) parser.RedisObject {
+	base := &model.BaseObject{DB: db, Key: key, Expiration: expiration(v.expire), Size: int(v.serializedSize())}
+	switch v.typ {
+	case "string":
+		base.Type = model.StringType
+		return &parser.StringObject{BaseObject: base, Value: v.str}
+	case "hash":
+		base.Type = model.HashType
+		var expire map[string]int64
+		if len(v.hexp) > 0 {
+			expire = make(map[string]int64, len(v.hash))
+			for f := range v.hash {
+				expire[f] = v.hexp[f]
+			}
+		}
+		return &parser.HashObject{BaseObject: base, Hash: v.hash, FieldExpirations: expire}
+	case "list":
+		base.Type = model.ListType
+		return &parser.ListObject{BaseObject: base, Values: v.list.values()}
+	case "set":
+		base.Type = model.SetType
+		members := make([][]byte, 0, len(v.set))
+		for m := range v.set {
+			members = append(members, []byte(m))
+		}
+		return &parser.SetObject{BaseObject: base, Members: members}
+	case "zset":
+		base.Type = model.ZSetType
+		return &parser.ZSetObject{BaseObject: base, Entries: sortedZSet(v.zset)}
+	}
+	// streams and modules: only the key, db and TTL can have changed
+	switch o := v.obj.(type) {
+	case *parser.StreamObject:
+		o.BaseObject.DB, o.BaseObject.Key, o.BaseObject.Expiration = db, key, base.Expiration
+	case *model.ModuleTypeObject:
+		o.BaseObject.DB, o.BaseObject.Key, o.BaseObject.Expiration = db, key, base.Expiration
+	}
+	return v.obj
+}
+
+func sortedZSet(z map[string]float64) []*model.ZSetEntry {
+	entries := make([]*model.ZSetEntry, 0, len(z))
+	for m, s := range z {
+		entries = append(entries, &model.ZSetEntry{Member: m, Score: s})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score < entries[j].Score
+		}
+		return entries[i].Member < entries[j].Member
+	})
+	return entries
+}
+
+// aofKeyspace replays commands on the keys kept in memory
+type aofKeyspace struct {
+	dbs map[int]map[string]*aofValue
+	db  int
+	now int64 // unix ms of the command being replayed
+}
+
+func newAOFKeyspace() *aofKeyspace {
+	return &aofKeyspace{dbs: map[int]map[string]*aofValue{}}
+}
+
+func (ks *aofKeyspace) sortedDBs() []int {
+	dbs := make([]int, 0, len(ks.dbs))
+	for db := range ks.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	return dbs
+}
+
+func (ks *aofKeyspace) keys(db int) map[string]*aofValue {
+	keys := ks.dbs[db]
+	if keys == nil {
+		keys = map[string]*aofValue{}
+		ks.dbs[db] = keys
+	}
+	return keys
+}
+
+// load keeps a key of the base RDB
+func (ks *aofKeyspace) load(obj parser.RedisObject, serialized uint64) {
+	v := &aofValue{}
+	if exp := obj.GetExpiration(); exp != nil {
+		v.expire = exp.UnixMilli()
+	}
+	switch o := obj.(type) {
+	case *parser.StringObject:
+		v.typ, v.str = "string", o.Value
+	case *parser.HashObject:
+		v.typ, v.hash, v.hexp = "hash", o.Hash, map[string]int64{}
+		for f, at := range o.FieldExpirations {
+			if at > 0 {
+				v.hexp[f] = at
+			}
+		}
+	case *parser.ListObject:
+		v.typ, v.list = "list", aofList{tail: o.Values}
+	case *parser.SetObject:
+		v.typ, v.set = "set", make(map[string]struct{}, len(o.Members))
+		for _, m := range o.Members {
+			v.set[string(m)] = struct{}{}
+		}
+	case *parser.ZSetObject:
+		v.typ, v.zset = "zset", make(map[string]float64, len(o.Entries))
+		for _, e := range o.Entries {
+			v.zset[e.Member] = e.Score
+		}
+	default:
+		v.obj, v.serialized = obj, serialized
+	}
+	ks.keys(obj.GetDBIndex())[obj.GetKey()] = v
+}
+
+// get returns the value of key if it has type typ. A missing key is created
+// when create is set, a key of another type returns nil.
+func (ks *aofKeyspace) get(key []byte, typ string, create bool) *aofValue {
+	keys := ks.keys(ks.db)
+	v := keys[string(key)]
+	if v == nil {
+		if !create {
+			return nil
+		}
+		v = &aofValue{typ: typ}
+		switch typ {
+		case "hash":
+			v.hash, v.hexp = map[string][]byte{}, map[string]int64{}
+		case "set":
+			v.set = map[string]struct{}{}
+		case "zset":
+			v.zset = map[string]float64{}
+		}
+		keys[string(key)] = v
+	}
+	if v.typ != typ || v.unsupported != "" {
+		return nil
+	}
+	return v
+}
+
+// cleanup deletes a collection that lost its last element
+func (ks *aofKeyspace) cleanup(key []byte) {
+	if v := ks.dbs[ks.db][string(key)]; v != nil && v.empty() {
+		delete(ks.dbs[ks.db], string(key))
+	}
+}
+
+// unsupported marks the keys of a command the replay cannot apply
+func (ks *aofKeyspace) unsupported(cmd string, args [][]byte) {
+	for _, k := range commandKeys(cmd, args) {
+		keys := ks.keys(ks.db)
+		v := keys[string(k)]
+		if v == nil {
+			v = &aofValue{typ: "unknown"}
+			keys[string(k)] = v
+		}
+		if v.unsupported == "" {
+			v.unsupported = strings.ToUpper(cmd)
+		}
+	}
+}
+
+// apply replays one command. Commands are only in the AOF if they changed
+// the dataset, so conditions like NX are already known to have held.
+func (ks *aofKeyspace) apply(args [][]byte) {
+	cmd := strings.ToLower(string(args[0]))
+	defer func() {
+		if r := recover(); r != nil {
+			ks.unsupported(cmd, args)
+		}
+	}()
+	if !ks.applyKeyspace(cmd, args) &&
+		!ks.applyString(cmd, args) &&
+		!ks.applyHash(cmd, args) &&
+		!ks.applyList(cmd, args) &&
+		!ks.applySet(cmd, args) &&
+		!ks.applyZSet(cmd, args) {
+		ks.unsupported(cmd, args)
+	}
+}
+
+// applyKeyspace replays commands on whole keys and databases, false for
+// other commands or invalid arguments
+func (ks *aofKeyspace) applyKeyspace(cmd string, args [][]byte) bool {
+	n := len(args)
+	switch cmd {
+	case "multi", "exec", "discard", "ping", "function", "script":
+	case "select":
+		if n != 2 {
+			return false
+		}
+		db, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return false
+		}
+		ks.db = db
+	case "flushdb":
+		delete(ks.dbs, ks.db)
+	case "flushall":
+		ks.dbs = map[int]map[string]*aofValue{}
+	case "swapdb":
+		if n != 3 {
+			return false
+		}
+		a, err1 := strconv.Atoi(string(args[1]))
+		b, err2 := strconv.Atoi(string(args[2]))
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		ks.dbs[a], ks.dbs[b] = ks.dbs[b], ks.dbs[a]
+	case "del", "unlink", "getdel":
+		for _, k := range args[1:] {
+			delete(ks.keys(ks.db), string(k))
+		}
+	case "expire", "pexpire", "expireat", "pexpireat":
+		if n < 3 {
+			return false
+		}
+		at, ok := parseExpire(args[2], ks.now, cmd[0] == 'p', strings.HasSuffix(cmd, "at"))
+		v := ks.keys(ks.db)[string(args[1])]
+		if !ok || v == nil {
+			return ok
+		}
+		v.expire = at
+	case "persist":
+		if n != 2 {
+			return false
+		}
+		if v := ks.keys(ks.db)[string(args[1])]; v != nil {
+			v.expire = 0
+		}
+	case "rename", "renamenx":
+		if n != 3 {
+			return false
+		}
+		keys := ks.keys(ks.db)
+		if v := keys[string(args[1])]; v != nil {
+			delete(keys, string(args[1]))
+			keys[string(args[2])] = v
+		}
+	case "move":
+		if n != 3 {
+			return false
+		}
+		db, err := strconv.Atoi(string(args[2]))
+		if err != nil {
+			return false
+		}
+		keys := ks.keys(ks.db)
+		if v := keys[string(args[1])]; v != nil {
+			delete(keys, string(args[1]))
+			ks.keys(db)[string(args[1])] = v
+		}
+	case "copy":
+		if n < 3 {
+			return false
+		}
+		db := ks.db
+		for i := 3; i < n; i++ {
+			if strings.EqualFold(string(args[i]), "db") && i+1 < n {
+				var err error
+				if db, err = strconv.Atoi(string(args[i+1])); err != nil {
+					return false
+				}
+				i++
+			}
+		}
+		if v := ks.keys(ks.db)[string(args[1])]; v != nil {
+			ks.keys(db)[string(args[2])] = v.clone()
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (ks *aofKeyspace) setString(key, value []byte, expire int64) {
+	ks.keys(ks.db)[string(key)] = &aofValue{typ: "string", str: append([]byte(nil), value...), expire: expire}
+}
+
+func (ks *aofKeyspace) applyString(cmd string, args [][]byte) bool {
+	n := len(args)
+	switch cmd {
+	case "set":
+		if n < 3 {
+			return false
+		}
+		var expire int64
+		for i := 3; i < n; i++ {
+			opt := strings.ToLower(string(args[i]))
+			switch opt {
+			case "ex", "px", "exat", "pxat":
+				if i+1 >= n {
+					return false
+				}
+				at, ok := parseExpire(args[i+1], ks.now, opt[0] == 'p', strings.HasSuffix(opt, "at"))
+				if !ok {
+					return false
+				}
+				expire = at
+				i++
+			case "keepttl":
+				if v := ks.keys(ks.db)[string(args[1])]; v != nil {
+					expire = v.expire
+				}
+			}
+		}
+		ks.setString(args[1], args[2], expire)
+	case "setnx", "getset":
+		if n != 3 {
+			return false
+		}
+		ks.setString(args[1], args[2], 0)
+	case "setex", "psetex":
+		if n != 4 {
+			return false
+		}
+		at, ok := parseExpire(args[2], ks.now, cmd == "psetex", false)
+		if !ok {
+			return false
+		}
+		ks.setString(args[1], args[3], at)
+	case "mset", "msetnx":
+		if n < 3 || n%2 != 1 {
+			return false
+		}
+		for i := 1; i < n; i += 2 {
+			ks.setString(args[i], args[i+1], 0)
+		}
+	case "append":
+		if n != 3 {
+			return false
+		}
+		v := ks.get(args[1], "string", true)
+		if v == nil {
+			return false
+		}
+		v.str = append(v.str, args[2]...)
+	case "setrange":
+		if n != 4 {
+			return false
+		}
+		off, err := strconv.Atoi(string(args[2]))
+		v := ks.get(args[1], "string", true)
+		if err != nil || off < 0 || v == nil {
+			return false
+		}
+		if end := off + len(args[3]); end > len(v.str) {
+			v.str = append(v.str, make([]byte, end-len(v.str))...)
+		}
+		copy(v.str[off:], args[3])
+	case "incr", "decr", "incrby", "decrby":
+		if n < 2 {
+			return false
+		}
+		by := int64(1)
+		if cmd == "incrby" || cmd == "decrby" {
+			if n != 3 {
+				return false
+			}
+			var err error
+			if by, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+				return false
+			}
+		}
+		if strings.HasPrefix(cmd, "decr") {
+			by = -by
+		}
+		v := ks.get(args[1], "string", true)
+		if v == nil {
+			return false
+		}
+		cur, _ := strconv.ParseInt(string(v.str), 10, 64)
+		v.str = strconv.AppendInt(nil, cur+by, 10)
+	case "incrbyfloat":
+		if n != 3 {
+			return false
+		}
+		by, err := strconv.ParseFloat(string(args[2]), 64)
+		v := ks.get(args[1], "string", true)
+		if err != nil || v == nil {
+			return false
+		}
+		cur, _ := strconv.ParseFloat(string(v.str), 64)
+		v.str = strconv.AppendFloat(nil, cur+by, 'f', -1, 64)
+	case "getex":
+		if n < 2 {
+			return false
+		}
+		v := ks.keys(ks.db)[string(args[1])]
+		for i := 2; i < n && v != nil; i++ {
+			opt := strings.ToLower(string(args[i]))
+			switch opt {
+			case "ex", "px", "exat", "pxat":
+				if i+1 >= n {
+					return false
+				}
+				at, ok := parseExpire(args[i+1], ks.now, opt[0] == 'p', strings.HasSuffix(opt, "at"))
+				if !ok {
+					return false
+				}
+				v.expire = at
+				i++
+			case "persist":
+				v.expire = 0
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// fieldArgs returns the fields after "FIELDS numfields" of the hash field
+// expiration commands
+func fieldArgs(args [][]byte) ([][]byte, bool) {
+	for i, a := range args {
+		if strings.EqualFold(string(a), "fields") && i+1 < len(args) {
+			num, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || i+2+num != len(args) {
+				return nil, false
+			}
+			return args[i+2:], true
+		}
+	}
+	return nil, false
+}
+
+func (ks *aofKeyspace) applyHash(cmd string, args [][]byte) bool {
+	n := len(args)
+	switch cmd {
+	case "hset", "hmset":
+		if n < 4 || n%2 != 0 {
+			return false
+		}
+		v := ks.get(args[1], "hash", true)
+		if v == nil {
+			return false
+		}
+		for i := 2; i < n; i += 2 {
+			v.hash[string(args[i])] = append([]byte(nil), args[i+1]...)
+			delete(v.hexp, string(args[i]))
+		}
+	case "hsetnx":
+		if n != 4 {
+			return false
+		}
+		v := ks.get(args[1], "hash", true)
+		if v == nil {
+			return false
+		}
+		v.hash[string(args[2])] = append([]byte(nil), args[3]...)
+	case "hdel":
+		if n < 3 {
+			return false
+		}
+		if v := ks.get(args[1], "hash", false); v != nil {
+			for _, f := range args[2:] {
+				delete(v.hash, string(f))
+				delete(v.hexp, string(f))
+			}
+			ks.cleanup(args[1])
+		}
+	case "hincrby", "hincrbyfloat":
+		if n != 4 {
+			return false
+		}
+		v := ks.get(args[1], "hash", true)
+		if v == nil {
+			return false
+		}
+		cur := v.hash[string(args[2])]
+		if cmd == "hincrby" {
+			by, err := strconv.ParseInt(string(args[3]), 10, 64)
+			if err != nil {
+				return false
+			}
+			c, _ := strconv.ParseInt(string(cur), 10, 64)
+			v.hash[string(args[2])] = strconv.AppendInt(nil, c+by, 10)
+		} else {
+			by, err := strconv.ParseFloat(string(args[3]), 64)
+			if err != nil {
+				return false
+			}
+			c, _ := strconv.ParseFloat(string(cur), 64)
+			v.hash[string(args[2])] = strconv.AppendFloat(nil, c+by, 'f', -1, 64)
+		}
+	case "hexpire", "hpexpire", "hexpireat", "hpexpireat":
+		// HEXPIRE and friends are propagated as HPEXPIREAT
+		if n < 6 {
+			return false
+		}
+		at, ok := parseExpire(args[2], ks.now, cmd[1] == 'p', strings.HasSuffix(cmd, "at"))
+		fields, okf := fieldArgs(args[3:])
+		if !ok || !okf {
+			return false
+		}
+		if v := ks.get(args[1], "hash", false); v != nil {
+			for _, f := range fields {
+				if _, exists := v.hash[string(f)]; exists {
+					v.hexp[string(f)] = at
+				}
+			}
+		}
+	case "hpersist":
+		if n < 5 {
+			return false
+		}
+		fields, ok := fieldArgs(args[2:])
+		if !ok {
+			return false
+		}
+		if v := ks.get(args[1], "hash", false); v != nil {
+			for _, f := range fields {
+				delete(v.hexp, string(f))
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// listIndex resolves a negative list index, the result may be out of range
+func listIndex(arg []byte, length int) (int, bool) {
+	i, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, false
+	}
+	if i < 0 {
+		i += length
+	}
+	return i, true
+}
+
+// listRange resolves start and stop the way LTRIM and ZREMRANGEBYRANK do,
+// empty when start > stop
+func listRange(startArg, stopArg []byte, length int) (int, int, bool) {
+	start, ok1 := listIndex(startArg, length)
+	stop, ok2 := listIndex(stopArg, length)
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, true
+}
+
+func (ks *aofKeyspace) applyList(cmd string, args [][]byte) bool {
+	n := len(args)
+	switch cmd {
+	case "lpush", "rpush", "lpushx", "rpushx":
+		if n < 3 {
+			return false
+		}
+		v := ks.get(args[1], "list", !strings.HasSuffix(cmd, "x"))
+		if v == nil {
+			// LPUSHX on a missing key does nothing
+			return ks.keys(ks.db)[string(args[1])] == nil
+		}
+		for _, val := range args[2:] {
+			val = append([]byte(nil), val...)
+			if cmd[0] == 'l' {
+				v.list.pushLeft(val)
+			} else {
+				v.list.pushRight(val)
+			}
+		}
+	case "lpop", "rpop":
+		if n < 2 || n > 3 {
+			return false
+		}
+		count := 1
+		if n == 3 {
+			var err error
+			if count, err = strconv.Atoi(string(args[2])); err != nil {
+				return false
+			}
+		}
+		if v := ks.get(args[1], "list", false); v != nil {
+			for ; count > 0 && v.list.len() > 0; count-- {
+				if cmd == "lpop" {
+					v.list.popLeft()
+				} else {
+					v.list.popRight()
+				}
+			}
+			ks.cleanup(args[1])
+		}
+	case "lset":
+		if n != 4 {
+			return false
+		}
+		if v := ks.get(args[1], "list", false); v != nil {
+			i, ok := listIndex(args[2], v.list.len())
+			if !ok || i < 0 || i >= v.list.len() {
+				return false
+			}
+			v.list.set(i, append([]byte(nil), args[3]...))
+		}
+	case "lrem":
+		if n != 4 {
+			return false
+		}
+		count, err := strconv.Atoi(string(args[2]))
+		if err != nil {
+			return false
+		}
+		if v := ks.get(args[1], "list", false); v != nil {
+			v.list = aofList{tail: listRemove(v.list.values(), args[3], count)}
+			ks.cleanup(args[1])
+		}
+	case "ltrim":
+		if n != 4 {
+			return false
+		}
+		if v := ks.get(args[1], "list", false); v != nil {
+			start, stop, ok := listRange(args[2], args[3], v.list.len())
+			if !ok {
+				return false
+			}
+			v.list.trim(start, stop)
+			ks.cleanup(args[1])
+		}
+	case "linsert":
+		if n != 5 {
+			return false
+		}
+		if v := ks.get(args[1], "list", false); v != nil {
+			after := strings.EqualFold(string(args[2]), "after")
+			values := v.list.values()
+			for i, val := range values {
+				if bytes.Equal(val, args[3]) {
+					if after {
+						i++
+					}
+					v.list.tail = append(values[:i], append([][]byte{append([]byte(nil), args[4]...)}, values[i:]...)...)
+					break
+				}
+			}
+		}
+	case "lmove", "rpoplpush":
+		from, to := "right", "left"
+		if cmd == "lmove" {
+			if n != 5 {
+				return false
+			}
+			from, to = strings.ToLower(string(args[3])), strings.ToLower(string(args[4]))
+		} else if n != 3 {
+			return false
+		}
+		src := ks.get(args[1], "list", false)
+		if src == nil || src.list.len() == 0 {
+			return true
+		}
+		var val []byte
+		if from == "left" {
+			val = src.list.popLeft()
+		} else {
+			val = src.list.popRight()
+		}
+		dst := ks.get(args[2], "list", true)
+		if dst == nil {
+			return false
+		}
+		if to == "left" {
+			dst.list.pushLeft(val)
+		} else {
+			dst.list.pushRight(val)
+		}
+		ks.cleanup(args[1])
+	default:
+		return false
+	}
+	return true
+}
+
+// aofList is a list as a deque: head holds the values pushed on the left in
+// reverse order, so LPUSH appends like RPUSH instead of copying the list
+type aofList struct {
+	head [][]byte
+	tail [][]byte
+}
+
+func (l *aofList) len() int {
+	return len(l.head) + len(l.tail)
+}
+
+func (l *aofList) pushLeft(v []byte) {
+	l.head = append(l.head, v)
+}
+
+func (l *aofList) pushRight(v []byte) {
+	l.tail = append(l.tail, v)
+}
+
+// popLeft removes the first value, the list must not be empty
+func (l *aofList) popLeft() []byte {
+	if n := len(l.head); n > 0 {
+		v := l.head[n-1]
+		l.head = l.head[:n-1]
+		return v
+	}
+	v := l.tail[0]
+	l.tail = l.tail[1:]
+	return v
+}
+
+// popRight removes the last value, the list must not be empty
+func (l *aofList) popRight() []byte {
+	if n := len(l.tail); n > 0 {
+		v := l.tail[n-1]
+		l.tail = l.tail[:n-1]
+		return v
+	}
+	v := l.head[0]
+	l.head = l.head[1:]
+	return v
+}
+
+// set replaces the value at index i
+func (l *aofList) set(i int, v []byte) {
+	if i < len(l.head) {
+		l.head[len(l.head)-1-i] = v
+		return
+	}
+	l.tail[i-len(l.head)] = v
+}
+
+// trim keeps the values from start to stop, none when start > stop
+func (l *aofList) trim(start, stop int) {
+	if start > stop {
+		l.head, l.tail = nil, nil
+		return
+	}
+	h := len(l.head)
+	if start < h {
+		l.head = l.head[h-1-min(stop, h-1) : h-start]
+	} else {
+		l.head = nil
+	}
+	if stop >= h {
+		l.tail = l.tail[max(start-h, 0) : stop-h+1]
+	} else {
+		l.tail = nil
+	}
+}
+
+// values returns the values in order, the deque is flattened into tail
+func (l *aofList) values() [][]byte {
+	if len(l.head) == 0 {
+		return l.tail
+	}
+	values := make([][]byte, 0, l.len())
+	for i := len(l.head) - 1; i >= 0; i-- {
+		values = append(values, l.head[i])
+	}
+	l.head, l.tail = nil, append(values, l.tail...)
+	return l.tail
+}
+
+// listRemove removes count occurrences of val, from the tail when count is
+// negative and all of them when it is 0
+func listRemove(list [][]byte, val []byte, count int) [][]byte {
+	remove := map[int]bool{}
+	if count >= 0 {
+		for i := 0; i < len(list) && (count == 0 || len(remove) < count); i++ {
+			if bytes.Equal(list[i], val) {
+				remove[i] = true
+			}
+		}
+	} else {
+		for i := len(list) - 1; i >= 0 && len(remove) < -count; i-- {
+			if bytes.Equal(list[i], val) {
+				remove[i] = true
+			}
+		}
+	}
+	res := list[:0:0]
+	for i, v := range list {
+		if !remove[i] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (ks *aofKeyspace) applySet(cmd string, args [][]byte) bool {
+	n := len(args)
+	switch cmd {
+	case "sadd":
+		if n < 3 {
+			return false
+		}
+		v := ks.get(args[1], "set", true)
+		if v == nil {
+			return false
+		}
+		for _, m := range args[2:] {
+			v.set[string(m)] = struct{}{}
+		}
+	case "srem":
+		if n < 3 {
+			return false
+		}
+		if v := ks.get(args[1], "set", false); v != nil {
+			for _, m := range args[2:] {
+				delete(v.set, string(m))
+			}
+			ks.cleanup(args[1])
+		}
+	case "smove":
+		if n != 4 {
+			return false
+		}
+		src := ks.get(args[1], "set", false)
+		if src == nil {
+			return true
+		}
+		if _, ok := src.set[string(args[3])]; !ok {
+			return true
+		}
+		delete(src.set, string(args[3]))
+		dst := ks.get(args[2], "set", true)
+		if dst == nil {
+			return false
+		}
+		dst.set[string(args[3])] = struct{}{}
+		ks.cleanup(args[1])
+	case "sinterstore", "sunionstore", "sdiffstore":
+		if n < 3 {
+			return false
+		}
+		var res map[string]struct{}
+		for i, k := range args[2:] {
+			src := ks.get(k, "set", false)
+			members := map[string]struct{}{}
+			if src != nil {
+				members = src.set
+			}
+			if i == 0 {
+				res = make(map[string]struct{}, len(members))
+				for m := range members {
+					res[m] = struct{}{}
+				}
+				continue
+			}
+			for m := range res {
+				_, in := members[m]
+				if (cmd == "sinterstore" && !in) || (cmd == "sdiffstore" && in) {
+					delete(res, m)
+				}
+			}
+			if cmd == "sunionstore" {
+				for m := range members {
+					res[m] = struct{}{}
+				}
+			}
+		}
+		keys := ks.keys(ks.db)
+		delete(keys, string(args[1]))
+		if len(res) > 0 {
+			keys[string(args[1])] = &aofValue{typ: "set", set: res}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// parseScoreBound parses a ZREMRANGEBYSCORE bound: a score, "(" for an
+// exclusive one, -inf or +inf
+func parseScoreBound(arg []byte) (float64, bool, bool) {
+	s := string(arg)
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	return v, exclusive, true
+}
+
+// lexInRange reports whether m is within ZREMRANGEBYLEX bounds
+func lexInRange(m string, min, max []byte) bool {
+	check := func(bound []byte, lower bool) bool {
+		switch {
+		case len(bound) == 0:
+			return false
+		case bound[0] == '-':
+			return lower
+		case bound[0] == '+':
+			return !lower
+		}
+		b := string(bound[1:])
+		if lower {
+			return m > b || (bound[0] == '[' && m == b)
+		}
+		return m < b || (bound[0] == '[' && m == b)
+	}
+	return check(min, true) && check(max, false)
+}
+
+func (ks *aofKeyspace) applyZSet(cmd string, args [][]byte) bool {
+	n := len(args)
+	switch cmd {
+	case "zadd":
+		if n < 4 {
+			return false
+		}
+		i, incr, nx, xx, gt, lt := 2, false, false, false, false, false
+		for ; i < n; i++ {
+			switch strings.ToLower(string(args[i])) {
+			case "nx":
+				nx = true
+				continue
+			case "xx":
+				xx = true
+				continue
+			case "gt":
+				gt = true
+				continue
+			case "lt":
+				lt = true
+				continue
+			case "ch":
+				continue
+			case "incr":
+				incr = true
+				continue
+			}
+			break
+		}
+		if (n-i)%2 != 0 || n == i {
+			return false
+		}
+		v := ks.get(args[1], "zset", true)
+		if v == nil {
+			return false
+		}
+		for ; i < n; i += 2 {
+			score, err := strconv.ParseFloat(string(args[i]), 64)
+			if err != nil {
+				return false
+			}
+			m := string(args[i+1])
+			cur, exists := v.zset[m]
+			if (nx && exists) || (xx && !exists) {
+				continue
+			}
+			if incr && exists {
+				score += cur
+			}
+			if exists && ((gt && score <= cur) || (lt && score >= cur)) {
+				continue
+			}
+			v.zset[m] = score
+		}
+		ks.cleanup(args[1])
+	case "zincrby":
+		if n != 4 {
+			return false
+		}
+		by, err := strconv.ParseFloat(string(args[2]), 64)
+		v := ks.get(args[1], "zset", true)
+		if err != nil || v == nil {
+			return false
+		}
+		v.zset[string(args[3])] += by
+	case "zrem":
+		if n < 3 {
+			return false
+		}
+		if v := ks.get(args[1], "zset", false); v != nil {
+			for _, m := range args[2:] {
+				delete(v.zset, string(m))
+			}
+			ks.cleanup(args[1])
+		}
+	case "zremrangebyscore":
+		if n != 4 {
+			return false
+		}
+		min, minEx, ok1 := parseScoreBound(args[2])
+		max, maxEx, ok2 := parseScoreBound(args[3])
+		if !ok1 || !ok2 {
+			return false
+		}
+		if v := ks.get(args[1], "zset", false); v != nil {
+			for m, s := range v.zset {
+				if (s > min || (!minEx && s == min)) && (s < max || (!maxEx && s == max)) {
+					delete(v.zset, m)
+				}
+			}
+			ks.cleanup(args[1])
+		}
+	case "zremrangebylex":
+		if n != 4 {
+			return false
+		}
+		if v := ks.get(args[1], "zset", false); v != nil {
+			for m := range v.zset {
+				if lexInRange(m, args[2], args[3]) {
+					delete(v.zset, m)
+				}
+			}
+			ks.cleanup(args[1])
+		}
+	case "zremrangebyrank", "zpopmin", "zpopmax":
+		if n < 2 {
+			return false
+		}
+		v := ks.get(args[1], "zset", false)
+		if v == nil {
+			return true
+		}
+		entries := sortedZSet(v.zset)
+		start, stop := 0, 0
+		switch cmd {
+		case "zremrangebyrank":
+			var ok bool
+			if n != 4 {
+				return false
+			}
+			if start, stop, ok = listRange(args[2], args[3], len(entries)); !ok {
+				return false
+			}
+		default:
+			count := 1
+			if n == 3 {
+				var err error
+				if count, err = strconv.Atoi(string(args[2])); err != nil {
+					return false
+				}
+			}
+			count = int(math.Min(float64(count), float64(len(entries))))
+			start, stop = 0, count-1
+			if cmd == "zpopmax" {
+				start, stop = len(entries)-count, len(entries)-1
+			}
+		}
+		for i := start; i <= stop && i < len(entries); i++ {
+			delete(v.zset, entries[i].Member)
+		}
+		ks.cleanup(args[1])
+	default:
+		return false
+	}
+	return true
+}
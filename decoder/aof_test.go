@@ -0,0 +1,263 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+)
+
+// resp encodes a command as an AOF holds it
+func resp(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return b.String()
+}
+
+// aofDir writes an appendonlydir of a base RDB and incremental AOFs
+func aofDir(t *testing.T, base []byte, incrs ...string) string {
+	dir := t.TempDir()
+	manifest := "file appendonly.aof.1.base.rdb seq 1 type b\n"
+	files := map[string][]byte{"appendonly.aof.1.base.rdb": base}
+	for i, incr := range incrs {
+		name := fmt.Sprintf("appendonly.aof.%d.incr.aof", i+1)
+		manifest += fmt.Sprintf("file %s seq %d type i\n", name, i+1)
+		files[name] = []byte(incr)
+	}
+	files["appendonly.aof.manifest"] = []byte(manifest)
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// compareAOF checks that the appendonlydir decodes to the keys of an RDB of
+// the same dataset, apart from the skipped keys
+func compareAOF(t *testing.T, dir string, want []byte, skipped ...string) *Decoder {
+	t.Helper()
+	got, d, err := decodeEntries(t, nil, func(d *Decoder) func(io.Reader) error {
+		return func(io.Reader) error { return d.DecodeAOFDir(dir, nil) }
+	})
+	if err != nil {
+		t.Fatalf("DecodeAOFDir: %v", err)
+	}
+	wantEntries, _, err := decodeEntries(t, want, func(d *Decoder) func(io.Reader) error { return d.DecodeWithHDT })
+	if err != nil {
+		t.Fatalf("DecodeWithHDT: %v", err)
+	}
+	for _, key := range skipped {
+		if got[key] != nil {
+			t.Errorf("%s: not skipped", key)
+		}
+	}
+	for key, w := range wantEntries {
+		g := got[key]
+		if g == nil {
+			t.Errorf("%s missing", key)
+			continue
+		}
+		// which of equal elements are kept depends on the map order
+		unorder(g)
+		unorder(w)
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("%s =\n%+v\nfrom an RDB\n%+v", key, g, w)
+		}
+	}
+	for key := range got {
+		if wantEntries[key] == nil {
+			t.Errorf("%s: not in the RDB", key)
+		}
+	}
+	return d
+}
+
+func TestDecodeAOFDir(t *testing.T) {
+	const t0, t1 = fixtureCtime, fixtureCtime + 1000
+	aux := func(ctime int64) [][2]string {
+		return [][2]string{{"redis-ver", "7.4.0"}, {"redis-bits", "64"}, {"ctime", fmt.Sprint(ctime)}}
+	}
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	zset := func(scores map[string]float64) []*model.ZSetEntry {
+		var entries []*model.ZSetEntry
+		for m, s := range scores {
+			entries = append(entries, &model.ZSetEntry{Member: m, Score: s})
+		}
+		return entries
+	}
+	list := func(values ...string) [][]byte {
+		var res [][]byte
+		for _, v := range values {
+			res = append(res, []byte(v))
+		}
+		return res
+	}
+
+	base := fixture(t, "0012", aux(t0), 9, func(enc *encoder.Encoder, w rdbWriter) {
+		check(enc.WriteStringObject("plain", []byte("untouched")))
+		check(enc.WriteStringObject("counter", []byte("5")))
+		check(enc.WriteHashMapObject("profile", map[string][]byte{
+			"name": []byte("ada"), "email": []byte("ada@example.com"), "age": []byte("36"),
+		}))
+		check(enc.WriteListObject("queue", list("a", "b")))
+		check(enc.WriteZSetObject("board", zset(map[string]float64{"alice": 1, "bob": 2})))
+		check(enc.WriteStringObject("old", []byte("renamed")))
+		check(enc.WriteStringObject("mover", []byte("moved")))
+		check(enc.WriteStringObject("ttl", []byte("expiring")))
+		check(enc.WriteDBHeader(1, 1, 0))
+		check(enc.WriteStringObject("first", []byte("db1")))
+		check(enc.WriteDBHeader(2, 1, 0))
+		check(enc.WriteStringObject("second", []byte("db2")))
+		check(enc.WriteDBHeader(3, 1, 0))
+		check(enc.WriteStringObject("gone", []byte("flushed")))
+	})
+	incr1 := fmt.Sprintf("#TS:%d\r\n", t0+500) +
+		resp("SELECT", "0") +
+		resp("SET", "counter", "42", "EX", "600") +
+		resp("HSET", "profile", "city", "paris") +
+		resp("HDEL", "profile", "age") +
+		resp("LPUSH", "queue", "c", "d") +
+		resp("LTRIM", "queue", "0", "2") +
+		resp("SWAPDB", "1", "2")
+	incr2 := fmt.Sprintf("#TS:%d\r\n", t1) +
+		resp("ZADD", "board", "3", "carol") +
+		resp("ZREM", "board", "alice") +
+		resp("RENAME", "old", "new") +
+		resp("MOVE", "mover", "1") +
+		resp("EXPIRE", "ttl", "3600") +
+		resp("SETBIT", "bits", "7", "1") +
+		resp("SELECT", "3") +
+		resp("FLUSHDB") +
+		resp("SELECT", "0") +
+		// cut off by a crash, ignored like aof-load-truncated does
+		"*3\r\n$3\r\nSET\r\n$4\r\nlost"
+
+	// the dataset after the last command
+	want := fixture(t, "0012", aux(t1), 8, func(enc *encoder.Encoder, w rdbWriter) {
+		check(enc.WriteStringObject("plain", []byte("untouched")))
+		check(enc.WriteStringObject("counter", []byte("42"), encoder.WithTTL((t0+500+600)*1000)))
+		check(enc.WriteHashMapObject("profile", map[string][]byte{
+			"name": []byte("ada"), "email": []byte("ada@example.com"), "city": []byte("paris"),
+		}))
+		check(enc.WriteListObject("queue", list("d", "c", "a")))
+		check(enc.WriteZSetObject("board", zset(map[string]float64{"bob": 2, "carol": 3})))
+		check(enc.WriteStringObject("new", []byte("renamed")))
+		check(enc.WriteStringObject("ttl", []byte("expiring"), encoder.WithTTL((t1+3600)*1000)))
+		check(enc.WriteDBHeader(1, 2, 0))
+		check(enc.WriteStringObject("second", []byte("db2")))
+		check(enc.WriteStringObject("mover", []byte("moved")))
+		check(enc.WriteDBHeader(2, 1, 0))
+		check(enc.WriteStringObject("first", []byte("db1")))
+	})
+
+	d := compareAOF(t, aofDir(t, base, incr1, incr2), want, "bits", "lost")
+	skipped := d.GetSkipped()
+	if len(skipped) != 1 || skipped[0].Keys != 1 || !strings.Contains(skipped[0].Reason, "SETBIT") {
+		t.Errorf("skipped %+v, want bits for SETBIT", skipped)
+	}
+}
+
+// TestDecodeAOFDirSnapshotTime checks that the keys the AOF does not touch
+// are analysed at the time of the last command too
+func TestDecodeAOFDirSnapshotTime(t *testing.T) {
+	const t0, t1 = fixtureCtime, fixtureCtime + 1000
+	fields := []string{"a", "b", "c"}
+	// a expires between the base and the last command
+	expire := map[string]int64{"a": (t0 + 100) * 1000, "b": (t1 + 100) * 1000}
+	rdb := func(ctime int64, touched string) []byte {
+		aux := [][2]string{{"redis-ver", "7.4.0"}, {"redis-bits", "64"}, {"ctime", fmt.Sprint(ctime)}}
+		return fixture(t, "0012", aux, 2, func(enc *encoder.Encoder, w rdbWriter) {
+			w.hashWithFieldTTLs("sessions", fields, expire)
+			if err := enc.WriteStringObject("touched", []byte(touched)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	incr := fmt.Sprintf("#TS:%d\r\n", t1) + resp("SET", "touched", "after")
+
+	d := compareAOF(t, aofDir(t, rdb(t0, "before"), incr), rdb(t1, "after"))
+	if at := d.snapshotTime(); at != t1 {
+		t.Errorf("snapshot time %d, want %d", at, t1)
+	}
+}
+
+func TestRESPReaderLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		aof  string
+		want error
+	}{
+		{"huge argument count", "*2000000000\r\n$3\r\nSET\r\n", ErrTruncated},
+		{"huge bulk length", "*1\r\n$9999999999\r\n", ErrCorrupt},
+		{"over proto-max-bulk-len", fmt.Sprintf("*1\r\n$%d\r\n", respMaxBulkLen+1), ErrCorrupt},
+		{"negative bulk length", "*1\r\n$-1\r\n", ErrCorrupt},
+		{"not a command", "+OK\r\n", ErrCorrupt},
+	}
+	for _, tt := range tests {
+		_, err := newRESPReader(strings.NewReader(tt.aof)).next()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestAOFList checks the deque against a plain slice
+func TestAOFList(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var l aofList
+	var want [][]byte
+	for i := 0; i < 5000; i++ {
+		v := []byte(fmt.Sprint(i))
+		switch op := rnd.Intn(10); {
+		case op < 3:
+			l.pushLeft(v)
+			want = append([][]byte{v}, want...)
+		case op < 6:
+			l.pushRight(v)
+			want = append(want, v)
+		case op == 6 && len(want) > 0:
+			l.popLeft()
+			want = want[1:]
+		case op == 7 && len(want) > 0:
+			l.popRight()
+			want = want[:len(want)-1]
+		case op == 8 && len(want) > 0:
+			j := rnd.Intn(len(want))
+			l.set(j, v)
+			want[j] = v
+		case op == 9:
+			start, stop := rnd.Intn(len(want)+2)-1, rnd.Intn(len(want)+2)-1
+			start, stop, _ = listRange([]byte(fmt.Sprint(start)), []byte(fmt.Sprint(stop)), len(want))
+			l.trim(start, stop)
+			if start > stop {
+				want = nil
+			} else {
+				want = want[start : stop+1]
+			}
+		}
+		if l.len() != len(want) {
+			t.Fatalf("op %d: %d values, want %d", i, l.len(), len(want))
+		}
+		if i%100 == 0 {
+			if got := l.values(); len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("op %d: %q, want %q", i, got, want)
+			}
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/919927181/rdb"
 	"github.com/919927181/rdb/nopdecoder"
@@ -36,17 +37,53 @@ type Entry struct {
 	Expiration         int64
 	LruIdle            uint64
 	LfuFreq            int
+
+	// element shape, used to infer and simulate encodings
+	ElemBytes  uint64
+	MaxElemLen uint64
+	AllInts    bool
+
+	// Elements is the drill-down of big collections, nil for small keys
+	Elements *ElementStats `json:",omitempty"`
+	// Scores profiles the scores of big sorted sets
+	Scores *ScoreStats `json:",omitempty"`
+	// Stream is the deep analysis of streams
+	Stream *StreamStats `json:",omitempty"`
+	// FieldTTL describes the field TTLs of hashes, nil without any
+	FieldTTL *FieldTTLStats `json:",omitempty"`
+	// Projected is the size and encoding under the projection target, see SetProjection
+	ProjectedBytes    uint64 `json:",omitempty"`
+	ProjectedEncoding string `json:",omitempty"`
 }
 
 // Decoder decode rdb file
 type Decoder struct {
-	Entries chan *Entry
+	// Entries receives the decoded keys in batches of up to entryBatchSize,
+	// it is closed when decoding ends
+	Entries chan []*Entry
+	batch   []*Entry
 	m       MemProfiler
 
-	usedMem int64
-	ctime   int64
+	usedMem  int64
+	ctime    int64
+	at       int64 // point in time of an AOF, overrides ctime
+	redisVer string
+	meta     RDBMeta
+	// profile overrides the memory profile selected from the aux fields
+	profile  *MemoryProfile
+	selected bool
+	target   *MemoryProfile // projection target
+	// encoding rules and projection target, set at the first key
+	sizing      bool
+	rules       EncodingRules
+	targetM     *MemProfiler
+	targetRules EncodingRules
+	elementKeys elementKeys // the largest keys, which get an element drill-down
+	skips    map[skipKey]*SkipStats
+	err      *DecodeError
 	//count   int
 	rdbVer int //rdb file version
+	valkey bool // VALKEY header, of Valkey 9 on
 	Db     int
 
 	currentInfo  *rdb.Info
@@ -55,16 +92,52 @@ type Decoder struct {
 	nopdecoder.NopDecoder
 }
 
+// entryBatchSize is the number of entries sent at once on Entries, so the
+// decoder and the counter meet once per batch rather than once per key
+const entryBatchSize = 256
+
 // NewDecoder new a rdb decoder
 func NewDecoder() *Decoder {
 	return &Decoder{
-		Entries: make(chan *Entry, 100000), // Increased from 1024 to prevent deadlock with large RDB files
+		Entries: make(chan []*Entry, 100000/entryBatchSize), // up to about 100000 entries ahead of the counter
 		m:       MemProfiler{},
 	}
 }
 
+// send adds an entry to the batch, sent once full
+func (d *Decoder) send(e *Entry) {
+	if d.batch == nil {
+		d.batch = make([]*Entry, 0, entryBatchSize)
+	}
+	d.batch = append(d.batch, e)
+	if len(d.batch) == entryBatchSize {
+		d.Entries <- d.batch
+		d.batch = nil
+	}
+}
+
+// closeEntries sends the last batch and closes Entries
+func (d *Decoder) closeEntries() {
+	if len(d.batch) > 0 {
+		d.Entries <- d.batch
+		d.batch = nil
+	}
+	close(d.Entries)
+}
+
 func (d *Decoder) sendEntry() {
-	d.Entries <- d.currentEntry
+	if d.currentEntry == nil {
+		// the key was skipped
+		return
+	}
+	d.send(d.currentEntry)
+	d.currentEntry = nil
+}
+
+// skipCurrent drops the key being decoded, its remaining callbacks are ignored.
+// The callback API gives no offsets.
+func (d *Decoder) skipCurrent(typ string, key []byte, reason error) {
+	d.skip(typ, string(key), d.Db, -1, 0, reason)
 	d.currentEntry = nil
 }
 
@@ -76,15 +149,80 @@ func (d *Decoder) GetUsedMem() int64 {
 	return d.usedMem
 }
 
+// snapshotTime is the ctime aux field, or now for RDBs without one.
+// For an AOF it is the time of the last command.
+func (d *Decoder) snapshotTime() int64 {
+	if d.at > 0 {
+		return d.at
+	}
+	if d.ctime > 0 {
+		return d.ctime
+	}
+	return time.Now().Unix()
+}
+
+// GetMeta returns the aux fields, RESIZEDB hints and checksum result of the RDB
+func (d *Decoder) GetMeta() *RDBMeta {
+	return &d.meta
+}
+
+// GetRedisVersion returns the redis-ver aux field, empty if the RDB has none
+func (d *Decoder) GetRedisVersion() string {
+	return d.redisVer
+}
+
+// SetProfile overrides the memory profile instead of selecting it from the
+// aux fields of the RDB. It must be called before decoding.
+func (d *Decoder) SetProfile(p MemoryProfile) {
+	p = p.withDefaults()
+	d.profile = &p
+}
+
+// SetProjection makes the decoder also size every key as the server of the
+// target profile would store it, in ProjectedBytes and ProjectedEncoding.
+// It is supported by DecodeWithHDT and DecodeStream.
+func (d *Decoder) SetProjection(target MemoryProfile) {
+	target = target.withDefaults()
+	d.target = &target
+}
+
+// GetProfile returns the memory profile used for sizing
+func (d *Decoder) GetProfile() MemoryProfile {
+	d.selectProfile()
+	return d.m.profile()
+}
+
+// selectProfile picks the memory profile once the aux fields are read,
+// they come before the first database
+func (d *Decoder) selectProfile() {
+	if d.selected {
+		return
+	}
+	d.selected = true
+	if d.profile != nil {
+		d.m = *NewMemProfiler(*d.profile)
+	} else {
+		d.m = *NewMemProfiler(SelectProfile(&d.meta))
+	}
+}
+
 func (d *Decoder) StartRDB(ver int) {
 	d.rdbVer = ver
+	d.meta.Version = ver
+}
+
+// ResizeDatabase records the RESIZEDB hint of the current database
+func (d *Decoder) ResizeDatabase(dbSize, expiresSize uint32) {
+	d.meta.DBSizes = append(d.meta.DBSizes, DBSizeHint{DB: d.Db, Keys: uint64(dbSize), Expires: uint64(expiresSize)})
 }
 
 func (d *Decoder) StartDatabase(n int) {
+	d.selectProfile()
 	d.Db = n
 }
 
 func (d *Decoder) Aux(key, value []byte) {
+	d.meta.setAux(string(key), string(value))
 	switch string(key) {
 	case "ctime":
 		{
@@ -104,6 +242,9 @@ func (d *Decoder) Aux(key, value []byte) {
 			d.usedMem = n
 		}
 
+	case "redis-ver":
+		d.redisVer = string(value)
+
 	}
 }
 
@@ -139,12 +280,18 @@ func (d *Decoder) StartStream(key []byte, cardinality, expiry int64, info *rdb.I
 
 func (d *Decoder) Xadd(key, id, listpack []byte) {
 	e := d.currentEntry
+	if e == nil {
+		return
+	}
 	e.NumOfElem++
 	e.Bytes += d.m.mallocOverhead(uint64(len(listpack)))
 }
 
 func (d *Decoder) EndStream(key []byte, items uint64, lastEntryID string, cgroupsData rdb.StreamGroups) {
 	e := d.currentEntry
+	if e == nil {
+		return
+	}
 
 	for _, cg := range cgroupsData {
 		pendingLength := uint64(len(cg.Pending))
@@ -180,7 +327,7 @@ func (d *Decoder) Set(key, value []byte, expiry int64, info *rdb.Info) {
 		LfuFreq:    info.Freq,
 		Db:         d.Db,
 	}
-	d.Entries <- e
+	d.send(e)
 }
 
 // StartHash is called at the beginning of a hash.
@@ -197,7 +344,8 @@ func (d *Decoder) StartHash(key []byte, length, expiry int64, info *rdb.Info) {
 			bytes += uint64(info.SizeOfValue)
         }
 	} else {
-		panic(fmt.Sprintf("unexpected size(0) or encoding:%s", info.Encoding))
+		d.skipCurrent("hash", key, fmt.Errorf("%w: %s", ErrUnexpectedEncoding, info.Encoding))
+		return
 	}
 
 	d.currentInfo = info
@@ -217,6 +365,9 @@ func (d *Decoder) StartHash(key []byte, length, expiry int64, info *rdb.Info) {
 // Hset is called once for each field=value pair in a hash.
 func (d *Decoder) Hset(key, field, value []byte) {
 	e := d.currentEntry
+	if e == nil {
+		return
+	}
 
 	lenOfElem := d.m.ElemLen(field) + d.m.ElemLen(value)
 	if lenOfElem > e.LenOfLargestElem {
@@ -234,7 +385,7 @@ func (d *Decoder) Hset(key, field, value []byte) {
 		e.Bytes += d.m.SizeofString(value)
 		e.Bytes += d.m.HashTableEntryOverHead()
 
-		if d.rdbVer < 10 {
+		if d.m.profile().ElementRobj {
 			e.Bytes += 2 * d.m.RobjOverHead()
 		}
 	}
@@ -261,7 +412,8 @@ func (d *Decoder) StartSet(key []byte, cardinality, expiry int64, info *rdb.Info
 	} else if info.Encoding == "listpack" && info.SizeOfValue > 0 {
 		bytes += uint64(info.SizeOfValue)
 	} else {
-		panic(fmt.Sprintf("unexpected size(0) or encoding:%s", info.Encoding))
+		d.skipCurrent("set", key, fmt.Errorf("%w: %s", ErrUnexpectedEncoding, info.Encoding))
+		return
 	}
 
 	d.currentInfo = info
@@ -282,6 +434,9 @@ func (d *Decoder) StartSet(key []byte, cardinality, expiry int64, info *rdb.Info
 // Sadd is called once for each member of a set.
 func (d *Decoder) Sadd(key, member []byte) {
 	e := d.currentEntry
+	if e == nil {
+		return
+	}
 	lenOfElem := d.m.ElemLen(member)
 	if lenOfElem > e.LenOfLargestElem {
         if len(member) > 100 {
@@ -296,7 +451,7 @@ func (d *Decoder) Sadd(key, member []byte) {
 		e.Bytes += d.m.SizeofString(member)
 		e.Bytes += d.m.HashTableEntryOverHead()
 
-		if d.rdbVer < 10 {
+		if d.m.profile().ElementRobj {
 			e.Bytes += d.m.RobjOverHead()
 		}
 	}
@@ -340,6 +495,9 @@ func (d *Decoder) StartList(key []byte, length, expiry int64, info *rdb.Info) {
 func (d *Decoder) Rpush(key, value []byte, NodeEncodings uint64) {
 	//keyStr := string(key)
 	e := d.currentEntry
+	if e == nil {
+		return
+	}
 	e.NumOfElem++
 
 	switch d.currentInfo.Encoding {
@@ -354,7 +512,7 @@ func (d *Decoder) Rpush(key, value []byte, NodeEncodings uint64) {
 		}
 		e.Bytes += d.m.LinkedListEntryOverHead()
 		e.Bytes += sizeInlist
-		if d.rdbVer < 10 {
+		if d.m.profile().ElementRobj {
 			e.Bytes += d.m.RobjOverHead()
 		}
 	case "quicklist2":
@@ -365,7 +523,8 @@ func (d *Decoder) Rpush(key, value []byte, NodeEncodings uint64) {
 			}
 		}
 	default:
-		panic(fmt.Sprintf("unknown encoding:%s", d.currentInfo.Encoding))
+		d.skipCurrent("list", key, fmt.Errorf("%w: %s", ErrUnexpectedEncoding, d.currentInfo.Encoding))
+		return
 	}
 
 	lenOfElem := d.m.ElemLen(value)
@@ -382,6 +541,9 @@ func (d *Decoder) Rpush(key, value []byte, NodeEncodings uint64) {
 // EndList is called when there are no more values in a list.
 func (d *Decoder) EndList(key []byte) {
 	e := d.currentEntry
+	if e == nil {
+		return
+	}
 
 	switch d.currentInfo.Encoding {
 	case "quicklist":
@@ -405,7 +567,8 @@ func (d *Decoder) EndList(key []byte) {
 		// 	e.Bytes += uint64(info.SizeOfValue)
 		// }
 	default:
-		panic(fmt.Sprintf("unknown encoding:%s", d.currentInfo.Encoding))
+		d.skipCurrent("list", key, fmt.Errorf("%w: %s", ErrUnexpectedEncoding, d.currentInfo.Encoding))
+		return
 	}
 
 	d.sendEntry()
@@ -426,7 +589,8 @@ func (d *Decoder) StartZSet(key []byte, cardinality, expiry int64, info *rdb.Inf
 	} else if info.Encoding == "listpack" && info.SizeOfValue > 0 {
 		bytes += uint64(info.SizeOfValue)
 	} else {
-		panic(fmt.Sprintf("unexpected size(0) or encoding:%s", info.Encoding))
+		d.skipCurrent("sortedset", key, fmt.Errorf("%w: %s", ErrUnexpectedEncoding, info.Encoding))
+		return
 	}
 
 	d.currentEntry = &Entry{
@@ -445,6 +609,9 @@ func (d *Decoder) StartZSet(key []byte, cardinality, expiry int64, info *rdb.Inf
 // Zadd is called once for each member of a sorted set.
 func (d *Decoder) Zadd(key []byte, score float64, member []byte) {
 	e := d.currentEntry
+	if e == nil {
+		return
+	}
 	lenOfElem := d.m.ElemLen(member)
 	if lenOfElem > e.LenOfLargestElem {
         if len(member) > 100 {
@@ -458,7 +625,7 @@ func (d *Decoder) Zadd(key []byte, score float64, member []byte) {
 	if d.currentInfo.Encoding == "skiplist" {
 		e.Bytes += 8 // sizeof(score)
 		e.Bytes += d.m.SizeofString(member)
-		e.Bytes += d.m.SkipListEntryOverHead()
+		e.Bytes += d.m.SkipListEntryOverHead(member)
 
         // Truncate large element display to save memory
         if lenOfElem > e.LenOfLargestElem {
@@ -470,7 +637,7 @@ func (d *Decoder) Zadd(key []byte, score float64, member []byte) {
             e.LenOfLargestElem = lenOfElem
         }
 
-		if d.rdbVer < 10 {
+		if d.m.profile().ElementRobj {
 			e.Bytes += d.m.RobjOverHead()
 		}
 	}
@@ -484,6 +651,6 @@ func (d *Decoder) EndZSet(key []byte) {
 // EndRDB is called when parsing of the RDB file is complete.
 func (d *Decoder) EndRDB() {
 	fmt.Fprintf(os.Stderr, "EndRDB called - RDB parsing complete. Closing entries channel...\n")
-	close(d.Entries)
+	d.closeEntries()
 	fmt.Fprintf(os.Stderr, "Entries channel closed.\n")
 }
@@ -0,0 +1,203 @@
+package decoder
+
+import (
+	"container/heap"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// ElementStatsMinElems and ElementStatsMinBytes decide which collections
+	// get an element drill-down. Smaller keys are never among the biggest ones.
+	ElementStatsMinElems = 128
+	ElementStatsMinBytes = 16 << 10
+	// ElementStatsKeys is how many of the largest keys get a drill-down, at
+	// least as many as the server keeps
+	ElementStatsKeys = 500
+
+	elementTopK        = 20
+	elementNameMaxLen  = 100
+	fieldPatternsTopK  = 20
+	fieldPatternsLimit = 10000 // unique field patterns tracked per key
+)
+
+// ElementSize is a single element of a collection. For hashes Name is the
+// field and Size the value length, for the other types Name is the member
+// (truncated) and Size its length.
+type ElementSize struct {
+	Name  string
+	Size  uint64
+	Score float64 `json:",omitempty"` // sorted sets only
+}
+
+// SizeBucket counts elements up to UpTo bytes (powers of two)
+type SizeBucket struct {
+	UpTo  uint64
+	Count uint64
+}
+
+// FieldPattern is a hash field name with digits replaced by '*'
+type FieldPattern struct {
+	Pattern string
+	Count   uint64
+}
+
+// ElementStats is the element drill-down of a big collection
+type ElementStats struct {
+	TopElements   []ElementSize
+	SizeDist      []SizeBucket
+	FieldPatterns []FieldPattern `json:",omitempty"` // hashes only
+	OtherFields   uint64         `json:",omitempty"` // fields past the pattern limit
+}
+
+// ElementCollector builds ElementStats one element at a time, so it only
+// keeps the top K elements and never the whole key.
+type ElementCollector struct {
+	top      elementHeap
+	dist     map[uint64]uint64
+	patterns map[string]uint64
+	other    uint64
+}
+
+// NewElementCollector returns an empty collector
+func NewElementCollector() *ElementCollector {
+	return &ElementCollector{dist: map[uint64]uint64{}}
+}
+
+// Add records an element of the given size
+func (c *ElementCollector) Add(name string, size uint64) {
+	c.AddScored(name, size, 0)
+}
+
+// AddScored records a sorted set member with its score
+func (c *ElementCollector) AddScored(name string, size uint64, score float64) {
+	c.dist[sizeBucket(size)]++
+	if len(c.top) == elementTopK && size <= c.top[0].Size {
+		return
+	}
+	if len(name) > elementNameMaxLen {
+		name = name[:elementNameMaxLen] + "..."
+	}
+	heap.Push(&c.top, ElementSize{Name: name, Size: size, Score: score})
+	if len(c.top) > elementTopK {
+		heap.Pop(&c.top)
+	}
+}
+
+// AddField records a hash field name for the field frequency
+func (c *ElementCollector) AddField(field string) {
+	if c.patterns == nil {
+		c.patterns = map[string]uint64{}
+	}
+	p := maskDigits(field)
+	if _, ok := c.patterns[p]; !ok && len(c.patterns) >= fieldPatternsLimit {
+		c.other++
+		return
+	}
+	c.patterns[p]++
+}
+
+// Stats returns the collected stats
+func (c *ElementCollector) Stats() *ElementStats {
+	s := &ElementStats{OtherFields: c.other}
+	s.TopElements = append([]ElementSize{}, c.top...)
+	sort.Slice(s.TopElements, func(i, j int) bool {
+		return s.TopElements[i].Size > s.TopElements[j].Size
+	})
+	for upTo, n := range c.dist {
+		s.SizeDist = append(s.SizeDist, SizeBucket{UpTo: upTo, Count: n})
+	}
+	sort.Slice(s.SizeDist, func(i, j int) bool {
+		return s.SizeDist[i].UpTo < s.SizeDist[j].UpTo
+	})
+	for p, n := range c.patterns {
+		s.FieldPatterns = append(s.FieldPatterns, FieldPattern{Pattern: p, Count: n})
+	}
+	sort.Slice(s.FieldPatterns, func(i, j int) bool {
+		if s.FieldPatterns[i].Count != s.FieldPatterns[j].Count {
+			return s.FieldPatterns[i].Count > s.FieldPatterns[j].Count
+		}
+		return s.FieldPatterns[i].Pattern < s.FieldPatterns[j].Pattern
+	})
+	if len(s.FieldPatterns) > fieldPatternsTopK {
+		s.FieldPatterns = s.FieldPatterns[:fieldPatternsTopK]
+	}
+	return s
+}
+
+// wantsElementStats reports whether a key is big enough for a drill-down
+func wantsElementStats(elems, bytes uint64) bool {
+	return elems >= ElementStatsMinElems || bytes >= ElementStatsMinBytes
+}
+
+// elementKeys keeps the sizes of the ElementStatsKeys largest keys decoded
+// so far, a min-heap
+type elementKeys []uint64
+
+func (h elementKeys) Len() int            { return len(h) }
+func (h elementKeys) Less(i, j int) bool  { return h[i] < h[j] }
+func (h elementKeys) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *elementKeys) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *elementKeys) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// keep reports whether a key of elems elements and bytes bytes gets a
+// drill-down: it is big enough and one of the largest keys so far, when it
+// evicts the smallest of them. The counter drops the entries of the keys
+// that leave its largest keys, and their stats with them.
+func (h *elementKeys) keep(elems, bytes uint64) bool {
+	if !wantsElementStats(elems, bytes) {
+		return false
+	}
+	if len(*h) < ElementStatsKeys {
+		heap.Push(h, bytes)
+		return true
+	}
+	if bytes < (*h)[0] {
+		return false
+	}
+	(*h)[0] = bytes
+	heap.Fix(h, 0)
+	return true
+}
+
+// sizeBucket rounds size up to a power of two
+func sizeBucket(size uint64) uint64 {
+	if size <= 1 {
+		return 1
+	}
+	return 1 << uint(64-bits.LeadingZeros64(size-1))
+}
+
+// maskDigits replaces digits with '*', the same way key prefixes are grouped
+func maskDigits(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= '0' && c <= '9' {
+			b[i] = '*'
+		}
+	}
+	return string(b)
+}
+
+type elementHeap []ElementSize
+
+func (h elementHeap) Len() int           { return len(h) }
+func (h elementHeap) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h elementHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *elementHeap) Push(x interface{}) {
+	*h = append(*h, x.(ElementSize))
+}
+
+func (h *elementHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
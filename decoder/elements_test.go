@@ -0,0 +1,139 @@
+package decoder
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hdt3213/rdb/encoder"
+)
+
+func TestElementCollector(t *testing.T) {
+	c := NewElementCollector()
+	for i := 1; i <= 100; i++ {
+		c.Add(fmt.Sprintf("member:%d", i), uint64(i))
+	}
+	c.Add(strings.Repeat("x", 150), 1000)
+	s := c.Stats()
+
+	if len(s.TopElements) != elementTopK {
+		t.Fatalf("%d top elements, want %d", len(s.TopElements), elementTopK)
+	}
+	if s.TopElements[0].Size != 1000 || s.TopElements[0].Name != strings.Repeat("x", elementNameMaxLen)+"..." {
+		t.Errorf("largest element %+v, want the truncated 1000 bytes one", s.TopElements[0])
+	}
+	for i, e := range s.TopElements[1:] {
+		if want := uint64(100 - i); e.Size != want || e.Name != fmt.Sprintf("member:%d", want) {
+			t.Errorf("top element %d = %+v, want member:%d", i+1, e, want)
+		}
+	}
+
+	// 1, 2, 3-4, 5-8, ... 65-100, then 1000
+	want := []SizeBucket{{1, 1}, {2, 1}, {4, 2}, {8, 4}, {16, 8}, {32, 16}, {64, 32}, {128, 36}, {1024, 1}}
+	if !reflect.DeepEqual(s.SizeDist, want) {
+		t.Errorf("size distribution %v, want %v", s.SizeDist, want)
+	}
+	if s.FieldPatterns != nil {
+		t.Errorf("field patterns %v without fields", s.FieldPatterns)
+	}
+}
+
+func TestElementCollectorFields(t *testing.T) {
+	c := NewElementCollector()
+	for i := 0; i < 30; i++ {
+		c.AddField(fmt.Sprintf("session:%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		c.AddField(fmt.Sprintf("cart:%d:items", i))
+	}
+	c.AddField("name")
+	c.AddField("email")
+	s := c.Stats()
+	// by count then pattern, session:0-9 have one digit and session:10-29 two
+	want := []FieldPattern{{"session:**", 20}, {"cart:*:items", 10}, {"session:*", 10}, {"email", 1}, {"name", 1}}
+	if !reflect.DeepEqual(s.FieldPatterns, want) {
+		t.Errorf("field patterns %v, want %v", s.FieldPatterns, want)
+	}
+
+	// patterns past the limit are counted, not kept
+	c = NewElementCollector()
+	for i := 0; i < fieldPatternsLimit+5; i++ {
+		c.AddField(fmt.Sprintf("f%s", strings.Repeat("x", i%(fieldPatternsLimit+5))))
+	}
+	c.AddField("fx")
+	s = c.Stats()
+	if s.OtherFields != 5 || len(s.FieldPatterns) != fieldPatternsTopK || s.FieldPatterns[0] != (FieldPattern{"fx", 2}) {
+		t.Errorf("%d other fields, patterns %v, want 5 and fx first", s.OtherFields, s.FieldPatterns[:1])
+	}
+}
+
+func TestElementKeys(t *testing.T) {
+	var h elementKeys
+	if h.keep(ElementStatsMinElems-1, ElementStatsMinBytes-1) {
+		t.Error("small key kept")
+	}
+	for i := 0; i < ElementStatsKeys; i++ {
+		if !h.keep(ElementStatsMinElems, uint64(100000+i)) {
+			t.Fatalf("key %d of %d not kept", i, ElementStatsKeys)
+		}
+	}
+	if h.keep(ElementStatsMinElems, 99999) {
+		t.Error("key smaller than the largest ones kept")
+	}
+	if !h.keep(ElementStatsMinElems, 200000) {
+		t.Error("key larger than the smallest kept not kept")
+	}
+	if len(h) != ElementStatsKeys || h[0] != 100001 {
+		t.Errorf("%d keys, smallest %d, want %d and 100001", len(h), h[0], ElementStatsKeys)
+	}
+}
+
+// TestElementStatsLargestKeys checks that only the largest keys of an RDB
+// get a drill-down, with either decoder
+func TestElementStatsLargestKeys(t *testing.T) {
+	aux := [][2]string{{"redis-ver", "7.2.4"}, {"redis-bits", "64"}}
+	const keys = ElementStatsKeys + 100
+	rdb := fixture(t, "0011", aux, keys, func(enc *encoder.Encoder, w rdbWriter) {
+		// shrinking keys, the last ones are never among the largest
+		for i := 0; i < keys; i++ {
+			values := make([][]byte, ElementStatsMinElems)
+			for j := range values {
+				values[j] = []byte(fmt.Sprintf("%03d:%s", j, strings.Repeat("v", 4*(keys-i))))
+			}
+			if err := enc.WriteListObject(fmt.Sprintf("list:%04d", i), values); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	decoders := map[string]func(*Decoder) func(io.Reader) error{
+		"DecodeWithHDT": func(d *Decoder) func(io.Reader) error { return d.DecodeWithHDT },
+		"DecodeStream":  func(d *Decoder) func(io.Reader) error { return d.DecodeStream },
+	}
+	for name, decode := range decoders {
+		entries, _, err := decodeEntries(t, rdb, decode)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		withStats := 0
+		var smallestWith, largestWithout uint64
+		for _, e := range entries {
+			if e.Elements == nil {
+				largestWithout = max(largestWithout, e.Bytes)
+				continue
+			}
+			withStats++
+			if smallestWith == 0 || e.Bytes < smallestWith {
+				smallestWith = e.Bytes
+			}
+		}
+		// ties with the smallest kept are kept too
+		if withStats < ElementStatsKeys || withStats == keys {
+			t.Errorf("%s: %d of %d keys have a drill-down, want the %d largest", name, withStats, keys, ElementStatsKeys)
+		}
+		if largestWithout > smallestWith {
+			t.Errorf("%s: a key of %d bytes has no drill-down, one of %d has", name, largestWithout, smallestWith)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package decoder
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RedisVersion is the major/minor part of the redis-ver aux field.
+// A zero value means the RDB did not carry a version (Redis < 3.2).
+type RedisVersion struct {
+	Major int
+	Minor int
+}
+
+// ParseRedisVersion parses strings like "7.2.4" or "6.0.16"
+func ParseRedisVersion(s string) RedisVersion {
+	parts := strings.SplitN(strings.TrimSpace(s), ".", 3)
+	v := RedisVersion{}
+	if len(parts) > 0 {
+		v.Major, _ = strconv.Atoi(parts[0])
+	}
+	if len(parts) > 1 {
+		v.Minor, _ = strconv.Atoi(parts[1])
+	}
+	return v
+}
+
+// AtLeast reports whether v is major.minor or newer
+func (v RedisVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// Shape summarises the elements of a key, which is all that is needed to
+// infer its in-memory encoding or to re-estimate it under another encoding.
+type Shape struct {
+	Type       string
+	Elems      uint64 // fields for hashes, members for sets/zsets, values for lists
+	ElemBytes  uint64 // payload of all elements (hash fields and values both count)
+	MaxElemLen uint64 // longest single element, as checked by *-max-listpack-value
+	AllInts    bool   // every member (or the string value) is an integer
+	FieldTTLs  uint64 // hash fields with a TTL
+}
+
+// Shape returns the shape of the entry
+func (e *Entry) Shape() Shape {
+	return Shape{
+		Type:       e.Type,
+		Elems:      e.NumOfElem,
+		ElemBytes:  e.ElemBytes,
+		MaxElemLen: e.MaxElemLen,
+		AllInts:    e.AllInts,
+		FieldTTLs:  e.fieldTTLs(),
+	}
+}
+
+func (e *Entry) fieldTTLs() uint64 {
+	if e.FieldTTL == nil {
+		return 0
+	}
+	return e.FieldTTL.Fields
+}
+
+// EncodingRules mirrors the redis.conf thresholds that decide whether a
+// collection keeps its compact encoding or is converted to a full structure.
+// The listpack names are used for every version; before Redis 7 they are the
+// *-ziplist-* settings with the same meaning.
+type EncodingRules struct {
+	HashMaxListpackEntries uint64 `json:"hash-max-listpack-entries"`
+	HashMaxListpackValue   uint64 `json:"hash-max-listpack-value"`
+	ZSetMaxListpackEntries uint64 `json:"zset-max-listpack-entries"`
+	ZSetMaxListpackValue   uint64 `json:"zset-max-listpack-value"`
+	SetMaxIntsetEntries    uint64 `json:"set-max-intset-entries"`
+	SetMaxListpackEntries  uint64 `json:"set-max-listpack-entries"`
+	SetMaxListpackValue    uint64 `json:"set-max-listpack-value"`
+	ListMaxListpackSize    int64  `json:"list-max-listpack-size"`
+
+	Version RedisVersion `json:"-"`
+	// FieldTTLEncoding is the encoding of a small hash with field TTLs:
+	// listpackex since Redis 7.4, hashtable on Valkey 9, none before
+	FieldTTLEncoding string `json:"-"`
+}
+
+// DefaultEncodingRules returns the redis.conf defaults of the given version
+func DefaultEncodingRules(v RedisVersion) EncodingRules {
+	r := EncodingRules{
+		HashMaxListpackEntries: 512,
+		HashMaxListpackValue:   64,
+		ZSetMaxListpackEntries: 128,
+		ZSetMaxListpackValue:   64,
+		SetMaxIntsetEntries:    512,
+		ListMaxListpackSize:    -2,
+		Version:                v,
+	}
+	if v.AtLeast(7, 0) {
+		r.HashMaxListpackEntries = 128
+	}
+	// Sets got a listpack encoding in 7.2
+	if v.AtLeast(7, 2) {
+		r.SetMaxListpackEntries = 128
+		r.SetMaxListpackValue = 64
+	}
+	// Hash field TTLs came in 7.4
+	if v.AtLeast(7, 4) {
+		r.FieldTTLEncoding = "listpackex"
+	}
+	return r
+}
+
+// CompactEncoding is the name of the compact encoding: listpack since Redis 7, ziplist before
+func (r EncodingRules) CompactEncoding() string {
+	if r.Version.AtLeast(7, 0) {
+		return "listpack"
+	}
+	return "ziplist"
+}
+
+// listNodeLimit returns the max bytes and max entries of a single quicklist node.
+// Negative list-max-listpack-size values select a size class (-1 = 4kb ... -5 = 64kb).
+func (r EncodingRules) listNodeLimit() (uint64, uint64) {
+	s := r.ListMaxListpackSize
+	if s >= 0 {
+		if s == 0 {
+			s = 1
+		}
+		// positive sizes are an entry count, with the 8kb safety limit still applied
+		return 8192, uint64(s)
+	}
+	if s < -5 {
+		s = -5
+	}
+	return 4096 << uint(-s-1), ^uint64(0)
+}
+
+// Infer returns the in-memory encoding Redis picks for a key of this shape
+// when it loads the key under these rules.
+func (r EncodingRules) Infer(s Shape) string {
+	compact := r.CompactEncoding()
+	switch s.Type {
+	case "string":
+		if s.AllInts && s.ElemBytes <= 20 {
+			return "int"
+		}
+		if s.ElemBytes <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case "hash":
+		if s.Elems <= r.HashMaxListpackEntries && s.MaxElemLen <= r.HashMaxListpackValue {
+			if s.FieldTTLs > 0 && r.FieldTTLEncoding != "" {
+				return r.FieldTTLEncoding
+			}
+			return compact
+		}
+		return "hashtable"
+	case "sortedset", "zset":
+		if s.Elems <= r.ZSetMaxListpackEntries && s.MaxElemLen <= r.ZSetMaxListpackValue {
+			return compact
+		}
+		return "skiplist"
+	case "set":
+		if s.AllInts && s.Elems <= r.SetMaxIntsetEntries {
+			return "intset"
+		}
+		if s.Elems <= r.SetMaxListpackEntries && s.MaxElemLen <= r.SetMaxListpackValue {
+			return "listpack"
+		}
+		return "hashtable"
+	case "list":
+		// Single-node lists are kept as a plain listpack since 7.2
+		if r.Version.AtLeast(7, 2) {
+			maxBytes, maxEntries := r.listNodeLimit()
+			if s.Elems <= maxEntries && listpackBytes(s.Elems, s.ElemBytes) <= maxBytes {
+				return "listpack"
+			}
+		}
+		return "quicklist"
+	case "stream":
+		return "stream"
+	}
+	return ""
+}
+
+// listpackBytes estimates the size of a listpack holding elems entries
+// with a total payload of elemBytes: <total_bytes><size>...<end>
+func listpackBytes(elems, elemBytes uint64) uint64 {
+	if elems == 0 {
+		return 4 + 2 + 1
+	}
+	avg := elemBytes / elems
+	// encoding header plus backlen per entry
+	perEntry := uint64(2)
+	if avg >= 64 {
+		perEntry = 3
+	}
+	if avg >= 4096 {
+		perEntry = 7
+	}
+	return 4 + 2 + 1 + elemBytes + elems*perEntry
+}
+
+// ziplistBytes estimates the size of a ziplist holding elems entries
+// with a total payload of elemBytes: <zlbytes><zltail><zllen>...<zlend>
+func ziplistBytes(elems, elemBytes uint64) uint64 {
+	if elems == 0 {
+		return 4 + 4 + 2 + 1
+	}
+	avg := elemBytes / elems
+	// prevlen plus encoding header per entry
+	perEntry := uint64(2)
+	if avg >= 64 {
+		perEntry = 3
+	}
+	if avg >= 254 {
+		perEntry = 7
+	}
+	return 4 + 4 + 2 + 1 + elemBytes + elems*perEntry
+}
+
+// EstimateEncodingBytes estimates the memory used by the value of a key of
+// this shape stored in the given encoding. The top level overhead (dict entry,
+// key and robj) is not included, as it does not depend on the encoding.
+func (m *MemProfiler) EstimateEncodingBytes(s Shape, encoding string, rules EncodingRules) uint64 {
+	switch encoding {
+	case "int":
+		return 0
+	case "embstr":
+		return m.mallocOverhead(m.robjSize()+3+s.ElemBytes+1) - m.robjSize()
+	case "raw":
+		return m.sdsSize(s.ElemBytes)
+	}
+	n := s.Elems
+	if n == 0 {
+		return 0
+	}
+	elemRobj := uint64(0)
+	if m.profile().ElementRobj {
+		elemRobj = m.RobjOverHead()
+	}
+	// hashes and sorted sets store two listpack entries per element
+	lpElems, lpBytes := n, s.ElemBytes
+	switch s.Type {
+	case "hash":
+		lpElems = 2 * n
+	case "sortedset", "zset":
+		// scores are mostly small integers or timestamps
+		lpElems, lpBytes = 2*n, s.ElemBytes+n*8
+	}
+	avg := s.ElemBytes / lpElems
+	if s.Type == "sortedset" || s.Type == "zset" {
+		avg = s.ElemBytes / n
+	}
+
+	// field TTLs cost an ExpireMeta per field and per key
+	ttl := uint64(0)
+	if s.FieldTTLs > 0 && m.profile().FieldExpiry {
+		ttl = s.FieldTTLs
+	}
+
+	switch encoding {
+	case "listpack":
+		return listpackBytes(lpElems, lpBytes)
+	case "listpackex":
+		// a TTL entry per field, 8 byte timestamps or 0 for fields without one
+		return listpackBytes(lpElems+n, lpBytes+s.FieldTTLs*8) + m.listpackExOverhead()
+	case "ziplist":
+		return ziplistBytes(lpElems, lpBytes)
+	case "intset":
+		width := uint64(8)
+		if s.MaxElemLen <= 4 {
+			width = 2
+		} else if s.MaxElemLen <= 9 {
+			width = 4
+		}
+		return 8 + n*width
+	case "hashtable":
+		size := m.HashTableOverHead(n)
+		if s.Type == "hash" {
+			if ttl > 0 {
+				size += ttl*(m.hfieldSize(avg)-m.sdsSize(avg)) + m.hashExpireMetaOverhead()
+			}
+			return size + n*(m.HashTableEntryOverHead()+2*m.sdsSize(avg)+2*elemRobj)
+		}
+		return size + n*(m.setEntryOverHead()+m.sdsSize(avg)+elemRobj)
+	case "skiplist":
+		return m.SkipListOverHead(n) + n*(8+m.sdsSize(avg)+m.skipListEntryExpected()+elemRobj)
+	case "quicklist":
+		maxBytes, maxEntries := rules.listNodeLimit()
+		total := listpackBytes(n, s.ElemBytes)
+		nodes := (total + maxBytes - 1) / maxBytes
+		if rules.ListMaxListpackSize > 0 {
+			if byEntries := (n + maxEntries - 1) / maxEntries; byEntries > nodes {
+				nodes = byEntries
+			}
+		}
+		return m.QuickListOverHead(nodes) + total + (nodes-1)*m.ListPackEntryOverHead()
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Reasons a key is skipped or decoding stops
+var (
+	ErrNotRDB             = errors.New("not an RDB file")
+	ErrUnsupportedVersion = errors.New("unsupported RDB version")
+	ErrUnknownType        = errors.New("unknown object type")
+	ErrUnexpectedEncoding = errors.New("unexpected encoding")
+	ErrTruncated          = errors.New("truncated RDB")
+	ErrCorrupt            = errors.New("corrupt RDB")
+	ErrPanic              = errors.New("decoder panic")
+	ErrNotAOF             = errors.New("not a multi-part AOF directory")
+	ErrUnsupportedCommand = errors.New("unsupported AOF command")
+)
+
+// DecodeError is an error that stopped decoding. The keys before it are
+// still analysed.
+type DecodeError struct {
+	Offset int64 // bytes into the RDB where the failing record starts
+	Err    error // one of the Err* reasons
+	Detail string
+}
+
+func (e *DecodeError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("decoding stopped at byte %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("decoding stopped at byte %d: %v: %s", e.Offset, e.Err, e.Detail)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// parseError maps an error of the HDT parser to one of the reasons
+func parseError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "not a RDB file"), strings.Contains(msg, "empty file"):
+		return ErrNotRDB
+	case strings.Contains(msg, "version"):
+		return ErrUnsupportedVersion
+	case strings.Contains(msg, "unknown type flag"):
+		return ErrUnknownType
+	case strings.HasPrefix(msg, "panic:"):
+		return ErrPanic
+	case strings.Contains(msg, "EOF"):
+		return ErrTruncated
+	}
+	return ErrCorrupt
+}
+
+// skipSamples is the number of keys kept as examples per skip reason
+const skipSamples = 10
+
+// SkippedKey is a key that was not analysed
+type SkippedKey struct {
+	Key    string
+	Db     int
+	Offset int64 // bytes into the RDB where the key starts, -1 if unknown
+}
+
+// SkipStats counts the keys skipped for one type and reason
+type SkipStats struct {
+	Type    string
+	Reason  string
+	Keys    uint64
+	Bytes   uint64       // serialized size in the RDB
+	Samples []SkippedKey // the first skipped keys
+}
+
+type skipKey struct {
+	Type   string
+	Reason string
+}
+
+// skip records a key that is left out of the analysis
+func (d *Decoder) skip(typ, key string, db int, offset, size int64, reason error) {
+	if d.skips == nil {
+		d.skips = map[skipKey]*SkipStats{}
+	}
+	k := skipKey{Type: typ, Reason: reason.Error()}
+	s := d.skips[k]
+	if s == nil {
+		s = &SkipStats{Type: typ, Reason: k.Reason}
+		d.skips[k] = s
+	}
+	s.Keys++
+	if size > 0 {
+		s.Bytes += uint64(size)
+	}
+	if len(s.Samples) < skipSamples {
+		s.Samples = append(s.Samples, SkippedKey{Key: truncateElem([]byte(key)), Db: db, Offset: offset})
+	}
+}
+
+// GetSkipped returns the skipped keys per type and reason, most first
+func (d *Decoder) GetSkipped() []*SkipStats {
+	res := make([]*SkipStats, 0, len(d.skips))
+	for _, s := range d.skips {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Keys != res[j].Keys {
+			return res[i].Keys > res[j].Keys
+		}
+		if res[i].Type != res[j].Type {
+			return res[i].Type < res[j].Type
+		}
+		return res[i].Reason < res[j].Reason
+	})
+	return res
+}
+
+// GetError returns the error that stopped decoding, nil if the whole RDB
+// was read
+func (d *Decoder) GetError() *DecodeError {
+	return d.err
+}
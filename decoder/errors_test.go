@@ -0,0 +1,124 @@
+package decoder
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/parser"
+)
+
+func skipRDB(t *testing.T) []byte {
+	aux := [][2]string{{"redis-ver", "7.2.4"}, {"redis-bits", "64"}}
+	return fixture(t, "0011", aux, 4, func(enc *encoder.Encoder, w rdbWriter) {
+		for _, key := range []string{"first", "bad:1", "bad:2", "last"} {
+			if err := enc.WriteStringObject(key, []byte("value of "+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// recordAt returns the offset of the string record of key in rdb and its size
+func recordAt(t *testing.T, rdb []byte, key string) (int64, int64) {
+	i := bytes.Index(rdb, append([]byte{0, byte(len(key))}, key...))
+	if i < 0 {
+		t.Fatalf("no record of %s", key)
+	}
+	return int64(i), int64(2 + len(key) + 1 + len("value of "+key))
+}
+
+// TestSkippedKeys checks that a key whose analysis panics is skipped with
+// its offset and size, and that the other keys are still analysed
+func TestSkippedKeys(t *testing.T) {
+	rdb := skipRDB(t)
+	d := NewDecoder()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.decodeRDB(bytes.NewReader(rdb), func(obj parser.RedisObject, serialized uint64) bool {
+			if strings.HasPrefix(obj.GetKey(), "bad:") {
+				panic("cannot size the key")
+			}
+			return false
+		})
+		d.closeEntries()
+	}()
+	var keys []string
+	for batch := range d.Entries {
+		for _, e := range batch {
+			keys = append(keys, e.Key)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "first,last" {
+		t.Errorf("analysed %v, want first and last", keys)
+	}
+	if d.GetMeta().Checksum != ChecksumOK {
+		t.Errorf("checksum %q after skipping keys", d.GetMeta().Checksum)
+	}
+
+	skipped := d.GetSkipped()
+	if len(skipped) != 1 {
+		t.Fatalf("skipped %+v, want one reason", skipped)
+	}
+	s := skipped[0]
+	if s.Type != "string" || s.Keys != 2 || !strings.HasPrefix(s.Reason, ErrPanic.Error()+": cannot size the key") {
+		t.Errorf("skipped %+v, want 2 strings for a panic", s)
+	}
+	var size int64
+	for i, key := range []string{"bad:1", "bad:2"} {
+		offset, n := recordAt(t, rdb, key)
+		size += n
+		if i >= len(s.Samples) || s.Samples[i] != (SkippedKey{Key: key, Offset: offset}) {
+			t.Errorf("sample %d of %+v, want %s at byte %d", i, s.Samples, key, offset)
+		}
+	}
+	if s.Bytes != uint64(size) {
+		t.Errorf("skipped %d bytes, want %d", s.Bytes, size)
+	}
+}
+
+// TestTruncatedRDB checks that decoding stops at the record cut short with
+// the keys before it analysed, by both decoders. Without the trailer all
+// keys are analysed and the checksum is unverified.
+func TestTruncatedRDB(t *testing.T) {
+	rdb := skipRDB(t)
+	offset, size := recordAt(t, rdb, "bad:2")
+	tests := []struct {
+		name string
+		rdb  []byte
+		keys int
+	}{
+		{"in a record", rdb[:offset+size-3], 2},
+		{"between records", rdb[:offset], 2},
+	}
+	for _, tt := range tests {
+		for name, decode := range decoders {
+			entries, d, err := decodeEntries(t, tt.rdb, decode)
+			var de *DecodeError
+			if !errors.As(err, &de) || !errors.Is(err, ErrTruncated) || d.GetError() != de {
+				t.Errorf("%s/%s: error %v, want a truncated RDB", tt.name, name, err)
+				continue
+			}
+			if len(entries) != tt.keys || d.GetMeta().Checksum != ChecksumUnverified {
+				t.Errorf("%s/%s: %d keys, checksum %q, want %d and unverified", tt.name, name, len(entries), d.GetMeta().Checksum, tt.keys)
+			}
+			if len(d.GetSkipped()) != 0 {
+				t.Errorf("%s/%s: skipped %+v", tt.name, name, d.GetSkipped())
+			}
+			if de.Offset != offset {
+				t.Errorf("%s/%s: stopped at byte %d, want %d", tt.name, name, de.Offset, offset)
+			}
+		}
+	}
+	for name, decode := range decoders {
+		entries, d, err := decodeEntries(t, rdb[:len(rdb)-8], decode)
+		if err != nil || len(entries) != 4 || d.GetMeta().Checksum != ChecksumUnverified {
+			t.Errorf("no trailer/%s: %d keys, checksum %q, error %v", name, len(entries), d.GetMeta().Checksum, err)
+		}
+	}
+}
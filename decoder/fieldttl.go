@@ -0,0 +1,93 @@
+package decoder
+
+import (
+	"github.com/hdt3213/rdb/parser"
+)
+
+// FieldTTLStats describes the per-field TTLs of a hash (hash field
+// expiration, Redis 7.4 and 8)
+type FieldTTLStats struct {
+	Fields    uint64 // fields with a TTL
+	Expired   uint64 // fields already expired at the snapshot time
+	MinExpire int64  // earliest field expiry, unix ms
+	MaxExpire int64  // latest field expiry, unix ms
+	MetaBytes uint64 // memory the TTLs add to the key, part of its Bytes
+}
+
+// newFieldTTLStats summarises the field expirations of a hash relative to
+// refMs, nil when no field has a TTL
+func newFieldTTLStats(expire map[string]int64, refMs int64) *FieldTTLStats {
+	var s *FieldTTLStats
+	for _, at := range expire {
+		s = s.add(at, refMs)
+	}
+	return s
+}
+
+// add records a field expiring at unix ms at, 0 for a field without a TTL.
+// It returns the stats, allocated at the first field with a TTL.
+func (s *FieldTTLStats) add(at, refMs int64) *FieldTTLStats {
+	if at <= 0 {
+		return s
+	}
+	if s == nil {
+		s = &FieldTTLStats{MinExpire: at, MaxExpire: at}
+	}
+	s.Fields++
+	if at <= refMs {
+		s.Expired++
+	}
+	if at < s.MinExpire {
+		s.MinExpire = at
+	}
+	if at > s.MaxExpire {
+		s.MaxExpire = at
+	}
+	return s
+}
+
+// hasFieldTTL reports whether a field of the hash has a TTL
+func hasFieldTTL(expire map[string]int64) bool {
+	for _, at := range expire {
+		if at > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// listpackExOverhead is the listpackEx struct of a listpackex hash:
+// its ExpireMeta, the key and the listpack pointer
+func (m *MemProfiler) listpackExOverhead() uint64 {
+	return m.mallocOverhead(8 + 2*m.ptr())
+}
+
+// hashExpireMetaOverhead is the dict metadata of a hashtable hash with
+// field TTLs: its ExpireMeta, the ebuckets of its fields and the key
+func (m *MemProfiler) hashExpireMetaOverhead() uint64 {
+	return 8 + 2*m.ptr()
+}
+
+// hfieldSize is a hash field with a TTL in a hashtable: an mstr with the
+// ExpireMeta of the field in front of the string
+func (m *MemProfiler) hfieldSize(size uint64) uint64 {
+	return m.sdsSize(size + 8)
+}
+
+// FieldTTLBytes returns the memory the field TTLs of a hash add when it is
+// stored in encoding, 0 for servers without hash field expiration
+func (m *MemProfiler) FieldTTLBytes(o *parser.HashObject, encoding string, rules EncodingRules) uint64 {
+	if !hasFieldTTL(o.FieldExpirations) {
+		return 0
+	}
+	with, _ := m.SizeOfValue(o, encoding, rules)
+	plain := encoding
+	if plain == "listpackex" {
+		plain = "listpack"
+	}
+	without, _ := m.SizeOfValue(&parser.HashObject{BaseObject: o.BaseObject, Hash: o.Hash}, plain, rules)
+	if with < without {
+		return 0
+	}
+	return with - without
+}
@@ -1,12 +1,55 @@
 package decoder
 
 import (
+	"strconv"
+	"time"
+
 	"github.com/hdt3213/rdb/parser"
 )
 
+// addElem accumulates the shape of a key one element at a time
+func (e *Entry) addElem(elem string) {
+	n := uint64(len(elem))
+	e.ElemBytes += n
+	if n > e.MaxElemLen {
+		e.MaxElemLen = n
+	}
+	if e.AllInts && !isInt(elem) {
+		e.AllInts = false
+	}
+}
+
+// truncateElem keeps FieldOfLargestElem readable for big members
+func truncateElem(b []byte) string {
+	if len(b) > elementNameMaxLen {
+		return string(b[:elementNameMaxLen]) + "..."
+	}
+	return string(b)
+}
+
+// isInt reports whether Redis would store s as an integer
+func isInt(s string) bool {
+	if len(s) == 0 || len(s) > 20 {
+		return false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return err == nil && strconv.FormatInt(n, 10) == s
+}
+
 // ConvertToEntry converts HDT3213 RedisObject to our Entry format
 // This adapter allows us to use the new parser with existing analysis code
 func ConvertToEntry(obj parser.RedisObject) *Entry {
+	ref := time.Now().Unix()
+	entry := convertToEntry(obj, ref)
+	if wantsElementStats(entry.NumOfElem, entry.Bytes) {
+		entry.Elements, entry.Scores = elementStats(obj, ref)
+	}
+	return entry
+}
+
+// convertToEntry is ConvertToEntry with ages relative to ref, the snapshot
+// time in unix seconds
+func convertToEntry(obj parser.RedisObject, ref int64) *Entry {
 	entry := &Entry{
 		Key:   obj.GetKey(),
 		Type:  obj.GetType(),
@@ -22,6 +65,7 @@ func ConvertToEntry(obj parser.RedisObject) *Entry {
 	}
 
 	// Extract NumOfElem based on type
+	entry.AllInts = true
 	switch o := obj.(type) {
 	case *parser.ListObject:
 		entry.NumOfElem = uint64(len(o.Values))
@@ -29,8 +73,10 @@ func ConvertToEntry(obj parser.RedisObject) *Entry {
 		if len(o.Values) > 0 {
 			maxLen := 0
 			for _, v := range o.Values {
+				entry.addElem(string(v))
 				if len(v) > maxLen {
 					maxLen = len(v)
+					entry.FieldOfLargestElem = truncateElem(v)
 				}
 			}
 			entry.LenOfLargestElem = uint64(maxLen)
@@ -42,8 +88,10 @@ func ConvertToEntry(obj parser.RedisObject) *Entry {
 		if len(o.Members) > 0 {
 			maxLen := 0
 			for _, m := range o.Members {
+				entry.addElem(string(m))
 				if len(m) > maxLen {
 					maxLen = len(m)
+					entry.FieldOfLargestElem = truncateElem(m)
 				}
 			}
 			entry.LenOfLargestElem = uint64(maxLen)
@@ -51,11 +99,14 @@ func ConvertToEntry(obj parser.RedisObject) *Entry {
 
 	case *parser.HashObject:
 		entry.NumOfElem = uint64(len(o.Hash))
+		entry.FieldTTL = newFieldTTLStats(o.FieldExpirations, ref*1000)
 		// Find largest field
 		if len(o.Hash) > 0 {
 			maxLen := 0
 			var maxField string
 			for k, v := range o.Hash {
+				entry.addElem(k)
+				entry.addElem(string(v))
 				if len(v) > maxLen {
 					maxLen = len(v)
 					maxField = k
@@ -71,32 +122,69 @@ func ConvertToEntry(obj parser.RedisObject) *Entry {
 		if len(o.Entries) > 0 {
 			maxLen := 0
 			for _, e := range o.Entries {
+				entry.addElem(e.Member)
 				if len(e.Member) > maxLen {
 					maxLen = len(e.Member)
+					entry.FieldOfLargestElem = truncateElem([]byte(e.Member))
 				}
 			}
 			entry.LenOfLargestElem = uint64(maxLen)
 		}
 
 	case *parser.StreamObject:
-		// Stream entries count
-		totalEntries := 0
-		for _, e := range o.Entries {
-			totalEntries += len(e.Fields)
-		}
-		entry.NumOfElem = uint64(totalEntries)
+		// Stream message count
+		entry.Stream = newStreamStats(o, ref)
+		entry.NumOfElem = o.Length
 
 	case *parser.StringObject:
 		// For strings, NumOfElem is the length of the string value
 		// This is important for length distribution charts
 		entry.NumOfElem = uint64(len(o.Value))
-		
+		entry.addElem(string(o.Value))
+
 	default:
 		entry.NumOfElem = 0
 	}
 
-	// Encoding is not exposed by HDT3213, leave empty
+	if entry.ElemBytes == 0 {
+		entry.AllInts = false
+	}
+
+	// Encoding is not exposed by HDT3213, it is inferred from the shape
+	// once the redis version is known (see DecodeWithHDT)
 	entry.Encoding = ""
 
 	return entry
 }
+
+// elementStats is the element drill-down of a collection, and the score
+// profile of a sorted set. Scores are relative to ref, the snapshot time in
+// unix seconds.
+func elementStats(obj parser.RedisObject, ref int64) (*ElementStats, *ScoreStats) {
+	ec := NewElementCollector()
+	switch o := obj.(type) {
+	case *parser.ListObject:
+		for _, v := range o.Values {
+			ec.Add(string(v), uint64(len(v)))
+		}
+	case *parser.SetObject:
+		for _, m := range o.Members {
+			ec.Add(string(m), uint64(len(m)))
+		}
+	case *parser.HashObject:
+		for k, v := range o.Hash {
+			ec.Add(k, uint64(len(v)))
+			ec.AddField(k)
+		}
+	case *parser.ZSetObject:
+		sc := NewScoreCollector(ref)
+		for _, e := range o.Entries {
+			ec.AddScored(e.Member, uint64(len(e.Member)), e.Score)
+			sc.Add(e.Score)
+		}
+		return ec.Stats(), sc.Stats()
+	default:
+		return nil, nil
+	}
+	return ec.Stats(), nil
+}
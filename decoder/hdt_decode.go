@@ -1,33 +1,131 @@
 package decoder
 
 import (
+	"fmt"
 	"io"
-	
+
+	"github.com/hdt3213/rdb/model"
 	"github.com/hdt3213/rdb/parser"
 )
 
 // DecodeWithHDT uses the HDT3213 parser to decode RDB file
 // This replaces the old github.com/919927181/rdb parser
-func (d *Decoder) DecodeWithHDT(file io.Reader) error {
-	decoder := parser.NewDecoder(file)
-
-	err := decoder.Parse(func(obj parser.RedisObject) bool {
-		// Convert RedisObject to Entry using adapter
-		entry := ConvertToEntry(obj)
-		
-		// IMPORTANT: Create a copy to avoid all entries sharing the same pointer
-		// This prevents memory leak when entries are stored in heaps/maps
-		entryCopy := *entry
-		
-		// Send copy to channel for processing
-		d.Entries <- &entryCopy
-		
+//
+// It never panics: keys that cannot be analysed are skipped (see GetSkipped)
+// and an error that stops decoding is returned as a *DecodeError, also kept
+// for GetError. The keys decoded before it are still sent.
+func (d *Decoder) DecodeWithHDT(file io.Reader) (err error) {
+	// Close channel to signal Count() goroutine that parsing is complete
+	defer d.closeEntries()
+	return d.decodeRDB(file, nil)
+}
+
+// decodeRDB decodes an RDB without closing Entries. Keys for which keep
+// returns true are handed over to it instead of being sent, with their
+// serialized size.
+func (d *Decoder) decodeRDB(file io.Reader, keep func(obj parser.RedisObject, serialized uint64) bool) (err error) {
+	// start of the record being decoded, the read count after the previous one
+	var offset int64
+	defer func() {
+		if r := recover(); r != nil {
+			d.err = &DecodeError{Offset: offset, Err: ErrPanic, Detail: fmt.Sprint(r)}
+			err = d.err
+		}
+	}()
+
+	cr := newChecksumReader(file)
+	d.meta.Checksum = ChecksumUnverified
+	decoder := withModuleReaders(parser.NewDecoder(cr).WithSpecialOpCode())
+
+	parseErr := decoder.Parse(func(obj parser.RedisObject) (ok bool) {
+		start, end := offset, int64(decoder.GetReadCount())
+		offset = end
+		defer func() {
+			if r := recover(); r != nil {
+				d.skip(obj.GetType(), obj.GetKey(), obj.GetDBIndex(), start, end-start, fmt.Errorf("%w: %v", ErrPanic, r))
+				ok = true
+			}
+		}()
+
+		switch o := obj.(type) {
+		case *parser.AuxObject:
+			d.Aux([]byte(o.Key), []byte(o.Value))
+			return true
+		case *parser.DBSizeObject:
+			d.meta.DBSizes = append(d.meta.DBSizes, DBSizeHint{DB: o.DB, Keys: o.KeyCount, Expires: o.TTLCount})
+			return true
+		case *model.FunctionsObject:
+			return true
+		}
+
+		if keep != nil && keep(obj, uint64(end-start)) {
+			return true
+		}
+
+		// IMPORTANT: newEntry returns a fresh entry for every key, so that
+		// entries stored in heaps/maps never share a pointer
+		d.send(d.newEntry(obj, uint64(end-start)))
+
 		// Return true to continue parsing
 		return true
 	})
 
-	// Close channel to signal Count() goroutine that parsing is complete
-	close(d.Entries)
-	
-	return err
+	d.meta.Version = cr.version()
+	d.rdbVer = d.meta.Version
+	if parseErr != nil {
+		d.err = &DecodeError{Offset: offset, Err: parseError(parseErr), Detail: parseErr.Error()}
+		return d.err
+	}
+	cr.finish(int64(decoder.GetReadCount()))
+	d.meta.Checksum = cr.result()
+	return nil
+}
+
+// startSizing picks the profile and the encoding rules. Aux fields come
+// before the keys, so it is called at the first key.
+func (d *Decoder) startSizing() {
+	if d.sizing {
+		return
+	}
+	d.sizing = true
+	d.selectProfile()
+	d.rules = d.m.profile().EncodingRules()
+	if d.target != nil {
+		d.targetM = NewMemProfiler(*d.target)
+		d.targetRules = d.target.EncodingRules()
+	}
+}
+
+// newEntry converts a parsed key to an Entry and sizes it. serialized is
+// the size of the key in the RDB.
+func (d *Decoder) newEntry(obj parser.RedisObject, serialized uint64) *Entry {
+	d.startSizing()
+	rules, target, targetRules := d.rules, d.targetM, d.targetRules
+
+	// Convert RedisObject to Entry using adapter
+	entry := convertToEntry(obj, d.snapshotTime())
+	if o, ok := obj.(*model.ModuleTypeObject); ok {
+		// module keys are counted under their own type, the encoding is the module ID
+		entry.Type = ModuleTypeName(o.ModuleType)
+		entry.Encoding = o.ModuleType
+		entry.NumOfElem, entry.Bytes = d.m.SizeOfModuleObject(o, serialized)
+		if target != nil {
+			entry.ProjectedEncoding = entry.Encoding
+			_, entry.ProjectedBytes = target.SizeOfModuleObject(o, serialized)
+		}
+		return entry
+	}
+	entry.Encoding = rules.Infer(entry.Shape())
+	entry.Bytes = d.m.SizeOfObject(obj, entry.Encoding, rules)
+	if d.elementKeys.keep(entry.NumOfElem, entry.Bytes) {
+		entry.Elements, entry.Scores = elementStats(obj, d.snapshotTime())
+	}
+	if h, ok := obj.(*parser.HashObject); ok && entry.FieldTTL != nil {
+		entry.FieldTTL.MetaBytes = d.m.FieldTTLBytes(h, entry.Encoding, rules)
+	}
+	if target != nil {
+		entry.ProjectedEncoding = targetRules.Infer(entry.Shape())
+		entry.ProjectedBytes = target.SizeOfObject(obj, entry.ProjectedEncoding, targetRules)
+	}
+	return entry
 }
@@ -15,17 +15,15 @@
 package decoder
 
 import (
-	"math/rand"
+	"hash/fnv"
 	"sort"
 	"strconv"
 )
 
 var (
-	skiplistMaxLevel    = 64
+	skiplistMaxLevel    = 32 // ZSKIPLIST_MAXLEVEL
 	skiplistP           = 0.25
 	redisSharedInterges = int64(10000)
-	longSize            = uint64(8)
-	pointerSize         = uint64(8)
 	jemallocSizeClasses = []uint64{
 		8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 640, 768, 896, 1024,
 		1280, 1536, 1792, 2048, 2560, 3072, 3584, 4096, 5120, 6144, 7168, 8192, 10240, 12288, 14336, 16384, 20480, 24576,
@@ -58,11 +56,45 @@ var (
 	}
 )
 
-// MemProfiler get memory use for all kinds of data stuct
-type MemProfiler struct{}
+// MemProfiler get memory use for all kinds of data stuct.
+// The zero value uses DefaultProfile.
+type MemProfiler struct {
+	Profile MemoryProfile
+}
+
+// NewMemProfiler returns a MemProfiler for the given profile
+func NewMemProfiler(p MemoryProfile) *MemProfiler {
+	return &MemProfiler{Profile: p.withDefaults()}
+}
+
+func (m *MemProfiler) profile() MemoryProfile {
+	if m.Profile.Family == "" {
+		return DefaultProfile
+	}
+	return m.Profile.withDefaults()
+}
+
+// ptr is the size of a pointer
+func (m *MemProfiler) ptr() uint64 {
+	return m.profile().WordSize
+}
+
+// long is the size of a long, which follows the word size on Linux
+func (m *MemProfiler) long() uint64 {
+	return m.profile().WordSize
+}
 
 // mallocOverhead used memory
 func (m *MemProfiler) mallocOverhead(size uint64) uint64 {
+	if m.profile().Allocator == AllocatorLibc {
+		// glibc: size plus a size_t header, aligned to two words, min four words
+		w := m.ptr()
+		chunk := (size + w + 2*w - 1) &^ (2*w - 1)
+		if chunk < 4*w {
+			chunk = 4 * w
+		}
+		return chunk
+	}
 	idx := sort.Search(len(jemallocSizeClasses),
 		func(i int) bool { return jemallocSizeClasses[i] >= size })
 	if idx < len(jemallocSizeClasses) {
@@ -75,6 +107,17 @@ func (m *MemProfiler) mallocOverhead(size uint64) uint64 {
 // Each top level object is an entry in a dictionary, and so we have to include
 // the overhead of a dictionary entry
 func (m *MemProfiler) TopLevelObjOverhead(key []byte, expiry int64) uint64 {
+	if m.profile().EmbeddedKeys {
+		// Valkey 8 allocates the robj, the key sds and the expire together,
+		// the expires dict only keeps an entry pointing to it
+		size := m.robjSize() + 3 + uint64(len(key)) + 1
+		bytes := m.HashTableEntryOverHead()
+		if expiry > 0 {
+			size += 8
+			bytes += m.HashTableEntryOverHead()
+		}
+		return bytes + m.mallocOverhead(size)
+	}
 	return m.HashTableEntryOverHead() + m.SizeofString(key) + m.RobjOverHead() + m.KeyExpiryOverhead(expiry)
 }
 
@@ -90,7 +133,7 @@ func (m *MemProfiler) TopLevelObjOverhead(key []byte, expiry int64) uint64 {
 // case in which both tables are allocated, and so multiply
 // the size of **table by 1.5
 func (m *MemProfiler) HashTableOverHead(size uint64) uint64 {
-	return 4 + 7*longSize + 4*pointerSize + nextPower(size)*pointerSize*3/2
+	return 4 + 7*m.long() + 4*m.ptr() + nextPower(size)*m.ptr()*3/2
 }
 
 func (m *MemProfiler) SizeofStreamRadixTree(numElements uint64) uint64 {
@@ -99,20 +142,20 @@ func (m *MemProfiler) SizeofStreamRadixTree(numElements uint64) uint64 {
 }
 
 func (m *MemProfiler) StreamOverhead() uint64 {
-	return 2*pointerSize + 8 + 16 + // stream struct
-		pointerSize + 8*2 // rax struct
+	return 2*m.ptr() + 8 + 16 + // stream struct
+		m.ptr() + 8*2 // rax struct
 }
 
 func (m *MemProfiler) StreamConsumer(name []byte) uint64 {
-	return pointerSize*2 + 8 + m.SizeofString(name)
+	return m.ptr()*2 + 8 + m.SizeofString(name)
 }
 
 func (m *MemProfiler) StreamCG() uint64 {
-	return pointerSize*2 + 16
+	return m.ptr()*2 + 16
 }
 
 func (m *MemProfiler) StreamNACK(length uint64) uint64 {
-	return length * (pointerSize + 8 + 8)
+	return length * (m.ptr() + 8 + 8)
 }
 
 // HashTableEntryOverHead get memory use of hashtable entry
@@ -130,41 +173,57 @@ func (m *MemProfiler) StreamNACK(length uint64) uint64 {
 //	    struct dictEntry *next;
 //	} dictEntry;
 func (m *MemProfiler) HashTableEntryOverHead() uint64 {
-	return 3 * pointerSize
+	return m.mallocOverhead(3 * m.ptr())
+}
+
+// setEntryOverHead is the dict entry of a set member, which has no value
+// pointer since 7.2
+func (m *MemProfiler) setEntryOverHead() uint64 {
+	if m.profile().SetNoValue {
+		return m.mallocOverhead(2 * m.ptr())
+	}
+	return m.HashTableEntryOverHead()
 }
 
 // LinkedListOverHead get memory use of a linked list
 // See https://github.com/antirez/redis/blob/unstable/src/adlist.h
 // A list has 5 pointers + an unsigned long
 func (m *MemProfiler) LinkedListOverHead() uint64 {
-	return longSize + 5*pointerSize
+	return m.long() + 5*m.ptr()
 }
 
 // LinkedListEntryOverHead get memory use of a linked list entry
 // See https://github.com/antirez/redis/blob/unstable/src/adlist.h
 // A node has 3 pointers
 func (m *MemProfiler) LinkedListEntryOverHead() uint64 {
-	return 3 * pointerSize
+	return 3 * m.ptr()
 }
 
 // SkipListOverHead get memory use of a skiplist
 func (m *MemProfiler) SkipListOverHead(size uint64) uint64 {
-	return 2*pointerSize + m.HashTableOverHead(size) + (2*pointerSize + 16)
+	return 2*m.ptr() + m.HashTableOverHead(size) + (2*m.ptr() + 16)
+}
+
+// SkipListEntryOverHead get memory use of a skiplist entry. The level of the
+// node is derived from the member, so the same zset always gets the same size.
+func (m *MemProfiler) SkipListEntryOverHead(member []byte) uint64 {
+	return m.HashTableEntryOverHead() + 2*m.ptr() + 8 + (m.ptr()+8)*skiplistLevel(member)
 }
 
-// SkipListEntryOverHead get memory use of a skiplist entry
-func (m *MemProfiler) SkipListEntryOverHead() uint64 {
-	return m.HashTableEntryOverHead() + 2*pointerSize + 8 + (pointerSize+8)*zsetRandLevel()
+// skipListEntryExpected is SkipListEntryOverHead with the expected level
+// 1/(1-p) instead of a random one, for estimations over many entries
+func (m *MemProfiler) skipListEntryExpected() uint64 {
+	return m.HashTableEntryOverHead() + 2*m.ptr() + 8 + uint64(float64(m.ptr()+8)/(1-skiplistP))
 }
 
 func (m *MemProfiler) QuickListOverHead(size uint64) uint64 {
-	quicklist := 2*pointerSize + 8 + 2*4
-	quickitem := 4*pointerSize + 8 + 2*4
+	quicklist := 2*m.ptr() + 8 + 2*4
+	quickitem := 4*m.ptr() + 8 + 2*4
 	return quicklist + size*quickitem
 }
 
 func (m *MemProfiler) QuickList2OverHead() uint64 {
-	return 2*pointerSize + 2*8 + 2*4
+	return 2*m.ptr() + 2*8 + 2*4
 }
 
 func (m *MemProfiler) ListPackEntryOverHead() uint64 {
@@ -236,10 +295,16 @@ func (m *MemProfiler) KeyExpiryOverhead(expiry int64) uint64 {
 //	} robj;
 //
 // In Redis internals, each key-value pair maps to a redisObject structure containing an lru field that records last access timestamp. Default is 24 bits
+// The type, encoding and lru bit fields share a single 32-bit word.
 const LRU_BITS = 24
 
 func (m *MemProfiler) RobjOverHead() uint64 {
-	return pointerSize + 4 + 4 + LRU_BITS + 4
+	return m.mallocOverhead(m.robjSize())
+}
+
+// robjSize is sizeof(robj) before allocator rounding
+func (m *MemProfiler) robjSize() uint64 {
+	return (4+4+LRU_BITS)/8 + 4 + m.ptr()
 }
 
 // SizeofString get memory use of a string
@@ -253,13 +318,17 @@ func (m *MemProfiler) SizeofString(bytes []byte) uint64 {
 		}
 		return 8
 	}
-	size := uint64(len(str))
+	return m.sdsSize(uint64(len(str)))
+}
+
+// sdsSize get memory use of a sds string holding size bytes
+func (m *MemProfiler) sdsSize(size uint64) uint64 {
 	//return m.mallocOverhead(size + 8 + 1)
 	if size < 32 { // 2^5
 		return m.mallocOverhead(size + 1 + 1)
 	} else if size < 256 { // 2^8
-		return m.mallocOverhead(size + 2 + 1)
-	} else if size < 25536 { // 2^16
+		return m.mallocOverhead(size + 3 + 1)
+	} else if size < 65536 { // 2^16
 		return m.mallocOverhead(size + 1 + 4 + 1)
 	} else if size < 4294967296 { // 2^32
 		return m.mallocOverhead(size + 1 + 8 + 1)
@@ -288,15 +357,17 @@ func nextPower(size uint64) uint64 {
 	return power
 }
 
-func zsetRandLevel() uint64 {
-	level := 1
-	rint := rand.Intn(0xFFFF)
-	for rint < int(0xFFFF*1/4) { //skiplistP
+// skiplistLevel replaces the random level of zslRandomLevel with one drawn
+// from a hash of the member: every 2 bits of the hash are a coin with
+// p = 1/4, which keeps the distribution of levels and makes it reproducible
+func skiplistLevel(member []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(member)
+	bits := h.Sum64()
+	level := uint64(1)
+	for bits&3 == 0 && level < uint64(skiplistMaxLevel) {
 		level++
-		rint = rand.Intn(0xFFFF)
-	}
-	if level < skiplistMaxLevel {
-		return uint64(level)
+		bits >>= 2
 	}
-	return uint64(skiplistMaxLevel)
+	return level
 }
@@ -0,0 +1,125 @@
+package decoder
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+)
+
+func TestSkipListLevel(t *testing.T) {
+	members := []string{"", "a", "member:1", "member:2", "user:1000:score", "1700000000000"}
+	for _, member := range members {
+		level := skiplistLevel([]byte(member))
+		if level < 1 || level > uint64(skiplistMaxLevel) {
+			t.Errorf("skiplistLevel(%q) = %d, out of range", member, level)
+		}
+		for i := 0; i < 3; i++ {
+			if got := skiplistLevel([]byte(member)); got != level {
+				t.Errorf("skiplistLevel(%q) = %d, then %d", member, level, got)
+			}
+		}
+	}
+}
+
+// the hashed levels must follow the distribution of zslRandomLevel, so the
+// totals stay accurate
+func TestSkipListLevelDistribution(t *testing.T) {
+	const n = 200000
+	var sum uint64
+	counts := map[uint64]int{}
+	for i := 0; i < n; i++ {
+		level := skiplistLevel([]byte(fmt.Sprintf("member:%d", i)))
+		sum += level
+		counts[level]++
+	}
+	mean := float64(sum) / n
+	// expected level is 1/(1-p) = 4/3
+	if mean < 1.30 || mean > 1.37 {
+		t.Errorf("mean level = %.3f, want about 1.333", mean)
+	}
+	tests := []struct {
+		level uint64
+		share float64
+	}{
+		{level: 1, share: 0.75},
+		{level: 2, share: 0.1875},
+		{level: 3, share: 0.046875},
+	}
+	for _, tt := range tests {
+		got := float64(counts[tt.level]) / n
+		if got < tt.share*0.95 || got > tt.share*1.05 {
+			t.Errorf("share of level %d = %.4f, want about %.4f", tt.level, got, tt.share)
+		}
+	}
+}
+
+// skiplistRDB writes an RDB with sorted sets large enough to be skiplists
+func skiplistRDB(t *testing.T, redisVer string) []byte {
+	var buf bytes.Buffer
+	enc := encoder.NewEncoder(&buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteAux("redis-ver", redisVer); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	for k, size := range []int{200, 1000, 5000} {
+		entries := make([]*model.ZSetEntry, 0, size)
+		for i := 0; i < size; i++ {
+			entries = append(entries, &model.ZSetEntry{Member: fmt.Sprintf("member:%d", i), Score: float64(i)})
+		}
+		if err := enc.WriteZSetObject(fmt.Sprintf("zset:%d", k), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeSizes(t *testing.T, rdb []byte) map[string]uint64 {
+	d := NewDecoder()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.DecodeWithHDT(bytes.NewReader(rdb))
+	}()
+	sizes := map[string]uint64{}
+	for batch := range d.Entries {
+		for _, e := range batch {
+			if e.Encoding != "skiplist" {
+				t.Errorf("%s: encoding %q, want skiplist", e.Key, e.Encoding)
+			}
+			sizes[e.Key] = e.Bytes
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return sizes
+}
+
+func TestSkipListSizeRepeatable(t *testing.T) {
+	tests := []string{"6.2.14", "7.2.4", "7.4.0"}
+	for _, redisVer := range tests {
+		rdb := skiplistRDB(t, redisVer)
+		first := decodeSizes(t, rdb)
+		if len(first) != 3 {
+			t.Fatalf("redis %s: decoded %d keys, want 3", redisVer, len(first))
+		}
+		for run := 1; run < 5; run++ {
+			got := decodeSizes(t, rdb)
+			for key, size := range first {
+				if got[key] != size {
+					t.Errorf("redis %s, run %d: %s = %d bytes, first run %d", redisVer, run, key, got[key], size)
+				}
+			}
+		}
+	}
+}
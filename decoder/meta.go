@@ -0,0 +1,202 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/hdt3213/rdb/crc64jones"
+)
+
+// Checksum results of an RDB
+const (
+	ChecksumOK         = "ok"
+	ChecksumMismatch   = "mismatch"
+	ChecksumDisabled   = "disabled"   // saved with rdbchecksum no
+	ChecksumMissing    = "missing"    // RDB version 4 and older have no checksum
+	ChecksumUnverified = "unverified" // decoding did not reach the end of the file
+)
+
+// DBSizeHint is the RESIZEDB opcode of a database
+type DBSizeHint struct {
+	DB      int
+	Keys    uint64
+	Expires uint64
+}
+
+// RDBMeta is everything an RDB tells about itself besides the keys
+type RDBMeta struct {
+	Version    int               // RDB format version from the header
+	Aux        map[string]string // all aux fields as saved
+	RedisVer   string            `json:",omitempty"`
+	RedisBits  int               `json:",omitempty"`
+	CTime      int64             `json:",omitempty"`
+	UsedMem    int64             `json:",omitempty"`
+	ReplID     string            `json:",omitempty"`
+	ReplOffset int64             `json:",omitempty"`
+	AOFBase    bool              `json:",omitempty"`
+	DBSizes    []DBSizeHint      `json:",omitempty"`
+	Checksum   string
+}
+
+// setAux records an aux field and its parsed value
+func (m *RDBMeta) setAux(key, value string) {
+	if m.Aux == nil {
+		m.Aux = map[string]string{}
+	}
+	m.Aux[key] = value
+	switch key {
+	case "redis-ver":
+		m.RedisVer = value
+	case "redis-bits":
+		m.RedisBits, _ = strconv.Atoi(value)
+	case "ctime":
+		m.CTime, _ = strconv.ParseInt(value, 10, 64)
+	case "used-mem":
+		m.UsedMem, _ = strconv.ParseInt(value, 10, 64)
+	case "repl-id":
+		m.ReplID = value
+	case "repl-offset":
+		m.ReplOffset, _ = strconv.ParseInt(value, 10, 64)
+	case "aof-base", "aof-preamble":
+		m.AOFBase = value == "1"
+	}
+}
+
+// checksumWindow must be larger than the read-ahead of the parser, so the
+// bytes that make up the trailer are still around when decoding ends
+const checksumWindow = 64 << 10
+
+// checksumReader computes the CRC64 of the bytes it passes on. The latest
+// bytes are held back, as only the parser knows where the RDB ends (an AOF
+// preamble is followed by commands). It also captures the header.
+type checksumReader struct {
+	r       io.Reader
+	crc     hash.Hash64
+	header  []byte
+	pending []byte // read but not yet in crc
+	hashed  int64
+	tail    []byte // the checksum trailer once finished
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{r: r, crc: crc64jones.New()}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		if len(c.header) < 9 {
+			need := 9 - len(c.header)
+			if need > n {
+				need = n
+			}
+			c.header = append(c.header, p[:need]...)
+		}
+		c.pending = append(c.pending, p[:n]...)
+		// compact in chunks so each byte is moved about once
+		if len(c.pending) >= 2*checksumWindow {
+			over := len(c.pending) - checksumWindow
+			c.crc.Write(c.pending[:over])
+			c.hashed += int64(over)
+			c.pending = append(c.pending[:0], c.pending[over:]...)
+		}
+	}
+	return n, err
+}
+
+// finish marks the end of the RDB after consumed bytes, the last 8 of which
+// are the trailer. The HDT parser ignores a trailer it cannot read, consumed
+// then ends at the EOF opcode.
+func (c *checksumReader) finish(consumed int64) {
+	end := consumed - c.hashed
+	if end < 9 || end > int64(len(c.pending)) || c.pending[end-9] != rdbOpEOF {
+		return
+	}
+	c.crc.Write(c.pending[:end-8])
+	c.tail = append([]byte{}, c.pending[end-8:end]...)
+	c.pending = nil
+}
+
+// version returns the RDB version from the header
+func (c *checksumReader) version() int {
+	v, _, _ := parseHeader(c.header)
+	return v
+}
+
+// parseHeader reads the version of an RDB header, REDISxxxx or VALKEYxxx
+// from Valkey 9 on
+func parseHeader(header []byte) (version int, valkey bool, ok bool) {
+	if len(header) < 9 {
+		return 0, false, false
+	}
+	digits := header[5:9]
+	switch {
+	case string(header[:6]) == "VALKEY":
+		valkey, digits = true, header[6:9]
+	case string(header[:5]) != "REDIS":
+		return 0, false, false
+	}
+	version, err := strconv.Atoi(string(digits))
+	return version, valkey, err == nil
+}
+
+// IsRDBHeader reports whether head starts with the magic of an RDB
+func IsRDBHeader(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("REDIS")) || bytes.HasPrefix(head, []byte("VALKEY"))
+}
+
+// result compares the trailer with the computed checksum
+func (c *checksumReader) result() string {
+	if c.version() < 5 {
+		return ChecksumMissing
+	}
+	if len(c.tail) < 8 {
+		return ChecksumUnverified
+	}
+	expected := binary.LittleEndian.Uint64(c.tail)
+	if expected == 0 {
+		return ChecksumDisabled
+	}
+	if expected != c.crc.Sum64() {
+		return ChecksumMismatch
+	}
+	return ChecksumOK
+}
+
+// FileChecksum verifies the CRC64 trailer of a plain RDB file, before it is
+// decoded. Other files, e.g. compressed RDBs, give "".
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	c := &checksumReader{crc: crc64jones.New(), header: make([]byte, 9)}
+	if _, err := io.ReadFull(f, c.header); err != nil || !IsRDBHeader(c.header) {
+		return "", nil
+	}
+	if c.version() < 5 {
+		return ChecksumMissing, nil
+	}
+	// the header, the EOF opcode and the trailer
+	if info.Size() < 18 {
+		return ChecksumUnverified, nil
+	}
+	c.tail = make([]byte, 8)
+	if _, err := f.ReadAt(c.tail, info.Size()-8); err != nil {
+		return "", err
+	}
+	c.crc.Write(c.header)
+	if _, err := io.Copy(c.crc, io.LimitReader(f, info.Size()-8-9)); err != nil {
+		return "", err
+	}
+	return c.result(), nil
+}
@@ -0,0 +1,141 @@
+package decoder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hdt3213/rdb/encoder"
+)
+
+var decoders = map[string]func(*Decoder) func(io.Reader) error{
+	"DecodeWithHDT": func(d *Decoder) func(io.Reader) error { return d.DecodeWithHDT },
+	"DecodeStream":  func(d *Decoder) func(io.Reader) error { return d.DecodeStream },
+}
+
+func metaFixture(t *testing.T, version string, aux [][2]string) []byte {
+	return fixture(t, version, aux, 1, func(enc *encoder.Encoder, w rdbWriter) {
+		if err := enc.WriteStringObject("greeting", []byte("hello world")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestChecksum(t *testing.T) {
+	aux := [][2]string{{"redis-ver", "7.2.4"}, {"redis-bits", "64"}}
+	valid := metaFixture(t, "0011", aux)
+
+	mismatched := bytes.Clone(valid)
+	mismatched[bytes.Index(mismatched, []byte("hello"))] = 'j'
+
+	// saved with rdbchecksum no
+	disabled := bytes.Clone(valid)
+	copy(disabled[len(disabled)-8:], make([]byte, 8))
+
+	// RDB 4 ends at the EOF opcode
+	old := metaFixture(t, "0004", aux)
+	old = old[:len(old)-8]
+
+	tests := []struct {
+		name string
+		rdb  []byte
+		want string
+	}{
+		{"valid", valid, ChecksumOK},
+		{"mismatched", mismatched, ChecksumMismatch},
+		{"zero", disabled, ChecksumDisabled},
+		{"RDB 4", old, ChecksumMissing},
+	}
+	for _, tt := range tests {
+		for name, decode := range decoders {
+			entries, d, err := decodeEntries(t, tt.rdb, decode)
+			if err != nil {
+				t.Errorf("%s/%s: %v", tt.name, name, err)
+				continue
+			}
+			if got := d.GetMeta().Checksum; got != tt.want {
+				t.Errorf("%s/%s: checksum %q, want %q", tt.name, name, got, tt.want)
+			}
+			// a bad checksum is reported, the keys are still there
+			if len(entries) != 1 {
+				t.Errorf("%s/%s: %d keys", tt.name, name, len(entries))
+			}
+		}
+
+		path := filepath.Join(t.TempDir(), "dump.rdb")
+		if err := os.WriteFile(path, tt.rdb, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := FileChecksum(path); err != nil || got != tt.want {
+			t.Errorf("%s: FileChecksum = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// decoding stopped before the trailer
+	for name, decode := range decoders {
+		_, d, err := decodeEntries(t, valid[:len(valid)-12], decode)
+		if err == nil || d.GetMeta().Checksum != ChecksumUnverified {
+			t.Errorf("truncated/%s: checksum %q, error %v", name, d.GetMeta().Checksum, err)
+		}
+	}
+	// not an RDB, e.g. compressed
+	path := filepath.Join(t.TempDir(), "dump.rdb.gz")
+	if err := os.WriteFile(path, []byte("\x1f\x8b\x08\x00 not an rdb"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := FileChecksum(path); err != nil || got != "" {
+		t.Errorf("compressed: FileChecksum = %q, %v, want none", got, err)
+	}
+}
+
+func TestMetaAux(t *testing.T) {
+	aux := [][2]string{
+		{"redis-ver", "7.2.4"}, {"redis-bits", "64"}, {"ctime", fmt.Sprint(fixtureCtime)},
+		{"used-mem", "1048576"}, {"repl-id", "8c3bd1a5e6f4"}, {"repl-offset", "42"}, {"aof-base", "0"},
+	}
+	want := &RDBMeta{
+		Version: 11, RedisVer: "7.2.4", RedisBits: 64, CTime: fixtureCtime, UsedMem: 1 << 20,
+		ReplID: "8c3bd1a5e6f4", ReplOffset: 42, DBSizes: []DBSizeHint{{DB: 0, Keys: 1}}, Checksum: ChecksumOK,
+		Aux: map[string]string{},
+	}
+	for _, kv := range aux {
+		want.Aux[kv[0]] = kv[1]
+	}
+	for name, decode := range decoders {
+		_, d, err := decodeEntries(t, metaFixture(t, "0011", aux), decode)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := d.GetMeta(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: meta %+v, want %+v", name, got, want)
+		}
+		if got := d.snapshotTime(); got != fixtureCtime {
+			t.Errorf("%s: snapshot time %d, want the ctime", name, got)
+		}
+	}
+
+	// Redis before 3.2 saves no aux fields
+	for name, decode := range decoders {
+		before := time.Now().Unix()
+		_, d, err := decodeEntries(t, metaFixture(t, "0006", nil), decode)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		meta := d.GetMeta()
+		if meta.Aux != nil || meta.RedisVer != "" || meta.CTime != 0 || meta.Version != 6 || meta.Checksum != ChecksumOK {
+			t.Errorf("%s: meta %+v without aux fields", name, meta)
+		}
+		if got := SelectProfile(meta).Name(); got != "redis-3.0/jemalloc/64" {
+			t.Errorf("%s: profile %s without redis-ver", name, got)
+		}
+		// without a ctime, ages are relative to now
+		if got := d.snapshotTime(); got < before {
+			t.Errorf("%s: snapshot time %d without ctime, want now", name, got)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package decoder
+
+import (
+	"encoding/json"
+
+	"github.com/hdt3213/rdb/core"
+	"github.com/hdt3213/rdb/model"
+)
+
+// moduleTypes maps module type IDs to the key type they are counted as
+var moduleTypes = map[string]string{
+	"ReJSON-RL": "json",
+	"MBbloom--": "bloom",
+	"MBbloomCF": "cuckoo",
+	"CMSk-TYPE": "cms",
+	"TopK-TYPE": "topk",
+	"TDIS-TYPE": "tdigest",
+	"TSDB-TYPE": "timeseries",
+	"ft_index0": "search",
+	"ft_invidx": "search",
+	"graphdata": "graph",
+}
+
+// ModuleTypeName returns the key type of a module type ID, "module:<id>"
+// for modules it does not know
+func ModuleTypeName(id string) string {
+	if t, ok := moduleTypes[id]; ok {
+		return t
+	}
+	return "module:" + id
+}
+
+// moduleItem is one value a module saved with the RedisModule_Save* API
+type moduleItem struct {
+	Opcode core.Opcode
+	Uint   uint64
+	Int    int64
+	Float  float64
+	Len    int    // length of a string
+	Str    []byte // the string itself, only kept for modules that need it
+}
+
+// ModuleValue is the content of a module value as the items it was saved
+// with, which is all the RDB tells without the module's own loader
+type ModuleValue struct {
+	Module string
+	EncVer int
+	Items  []moduleItem
+}
+
+// strings returns the total length and number of the strings
+func (v *ModuleValue) strings() (total uint64, n uint64) {
+	for _, it := range v.Items {
+		if it.Opcode == core.ModuleOpcodeString {
+			total += uint64(it.Len)
+			n++
+		}
+	}
+	return total, n
+}
+
+// is reports whether the items start with the given opcodes
+func (v *ModuleValue) is(opcodes ...core.Opcode) bool {
+	if len(v.Items) < len(opcodes) {
+		return false
+	}
+	for i, op := range opcodes {
+		if v.Items[i].Opcode != op {
+			return false
+		}
+	}
+	return true
+}
+
+// moduleReader returns a handler that reads a module value item by item
+func moduleReader(module string) core.ModuleTypeHandleFunc {
+	// RedisJSON saves the document as a string, which is parsed for the estimate
+	keepStrings := module == "ReJSON-RL"
+	return func(h core.ModuleTypeHandler, encVer int) (interface{}, error) {
+		v := &ModuleValue{Module: module, EncVer: encVer}
+		for {
+			op, err := h.ReadOpcode()
+			if err != nil {
+				return nil, err
+			}
+			it := moduleItem{Opcode: op}
+			switch op {
+			case core.ModuleOpcodeEOF:
+				return v, nil
+			case core.ModuleOpcodeSInt:
+				it.Int, err = h.ReadSInt()
+			case core.ModuleOpcodeUInt:
+				it.Uint, err = h.ReadUInt()
+			case core.ModuleOpcodeFloat:
+				var f float32
+				f, err = h.ReadFloat32()
+				it.Float = float64(f)
+			case core.ModuleOpcodeDouble:
+				it.Float, err = h.ReadDouble()
+			case core.ModuleOpcodeString:
+				var s []byte
+				s, err = h.ReadString()
+				it.Len = len(s)
+				if keepStrings {
+					it.Str = s
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			v.Items = append(v.Items, it)
+		}
+	}
+}
+
+// withModuleReaders registers a reader for every known module type
+func withModuleReaders(dec *core.Decoder) *core.Decoder {
+	for id := range moduleTypes {
+		dec = dec.WithSpecialType(id, moduleReader(id))
+	}
+	return dec
+}
+
+// SizeOfModuleObject returns the element count of a module key and its
+// memory estimate including the keyspace overhead. serialized is the size of
+// the key in the RDB, used for modules it has no model of.
+func (m *MemProfiler) SizeOfModuleObject(o *model.ModuleTypeObject, serialized uint64) (elems, bytes uint64) {
+	var expiry int64
+	if exp := o.GetExpiration(); exp != nil {
+		expiry = exp.UnixNano() / int64(1e6)
+	}
+	elems, bytes = m.sizeOfModule(o, serialized)
+	return elems, m.TopLevelObjOverhead([]byte(o.Key), expiry) + bytes
+}
+
+// sizeOfModule estimates the elements and memory of a module value. Without
+// a model for the module the serialized size is used.
+func (m *MemProfiler) sizeOfModule(o *model.ModuleTypeObject, serialized uint64) (elems, bytes uint64) {
+	v, ok := o.Value.(*ModuleValue)
+	if !ok {
+		return 0, serialized
+	}
+	strBytes, strs := v.strings()
+	switch v.Module {
+	case "ReJSON-RL":
+		// RedisJSON 2 saves the document as JSON text, 1.x as a node tree
+		if v.EncVer >= 2 && v.is(core.ModuleOpcodeString) {
+			var doc interface{}
+			if err := json.Unmarshal(v.Items[0].Str, &doc); err == nil {
+				elems, bytes = m.sizeOfJSON(doc)
+				return elems, bytes + m.mallocOverhead(2*m.ptr())
+			}
+		}
+		return uint64(len(v.Items)), serialized
+	case "MBbloom--":
+		// size, nfilters, options, growth, then each filter with its bit array
+		if v.is(core.ModuleOpcodeUInt, core.ModuleOpcodeUInt) {
+			elems = v.Items[0].Uint
+			filters := v.Items[1].Uint
+			// SBChain, then an array of SBLink (struct bloom and a size)
+			bytes = m.mallocOverhead(4*m.long()+m.ptr()) + m.mallocOverhead(filters*(7*8+m.ptr()+m.long()))
+			for _, it := range v.Items {
+				if it.Opcode == core.ModuleOpcodeString {
+					bytes += m.mallocOverhead(uint64(it.Len))
+				}
+			}
+			return elems, bytes
+		}
+	case "TSDB-TYPE":
+		// keyName, retention, chunkSize, options, lastTimestamp, lastValue, totalSamples
+		if v.is(core.ModuleOpcodeString, core.ModuleOpcodeUInt, core.ModuleOpcodeUInt, core.ModuleOpcodeUInt,
+			core.ModuleOpcodeUInt, core.ModuleOpcodeDouble, core.ModuleOpcodeUInt) {
+			elems = v.Items[6].Uint
+		}
+		// the Series struct, then each label, rule and chunk is an allocation
+		// of its own next to its buffer
+		bytes = m.mallocOverhead(256)
+		for _, it := range v.Items {
+			if it.Opcode == core.ModuleOpcodeString {
+				bytes += m.mallocOverhead(uint64(it.Len)) + m.RobjOverHead()
+			}
+		}
+		return elems, bytes
+	}
+	// counters, sketches and filters keep their saved buffers in memory
+	if strs > 0 {
+		return 0, strBytes + strs*m.mallocOverhead(4*m.ptr())
+	}
+	return 0, serialized
+}
+
+// sizeOfJSON counts the values of a JSON document and estimates their size
+// as RedisJSON 2 stores them (ijson): every value is a tagged pointer,
+// small numbers, booleans and null live inside it
+func (m *MemProfiler) sizeOfJSON(doc interface{}) (elems, bytes uint64) {
+	elems = 1
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		// header plus the key and value pointers and the hash index of each entry
+		bytes = m.mallocOverhead(2*m.long() + uint64(len(v))*(2*m.ptr()+m.long()))
+		for k, child := range v {
+			e, b := m.sizeOfJSON(child)
+			elems += e
+			bytes += b + m.mallocOverhead(2*m.long()+uint64(len(k)))
+		}
+	case []interface{}:
+		bytes = m.mallocOverhead(2*m.long() + uint64(len(v))*m.ptr())
+		for _, child := range v {
+			e, b := m.sizeOfJSON(child)
+			elems += e
+			bytes += b
+		}
+	case string:
+		bytes = m.mallocOverhead(2*m.long() + uint64(len(v)))
+	case float64:
+		if v != float64(int64(v)) || v < -(1<<23) || v >= 1<<23 {
+			bytes = m.mallocOverhead(2 * 8)
+		}
+	}
+	return elems, bytes
+}
@@ -0,0 +1,116 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/hdt3213/rdb/core"
+	"github.com/hdt3213/rdb/encoder"
+)
+
+// module writes a RDB_TYPE_MODULE_2 record of the module type id. items
+// are saved as with RedisModule_Save*: uint64, int64, float64 and string.
+func (w rdbWriter) module(key, id string, encVer uint64, items ...interface{}) {
+	w.WriteByte(7)
+	w.str(key)
+	var moduleID uint64
+	for _, c := range id {
+		moduleID = moduleID<<6 | uint64(strings.IndexRune(core.ModuleTypeNameCharSet, c))
+	}
+	w.length(moduleID<<10 | encVer)
+	for _, it := range items {
+		switch v := it.(type) {
+		case uint64:
+			w.length(uint64(core.ModuleOpcodeUInt))
+			w.length(v)
+		case int64:
+			w.length(uint64(core.ModuleOpcodeSInt))
+			w.length(uint64(v))
+		case float64:
+			w.length(uint64(core.ModuleOpcodeDouble))
+			binary.Write(w, binary.LittleEndian, math.Float64bits(v))
+		case string:
+			w.length(uint64(core.ModuleOpcodeString))
+			w.str(v)
+		}
+	}
+	w.length(uint64(core.ModuleOpcodeEOF))
+}
+
+func moduleRDB(t *testing.T) []byte {
+	aux := [][2]string{{"redis-ver", "7.2.4"}, {"redis-bits", "64"}}
+	return fixture(t, "0011", aux, 6, func(enc *encoder.Encoder, w rdbWriter) {
+		if err := enc.WriteStringObject("plain", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		w.module("doc", "ReJSON-RL", 3, `{"a":1,"b":[1,2.5,"x"],"c":{"d":null}}`)
+		// size, filters, options, growth, then the filter and its bit array
+		w.module("bloom", "MBbloom--", 4, uint64(1000), uint64(1), uint64(2), uint64(2),
+			uint64(1000), uint64(7), float64(0.01), float64(9.6), uint64(9585), uint64(1198), uint64(13), strings.Repeat("\x00", 1198), uint64(1000))
+		// keyName, retention, chunkSize, options, lastTimestamp, lastValue,
+		// totalSamples, then a label and a chunk
+		w.module("temp", "TSDB-TYPE", 5, "temp", uint64(0), uint64(4096), uint64(0), uint64(1700000000000), float64(21.5), uint64(500),
+			uint64(1), "room", "kitchen", strings.Repeat("c", 4096))
+		w.module("sketch", "CMSk-TYPE", 0, uint64(2000), uint64(5), uint64(0), strings.Repeat("\x01", 40000))
+		w.module("other", "xyzmodule", 1, uint64(1), "payload")
+	})
+}
+
+func TestModules(t *testing.T) {
+	tests := []struct {
+		key      string
+		typ      string
+		elems    uint64
+		minBytes uint64 // at least the saved payload
+	}{
+		// the root, a, b and its 3 values, c and d
+		{"doc", "json", 8, 0},
+		{"bloom", "bloom", 1000, 1198},
+		{"temp", "timeseries", 500, 4096},
+		{"sketch", "cms", 0, 40000},
+		{"other", "module:xyzmodule", 0, 7},
+	}
+	rdb := moduleRDB(t)
+	decoders := map[string]func(*Decoder) func(io.Reader) error{
+		"DecodeWithHDT": func(d *Decoder) func(io.Reader) error { return d.DecodeWithHDT },
+		"DecodeStream":  func(d *Decoder) func(io.Reader) error { return d.DecodeStream },
+	}
+	for name, decode := range decoders {
+		entries, _, err := decodeEntries(t, rdb, decode)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(entries) != 6 {
+			t.Errorf("%s: %d keys, want 6", name, len(entries))
+		}
+		for _, tt := range tests {
+			e := entries[tt.key]
+			if e == nil {
+				t.Errorf("%s: %s missing", name, tt.key)
+				continue
+			}
+			if e.Type != tt.typ || e.NumOfElem != tt.elems {
+				t.Errorf("%s: %s is a %s of %d elements, want a %s of %d", name, tt.key, e.Type, e.NumOfElem, tt.typ, tt.elems)
+			}
+			if e.Bytes <= tt.minBytes {
+				t.Errorf("%s: %s is %d bytes, want more than %d", name, tt.key, e.Bytes, tt.minBytes)
+			}
+		}
+	}
+}
+
+func TestModuleTypeName(t *testing.T) {
+	for id, want := range map[string]string{
+		"ReJSON-RL": "json",
+		"TSDB-TYPE": "timeseries",
+		"ft_index0": "search",
+		"xyzmodule": "module:xyzmodule",
+	} {
+		if got := ModuleTypeName(id); got != want {
+			t.Errorf("ModuleTypeName(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package decoder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Allocators a profile can model
+const (
+	AllocatorJemalloc = "jemalloc"
+	AllocatorLibc     = "libc"
+)
+
+// MemoryProfile describes the memory layout of a Redis or Valkey build:
+// the version decides encodings and struct layouts, the allocator and word
+// size decide how every allocation is rounded.
+type MemoryProfile struct {
+	Family    string // "redis" or "valkey"
+	Version   RedisVersion
+	Allocator string
+	WordSize  uint64 // 8 for 64-bit builds, 4 for 32-bit
+
+	// ElementRobj: before 3.2 collection elements were wrapped in robjs
+	ElementRobj bool
+	// SetNoValue: since 7.2 set dict entries have no value pointer
+	SetNoValue bool
+	// EmbeddedKeys: since Valkey 8 the key (and expire) live inside the robj
+	EmbeddedKeys bool
+	// FieldExpiry: since Redis 7.4 and Valkey 9 hash fields can have a TTL
+	FieldExpiry bool
+}
+
+// baseProfiles are the versions where the memory layout changed. A version
+// in between uses the newest profile before it.
+var baseProfiles = []MemoryProfile{
+	{Family: "redis", Version: RedisVersion{3, 0}, ElementRobj: true},
+	{Family: "redis", Version: RedisVersion{3, 2}},
+	{Family: "redis", Version: RedisVersion{5, 0}},
+	{Family: "redis", Version: RedisVersion{6, 0}},
+	{Family: "redis", Version: RedisVersion{6, 2}},
+	{Family: "redis", Version: RedisVersion{7, 0}},
+	{Family: "redis", Version: RedisVersion{7, 2}, SetNoValue: true},
+	{Family: "redis", Version: RedisVersion{7, 4}, SetNoValue: true, FieldExpiry: true},
+	{Family: "valkey", Version: RedisVersion{7, 2}, SetNoValue: true},
+	{Family: "valkey", Version: RedisVersion{8, 0}, SetNoValue: true, EmbeddedKeys: true},
+	{Family: "valkey", Version: RedisVersion{9, 0}, SetNoValue: true, EmbeddedKeys: true, FieldExpiry: true},
+}
+
+// DefaultProfile is used when nothing is known about the server
+var DefaultProfile = LookupProfile("redis", RedisVersion{7, 0})
+
+// Profiles returns the known profiles with the default allocator and word size
+func Profiles() []MemoryProfile {
+	res := make([]MemoryProfile, 0, len(baseProfiles))
+	for _, p := range baseProfiles {
+		res = append(res, p.withDefaults())
+	}
+	return res
+}
+
+func (p MemoryProfile) withDefaults() MemoryProfile {
+	if p.Allocator == "" {
+		p.Allocator = AllocatorJemalloc
+	}
+	if p.WordSize == 0 {
+		p.WordSize = 8
+	}
+	return p
+}
+
+// EncodingRules returns the redis.conf defaults of the profile. Valkey
+// converts a hash to a hashtable when a field gets a TTL.
+func (p MemoryProfile) EncodingRules() EncodingRules {
+	r := DefaultEncodingRules(p.Version)
+	if p.Family == "valkey" {
+		r.FieldTTLEncoding = ""
+		if p.FieldExpiry {
+			r.FieldTTLEncoding = "hashtable"
+		}
+	}
+	return r
+}
+
+// Name returns the profile name in the format accepted by ParseProfile,
+// e.g. "redis-7.2/jemalloc/64"
+func (p MemoryProfile) Name() string {
+	p = p.withDefaults()
+	return fmt.Sprintf("%s-%d.%d/%s/%d", p.Family, p.Version.Major, p.Version.Minor, p.Allocator, p.WordSize*8)
+}
+
+// String implements fmt.Stringer
+func (p MemoryProfile) String() string {
+	return p.Name()
+}
+
+// LookupProfile returns the profile of a server version. Versions before the
+// first Valkey profile fall back to the Redis profile they forked from.
+func LookupProfile(family string, v RedisVersion) MemoryProfile {
+	family = strings.ToLower(family)
+	if family != "valkey" {
+		family = "redis"
+	}
+	var candidates []MemoryProfile
+	for _, p := range baseProfiles {
+		if p.Family == family {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return !candidates[i].Version.AtLeast(candidates[j].Version.Major, candidates[j].Version.Minor)
+	})
+	if !v.AtLeast(candidates[0].Version.Major, candidates[0].Version.Minor) {
+		if family == "valkey" {
+			return LookupProfile("redis", v)
+		}
+		return candidates[0].withDefaults()
+	}
+	best := candidates[0]
+	for _, p := range candidates {
+		if v.AtLeast(p.Version.Major, p.Version.Minor) {
+			best = p
+		}
+	}
+	best = best.withDefaults()
+	// keep the exact version, it drives the encoding rules
+	best.Version = v
+	return best
+}
+
+// ParseProfile parses "<family>-<major.minor>[/<allocator>][/<bits>]",
+// e.g. "redis-6.2", "valkey-8.0/libc" or "redis-7.2/jemalloc/32"
+func ParseProfile(s string) (MemoryProfile, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	dash := strings.LastIndex(parts[0], "-")
+	if dash <= 0 {
+		return MemoryProfile{}, fmt.Errorf("invalid memory profile %q, want e.g. redis-7.2 or valkey-8.0/libc/64", s)
+	}
+	family := strings.ToLower(parts[0][:dash])
+	if family != "redis" && family != "valkey" {
+		return MemoryProfile{}, fmt.Errorf("unknown server family %q in memory profile %q", family, s)
+	}
+	v := ParseRedisVersion(parts[0][dash+1:])
+	if v.Major == 0 {
+		return MemoryProfile{}, fmt.Errorf("invalid version in memory profile %q", s)
+	}
+	p := LookupProfile(family, v)
+	for _, opt := range parts[1:] {
+		switch strings.ToLower(opt) {
+		case AllocatorJemalloc, AllocatorLibc:
+			p.Allocator = strings.ToLower(opt)
+		case "32", "64":
+			bits, _ := strconv.Atoi(opt)
+			p.WordSize = uint64(bits / 8)
+		default:
+			return MemoryProfile{}, fmt.Errorf("unknown option %q in memory profile %q", opt, s)
+		}
+	}
+	return p, nil
+}
+
+// SelectProfile picks the profile matching the aux fields of an RDB:
+// valkey-ver or redis-ver for the version and redis-bits for the word size.
+// RDBs without a version come from Redis before 3.2.
+func SelectProfile(meta *RDBMeta) MemoryProfile {
+	if meta == nil {
+		return DefaultProfile
+	}
+	var p MemoryProfile
+	if ver, ok := meta.Aux["valkey-ver"]; ok {
+		p = LookupProfile("valkey", ParseRedisVersion(ver))
+	} else if meta.RedisVer != "" {
+		p = LookupProfile("redis", ParseRedisVersion(meta.RedisVer))
+	} else {
+		p = LookupProfile("redis", RedisVersion{3, 0})
+	}
+	if meta.RedisBits == 32 {
+		p.WordSize = 4
+	}
+	return p
+}
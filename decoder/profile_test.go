@@ -0,0 +1,223 @@
+package decoder
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hdt3213/rdb/model"
+	"github.com/hdt3213/rdb/parser"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "redis-7.2", want: "redis-7.2/jemalloc/64"},
+		{in: "redis-6.2/libc", want: "redis-6.2/libc/64"},
+		{in: "valkey-8.0/libc/32", want: "valkey-8.0/libc/32"},
+		{in: "Redis-7.0/32/jemalloc", want: "redis-7.0/jemalloc/32"},
+		{in: " redis-7.4.1 ", want: "redis-7.4/jemalloc/64"},
+		{in: "", wantErr: true},
+		{in: "redis", wantErr: true},
+		{in: "keydb-6.2", wantErr: true},
+		{in: "redis-x", wantErr: true},
+		{in: "redis-7.2/tcmalloc", wantErr: true},
+		{in: "redis-7.2/16", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := ParseProfile(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseProfile(%q) = %s, want error", tt.in, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseProfile(%q) error: %v", tt.in, err)
+			continue
+		}
+		if p.Name() != tt.want {
+			t.Errorf("ParseProfile(%q) = %s, want %s", tt.in, p.Name(), tt.want)
+		}
+	}
+}
+
+func TestLookupProfile(t *testing.T) {
+	tests := []struct {
+		family       string
+		version      RedisVersion
+		elementRobj  bool
+		setNoValue   bool
+		embeddedKeys bool
+	}{
+		{family: "redis", version: RedisVersion{2, 8}, elementRobj: true},
+		{family: "redis", version: RedisVersion{3, 0}, elementRobj: true},
+		{family: "redis", version: RedisVersion{4, 0}},
+		{family: "redis", version: RedisVersion{7, 0}},
+		{family: "redis", version: RedisVersion{7, 2}, setNoValue: true},
+		{family: "redis", version: RedisVersion{8, 0}, setNoValue: true},
+		{family: "valkey", version: RedisVersion{7, 2}, setNoValue: true},
+		{family: "valkey", version: RedisVersion{8, 1}, setNoValue: true, embeddedKeys: true},
+		// Valkey before the fork uses the Redis layout
+		{family: "valkey", version: RedisVersion{6, 2}},
+		{family: "unknown", version: RedisVersion{6, 2}},
+	}
+	for _, tt := range tests {
+		p := LookupProfile(tt.family, tt.version)
+		if p.ElementRobj != tt.elementRobj || p.SetNoValue != tt.setNoValue || p.EmbeddedKeys != tt.embeddedKeys {
+			t.Errorf("LookupProfile(%s, %v) = %+v", tt.family, tt.version, p)
+		}
+		if p.Allocator != AllocatorJemalloc || p.WordSize != 8 {
+			t.Errorf("LookupProfile(%s, %v) defaults = %s/%d", tt.family, tt.version, p.Allocator, p.WordSize)
+		}
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	tests := []struct {
+		name string
+		aux  map[string]string
+		want string
+	}{
+		{name: "no aux", aux: nil, want: "redis-3.0/jemalloc/64"},
+		{name: "redis", aux: map[string]string{"redis-ver": "7.2.4", "redis-bits": "64"}, want: "redis-7.2/jemalloc/64"},
+		{name: "redis 32-bit", aux: map[string]string{"redis-ver": "6.2.14", "redis-bits": "32"}, want: "redis-6.2/jemalloc/32"},
+		{name: "valkey", aux: map[string]string{"redis-ver": "7.2.4", "valkey-ver": "8.0.1"}, want: "valkey-8.0/jemalloc/64"},
+	}
+	for _, tt := range tests {
+		meta := &RDBMeta{}
+		for k, v := range tt.aux {
+			meta.setAux(k, v)
+		}
+		if got := SelectProfile(meta).Name(); got != tt.want {
+			t.Errorf("%s: SelectProfile = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if got := SelectProfile(nil).Name(); got != DefaultProfile.Name() {
+		t.Errorf("SelectProfile(nil) = %s, want %s", got, DefaultProfile.Name())
+	}
+}
+
+func TestMallocOverhead(t *testing.T) {
+	tests := []struct {
+		profile string
+		size    uint64
+		want    uint64
+	}{
+		{profile: "redis-7.2/jemalloc/64", size: 1, want: 8},
+		{profile: "redis-7.2/jemalloc/64", size: 24, want: 24},
+		{profile: "redis-7.2/jemalloc/64", size: 25, want: 32},
+		{profile: "redis-7.2/jemalloc/64", size: 4097, want: 5120},
+		{profile: "redis-7.2/libc/64", size: 1, want: 32},
+		{profile: "redis-7.2/libc/64", size: 24, want: 32},
+		{profile: "redis-7.2/libc/64", size: 25, want: 48},
+		{profile: "redis-7.2/libc/32", size: 1, want: 16},
+		{profile: "redis-7.2/libc/32", size: 13, want: 24},
+	}
+	for _, tt := range tests {
+		p, _ := ParseProfile(tt.profile)
+		if got := NewMemProfiler(p).mallocOverhead(tt.size); got != tt.want {
+			t.Errorf("%s: mallocOverhead(%d) = %d, want %d", tt.profile, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestProfileOverheads(t *testing.T) {
+	key := []byte(strings.Repeat("k", 30))
+	tests := []struct {
+		profile   string
+		robj      uint64
+		dictEntry uint64
+		setEntry  uint64
+		topLevel  uint64 // key of 30 bytes with an expiry
+	}{
+		{profile: "redis-3.0", robj: 16, dictEntry: 24, setEntry: 24, topLevel: 104},
+		{profile: "redis-3.2", robj: 16, dictEntry: 24, setEntry: 24, topLevel: 104},
+		{profile: "redis-5.0", robj: 16, dictEntry: 24, setEntry: 24, topLevel: 104},
+		{profile: "redis-6.0", robj: 16, dictEntry: 24, setEntry: 24, topLevel: 104},
+		{profile: "redis-6.2", robj: 16, dictEntry: 24, setEntry: 24, topLevel: 104},
+		{profile: "redis-7.0", robj: 16, dictEntry: 24, setEntry: 24, topLevel: 104},
+		{profile: "redis-7.2", robj: 16, dictEntry: 24, setEntry: 16, topLevel: 104},
+		{profile: "redis-7.4", robj: 16, dictEntry: 24, setEntry: 16, topLevel: 104},
+		{profile: "valkey-7.2", robj: 16, dictEntry: 24, setEntry: 16, topLevel: 104},
+		{profile: "valkey-8.0", robj: 16, dictEntry: 24, setEntry: 16, topLevel: 112},
+		{profile: "redis-7.2/libc/64", robj: 32, dictEntry: 32, setEntry: 32, topLevel: 152},
+		{profile: "redis-7.2/jemalloc/32", robj: 16, dictEntry: 16, setEntry: 8, topLevel: 88},
+		{profile: "redis-7.2/libc/32", robj: 16, dictEntry: 16, setEntry: 16, topLevel: 96},
+	}
+	for _, tt := range tests {
+		p, err := ParseProfile(tt.profile)
+		if err != nil {
+			t.Fatalf("ParseProfile(%q): %v", tt.profile, err)
+		}
+		m := NewMemProfiler(p)
+		if got := m.RobjOverHead(); got != tt.robj {
+			t.Errorf("%s: RobjOverHead = %d, want %d", tt.profile, got, tt.robj)
+		}
+		if got := m.HashTableEntryOverHead(); got != tt.dictEntry {
+			t.Errorf("%s: HashTableEntryOverHead = %d, want %d", tt.profile, got, tt.dictEntry)
+		}
+		if got := m.setEntryOverHead(); got != tt.setEntry {
+			t.Errorf("%s: setEntryOverHead = %d, want %d", tt.profile, got, tt.setEntry)
+		}
+		if got := m.TopLevelObjOverhead(key, 1700000000000); got != tt.topLevel {
+			t.Errorf("%s: TopLevelObjOverhead = %d, want %d", tt.profile, got, tt.topLevel)
+		}
+	}
+}
+
+// every known profile must round-trip through its name
+func TestProfileNames(t *testing.T) {
+	for _, p := range Profiles() {
+		if _, err := ParseProfile(p.Name()); err != nil {
+			t.Errorf("profile %s does not parse back: %v", p.Name(), err)
+		}
+	}
+}
+
+func TestSizeOfValue(t *testing.T) {
+	base := func(typ string) *model.BaseObject {
+		return &model.BaseObject{Key: "k", Type: typ}
+	}
+	members := func(ms ...string) [][]byte {
+		var res [][]byte
+		for _, m := range ms {
+			res = append(res, []byte(m))
+		}
+		return res
+	}
+	hash := &parser.HashObject{BaseObject: base("hash"), Hash: map[string][]byte{"a": []byte("1"), "b": []byte("2")}}
+	tests := []struct {
+		name     string
+		profile  string
+		obj      parser.RedisObject
+		encoding string
+		want     uint64
+	}{
+		{name: "int string", profile: "redis-7.2", obj: &parser.StringObject{BaseObject: base("string"), Value: []byte("12345")}, encoding: "int", want: 0},
+		{name: "embstr", profile: "redis-7.2", obj: &parser.StringObject{BaseObject: base("string"), Value: []byte("hello")}, encoding: "embstr", want: 16},
+		{name: "raw", profile: "redis-7.2", obj: &parser.StringObject{BaseObject: base("string"), Value: []byte(strings.Repeat("x", 100))}, encoding: "raw", want: 112},
+		{name: "hash listpack", profile: "redis-7.2", obj: hash, encoding: "listpack", want: 24},
+		{name: "hash ziplist", profile: "redis-6.2", obj: hash, encoding: "ziplist", want: 24},
+		{name: "intset", profile: "redis-7.2", obj: &parser.SetObject{BaseObject: base("set"), Members: members("1", "2", "70000")}, encoding: "intset", want: 24},
+		{name: "set hashtable 7.2", profile: "redis-7.2", obj: &parser.SetObject{BaseObject: base("set"), Members: members("aa", "bb")}, encoding: "hashtable", want: 188},
+		{name: "set hashtable 7.0", profile: "redis-7.0", obj: &parser.SetObject{BaseObject: base("set"), Members: members("aa", "bb")}, encoding: "hashtable", want: 204},
+		{name: "set hashtable 3.0", profile: "redis-3.0", obj: &parser.SetObject{BaseObject: base("set"), Members: members("aa", "bb")}, encoding: "hashtable", want: 236},
+		{name: "zset listpack", profile: "redis-7.2", obj: &parser.ZSetObject{BaseObject: base("zset"), Entries: []*model.ZSetEntry{{Member: "a", Score: 1.5}}}, encoding: "listpack", want: 16},
+		{name: "list quicklist", profile: "redis-7.0", obj: &parser.ListObject{BaseObject: base("list"), Values: members("a", "b")}, encoding: "quicklist", want: 96},
+		{name: "list listpack", profile: "redis-7.2", obj: &parser.ListObject{BaseObject: base("list"), Values: members("a", "b")}, encoding: "listpack", want: 16},
+	}
+	for _, tt := range tests {
+		p, _ := ParseProfile(tt.profile)
+		got, ok := NewMemProfiler(p).SizeOfValue(tt.obj, tt.encoding, DefaultEncodingRules(p.Version))
+		if !ok {
+			t.Errorf("%s: SizeOfValue not supported", tt.name)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: SizeOfValue = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,571 @@
+package decoder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/hdt3213/rdb/lzf"
+)
+
+// rdbReader reads the encoded values of an RDB (lengths, strings, floats)
+// and counts the bytes read. It reads one value at a time so the caller
+// decides what to keep.
+type rdbReader struct {
+	r       *bufio.Reader
+	pending []byte // bytes given back with unread, read first
+	n       int64  // bytes read
+	buf     [8]byte
+	str     []byte // scratch buffer of readStringBuf
+}
+
+// newRDBReader reads r ahead by less than checksumWindow, so the checksum
+// trailer is still in the window when the reader stops at it
+func newRDBReader(r io.Reader) *rdbReader {
+	return &rdbReader{r: bufio.NewReaderSize(r, checksumWindow/2)}
+}
+
+func (r *rdbReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		r.n += int64(n)
+		return n, nil
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *rdbReader) ReadByte() (byte, error) {
+	if len(r.pending) > 0 {
+		b := r.pending[0]
+		r.pending = r.pending[1:]
+		r.n++
+		return b, nil
+	}
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+// unread gives back the last bytes read, they are read again next
+func (r *rdbReader) unread(b []byte) {
+	r.pending = append(append([]byte{}, b...), r.pending...)
+	r.n -= int64(len(b))
+}
+
+func (r *rdbReader) readFull(p []byte) error {
+	_, err := io.ReadFull(r, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// discard skips n bytes
+func (r *rdbReader) discard(n uint64) error {
+	_, err := io.CopyN(io.Discard, r, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// String encodings of the special lengths
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// readLength reads a length. special is true for the string encodings
+// (integers and LZF), the length is then the encoding.
+func (r *rdbReader) readLength() (length uint64, special bool, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			if err := r.readFull(r.buf[:4]); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(r.buf[:4])), false, nil
+		case 0x81:
+			if err := r.readFull(r.buf[:8]); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(r.buf[:8]), false, nil
+		}
+		return 0, false, fmt.Errorf("%w: length encoding %#x", ErrCorrupt, b)
+	}
+	return uint64(b & 0x3f), true, nil
+}
+
+// readString reads a string into a new slice
+func (r *rdbReader) readString() ([]byte, error) {
+	s, err := r.readStringBuf()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), s...), nil
+}
+
+// readStringBuf reads a string into a scratch buffer, valid until the next
+// read of a string
+func (r *rdbReader) readStringBuf() ([]byte, error) {
+	length, special, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if special {
+		return r.readEncodedString(length)
+	}
+	r.str = grow(r.str, length)
+	return r.str, r.readFull(r.str)
+}
+
+// readEncodedString reads an integer or LZF string of encoding enc
+func (r *rdbReader) readEncodedString(enc uint64) ([]byte, error) {
+	switch enc {
+	case rdbEncInt8, rdbEncInt16, rdbEncInt32:
+		var x int64
+		var err error
+		switch enc {
+		case rdbEncInt8:
+			var b byte
+			b, err = r.ReadByte()
+			x = int64(int8(b))
+		case rdbEncInt16:
+			err = r.readFull(r.buf[:2])
+			x = int64(int16(binary.LittleEndian.Uint16(r.buf[:2])))
+		default:
+			err = r.readFull(r.buf[:4])
+			x = int64(int32(binary.LittleEndian.Uint32(r.buf[:4])))
+		}
+		r.str = strconv.AppendInt(r.str[:0], x, 10)
+		return r.str, err
+	case rdbEncLZF:
+		in, _, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		out, _, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		compressed := make([]byte, in)
+		if err := r.readFull(compressed); err != nil {
+			return nil, err
+		}
+		s, err := lzf.Decompress(compressed, int(in), int(out))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		r.str = s
+		return s, nil
+	}
+	return nil, fmt.Errorf("%w: string encoding %d", ErrCorrupt, enc)
+}
+
+// readHead reads a string of length bytes keeping its first max bytes
+func (r *rdbReader) readHead(length uint64, max int) ([]byte, error) {
+	keep := length
+	if keep > uint64(max) {
+		keep = uint64(max)
+	}
+	r.str = grow(r.str, keep)
+	if err := r.readFull(r.str); err != nil {
+		return nil, err
+	}
+	return r.str, r.discard(length - keep)
+}
+
+// readDouble reads a binary double (ZSET2 scores)
+func (r *rdbReader) readDouble() (float64, error) {
+	if err := r.readFull(r.buf[:8]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.buf[:8])), nil
+}
+
+// readLiteralDouble reads a double saved as a string (ZSET scores)
+func (r *rdbReader) readLiteralDouble() (float64, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	var b [252]byte
+	if err := r.readFull(b[:n]); err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(string(b[:n]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: score %q", ErrCorrupt, b[:n])
+	}
+	return f, nil
+}
+
+// readInt64 reads a little endian 64-bit integer
+func (r *rdbReader) readInt64() (int64, error) {
+	if err := r.readFull(r.buf[:8]); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(r.buf[:8])), nil
+}
+
+// skipModuleValue skips the items of a module value up to its EOF opcode
+func (r *rdbReader) skipModuleValue() error {
+	for {
+		op, _, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case 0: // EOF
+			return nil
+		case 1, 2: // signed, unsigned integer
+			_, _, err = r.readLength()
+		case 3: // float
+			err = r.readFull(r.buf[:4])
+		case 4: // double
+			err = r.readFull(r.buf[:8])
+		case 5: // string
+			_, err = r.readStringBuf()
+		default:
+			return fmt.Errorf("%w: module opcode %d", ErrCorrupt, op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func grow(b []byte, n uint64) []byte {
+	if uint64(cap(b)) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+var errBlob = fmt.Errorf("%w: malformed ziplist, listpack or intset", ErrCorrupt)
+
+// ziplistEach calls fn with every entry of a ziplist. Integer entries are
+// formatted into a scratch buffer, fn must copy what it keeps.
+func ziplistEach(zl []byte, fn func(v []byte) error) error {
+	if len(zl) < 11 {
+		return errBlob
+	}
+	var num [20]byte
+	for i := 10; ; {
+		if i >= len(zl) {
+			return errBlob
+		}
+		if zl[i] == 0xff {
+			return nil
+		}
+		// prevlen
+		if zl[i] == 0xfe {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(zl) {
+			return errBlob
+		}
+		header := zl[i]
+		i++
+		var v []byte
+		switch header >> 6 {
+		case 0:
+			n := int(header & 0x3f)
+			if i+n > len(zl) {
+				return errBlob
+			}
+			v, i = zl[i:i+n], i+n
+		case 1:
+			if i >= len(zl) {
+				return errBlob
+			}
+			n := int(header&0x3f)<<8 | int(zl[i])
+			i++
+			if i+n > len(zl) {
+				return errBlob
+			}
+			v, i = zl[i:i+n], i+n
+		case 2:
+			if i+4 > len(zl) {
+				return errBlob
+			}
+			n := int(binary.BigEndian.Uint32(zl[i:]))
+			i += 4
+			if n < 0 || i+n > len(zl) {
+				return errBlob
+			}
+			v, i = zl[i:i+n], i+n
+		default:
+			var x int64
+			var width int
+			switch header {
+			case 0xc0:
+				width = 2
+			case 0xd0:
+				width = 4
+			case 0xe0:
+				width = 8
+			case 0xf0:
+				width = 3
+			case 0xfe:
+				width = 1
+			default:
+				if header>>4 != 0x0f {
+					return errBlob
+				}
+				x = int64(header&0x0f) - 1
+			}
+			if i+width > len(zl) {
+				return errBlob
+			}
+			switch width {
+			case 1:
+				x = int64(int8(zl[i]))
+			case 2:
+				x = int64(int16(binary.LittleEndian.Uint16(zl[i:])))
+			case 3:
+				x = int64(int32(uint32(zl[i])<<8|uint32(zl[i+1])<<16|uint32(zl[i+2])<<24) >> 8)
+			case 4:
+				x = int64(int32(binary.LittleEndian.Uint32(zl[i:])))
+			case 8:
+				x = int64(binary.LittleEndian.Uint64(zl[i:]))
+			}
+			i += width
+			v = strconv.AppendInt(num[:0], x, 10)
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+}
+
+// listpackEach calls fn with every entry of a listpack. Integer entries are
+// formatted into a scratch buffer, fn must copy what it keeps.
+func listpackEach(lp []byte, fn func(v []byte) error) error {
+	if len(lp) < 7 {
+		return errBlob
+	}
+	var num [20]byte
+	for i := 6; ; {
+		// the HDT3213 encoder writes stream nodes without the end byte, their
+		// header counts the bytes without it
+		if i == len(lp) && binary.LittleEndian.Uint32(lp) == uint32(len(lp)) {
+			return nil
+		}
+		if i >= len(lp) {
+			return errBlob
+		}
+		header := lp[i]
+		if header == 0xff {
+			return nil
+		}
+		i++
+		var v []byte
+		var x int64
+		var str bool
+		var size int // encoding and data, without the backlen
+		switch {
+		case header>>7 == 0: // 0xxxxxxx, 7 bit uint
+			x, size = int64(header), 1
+		case header>>6 == 2: // 10xxxxxx, string up to 63 bytes
+			n := int(header & 0x3f)
+			if i+n > len(lp) {
+				return errBlob
+			}
+			v, i, str, size = lp[i:i+n], i+n, true, 1+n
+		case header>>5 == 6: // 110xxxxx, 13 bit int
+			if i >= len(lp) {
+				return errBlob
+			}
+			u := int64(header&0x1f)<<8 | int64(lp[i])
+			if u >= 1<<12 {
+				u -= 1 << 13
+			}
+			x, i, size = u, i+1, 2
+		case header>>4 == 14: // 1110xxxx, string up to 4095 bytes
+			if i >= len(lp) {
+				return errBlob
+			}
+			n := int(header&0x0f)<<8 | int(lp[i])
+			i++
+			if i+n > len(lp) {
+				return errBlob
+			}
+			v, i, str, size = lp[i:i+n], i+n, true, 2+n
+		case header == 0xf0: // 32 bit string length
+			if i+4 > len(lp) {
+				return errBlob
+			}
+			n := int(binary.LittleEndian.Uint32(lp[i:]))
+			i += 4
+			if n < 0 || i+n > len(lp) {
+				return errBlob
+			}
+			v, i, str, size = lp[i:i+n], i+n, true, 5+n
+		default:
+			var width int
+			switch header {
+			case 0xf1:
+				width = 2
+			case 0xf2:
+				width = 3
+			case 0xf3:
+				width = 4
+			case 0xf4:
+				width = 8
+			}
+			if width == 0 || i+width > len(lp) {
+				return errBlob
+			}
+			switch width {
+			case 2:
+				x = int64(int16(binary.LittleEndian.Uint16(lp[i:])))
+			case 3:
+				x = int64(int32(uint32(lp[i])<<8|uint32(lp[i+1])<<16|uint32(lp[i+2])<<24) >> 8)
+			case 4:
+				x = int64(int32(binary.LittleEndian.Uint32(lp[i:])))
+			case 8:
+				x = int64(binary.LittleEndian.Uint64(lp[i:]))
+			}
+			i, size = i+width, 1+width
+		}
+		i += lpBacklenBytes(size)
+		if !str {
+			v = strconv.AppendInt(num[:0], x, 10)
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+}
+
+// lpBacklenBytes is the size of the backlen of an entry of size bytes
+func lpBacklenBytes(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEach calls fn with every integer of an intset, formatted
+func intsetEach(is []byte, fn func(v []byte) error) error {
+	if len(is) < 8 {
+		return errBlob
+	}
+	width := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if (width != 2 && width != 4 && width != 8) || 8+n*width > len(is) {
+		return errBlob
+	}
+	var num [20]byte
+	for i := 8; i < 8+n*width; i += width {
+		var x int64
+		switch width {
+		case 2:
+			x = int64(int16(binary.LittleEndian.Uint16(is[i:])))
+		case 4:
+			x = int64(int32(binary.LittleEndian.Uint32(is[i:])))
+		case 8:
+			x = int64(binary.LittleEndian.Uint64(is[i:]))
+		}
+		if err := fn(strconv.AppendInt(num[:0], x, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipmapEach calls fn with every field and value of a zipmap (hashes of
+// Redis before 2.6)
+func zipmapEach(zm []byte, fn func(field, value []byte) error) error {
+	// entry length: 1 byte up to 252, 253 then 4 bytes, 255 is the end
+	entry := func(i int, free bool) ([]byte, int, error) {
+		if i >= len(zm) {
+			return nil, 0, errBlob
+		}
+		n := int(zm[i])
+		i++
+		switch {
+		case n == 253:
+			if i+4 > len(zm) {
+				return nil, 0, errBlob
+			}
+			n = int(binary.BigEndian.Uint32(zm[i:]))
+			i += 4
+		case n >= 254:
+			return nil, 0, errBlob
+		}
+		skip := 0
+		if free {
+			if i >= len(zm) {
+				return nil, 0, errBlob
+			}
+			skip = int(zm[i])
+			i++
+		}
+		if n < 0 || i+n+skip > len(zm) {
+			return nil, 0, errBlob
+		}
+		return zm[i : i+n], i + n + skip, nil
+	}
+	for i := 1; ; {
+		if i >= len(zm) {
+			return errBlob
+		}
+		if zm[i] == 0xff {
+			return nil
+		}
+		field, next, err := entry(i, false)
+		if err != nil {
+			return err
+		}
+		value, next, err := entry(next, true)
+		if err != nil {
+			return err
+		}
+		if err := fn(field, value); err != nil {
+			return err
+		}
+		i = next
+	}
+}
@@ -0,0 +1,214 @@
+package decoder
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	day = 24 * 60 * 60
+
+	// scores between 2000-01-01 and a year after the snapshot look like epochs
+	minEpochSec = 946684800
+	futureSlack = 365 * day
+
+	// a zset counts as a timestamp index when this share of members are epochs
+	timestampShare = 0.9
+
+	// UntrimmedMinAgeDays and UntrimmedMaxNewestDays flag time-indexed zsets
+	// whose oldest member is old while new members are still being added
+	UntrimmedMinAgeDays    = 90
+	UntrimmedMaxNewestDays = 7
+)
+
+// ageLimits are the upper bounds, in days, of the age distribution buckets
+var ageLimits = []int64{1, 7, 30, 90, 365}
+
+// AgeBucket counts members up to MaxDays old, MaxDays 0 is the open-ended last bucket
+type AgeBucket struct {
+	MaxDays int64
+	Count   uint64
+}
+
+// Score is a sorted set score. JSON has no infinities, they are written as
+// Redis writes them: "inf" and "-inf".
+type Score float64
+
+func (s Score) MarshalJSON() ([]byte, error) {
+	switch {
+	case math.IsInf(float64(s), 1):
+		return []byte(`"inf"`), nil
+	case math.IsInf(float64(s), -1):
+		return []byte(`"-inf"`), nil
+	}
+	return json.Marshal(float64(s))
+}
+
+func (s *Score) UnmarshalJSON(b []byte) error {
+	var v float64
+	if len(b) > 0 && b[0] == '"' {
+		var str string
+		if err := json.Unmarshal(b, &str); err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return err
+		}
+		v = f
+	} else if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*s = Score(v)
+	return nil
+}
+
+// ScoreBucket counts scores with an absolute value below UpTo (powers of
+// ten), infinite scores in the bucket of UpTo inf
+type ScoreBucket struct {
+	UpTo     Score
+	Negative bool `json:",omitempty"`
+	Count    uint64
+}
+
+// ScoreStats profiles the scores of a big sorted set. When most scores are
+// epochs (TimeUnit "s" or "ms"), the ages are relative to the snapshot time.
+type ScoreStats struct {
+	Min      Score
+	Max      Score
+	Dist     []ScoreBucket
+	TimeUnit string `json:",omitempty"`
+
+	OldestAgeDays float64     `json:",omitempty"`
+	NewestAgeDays float64     `json:",omitempty"`
+	AgeDist       []AgeBucket `json:",omitempty"`
+	OlderThan30d  float64     `json:",omitempty"` // share of members, 0..1
+	Untrimmed     bool        `json:",omitempty"`
+}
+
+// ScoreCollector builds ScoreStats one member at a time
+type ScoreCollector struct {
+	ref  int64 // snapshot time in unix seconds
+	n    uint64
+	min  float64
+	max  float64
+	dist map[ScoreBucket]uint64
+
+	// per unit: members, oldest/newest epoch seconds and age buckets
+	epochs [2]uint64
+	oldest [2]float64
+	newest [2]float64
+	ages   [2][]uint64
+}
+
+// NewScoreCollector returns a collector with ages relative to ref (unix seconds)
+func NewScoreCollector(ref int64) *ScoreCollector {
+	c := &ScoreCollector{ref: ref, dist: map[ScoreBucket]uint64{}}
+	for i := range c.ages {
+		c.ages[i] = make([]uint64, len(ageLimits)+1)
+		c.oldest[i] = math.Inf(1)
+		c.newest[i] = math.Inf(-1)
+	}
+	return c
+}
+
+// Add records a score. Redis refuses NaN scores, one of a corrupt RDB is
+// left out.
+func (c *ScoreCollector) Add(score float64) {
+	if math.IsNaN(score) {
+		return
+	}
+	if c.n == 0 || score < c.min {
+		c.min = score
+	}
+	if c.n == 0 || score > c.max {
+		c.max = score
+	}
+	c.n++
+
+	b := ScoreBucket{UpTo: 1, Negative: score < 0}
+	if abs := math.Abs(score); abs >= 1 && !math.IsInf(abs, 0) {
+		// Log10 of a power of ten may fall just short of it
+		upTo := math.Pow(10, math.Floor(math.Log10(abs))+1)
+		if upTo <= abs {
+			upTo *= 10
+		}
+		b.UpTo = Score(upTo)
+	} else if math.IsInf(abs, 0) {
+		b.UpTo = Score(abs)
+	}
+	c.dist[b]++
+
+	if score != math.Trunc(score) {
+		return
+	}
+	maxSec := float64(c.ref + futureSlack)
+	for unit, scale := range []float64{1, 1000} {
+		sec := score / scale
+		if sec < minEpochSec || sec > maxSec {
+			continue
+		}
+		c.epochs[unit]++
+		if sec < c.oldest[unit] {
+			c.oldest[unit] = sec
+		}
+		if sec > c.newest[unit] {
+			c.newest[unit] = sec
+		}
+		age := (float64(c.ref) - sec) / day
+		i := sort.Search(len(ageLimits), func(i int) bool { return age <= float64(ageLimits[i]) })
+		c.ages[unit][i]++
+	}
+}
+
+// Stats returns the collected stats
+func (c *ScoreCollector) Stats() *ScoreStats {
+	s := &ScoreStats{Min: Score(c.min), Max: Score(c.max)}
+	for b, n := range c.dist {
+		b.Count = n
+		s.Dist = append(s.Dist, b)
+	}
+	sort.Slice(s.Dist, func(i, j int) bool {
+		a, b := s.Dist[i], s.Dist[j]
+		if a.Negative != b.Negative {
+			return a.Negative
+		}
+		if a.Negative {
+			return a.UpTo > b.UpTo
+		}
+		return a.UpTo < b.UpTo
+	})
+	if c.n == 0 {
+		return s
+	}
+
+	unit := -1
+	for u, name := range []string{"s", "ms"} {
+		if float64(c.epochs[u]) >= timestampShare*float64(c.n) {
+			unit = u
+			s.TimeUnit = name
+			break
+		}
+	}
+	if unit < 0 {
+		return s
+	}
+	s.OldestAgeDays = (float64(c.ref) - c.oldest[unit]) / day
+	s.NewestAgeDays = (float64(c.ref) - c.newest[unit]) / day
+	var older uint64
+	for i, n := range c.ages[unit] {
+		b := AgeBucket{Count: n}
+		if i < len(ageLimits) {
+			b.MaxDays = ageLimits[i]
+		}
+		if i > 2 { // buckets past 30 days
+			older += n
+		}
+		s.AgeDist = append(s.AgeDist, b)
+	}
+	s.OlderThan30d = float64(older) / float64(c.epochs[unit])
+	s.Untrimmed = s.OldestAgeDays >= UntrimmedMinAgeDays && s.NewestAgeDays <= UntrimmedMaxNewestDays
+	return s
+}
@@ -0,0 +1,119 @@
+package decoder
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestScoreBuckets(t *testing.T) {
+	inf := Score(math.Inf(1))
+	tests := []struct {
+		name     string
+		scores   []float64
+		min, max Score
+		dist     []ScoreBucket
+	}{
+		{"under one", []float64{0, 0.5, 0.999}, 0, 0.999, []ScoreBucket{{UpTo: 1, Count: 3}}},
+		// a power of ten is the first of its bucket
+		{"powers of ten", []float64{1, 9.99, 10, 99, 100, 1000, 1e15}, 1, 1e15,
+			[]ScoreBucket{{UpTo: 10, Count: 2}, {UpTo: 100, Count: 2}, {UpTo: 1000, Count: 1}, {UpTo: 1e4, Count: 1}, {UpTo: 1e16, Count: 1}}},
+		{"negative", []float64{-0.5, -5, -50, 5}, -50, 5,
+			[]ScoreBucket{{UpTo: 100, Negative: true, Count: 1}, {UpTo: 10, Negative: true, Count: 1}, {UpTo: 1, Negative: true, Count: 1}, {UpTo: 10, Count: 1}}},
+		{"single", []float64{42}, 42, 42, []ScoreBucket{{UpTo: 100, Count: 1}}},
+		{"infinities", []float64{math.Inf(-1), 3, math.Inf(1)}, -inf, inf,
+			[]ScoreBucket{{UpTo: inf, Negative: true, Count: 1}, {UpTo: 10, Count: 1}, {UpTo: inf, Count: 1}}},
+		// Redis refuses NaN, one of a corrupt RDB is left out
+		{"NaN first", []float64{math.NaN(), 2, 7}, 2, 7, []ScoreBucket{{UpTo: 10, Count: 2}}},
+		{"NaN only", []float64{math.NaN()}, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		c := NewScoreCollector(fixtureCtime)
+		for _, s := range tt.scores {
+			c.Add(s)
+		}
+		s := c.Stats()
+		if s.Min != tt.min || s.Max != tt.max {
+			t.Errorf("%s: range %v..%v, want %v..%v", tt.name, s.Min, s.Max, tt.min, tt.max)
+		}
+		if !reflect.DeepEqual(s.Dist, tt.dist) {
+			t.Errorf("%s: distribution %+v, want %+v", tt.name, s.Dist, tt.dist)
+		}
+		if s.TimeUnit != "" {
+			t.Errorf("%s: time unit %q", tt.name, s.TimeUnit)
+		}
+	}
+}
+
+func TestScoreAges(t *testing.T) {
+	const ref = fixtureCtime
+	tests := []struct {
+		name      string
+		ages      []float64 // days before ref
+		ms        bool
+		unit      string
+		untrimmed bool
+		older     float64
+	}{
+		// old members are never trimmed while new ones are added
+		{"seconds", []float64{0, 0.5, 3, 20, 60, 200, 400}, false, "s", true, 3.0 / 7},
+		{"milliseconds", []float64{1, 100, 120}, true, "ms", true, 2.0 / 3},
+		{"trimmed", []float64{1, 2, 60}, false, "s", false, 1.0 / 3},
+		{"exactly the untrimmed limits", []float64{UntrimmedMaxNewestDays, UntrimmedMinAgeDays}, false, "s", true, 0.5},
+		{"newest too old", []float64{UntrimmedMaxNewestDays + 1, 200}, false, "s", false, 0.5},
+	}
+	for _, tt := range tests {
+		c := NewScoreCollector(ref)
+		for _, age := range tt.ages {
+			score := float64(ref) - age*day
+			if tt.ms {
+				score *= 1000
+			}
+			c.Add(score)
+		}
+		s := c.Stats()
+		if s.TimeUnit != tt.unit || s.Untrimmed != tt.untrimmed || math.Abs(s.OlderThan30d-tt.older) > 1e-9 {
+			t.Errorf("%s: unit %q, untrimmed %v, older than 30d %v, want %q, %v, %v", tt.name, s.TimeUnit, s.Untrimmed, s.OlderThan30d, tt.unit, tt.untrimmed, tt.older)
+		}
+		if s.NewestAgeDays != tt.ages[0] || s.OldestAgeDays != tt.ages[len(tt.ages)-1] {
+			t.Errorf("%s: ages %v..%v days", tt.name, s.NewestAgeDays, s.OldestAgeDays)
+		}
+		var n uint64
+		for _, b := range s.AgeDist {
+			n += b.Count
+		}
+		if n != uint64(len(tt.ages)) || len(s.AgeDist) != len(ageLimits)+1 {
+			t.Errorf("%s: age distribution %+v", tt.name, s.AgeDist)
+		}
+	}
+
+	// a few epochs among other scores are not a timestamp index
+	c := NewScoreCollector(ref)
+	for _, score := range []float64{ref, 1, 2, 3} {
+		c.Add(score)
+	}
+	if s := c.Stats(); s.TimeUnit != "" || s.AgeDist != nil {
+		t.Errorf("mixed scores: time unit %q, ages %v", s.TimeUnit, s.AgeDist)
+	}
+}
+
+// TestScoreJSON checks that infinite scores survive JSON, which has none
+func TestScoreJSON(t *testing.T) {
+	c := NewScoreCollector(fixtureCtime)
+	for _, s := range []float64{math.Inf(-1), 0.25, math.Inf(1)} {
+		c.Add(s)
+	}
+	want := c.Stats()
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ScoreStats
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("%s decoded to %+v, want %+v", b, got, want)
+	}
+}
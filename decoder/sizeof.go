@@ -0,0 +1,424 @@
+package decoder
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/hdt3213/rdb/parser"
+)
+
+// SizeOfObject estimates the memory used by a key, including the keyspace
+// overhead, as the server of m's profile would store it in encoding.
+// Types it cannot size (modules) keep the size from the parser.
+func (m *MemProfiler) SizeOfObject(obj parser.RedisObject, encoding string, rules EncodingRules) uint64 {
+	var expiry int64
+	if exp := obj.GetExpiration(); exp != nil {
+		expiry = exp.UnixNano() / int64(1e6)
+	}
+	value, ok := m.SizeOfValue(obj, encoding, rules)
+	if !ok {
+		return uint64(obj.GetSize())
+	}
+	return m.TopLevelObjOverhead([]byte(obj.GetKey()), expiry) + value
+}
+
+// SizeOfValue estimates the memory used by the value of obj alone. The
+// second result is false for types it cannot size.
+func (m *MemProfiler) SizeOfValue(obj parser.RedisObject, encoding string, rules EncodingRules) (uint64, bool) {
+	var s *valueSizer
+	switch o := obj.(type) {
+	case *parser.StringObject:
+		return m.sizeOfString(uint64(len(o.Value)), encoding), true
+
+	case *parser.HashObject:
+		s = m.newValueSizer("hash", rules, encoding)
+		for k, v := range o.Hash {
+			s.addField(k, string(v), o.FieldExpirations[k])
+		}
+		return s.size(encoding, m.profile().FieldExpiry && hasFieldTTL(o.FieldExpirations)), true
+
+	case *parser.SetObject:
+		s = m.newValueSizer("set", rules, encoding)
+		for _, mem := range o.Members {
+			s.add(string(mem))
+		}
+
+	case *parser.ZSetObject:
+		s = m.newValueSizer("zset", rules, encoding)
+		for _, e := range o.Entries {
+			s.addScored(e.Member, e.Score)
+		}
+
+	case *parser.ListObject:
+		s = m.newValueSizer("list", rules, encoding)
+		for _, v := range o.Values {
+			s.add(string(v))
+		}
+
+	default:
+		return 0, false
+	}
+	return s.size(encoding, false), true
+}
+
+// sizeOfString is the value of a string of n bytes in encoding
+func (m *MemProfiler) sizeOfString(n uint64, encoding string) uint64 {
+	switch encoding {
+	case "int":
+		// the integer is stored in the robj pointer
+		return 0
+	case "embstr":
+		// robj and sds share one allocation, the robj is part of the top level overhead
+		return m.mallocOverhead(m.robjSize()+3+n+1) - m.robjSize()
+	}
+	return m.sdsSize(n)
+}
+
+// valueSizer sizes the value of a collection one element at a time, so a
+// key never has to be held in memory to be sized. It only sizes the given
+// encodings, all of them if none is given: the encoding of a streamed key
+// is only known after its last element.
+type valueSizer struct {
+	m        *MemProfiler
+	typ      string
+	elemRobj uint64
+
+	n      uint64
+	lp     *listpackSizer // listpack, and listpackex with lpTTL
+	lpTTL  *listpackSizer // the TTL entry of every field
+	zl     *ziplistSizer
+	ql     *quicklistSizer
+	intset bool
+	width  uint64 // of the intset
+	// table sums the hashtable or skiplist entries, tableTTL the hashtable
+	// entries with the fields that have a TTL stored as hfields
+	tables          bool
+	table, tableTTL uint64
+}
+
+// newValueSizer returns a sizer for a collection of type typ
+func (m *MemProfiler) newValueSizer(typ string, rules EncodingRules, encodings ...string) *valueSizer {
+	s := &valueSizer{m: m, typ: typ, width: 2}
+	if m.profile().ElementRobj {
+		s.elemRobj = m.RobjOverHead()
+	}
+	want := func(encoding string) bool {
+		if len(encodings) == 0 {
+			return true
+		}
+		for _, e := range encodings {
+			if e == encoding {
+				return true
+			}
+		}
+		return false
+	}
+	if want("listpack") || want("listpackex") {
+		s.lp = newListpackSizer()
+	}
+	if want("listpackex") {
+		s.lpTTL = newListpackSizer()
+	}
+	if want("ziplist") {
+		s.zl = newZiplistSizer()
+	}
+	s.intset = want("intset")
+	switch typ {
+	case "list":
+		if want("quicklist") {
+			s.ql = m.newQuicklistSizer(rules)
+		}
+	case "zset", "sortedset":
+		s.tables = want("skiplist")
+	default:
+		s.tables = want("hashtable")
+	}
+	// unknown encodings are sized as the full structure
+	if len(encodings) > 0 && s.lp == nil && s.zl == nil && !s.intset {
+		s.tables = true
+		if typ == "list" && s.ql == nil {
+			s.ql = m.newQuicklistSizer(rules)
+		}
+	}
+	return s
+}
+
+// add adds a list value or a set member
+func (s *valueSizer) add(v string) {
+	s.n++
+	if s.lp != nil {
+		s.lp.add(v)
+	}
+	if s.zl != nil {
+		s.zl.add(v)
+	}
+	if s.ql != nil {
+		s.ql.add(v)
+	}
+	if s.intset {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			s.width = 8
+		} else if (n < math.MinInt16 || n > math.MaxInt16) && s.width < 4 {
+			s.width = 4
+		}
+	}
+	if s.tables {
+		s.table += s.m.setEntryOverHead() + s.m.sdsSize(uint64(len(v))) + s.elemRobj
+	}
+}
+
+// addScored adds a sorted set member
+func (s *valueSizer) addScored(member string, score float64) {
+	s.n++
+	if s.lp != nil || s.zl != nil {
+		f := formatScore(score)
+		if s.lp != nil {
+			s.lp.add(member)
+			s.lp.add(f)
+		}
+		if s.zl != nil {
+			s.zl.add(member)
+			s.zl.add(f)
+		}
+	}
+	if s.tables {
+		s.table += 8 + s.m.sdsSize(uint64(len(member))) + s.m.SkipListEntryOverHead([]byte(member)) + s.elemRobj
+	}
+}
+
+// addField adds a hash field, expireAt is its TTL in unix ms, 0 for none
+func (s *valueSizer) addField(field, value string, expireAt int64) {
+	m := s.m
+	s.n++
+	if s.lp != nil {
+		s.lp.add(field)
+		s.lp.add(value)
+	}
+	if s.lpTTL != nil {
+		s.lpTTL.add(strconv.FormatInt(expireAt, 10))
+	}
+	if s.zl != nil {
+		s.zl.add(field)
+		s.zl.add(value)
+	}
+	if s.tables {
+		entry := m.HashTableEntryOverHead() + m.sdsSize(uint64(len(value))) + 2*s.elemRobj
+		s.table += entry + m.sdsSize(uint64(len(field)))
+		if expireAt > 0 {
+			s.tableTTL += entry + m.hfieldSize(uint64(len(field)))
+		} else {
+			s.tableTTL += entry + m.sdsSize(uint64(len(field)))
+		}
+	}
+}
+
+// size returns the size of the value in encoding. fieldTTLs is whether a
+// hashtable keeps the TTLs of its fields.
+func (s *valueSizer) size(encoding string, fieldTTLs bool) uint64 {
+	m := s.m
+	switch encoding {
+	case "listpack":
+		if s.lp != nil {
+			return m.mallocOverhead(s.lp.bytes())
+		}
+	case "listpackex":
+		if s.lpTTL != nil {
+			// the TTL entries are in the same listpack
+			return m.mallocOverhead(s.lp.bytes()+s.lpTTL.bytes()-newListpackSizer().bytes()) + m.listpackExOverhead()
+		}
+	case "ziplist":
+		if s.zl != nil {
+			return m.mallocOverhead(s.zl.bytes())
+		}
+	case "intset":
+		if s.intset {
+			return m.mallocOverhead(8 + s.n*s.width)
+		}
+	}
+	switch s.typ {
+	case "list":
+		return s.ql.bytes()
+	case "zset", "sortedset":
+		return m.SkipListOverHead(s.n) + s.table
+	}
+	if fieldTTLs {
+		return m.HashTableOverHead(s.n) + m.hashExpireMetaOverhead() + s.tableTTL
+	}
+	return m.HashTableOverHead(s.n) + s.table
+}
+
+// quicklistSizer packs values into quicklist nodes the way Redis fills
+// them: listpacks since 7.0, ziplists before
+type quicklistSizer struct {
+	m                    *MemProfiler
+	maxBytes, maxEntries uint64
+	useListpack          bool
+
+	node  uint64 // a quicklistNode
+	total uint64 // the quicklist and its full nodes
+	lp    *listpackSizer
+	zl    *ziplistSizer
+	count uint64 // values in the current node
+}
+
+func (m *MemProfiler) newQuicklistSizer(rules EncodingRules) *quicklistSizer {
+	q := &quicklistSizer{m: m, useListpack: rules.Version.AtLeast(7, 0)}
+	q.maxBytes, q.maxEntries = rules.listNodeLimit()
+	// quicklistNode: prev, next, entry, sz and a 32-bit field of flags
+	q.node = m.mallocOverhead(3*m.ptr() + m.long() + 4)
+	// quicklist: head, tail, count, len and 32 bits of fill/compress/bookmarks
+	q.total = m.mallocOverhead(2*m.ptr() + 2*m.long() + 4)
+	return q
+}
+
+func (q *quicklistSizer) add(v string) {
+	if q.count == 0 {
+		q.lp, q.zl = newListpackSizer(), newZiplistSizer()
+	}
+	var next uint64
+	if q.useListpack {
+		next = q.lp.bytes() + lpEntryBytes(v)
+	} else {
+		next = q.zl.bytes() + zlEntryBytes(v, q.zl.prev)
+	}
+	if q.count > 0 && (next > q.maxBytes || q.count >= q.maxEntries) {
+		q.total += q.nodeBytes()
+		q.lp, q.zl = newListpackSizer(), newZiplistSizer()
+		q.count = 0
+	}
+	q.lp.add(v)
+	q.zl.add(v)
+	q.count++
+}
+
+// nodeBytes is the size of the current node
+func (q *quicklistSizer) nodeBytes() uint64 {
+	if q.count == 0 {
+		return 0
+	}
+	if q.useListpack {
+		return q.node + q.m.mallocOverhead(q.lp.bytes())
+	}
+	return q.node + q.m.mallocOverhead(q.zl.bytes())
+}
+
+// bytes is the size of the quicklist of the values so far
+func (q *quicklistSizer) bytes() uint64 {
+	return q.total + q.nodeBytes()
+}
+
+// formatScore renders a score the way it is stored in a listpack
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+type listpackSizer struct {
+	total uint64
+}
+
+func newListpackSizer() *listpackSizer {
+	// <total_bytes><num_elements> ... <end>
+	return &listpackSizer{total: 4 + 2 + 1}
+}
+
+func (l *listpackSizer) add(s string) {
+	l.total += lpEntryBytes(s)
+}
+
+func (l *listpackSizer) bytes() uint64 {
+	return l.total
+}
+
+// lpEntryBytes is the size of a listpack entry: encoding, data and backlen
+func lpEntryBytes(s string) uint64 {
+	var size uint64
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil && isInt(s) {
+		switch {
+		case v >= 0 && v <= 127:
+			size = 1
+		case v >= -4096 && v <= 4095:
+			size = 2
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			size = 3
+		case v >= -(1<<23) && v < 1<<23:
+			size = 4
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			size = 5
+		default:
+			size = 9
+		}
+	} else {
+		n := uint64(len(s))
+		switch {
+		case n < 64:
+			size = 1 + n
+		case n < 4096:
+			size = 2 + n
+		default:
+			size = 5 + n
+		}
+	}
+	switch {
+	case size <= 127:
+		return size + 1
+	case size < 16383:
+		return size + 2
+	case size < 2097151:
+		return size + 3
+	case size < 268435455:
+		return size + 4
+	}
+	return size + 5
+}
+
+type ziplistSizer struct {
+	total uint64
+	prev  uint64
+}
+
+func newZiplistSizer() *ziplistSizer {
+	// <zlbytes><zltail><zllen> ... <zlend>
+	return &ziplistSizer{total: 4 + 4 + 2 + 1}
+}
+
+func (z *ziplistSizer) add(s string) {
+	z.prev = zlEntryBytes(s, z.prev)
+	z.total += z.prev
+}
+
+func (z *ziplistSizer) bytes() uint64 {
+	return z.total
+}
+
+// zlEntryBytes is the size of a ziplist entry after an entry of prev bytes:
+// prevlen, encoding and data
+func zlEntryBytes(s string, prev uint64) uint64 {
+	size := uint64(1)
+	if prev >= 254 {
+		size = 5
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil && isInt(s) {
+		switch {
+		case v >= 0 && v <= 12:
+			return size + 1
+		case v >= math.MinInt8 && v <= math.MaxInt8:
+			return size + 2
+		case v >= math.MinInt16 && v <= math.MaxInt16:
+			return size + 3
+		case v >= -(1<<23) && v < 1<<23:
+			return size + 4
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			return size + 5
+		}
+		return size + 9
+	}
+	n := uint64(len(s))
+	switch {
+	case n <= 63:
+		return size + 1 + n
+	case n <= 16383:
+		return size + 2 + n
+	}
+	return size + 5 + n
+}
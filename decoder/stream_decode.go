@@ -0,0 +1,565 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/hdt3213/rdb/memprofiler"
+	"github.com/hdt3213/rdb/model"
+)
+
+// StreamMinElems is the number of elements from which DecodeStream stops
+// keeping the elements of a key and analyses them one at a time
+const StreamMinElems = 1024
+
+// StreamMinStringBytes is the length from which DecodeStream skips over a
+// string value instead of reading it
+const StreamMinStringBytes = 1 << 20
+
+// RDB opcodes
+const (
+	rdbOpSlotImport = 243 // Valkey; Redis 8 reuses it for key metadata
+	rdbOpSlotInfo   = 244 // Valkey
+	rdbOpFunction   = 245
+	rdbOpModuleAux  = 247
+	rdbOpIdle       = 248
+	rdbOpFreq       = 249
+	rdbOpAux        = 250
+	rdbOpResizeDB   = 251
+	rdbOpExpireMs   = 252
+	rdbOpExpireSec  = 253
+	rdbOpSelectDB   = 254
+	rdbOpEOF        = 255
+	rdbMaxVersion   = 12 // Redis 8
+	rdbValkey       = 80 // Valkey 9, behind a VALKEY magic
+	rdbChecksumFrom = 5 // first version with a CRC64 trailer
+)
+
+// RDB object types
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZSet             = 3
+	rdbTypeHash             = 4
+	rdbTypeZSet2            = 5
+	rdbTypeModule           = 6
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZSetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZSetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+	rdbTypeHashFieldTTLRC   = 22 // 7.4 release candidates, absolute TTLs; Valkey hash2
+	rdbTypeHashListpackExRC = 23
+	rdbTypeHashFieldTTL     = 24
+	rdbTypeHashListpackEx   = 25
+	quicklistNodePlain      = 1
+	stringHeadLen           = 32 // kept of skipped strings, enough for isInt
+	hashFieldTTLBase        = 1  // relative field TTLs are stored +1, 0 is no TTL
+)
+
+// DecodeStream decodes an RDB like DecodeWithHDT, but reads the elements
+// of a key one at a time. Keys of StreamMinElems elements or more are
+// analysed as they are read and never held in memory, so the memory used
+// does not depend on the size of the largest key. Smaller keys give the
+// same entries as DecodeWithHDT.
+//
+// Streams and module values are read whole, like by DecodeWithHDT.
+func (d *Decoder) DecodeStream(file io.Reader) (err error) {
+	defer d.closeEntries()
+
+	// start of the record being decoded
+	var offset int64
+	defer func() {
+		if r := recover(); r != nil {
+			d.err = &DecodeError{Offset: offset, Err: ErrPanic, Detail: fmt.Sprint(r)}
+			err = d.err
+		}
+	}()
+
+	cr := newChecksumReader(file)
+	d.meta.Checksum = ChecksumUnverified
+	r := newRDBReader(cr)
+	if err := d.readHeader(r); err != nil {
+		d.err = &DecodeError{Err: streamError(err), Detail: err.Error()}
+		return d.err
+	}
+
+	db := 0
+	var expireMs int64
+	for {
+		op, err := r.ReadByte()
+		if err == nil {
+			switch op {
+			case rdbOpEOF:
+				d.finishStream(r, cr)
+				return nil
+			case rdbOpSelectDB:
+				var n uint64
+				n, _, err = r.readLength()
+				db = int(n)
+			case rdbOpExpireMs:
+				expireMs, err = r.readInt64()
+			case rdbOpExpireSec:
+				err = r.readFull(r.buf[:4])
+				expireMs = int64(binary.LittleEndian.Uint32(r.buf[:4])) * 1000
+			case rdbOpResizeDB:
+				var keys, expires uint64
+				if keys, _, err = r.readLength(); err == nil {
+					expires, _, err = r.readLength()
+					d.meta.DBSizes = append(d.meta.DBSizes, DBSizeHint{DB: db, Keys: keys, Expires: expires})
+				}
+			case rdbOpAux:
+				var key, value []byte
+				if key, err = r.readString(); err == nil {
+					if value, err = r.readStringBuf(); err == nil {
+						d.Aux(key, value)
+					}
+				}
+			case rdbOpModuleAux:
+				if _, _, err = r.readLength(); err == nil {
+					err = r.skipModuleValue()
+				}
+			case rdbOpFunction:
+				_, err = r.readStringBuf()
+			case rdbOpIdle:
+				_, _, err = r.readLength()
+			case rdbOpFreq:
+				_, err = r.ReadByte()
+			case rdbOpSlotInfo, rdbOpSlotImport:
+				if !d.valkey {
+					err = fmt.Errorf("%w: opcode %d", ErrUnknownType, op)
+					break
+				}
+				err = r.skipSlotOp(op)
+			default:
+				err = d.decodeKey(r, op, db, expireMs, offset)
+				expireMs = 0
+			}
+		}
+		if err != nil {
+			d.err = &DecodeError{Offset: offset, Err: streamError(err), Detail: err.Error()}
+			return d.err
+		}
+		if op != rdbOpExpireMs && op != rdbOpExpireSec {
+			offset = r.n
+		}
+	}
+}
+
+// finishStream verifies the checksum trailer after the EOF opcode
+func (d *Decoder) finishStream(r *rdbReader, cr *checksumReader) {
+	if d.meta.Version < rdbChecksumFrom {
+		d.meta.Checksum = ChecksumMissing
+		return
+	}
+	if r.readFull(r.buf[:8]) != nil {
+		return
+	}
+	cr.finish(r.n)
+	d.meta.Checksum = cr.result()
+}
+
+// readHeader reads the REDISxxxx or VALKEYxxx header
+func (d *Decoder) readHeader(r *rdbReader) error {
+	var header [9]byte
+	if err := r.readFull(header[:]); err != nil {
+		return err
+	}
+	version, valkey, ok := parseHeader(header[:])
+	if !ok {
+		return ErrNotRDB
+	}
+	d.meta.Version = version
+	d.rdbVer = version
+	d.valkey = valkey
+	if valkey && version != rdbValkey || !valkey && (version < 1 || version > rdbMaxVersion) {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	return nil
+}
+
+// skipSlotOp skips the cluster slot info or slot import of a Valkey RDB
+func (r *rdbReader) skipSlotOp(op byte) error {
+	if op == rdbOpSlotInfo {
+		// slot, keys and expires
+		for i := 0; i < 3; i++ {
+			if _, _, err := r.readLength(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// the import job and its slot ranges
+	if _, err := r.readStringBuf(); err != nil {
+		return err
+	}
+	n, _, err := r.readLength()
+	for i := uint64(0); err == nil && i < 2*n; i++ {
+		_, _, err = r.readLength()
+	}
+	return err
+}
+
+// streamError maps an error of DecodeStream to one of the reasons
+func streamError(err error) error {
+	for _, reason := range []error{ErrNotRDB, ErrUnsupportedVersion, ErrUnknownType, ErrCorrupt} {
+		if errors.Is(err, reason) {
+			return reason
+		}
+	}
+	return parseError(err)
+}
+
+// decodeKey decodes the key of type typ that starts at offset and sends
+// its entry. A key that cannot be analysed once read is skipped.
+func (d *Decoder) decodeKey(r *rdbReader, typ byte, db int, expireMs int64, offset int64) error {
+	typeName := objectType(typ)
+	if typeName == "" {
+		return fmt.Errorf("%w: %d", ErrUnknownType, typ)
+	}
+	key, err := r.readString()
+	if err != nil {
+		return err
+	}
+	base := &model.BaseObject{DB: db, Key: string(key), Type: typeName}
+	if expireMs > 0 {
+		expiration := time.Unix(0, expireMs*int64(time.Millisecond))
+		base.Expiration = &expiration
+	}
+	switch typ {
+	case rdbTypeString:
+		return d.decodeString(r, base, offset)
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3, rdbTypeModule, rdbTypeModule2:
+		obj, err := d.readObject(r, typ, base)
+		if err != nil {
+			return err
+		}
+		return d.sendKey(obj.GetType(), base.Key, db, offset, r.n, func() *Entry {
+			return d.newEntry(obj, uint64(r.n-offset))
+		})
+	}
+	c, err := d.readCollection(r, typ, base)
+	if err != nil {
+		return err
+	}
+	return d.sendKey(base.Type, base.Key, db, offset, r.n, func() *Entry {
+		return c.entry(uint64(r.n - offset))
+	})
+}
+
+// sendKey sends the entry made by newEntry, or skips the key if it panics
+func (d *Decoder) sendKey(typ, key string, db int, start, end int64, newEntry func() *Entry) error {
+	entry, err := func() (entry *Entry, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%w: %v", ErrPanic, r)
+			}
+		}()
+		return newEntry(), nil
+	}()
+	if err != nil {
+		d.skip(typ, key, db, start, end-start, err)
+		return nil
+	}
+	d.send(entry)
+	return nil
+}
+
+// decodeString decodes a string value, skipping over big ones
+func (d *Decoder) decodeString(r *rdbReader, base *model.BaseObject, offset int64) error {
+	length, special, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	if special || length < StreamMinStringBytes {
+		var value []byte
+		if special {
+			value, err = r.readEncodedString(length)
+			value = append([]byte(nil), value...)
+		} else {
+			value = make([]byte, length)
+			err = r.readFull(value)
+		}
+		if err != nil {
+			return err
+		}
+		obj := &model.StringObject{BaseObject: base, Value: value}
+		base.Encoding = model.StringEncoding
+		base.Size = memprofiler.SizeOfObject(obj)
+		return d.sendKey(base.Type, base.Key, base.DB, offset, r.n, func() *Entry {
+			return d.newEntry(obj, uint64(r.n-offset))
+		})
+	}
+	head, err := r.readHead(length, stringHeadLen)
+	if err != nil {
+		return err
+	}
+	return d.sendKey(base.Type, base.Key, base.DB, offset, r.n, func() *Entry {
+		b := d.newKeyBuilder(base)
+		b.setString(head, length)
+		return b.entry()
+	})
+}
+
+// objectType is the type of the keys of RDB type typ, "" if unknown
+func objectType(typ byte) string {
+	switch typ {
+	case rdbTypeString:
+		return model.StringType
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return model.ListType
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return model.SetType
+	case rdbTypeZSet, rdbTypeZSet2, rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		return model.ZSetType
+	case rdbTypeHash, rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack,
+		rdbTypeHashFieldTTLRC, rdbTypeHashListpackExRC, rdbTypeHashFieldTTL, rdbTypeHashListpackEx:
+		return model.HashType
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return model.StreamType
+	case rdbTypeModule, rdbTypeModule2:
+		return "module" // named after the module once read
+	}
+	return ""
+}
+
+// readCollection reads the elements of a list, set, sorted set or hash
+func (d *Decoder) readCollection(r *rdbReader, typ byte, base *model.BaseObject) (*collection, error) {
+	c := d.newCollection(base)
+
+	switch typ {
+	case rdbTypeList, rdbTypeSet:
+		base.Encoding = model.ListEncoding
+		if typ == rdbTypeSet {
+			base.Encoding = model.SetEncoding
+		}
+		return c, readEach(r, func() error {
+			v, err := r.readStringBuf()
+			if err == nil {
+				c.add(v)
+			}
+			return err
+		})
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		base.Encoding = model.ZSetEncoding
+		return c, readEach(r, func() error {
+			member, err := r.readStringBuf()
+			if err != nil {
+				return err
+			}
+			var score float64
+			if typ == rdbTypeZSet2 {
+				score, err = r.readDouble()
+			} else {
+				score, err = r.readLiteralDouble()
+			}
+			if err == nil {
+				c.addScored(member, score)
+			}
+			return err
+		})
+
+	case rdbTypeHash, rdbTypeHashFieldTTL, rdbTypeHashFieldTTLRC:
+		base.Encoding = model.HashEncoding
+		withTTL := typ != rdbTypeHash
+		var minExpire int64
+		if withTTL {
+			base.Encoding = model.HashExEncoding
+			c.withFieldTTLs()
+		}
+		if typ == rdbTypeHashFieldTTL {
+			var err error
+			if minExpire, err = r.readInt64(); err != nil {
+				return nil, err
+			}
+		}
+		var field []byte
+		if d.valkey && typ == rdbTypeHashFieldTTLRC {
+			// the absolute TTL follows each field and value, -1 is none
+			return c, readEach(r, func() error {
+				f, err := r.readStringBuf()
+				if err != nil {
+					return err
+				}
+				field = append(field[:0], f...)
+				value, err := r.readStringBuf()
+				if err != nil {
+					return err
+				}
+				expireAt, err := r.readInt64()
+				if err == nil {
+					c.addField(field, value, max(expireAt, 0))
+				}
+				return err
+			})
+		}
+		return c, readEach(r, func() error {
+			var expireAt int64
+			if withTTL {
+				ttl, _, err := r.readLength()
+				if err != nil {
+					return err
+				}
+				expireAt = int64(ttl)
+				if typ == rdbTypeHashFieldTTL && ttl != 0 {
+					expireAt = int64(ttl) + minExpire - hashFieldTTLBase
+				}
+			}
+			f, err := r.readStringBuf()
+			if err != nil {
+				return err
+			}
+			field = append(field[:0], f...)
+			value, err := r.readStringBuf()
+			if err == nil {
+				c.addField(field, value, expireAt)
+			}
+			return err
+		})
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		// sized by hdt as a linked list, the nodes are not kept
+		base.Encoding = model.ListEncoding
+		return c, readEach(r, func() error {
+			container := uint64(0)
+			if typ == rdbTypeListQuicklist2 {
+				var err error
+				if container, _, err = r.readLength(); err != nil {
+					return err
+				}
+			}
+			node, err := r.readStringBuf()
+			switch {
+			case err != nil:
+				return err
+			case typ == rdbTypeListQuicklist:
+				return ziplistEach(node, addTo(c))
+			case container == quicklistNodePlain:
+				c.add(node)
+				return nil
+			}
+			return listpackEach(node, addTo(c))
+		})
+	}
+
+	// the other encodings are a single blob
+	if typ == rdbTypeHashListpackEx {
+		if _, err := r.readInt64(); err != nil { // next field expiry
+			return nil, err
+		}
+	}
+	blob, err := r.readStringBuf()
+	if err != nil {
+		return nil, err
+	}
+	size := len(blob)
+	switch typ {
+	case rdbTypeHashZipmap:
+		base.Encoding = model.ZipMapEncoding
+		err = zipmapEach(blob, func(field, value []byte) error {
+			c.addField(field, value, 0)
+			return nil
+		})
+	case rdbTypeListZiplist:
+		base.Encoding, base.Extra = model.ZipListEncoding, &model.ZiplistDetail{RawStringSize: size}
+		err = ziplistEach(blob, addTo(c))
+	case rdbTypeSetIntset:
+		base.Encoding, base.Extra = model.IntSetEncoding, &model.IntsetDetail{RawStringSize: size}
+		err = intsetEach(blob, addTo(c))
+	case rdbTypeSetListpack:
+		base.Encoding, base.Extra = model.ListPackEncoding, &model.ListpackDetail{RawStringSize: size}
+		err = listpackEach(blob, addTo(c))
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		base.Encoding, base.Extra = model.ListPackEncoding, &model.ListpackDetail{RawStringSize: size}
+		each := listpackEach
+		if typ == rdbTypeZSetZiplist {
+			base.Encoding, base.Extra = model.ZipListEncoding, &model.ZiplistDetail{RawStringSize: size}
+			each = ziplistEach
+		}
+		var member []byte
+		pos := 0
+		err = each(blob, func(v []byte) error {
+			pos++
+			if pos%2 == 1 {
+				member = append(member[:0], v...)
+				return nil
+			}
+			score, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				return fmt.Errorf("%w: score %q", ErrCorrupt, v)
+			}
+			c.addScored(member, score)
+			return nil
+		})
+	case rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeHashListpackExRC, rdbTypeHashListpackEx:
+		base.Encoding, base.Extra = model.ListPackEncoding, &model.ListpackDetail{RawStringSize: size}
+		each, width := listpackEach, 2
+		switch typ {
+		case rdbTypeHashZiplist:
+			base.Encoding, base.Extra = model.ZipListEncoding, &model.ZiplistDetail{RawStringSize: size}
+			each = ziplistEach
+		case rdbTypeHashListpackExRC, rdbTypeHashListpackEx:
+			base.Encoding = model.ListPackExEncoding
+			c.withFieldTTLs()
+			width = 3
+		}
+		var field, value []byte
+		pos := 0
+		err = each(blob, func(v []byte) error {
+			pos++
+			switch {
+			case pos%width == 1:
+				field = append(field[:0], v...)
+			case width == 2:
+				c.addField(field, v, 0)
+			case pos%width == 2:
+				value = append(value[:0], v...)
+			default:
+				expireAt, err := strconv.ParseInt(string(v), 10, 64)
+				if err != nil {
+					return fmt.Errorf("%w: field TTL %q", ErrCorrupt, v)
+				}
+				c.addField(field, value, expireAt)
+			}
+			return nil
+		})
+	}
+	return c, err
+}
+
+// readEach reads a length, then calls read as many times
+func readEach(r *rdbReader, read func() error) error {
+	n, _, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		if err := read(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTo adds the entries of a ziplist or listpack to c
+func addTo(c *collection) func(v []byte) error {
+	return func(v []byte) error {
+		c.add(v)
+		return nil
+	}
+}
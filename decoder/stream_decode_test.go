@@ -0,0 +1,204 @@
+package decoder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+)
+
+// streamRDB writes an RDB with small and big keys of every type
+func streamRDB(t *testing.T, redisVer string) []byte {
+	values := func(n int, format string) [][]byte {
+		v := make([][]byte, n)
+		for i := range v {
+			v[i] = []byte(fmt.Sprintf(format, i))
+		}
+		return v
+	}
+	zset := func(n int) []*model.ZSetEntry {
+		entries := make([]*model.ZSetEntry, n)
+		for i := range entries {
+			entries[i] = &model.ZSetEntry{Member: fmt.Sprintf("member:%d", i), Score: float64(i) / 2}
+		}
+		return entries
+	}
+	hash := func(n int) map[string][]byte {
+		h := map[string][]byte{}
+		for i := 0; i < n; i++ {
+			h[fmt.Sprintf("field:%d", i)] = []byte(strings.Repeat("v", i%50))
+		}
+		return h
+	}
+	fields := make([]string, 3000)
+	expire := map[string]int64{}
+	for i := range fields {
+		fields[i] = fmt.Sprintf("field:%d", i)
+		if i%3 == 0 {
+			expire[fields[i]] = (fixtureCtime+3600)*1000 + int64(i)
+		}
+	}
+	stream := &model.StreamObject{
+		Version: 1,
+		Length:  1,
+		LastId:  &model.StreamId{Ms: 1640995200000},
+		Entries: []*model.StreamEntry{{
+			FirstMsgId: &model.StreamId{Ms: 1640995200000},
+			Fields:     []string{"field1"},
+			Msgs: []*model.StreamMessage{{
+				Id:     &model.StreamId{Ms: 1640995200000},
+				Fields: map[string]string{"field1": "value1"},
+			}},
+		}},
+		Groups: []*model.StreamGroup{},
+	}
+	// nodes of messages with the master fields or their own, some pending
+	// in a consumer group. A node holds 4 messages a second apart, as the
+	// encoder writes deltas of 4096 to 8191 as negative 13 bit integers.
+	groups := testStream{version: 3, n: 300, deleted: true, groups: []testGroup{{delivered: 200, consumers: []testConsumer{
+		{pending: 20, seenAgeMs: 1000, activeAgeMs: 500}, {pending: 5, seenAgeMs: 9000},
+	}}}}.object()
+	msgs := groups.Entries[0].Msgs
+	for i, m := range msgs {
+		m.Fields = map[string]string{"a": "1"}
+		if i%2 == 1 {
+			m.Fields = map[string]string{"b": "2", "c": "3"}
+		}
+	}
+	groups.Entries = nil
+	for i := 0; i < len(msgs); i += 4 {
+		groups.Entries = append(groups.Entries, &model.StreamEntry{FirstMsgId: msgs[i].Id, Fields: []string{"a"}, Msgs: msgs[i : i+4]})
+	}
+
+	aux := [][2]string{{"redis-ver", redisVer}, {"redis-bits", "64"}, {"ctime", fmt.Sprint(fixtureCtime)}}
+	return fixture(t, "0011", aux, 17, func(enc *encoder.Encoder, w rdbWriter) {
+		for _, err := range []error{
+			enc.WriteStringObject("small", []byte("hello")),
+			enc.WriteStringObject("int", []byte("12345"), encoder.WithTTL((fixtureCtime+60)*1000)),
+			enc.WriteStringObject("big", bytes.Repeat([]byte("x"), StreamMinStringBytes+10)),
+			enc.WriteListObject("list:small", values(10, "value:%d")),
+			enc.WriteListObject("list:big", values(5000, "value:%d")),
+			enc.WriteSetObject("set:ints", values(100, "%d")),
+			enc.WriteSetObject("set:big", values(3000, "member:%d")),
+			enc.WriteZSetObject("zset:small", zset(10)),
+			enc.WriteZSetObject("zset:big", zset(StreamMinElems)),
+			enc.WriteHashMapObject("hash:small", hash(10)),
+			enc.WriteHashMapObject("hash:big", hash(4000), encoder.WithTTL((fixtureCtime+60)*1000)),
+			enc.WriteStreamObject("stream", stream),
+			enc.WriteStreamObject("stream:groups", groups),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.hashWithFieldTTLs("hash:ttl:small", fields[:30], expire)
+		w.hashWithFieldTTLs("hash:ttl:big", fields, expire)
+	})
+}
+
+func decodeEntries(t *testing.T, rdb []byte, decode func(*Decoder) func(io.Reader) error) (map[string]*Entry, *Decoder, error) {
+	t.Helper()
+	d := NewDecoder()
+	d.SetProjection(LookupProfile("valkey", ParseRedisVersion("8.1")))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- decode(d)(bytes.NewReader(rdb))
+	}()
+	entries := map[string]*Entry{}
+	for batch := range d.Entries {
+		for _, e := range batch {
+			entries[e.Key] = e
+		}
+	}
+	return entries, d, <-errc
+}
+
+// unorder clears the element names of a hash entry
+func unorder(e *Entry) {
+	e.FieldOfLargestElem = ""
+	if e.Elements != nil {
+		for i := range e.Elements.TopElements {
+			e.Elements.TopElements[i].Name = ""
+		}
+	}
+}
+
+// compareDecoders checks that DecodeStream gives the entries and metadata
+// of DecodeWithHDT
+func compareDecoders(t *testing.T, name string, rdb []byte) {
+	want, wantD, wantErr := decodeEntries(t, rdb, func(d *Decoder) func(io.Reader) error { return d.DecodeWithHDT })
+	got, gotD, err := decodeEntries(t, rdb, func(d *Decoder) func(io.Reader) error { return d.DecodeStream })
+	if (err == nil) != (wantErr == nil) || (err != nil && !errors.Is(err, errors.Unwrap(wantErr))) {
+		t.Errorf("%s: err = %v, DecodeWithHDT %v", name, err, wantErr)
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s: %d keys, DecodeWithHDT %d", name, len(got), len(want))
+	}
+	for key, w := range want {
+		g := got[key]
+		if g == nil {
+			t.Errorf("%s: %s missing", name, key)
+			continue
+		}
+		if w.Type == "hash" {
+			// which of equal values are kept depends on the map order
+			unorder(g)
+			unorder(w)
+		}
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("%s: %s =\n%+v\nDecodeWithHDT\n%+v", name, key, g, w)
+		}
+	}
+	if !reflect.DeepEqual(gotD.GetMeta(), wantD.GetMeta()) {
+		t.Errorf("%s: meta = %+v, DecodeWithHDT %+v", name, gotD.GetMeta(), wantD.GetMeta())
+	}
+}
+
+func TestDecodeStreamMatchesHDT(t *testing.T) {
+	for _, redisVer := range []string{"6.2.14", "7.4.0"} {
+		compareDecoders(t, "generated "+redisVer, streamRDB(t, redisVer))
+	}
+	compareDecoders(t, "modules", moduleRDB(t))
+	files, err := filepath.Glob("testdata/*.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		rdb, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareDecoders(t, file, rdb)
+	}
+}
+
+func TestDecodeStreamErrors(t *testing.T) {
+	rdb := streamRDB(t, "7.4.0")
+	tests := []struct {
+		name string
+		rdb  []byte
+		want error
+	}{
+		{"not an RDB", []byte("*1\r\n$4\r\nPING\r\n"), ErrNotRDB},
+		{"version", append([]byte("REDIS0080"), rdb[9:]...), ErrUnsupportedVersion},
+		{"truncated", rdb[:len(rdb)/2], ErrTruncated},
+		{"unknown type", append(append([]byte{}, rdb[:len(rdb)-9]...), 30), ErrUnknownType},
+	}
+	for _, tt := range tests {
+		_, d, err := decodeEntries(t, tt.rdb, func(d *Decoder) func(io.Reader) error { return d.DecodeStream })
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+		if d.GetError() == nil {
+			t.Errorf("%s: GetError() = nil", tt.name)
+		}
+	}
+}
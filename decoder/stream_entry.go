@@ -0,0 +1,258 @@
+package decoder
+
+import (
+	"github.com/hdt3213/rdb/memprofiler"
+	"github.com/hdt3213/rdb/model"
+)
+
+// collection gathers the elements of a key as they are decoded. The first
+// StreamMinElems are kept, so small keys are analysed whole like
+// DecodeWithHDT does. Past that they go to a keyBuilder one at a time and
+// the key is never held in memory.
+type collection struct {
+	d    *Decoder
+	base *model.BaseObject
+
+	values [][]byte // list values, set members
+	zset   []*model.ZSetEntry
+	hash   map[string][]byte
+	expire map[string]int64 // field TTLs, nil for hashes without
+	n      int
+
+	b *keyBuilder // once the key is streamed
+}
+
+func (d *Decoder) newCollection(base *model.BaseObject) *collection {
+	c := &collection{d: d, base: base}
+	if base.Type == model.HashType {
+		c.hash = map[string][]byte{}
+	}
+	return c
+}
+
+// withFieldTTLs makes the hash keep the TTL of its fields
+func (c *collection) withFieldTTLs() {
+	c.expire = map[string]int64{}
+}
+
+// spill hands the kept elements to a keyBuilder once the key is too big
+func (c *collection) spill() {
+	c.n++
+	if c.b != nil || c.n < StreamMinElems {
+		return
+	}
+	c.b = c.d.newKeyBuilder(c.base)
+	for _, v := range c.values {
+		c.b.add(v)
+	}
+	for _, e := range c.zset {
+		c.b.addScored([]byte(e.Member), e.Score)
+	}
+	for k, v := range c.hash {
+		c.b.addField([]byte(k), v, c.expire[k])
+	}
+	c.values, c.zset, c.hash, c.expire = nil, nil, nil, nil
+}
+
+// add adds a list value or set member. v may be reused by the caller.
+func (c *collection) add(v []byte) {
+	if c.b != nil {
+		c.b.add(v)
+		return
+	}
+	c.values = append(c.values, append([]byte(nil), v...))
+	c.spill()
+}
+
+// addScored adds a sorted set member
+func (c *collection) addScored(member []byte, score float64) {
+	if c.b != nil {
+		c.b.addScored(member, score)
+		return
+	}
+	c.zset = append(c.zset, &model.ZSetEntry{Member: string(member), Score: score})
+	c.spill()
+}
+
+// addField adds a hash field, expireAt is its TTL in unix ms, 0 for none
+func (c *collection) addField(field, value []byte, expireAt int64) {
+	if c.b != nil {
+		c.b.addField(field, value, expireAt)
+		return
+	}
+	k := string(field)
+	c.hash[k] = append([]byte(nil), value...)
+	if c.expire != nil {
+		c.expire[k] = expireAt
+	}
+	c.spill()
+}
+
+// entry returns the Entry of the key. serialized is its size in the RDB.
+func (c *collection) entry(serialized uint64) *Entry {
+	if c.b != nil {
+		return c.b.entry()
+	}
+	var obj model.RedisObject
+	switch c.base.Type {
+	case model.ListType:
+		obj = &model.ListObject{BaseObject: c.base, Values: c.values}
+	case model.SetType:
+		obj = &model.SetObject{BaseObject: c.base, Members: c.values}
+	case model.ZSetType:
+		obj = &model.ZSetObject{BaseObject: c.base, Entries: c.zset}
+	default:
+		obj = &model.HashObject{BaseObject: c.base, Hash: c.hash, FieldExpirations: c.expire}
+	}
+	c.base.Size = memprofiler.SizeOfObject(obj)
+	return c.d.newEntry(obj, serialized)
+}
+
+// keyBuilder builds the Entry of a key one element at a time, like the
+// callbacks of the legacy decoder (Hset, Sadd, Zadd, Rpush). It keeps the
+// shape of the key, its top elements and its size in every encoding, not
+// the elements.
+type keyBuilder struct {
+	d      *Decoder
+	e      *Entry
+	expiry int64 // unix ms, 0 for none
+	refMs  int64
+
+	elems  *ElementCollector
+	scores *ScoreCollector
+	size   *valueSizer
+	target *valueSizer // under the projection target
+}
+
+func (d *Decoder) newKeyBuilder(base *model.BaseObject) *keyBuilder {
+	d.startSizing()
+	b := &keyBuilder{
+		d:     d,
+		e:     &Entry{Key: base.Key, Type: base.Type, Db: base.DB, AllInts: true},
+		refMs: d.snapshotTime() * 1000,
+	}
+	if base.Expiration != nil {
+		b.expiry = base.Expiration.UnixNano() / int64(1e6)
+		b.e.Expiration = base.Expiration.Unix() * 1000
+	}
+	if base.Type != model.StringType {
+		// a single key is streamed at a time, its drill-down is kept if it
+		// is one of the largest keys once sized
+		b.elems = NewElementCollector()
+		b.size = d.m.newValueSizer(base.Type, d.rules)
+		if d.targetM != nil {
+			b.target = d.targetM.newValueSizer(base.Type, d.targetRules)
+		}
+	}
+	if base.Type == model.ZSetType {
+		b.scores = NewScoreCollector(d.snapshotTime())
+	}
+	return b
+}
+
+// largest keeps the name of the longest element
+func (b *keyBuilder) largest(name []byte) {
+	if uint64(len(name)) > b.e.LenOfLargestElem {
+		b.e.LenOfLargestElem = uint64(len(name))
+		b.e.FieldOfLargestElem = truncateElem(name)
+	}
+}
+
+// add adds a list value or set member
+func (b *keyBuilder) add(v []byte) {
+	s := string(v)
+	b.e.NumOfElem++
+	b.e.addElem(s)
+	b.largest(v)
+	b.elems.Add(s, uint64(len(v)))
+	b.size.add(s)
+	if b.target != nil {
+		b.target.add(s)
+	}
+}
+
+// addScored adds a sorted set member
+func (b *keyBuilder) addScored(member []byte, score float64) {
+	s := string(member)
+	b.e.NumOfElem++
+	b.e.addElem(s)
+	b.largest(member)
+	b.elems.AddScored(s, uint64(len(member)), score)
+	b.scores.Add(score)
+	b.size.addScored(s, score)
+	if b.target != nil {
+		b.target.addScored(s, score)
+	}
+}
+
+// addField adds a hash field, expireAt is its TTL in unix ms, 0 for none
+func (b *keyBuilder) addField(field, value []byte, expireAt int64) {
+	k, v := string(field), string(value)
+	b.e.NumOfElem++
+	b.e.addElem(k)
+	b.e.addElem(v)
+	if uint64(len(value)) > b.e.LenOfLargestElem {
+		b.e.LenOfLargestElem = uint64(len(value))
+		b.e.FieldOfLargestElem = k
+	}
+	b.elems.Add(k, uint64(len(value)))
+	b.elems.AddField(k)
+	b.e.FieldTTL = b.e.FieldTTL.add(expireAt, b.refMs)
+	b.size.addField(k, v, expireAt)
+	if b.target != nil {
+		b.target.addField(k, v, expireAt)
+	}
+}
+
+// setString sets the value of a string of n bytes that starts with head
+func (b *keyBuilder) setString(head []byte, n uint64) {
+	b.e.NumOfElem = n
+	b.e.ElemBytes = n
+	b.e.MaxElemLen = n
+	b.e.AllInts = n <= 20 && isInt(string(head))
+}
+
+// entry sizes the key and returns its Entry
+func (b *keyBuilder) entry() *Entry {
+	d, e := b.d, b.e
+	if e.ElemBytes == 0 {
+		e.AllInts = false
+	}
+	e.Encoding = d.rules.Infer(e.Shape())
+	e.Bytes = d.m.TopLevelObjOverhead([]byte(e.Key), b.expiry) + b.valueSize(&d.m, b.size, e.Encoding)
+	if b.elems != nil && d.elementKeys.keep(e.NumOfElem, e.Bytes) {
+		e.Elements = b.elems.Stats()
+		if b.scores != nil {
+			e.Scores = b.scores.Stats()
+		}
+	}
+	if e.FieldTTL != nil {
+		e.FieldTTL.MetaBytes = b.fieldTTLBytes(&d.m, b.size, e.Encoding)
+	}
+	if d.targetM != nil {
+		e.ProjectedEncoding = d.targetRules.Infer(e.Shape())
+		e.ProjectedBytes = d.targetM.TopLevelObjOverhead([]byte(e.Key), b.expiry) + b.valueSize(d.targetM, b.target, e.ProjectedEncoding)
+	}
+	return e
+}
+
+// valueSize is the size of the value in encoding as m sizes it
+func (b *keyBuilder) valueSize(m *MemProfiler, s *valueSizer, encoding string) uint64 {
+	if s == nil {
+		return m.sizeOfString(b.e.ElemBytes, encoding)
+	}
+	return s.size(encoding, m.profile().FieldExpiry && b.e.FieldTTL != nil)
+}
+
+// fieldTTLBytes is what the field TTLs add to the hash, see FieldTTLBytes
+func (b *keyBuilder) fieldTTLBytes(m *MemProfiler, s *valueSizer, encoding string) uint64 {
+	plain := encoding
+	if plain == "listpackex" {
+		plain = "listpack"
+	}
+	with, without := b.valueSize(m, s, encoding), s.size(plain, false)
+	if with < without {
+		return 0
+	}
+	return with - without
+}
@@ -0,0 +1,335 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hdt3213/rdb/core"
+	"github.com/hdt3213/rdb/memprofiler"
+	"github.com/hdt3213/rdb/model"
+)
+
+// Streams and module values are read whole by DecodeStream, into the model
+// types of the HDT3213 parser so DecodeWithHDT and DecodeStream size them
+// alike.
+
+const (
+	streamItemDeleted    = 1 << 0
+	streamItemSameFields = 1 << 1
+	moduleIDCharset      = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+// readObject reads a stream or a module value of RDB type typ
+func (d *Decoder) readObject(r *rdbReader, typ byte, base *model.BaseObject) (model.RedisObject, error) {
+	var obj model.RedisObject
+	var err error
+	switch typ {
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		base.Type = model.StreamType
+		obj, err = readStream(r, typ, base)
+	case rdbTypeModule2:
+		obj, err = readModule(r, base)
+	default:
+		// module values of RDB type 6 cannot be read without the module
+		return nil, fmt.Errorf("%w: %d", ErrUnknownType, typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	base.Size = memprofiler.SizeOfObject(obj)
+	return obj, nil
+}
+
+// readStream reads a stream. Its messages keep their ID and whether they
+// are deleted, the analysis does not look at their fields.
+func readStream(r *rdbReader, typ byte, base *model.BaseObject) (*model.StreamObject, error) {
+	s := &model.StreamObject{BaseObject: base, Version: 1}
+	switch typ {
+	case rdbTypeStreamListpacks2:
+		s.Version = 2
+	case rdbTypeStreamListpacks3:
+		s.Version = 3
+	}
+	nodes, _, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		header, err := r.readStringBuf()
+		if err != nil {
+			return nil, err
+		}
+		if len(header) != 16 {
+			return nil, fmt.Errorf("%w: stream node ID of %d bytes", ErrCorrupt, len(header))
+		}
+		first := &model.StreamId{Ms: binary.BigEndian.Uint64(header), Sequence: binary.BigEndian.Uint64(header[8:])}
+		lp, err := r.readStringBuf()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := streamNodeEach(lp, first)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = append(s.Entries, entry)
+	}
+
+	if s.Length, _, err = r.readLength(); err != nil {
+		return nil, err
+	}
+	if s.LastId, err = readStreamID(r); err != nil {
+		return nil, err
+	}
+	if s.Version >= 2 {
+		if s.FirstId, err = readStreamID(r); err != nil {
+			return nil, err
+		}
+		if s.MaxDeletedId, err = readStreamID(r); err != nil {
+			return nil, err
+		}
+		if s.AddedEntriesCount, _, err = r.readLength(); err != nil {
+			return nil, err
+		}
+	}
+	s.Groups, err = readStreamGroups(r, s.Version)
+	return s, err
+}
+
+// streamNodeEach reads the messages of a stream node, a listpack of
+// deltas to first: the live and deleted counts and the master fields, then
+// per message its flags, ID, fields and values, and its number of items.
+func streamNodeEach(lp []byte, first *model.StreamId) (*model.StreamEntry, error) {
+	const (
+		count = iota
+		deleted
+		masterFields
+		masterField
+		masterEnd
+		flags
+		idMs
+		idSeq
+		fields
+		values
+		end
+	)
+	entry := &model.StreamEntry{FirstMsgId: first}
+	state := count
+	var masterN, left, flag, ms int64
+	var msg *model.StreamMessage
+	toValues := func(n int64) {
+		left, state = n, values
+		if n == 0 {
+			state = end
+		}
+	}
+	err := listpackEach(lp, func(v []byte) error {
+		if state == masterField || state == values {
+			if left--; left == 0 {
+				state++
+			}
+			return nil
+		}
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: stream node item %q", ErrCorrupt, v)
+		}
+		switch state {
+		case count, deleted:
+			state++
+		case masterFields:
+			masterN, left, state = n, n, masterField
+			if n == 0 {
+				state = masterEnd
+			}
+		case masterEnd, end:
+			if msg != nil {
+				entry.Msgs = append(entry.Msgs, msg)
+			}
+			state = flags
+		case flags:
+			flag, state = n, idMs
+		case idMs:
+			ms, state = n, idSeq
+		case idSeq:
+			msg = &model.StreamMessage{
+				Id:      &model.StreamId{Ms: uint64(ms + int64(first.Ms)), Sequence: uint64(n + int64(first.Sequence))},
+				Deleted: flag&streamItemDeleted != 0,
+			}
+			state = fields
+			if flag&streamItemSameFields != 0 {
+				toValues(masterN)
+			}
+		case fields:
+			toValues(2 * n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if state != flags {
+		return nil, fmt.Errorf("%w: stream node ends in a message", ErrCorrupt)
+	}
+	return entry, nil
+}
+
+func readStreamID(r *rdbReader) (*model.StreamId, error) {
+	ms, _, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	seq, _, err := r.readLength()
+	return &model.StreamId{Ms: ms, Sequence: seq}, err
+}
+
+// readRawStreamID reads an ID of a PEL, two big endian integers
+func readRawStreamID(r *rdbReader) (*model.StreamId, error) {
+	var b [16]byte
+	if err := r.readFull(b[:]); err != nil {
+		return nil, err
+	}
+	return &model.StreamId{Ms: binary.BigEndian.Uint64(b[:]), Sequence: binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+func readStreamGroups(r *rdbReader, version uint) ([]*model.StreamGroup, error) {
+	n, _, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var groups []*model.StreamGroup
+	for i := uint64(0); i < n; i++ {
+		g := &model.StreamGroup{}
+		name, err := r.readStringBuf()
+		if err != nil {
+			return nil, err
+		}
+		g.Name = string(name)
+		if g.LastId, err = readStreamID(r); err != nil {
+			return nil, err
+		}
+		if version >= 2 {
+			if g.EntriesRead, _, err = r.readLength(); err != nil {
+				return nil, err
+			}
+		}
+
+		pending, _, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < pending; j++ {
+			nack := &model.StreamNAck{}
+			if nack.Id, err = readRawStreamID(r); err != nil {
+				return nil, err
+			}
+			delivered, err := r.readInt64()
+			if err != nil {
+				return nil, err
+			}
+			nack.DeliveryTime = uint64(delivered)
+			if nack.DeliveryCount, _, err = r.readLength(); err != nil {
+				return nil, err
+			}
+			g.Pending = append(g.Pending, nack)
+		}
+
+		consumers, _, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			c := &model.StreamConsumer{}
+			name, err := r.readStringBuf()
+			if err != nil {
+				return nil, err
+			}
+			c.Name = string(name)
+			seen, err := r.readInt64()
+			if err != nil {
+				return nil, err
+			}
+			c.SeenTime, c.ActiveTime = uint64(seen), uint64(seen)
+			if version >= 3 {
+				active, err := r.readInt64()
+				if err != nil {
+					return nil, err
+				}
+				c.ActiveTime = uint64(active)
+			}
+			pending, _, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			for k := uint64(0); k < pending; k++ {
+				id, err := readRawStreamID(r)
+				if err != nil {
+					return nil, err
+				}
+				c.Pending = append(c.Pending, id)
+			}
+			g.Consumers = append(g.Consumers, c)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// readModule reads a module value. The items of known modules are kept,
+// the others are skipped.
+func readModule(r *rdbReader, base *model.BaseObject) (*model.ModuleTypeObject, error) {
+	id, _, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	o := &model.ModuleTypeObject{BaseObject: base, ModuleType: moduleTypeName(id)}
+	base.Type = o.ModuleType
+	if _, ok := moduleTypes[o.ModuleType]; !ok {
+		return o, r.skipModuleValue()
+	}
+	o.Value, err = moduleReader(o.ModuleType)(moduleHandler{r}, int(id&1023))
+	return o, err
+}
+
+// moduleTypeName decodes the module type ID of a module value: nine
+// characters of 6 bits, then 10 bits of encoding version
+func moduleTypeName(id uint64) string {
+	var name [9]byte
+	id >>= 10
+	for i := 8; i >= 0; i-- {
+		name[i] = moduleIDCharset[id&63]
+		id >>= 6
+	}
+	return string(name[:])
+}
+
+// moduleHandler reads a module value for moduleReader
+type moduleHandler struct {
+	r *rdbReader
+}
+
+func (h moduleHandler) ReadByte() (byte, error)      { return h.r.ReadByte() }
+func (h moduleHandler) ReadFull(buf []byte) error    { return h.r.readFull(buf) }
+func (h moduleHandler) ReadUInt() (uint64, error)    { v, _, err := h.r.readLength(); return v, err }
+func (h moduleHandler) ReadSInt() (int64, error)     { v, _, err := h.r.readLength(); return int64(v), err }
+func (h moduleHandler) ReadDouble() (float64, error) { return h.r.readDouble() }
+func (h moduleHandler) ReadString() ([]byte, error)  { return h.r.readString() }
+func (h moduleHandler) ReadLength() (uint64, bool, error) {
+	return h.r.readLength()
+}
+
+func (h moduleHandler) ReadOpcode() (core.Opcode, error) {
+	op, _, err := h.r.readLength()
+	if err == nil && op > uint64(core.ModuleOpcodeString) {
+		err = fmt.Errorf("%w: module opcode %d", ErrCorrupt, op)
+	}
+	return core.Opcode(op), err
+}
+
+func (h moduleHandler) ReadFloat32() (float32, error) {
+	if err := h.r.readFull(h.r.buf[:4]); err != nil {
+		return 0, err
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(h.r.buf[:4])), nil
+}
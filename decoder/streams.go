@@ -0,0 +1,178 @@
+package decoder
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/hdt3213/rdb/model"
+)
+
+const (
+	// StreamUntrimmedMinEntries is the length from which a stream that never
+	// lost an entry is flagged as not trimmed by MAXLEN/MINID
+	StreamUntrimmedMinEntries = 10000
+	// StreamDeadConsumerMinPending and StreamDeadConsumerIdleDays flag
+	// consumers that hold a large PEL and have not been seen for a while
+	StreamDeadConsumerMinPending = 1000
+	StreamDeadConsumerIdleDays   = 1
+	// StreamLaggingGroupMinEntries flags groups with this many undelivered entries
+	StreamLaggingGroupMinEntries = 10000
+
+	untrimmedStreamMinAgeDays = 30
+)
+
+// Stream flags
+const (
+	StreamFlagUntrimmed    = "untrimmed"
+	StreamFlagDeadConsumer = "dead-consumer"
+	StreamFlagLaggingGroup = "lagging-group"
+)
+
+// StreamGroupStats describes a consumer group of a stream
+type StreamGroupStats struct {
+	Name                 string
+	LastDeliveredID      string
+	Consumers            int
+	Pending              uint64   // size of the group PEL
+	OldestPendingID      string   `json:",omitempty"`
+	OldestPendingAgeDays float64  `json:",omitempty"`
+	Lag                  uint64   // entries after the last delivered ID
+	DeadConsumers        []string `json:",omitempty"`
+}
+
+// StreamStats is the deep analysis of a stream
+type StreamStats struct {
+	Length       uint64
+	FirstID      string
+	LastID       string
+	SpanDays     float64 // age span between the first and last entry
+	MaxDeletedID string  `json:",omitempty"`
+	AddedEntries uint64  `json:",omitempty"` // all-time added entries, RDB 10+ only
+	Groups       []StreamGroupStats
+	Consumers    int
+	Flags        []string `json:",omitempty"`
+}
+
+// HasFlags reports whether the stream needs attention
+func (s *StreamStats) HasFlags() bool {
+	return s != nil && len(s.Flags) > 0
+}
+
+func formatStreamID(id *model.StreamId) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Sequence, 10)
+}
+
+// streamIDLess reports whether a is before b, nil is 0-0
+func streamIDLess(a, b *model.StreamId) bool {
+	var am, as, bm, bs uint64
+	if a != nil {
+		am, as = a.Ms, a.Sequence
+	}
+	if b != nil {
+		bm, bs = b.Ms, b.Sequence
+	}
+	return am < bm || (am == bm && as < bs)
+}
+
+// newStreamStats analyses a stream with ages relative to ref (unix seconds)
+func newStreamStats(o *model.StreamObject, ref int64) *StreamStats {
+	refMs := float64(ref) * 1000
+	s := &StreamStats{
+		Length:       o.Length,
+		LastID:       formatStreamID(o.LastId),
+		AddedEntries: o.AddedEntriesCount,
+	}
+	if o.MaxDeletedId != nil && (o.MaxDeletedId.Ms > 0 || o.MaxDeletedId.Sequence > 0) {
+		s.MaxDeletedID = formatStreamID(o.MaxDeletedId)
+	}
+
+	// live messages, the first ID from the header is only set since RDB 10
+	first := o.FirstId
+	var ids []*model.StreamId
+	for _, e := range o.Entries {
+		for _, m := range e.Msgs {
+			if m.Deleted || m.Id == nil {
+				continue
+			}
+			ids = append(ids, m.Id)
+			if first == nil || (first.Ms == 0 && first.Sequence == 0) || streamIDLess(m.Id, first) {
+				first = m.Id
+			}
+		}
+	}
+	if len(ids) > 0 {
+		s.FirstID = formatStreamID(first)
+		if o.LastId != nil {
+			s.SpanDays = float64(o.LastId.Ms-first.Ms) / 1000 / day
+		}
+	}
+
+	for _, g := range o.Groups {
+		gs := StreamGroupStats{
+			Name:            g.Name,
+			LastDeliveredID: formatStreamID(g.LastId),
+			Consumers:       len(g.Consumers),
+			Pending:         uint64(len(g.Pending)),
+		}
+		var oldest *model.StreamNAck
+		for _, p := range g.Pending {
+			if oldest == nil || streamIDLess(p.Id, oldest.Id) {
+				oldest = p
+			}
+		}
+		if oldest != nil {
+			gs.OldestPendingID = formatStreamID(oldest.Id)
+			gs.OldestPendingAgeDays = (refMs - float64(oldest.Id.Ms)) / 1000 / day
+		}
+		// ids are in stream order
+		gs.Lag = uint64(len(ids) - sort.Search(len(ids), func(i int) bool {
+			return streamIDLess(g.LastId, ids[i])
+		}))
+		for _, c := range g.Consumers {
+			seen := c.SeenTime
+			if c.ActiveTime > seen {
+				seen = c.ActiveTime
+			}
+			idle := (refMs - float64(seen)) / 1000 / day
+			if len(c.Pending) >= StreamDeadConsumerMinPending && idle >= StreamDeadConsumerIdleDays {
+				gs.DeadConsumers = append(gs.DeadConsumers, c.Name)
+			}
+		}
+		s.Consumers += gs.Consumers
+		s.Groups = append(s.Groups, gs)
+	}
+
+	s.Flags = streamFlags(s, first, refMs, o.Version >= 2)
+	return s
+}
+
+func streamFlags(s *StreamStats, first *model.StreamId, refMs float64, v2 bool) []string {
+	var flags []string
+	if s.Length >= StreamUntrimmedMinEntries {
+		untrimmed := false
+		if v2 {
+			// nothing was ever removed
+			untrimmed = s.MaxDeletedID == "" && s.AddedEntries == s.Length
+		} else if first != nil {
+			untrimmed = (refMs-float64(first.Ms))/1000/day >= untrimmedStreamMinAgeDays
+		}
+		if untrimmed {
+			flags = append(flags, StreamFlagUntrimmed)
+		}
+	}
+	dead, lagging := false, false
+	for _, g := range s.Groups {
+		dead = dead || len(g.DeadConsumers) > 0
+		lagging = lagging || g.Lag >= StreamLaggingGroupMinEntries
+	}
+	if dead {
+		flags = append(flags, StreamFlagDeadConsumer)
+	}
+	if lagging {
+		flags = append(flags, StreamFlagLaggingGroup)
+	}
+	return flags
+}
@@ -0,0 +1,145 @@
+package decoder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hdt3213/rdb/model"
+)
+
+const streamRefMs = fixtureCtime * 1000
+
+// testStream is a stream of n messages one second apart, the last one at
+// ref - lastAgeMs
+type testStream struct {
+	version   uint
+	n         int
+	lastAgeMs uint64
+	deleted   bool // the first message is deleted
+	groups    []testGroup
+}
+
+type testGroup struct {
+	delivered int // messages delivered to the group
+	consumers []testConsumer
+}
+
+type testConsumer struct {
+	pending     int // of the delivered messages
+	seenAgeMs   uint64
+	activeAgeMs uint64 // 0 if not set, before RDB 11
+}
+
+func (ts testStream) object() *model.StreamObject {
+	id := func(i int) *model.StreamId {
+		return &model.StreamId{Ms: streamRefMs - ts.lastAgeMs - uint64(ts.n-1-i)*1000}
+	}
+	o := &model.StreamObject{Version: ts.version, Length: uint64(ts.n), LastId: id(ts.n - 1)}
+	entry := &model.StreamEntry{FirstMsgId: id(0)}
+	for i := 0; i < ts.n; i++ {
+		entry.Msgs = append(entry.Msgs, &model.StreamMessage{Id: id(i), Deleted: ts.deleted && i == 0})
+	}
+	o.Entries = []*model.StreamEntry{entry}
+	if ts.version >= 2 {
+		o.FirstId, o.MaxDeletedId, o.AddedEntriesCount = id(0), &model.StreamId{}, uint64(ts.n)
+		if ts.deleted {
+			o.Length--
+			o.FirstId, o.MaxDeletedId = id(1), id(0)
+		}
+	}
+	for _, g := range ts.groups {
+		group := &model.StreamGroup{Name: "workers", LastId: &model.StreamId{}}
+		if g.delivered > 0 {
+			group.LastId = id(g.delivered - 1)
+		}
+		next := 0
+		for _, c := range g.consumers {
+			consumer := &model.StreamConsumer{Name: "c", SeenTime: streamRefMs - c.seenAgeMs}
+			if c.activeAgeMs > 0 {
+				consumer.ActiveTime = streamRefMs - c.activeAgeMs
+			}
+			for i := 0; i < c.pending; i++ {
+				nack := &model.StreamNAck{Id: id(next)}
+				next++
+				consumer.Pending = append(consumer.Pending, nack.Id)
+				group.Pending = append(group.Pending, nack)
+			}
+			group.Consumers = append(group.Consumers, consumer)
+		}
+		o.Groups = append(o.Groups, group)
+	}
+	return o
+}
+
+func TestStreamFlags(t *testing.T) {
+	const day = 24 * 3600 * 1000
+	dead := StreamDeadConsumerMinPending
+	tests := []struct {
+		name   string
+		stream testStream
+		flags  []string
+	}{
+		{"small", testStream{version: 2, n: 10}, nil},
+		// RDB 10+: nothing was ever deleted
+		{"untrimmed", testStream{version: 2, n: StreamUntrimmedMinEntries}, []string{StreamFlagUntrimmed}},
+		{"untrimmed, one short", testStream{version: 2, n: StreamUntrimmedMinEntries - 1}, nil},
+		{"trimmed", testStream{version: 2, n: StreamUntrimmedMinEntries + 1, deleted: true}, nil},
+		// before RDB 10: the first entry is old
+		{"untrimmed v1", testStream{version: 1, n: StreamUntrimmedMinEntries, lastAgeMs: 30 * day}, []string{StreamFlagUntrimmed}},
+		{"recent v1", testStream{version: 1, n: StreamUntrimmedMinEntries, lastAgeMs: 20 * day}, nil},
+
+		{"dead consumer", testStream{version: 2, n: dead, groups: []testGroup{{delivered: dead, consumers: []testConsumer{
+			{pending: dead, seenAgeMs: StreamDeadConsumerIdleDays * day}}}}}, []string{StreamFlagDeadConsumer}},
+		{"small PEL", testStream{version: 2, n: dead, groups: []testGroup{{delivered: dead, consumers: []testConsumer{
+			{pending: dead - 1, seenAgeMs: 10 * day}}}}}, nil},
+		{"recently seen", testStream{version: 2, n: dead, groups: []testGroup{{delivered: dead, consumers: []testConsumer{
+			{pending: dead, seenAgeMs: StreamDeadConsumerIdleDays*day - 1}}}}}, nil},
+		// RDB 11 active time, newer than the seen time
+		{"recently active", testStream{version: 3, n: dead, groups: []testGroup{{delivered: dead, consumers: []testConsumer{
+			{pending: dead, seenAgeMs: 10 * day, activeAgeMs: 1000}}}}}, nil},
+
+		{"lagging group", testStream{version: 2, n: StreamLaggingGroupMinEntries + 5, deleted: true, groups: []testGroup{{delivered: 5}}},
+			[]string{StreamFlagLaggingGroup}},
+		{"group one short", testStream{version: 2, n: StreamLaggingGroupMinEntries + 5, deleted: true, groups: []testGroup{{delivered: 6}}}, nil},
+	}
+	for _, tt := range tests {
+		s := newStreamStats(tt.stream.object(), fixtureCtime)
+		if !reflect.DeepEqual(s.Flags, tt.flags) {
+			t.Errorf("%s: flags %v, want %v", tt.name, s.Flags, tt.flags)
+		}
+		if s.HasFlags() != (tt.flags != nil) {
+			t.Errorf("%s: HasFlags() = %v", tt.name, s.HasFlags())
+		}
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	const day = 24 * 3600 * 1000
+	o := testStream{version: 2, n: 100, lastAgeMs: 2 * day, deleted: true, groups: []testGroup{
+		{delivered: 40, consumers: []testConsumer{{pending: 3, seenAgeMs: 1000}, {pending: 2, seenAgeMs: 1000}}},
+		{},
+	}}.object()
+	s := newStreamStats(o, fixtureCtime)
+
+	first, last := o.Entries[0].Msgs[1].Id, o.LastId
+	if s.Length != 99 || s.FirstID != formatStreamID(first) || s.LastID != formatStreamID(last) || s.MaxDeletedID == "" {
+		t.Errorf("length %d, IDs %s..%s, max deleted %q", s.Length, s.FirstID, s.LastID, s.MaxDeletedID)
+	}
+	if want := 98.0 / 86400; s.SpanDays < want-1e-9 || s.SpanDays > want+1e-9 {
+		t.Errorf("span %v days, want %v", s.SpanDays, want)
+	}
+	if len(s.Groups) != 2 || s.Consumers != 2 {
+		t.Fatalf("%d groups, %d consumers", len(s.Groups), s.Consumers)
+	}
+	// the deleted first message is not pending delivery
+	g := s.Groups[0]
+	if g.Pending != 5 || g.Lag != 60 || g.OldestPendingID != formatStreamID(o.Entries[0].Msgs[0].Id) {
+		t.Errorf("group %+v, want 5 pending from the first message and a lag of 60", g)
+	}
+	if want := (2*day + 99*1000) / float64(day); g.OldestPendingAgeDays < want-1e-9 || g.OldestPendingAgeDays > want+1e-9 {
+		t.Errorf("oldest pending %v days old, want %v", g.OldestPendingAgeDays, want)
+	}
+	if s.Groups[1].Lag != 99 || s.Groups[1].Pending != 0 || s.Groups[1].OldestPendingID != "" {
+		t.Errorf("new group %+v, want a lag of the whole stream", s.Groups[1])
+	}
+}
@@ -0,0 +1,34 @@
+#!/bin/sh
+# Regenerates the server dumps of hashes with field TTLs: runs each server
+# image, writes the hash2-hfe key and saves it. Needs docker.
+#
+#   cd decoder/testdata && ./generate.sh
+set -eu
+
+dump() {
+	file=$1 image=$2 ttls=$3
+	name=rdb-fixture-$$
+	docker run -d --rm --name "$name" "$image" >/dev/null
+	trap 'docker rm -f "$name" >/dev/null 2>&1 || true' EXIT
+	until docker exec "$name" redis-cli ping >/dev/null 2>&1 ||
+		docker exec "$name" valkey-cli ping >/dev/null 2>&1; do
+		sleep 1
+	done
+	cli=redis-cli
+	docker exec "$name" sh -c 'command -v valkey-cli' >/dev/null 2>&1 && cli=valkey-cli
+	docker exec "$name" $cli HSET hash2-hfe F1 V1 F2 V2 F3 V3 >/dev/null
+	if [ "$ttls" = yes ]; then
+		docker exec "$name" $cli HPEXPIREAT hash2-hfe 2715785640000 FIELDS 1 F1 >/dev/null
+		docker exec "$name" $cli HPEXPIREAT hash2-hfe 2400425640000 FIELDS 1 F2 >/dev/null
+	fi
+	docker exec "$name" $cli SAVE >/dev/null
+	docker cp "$name:/data/dump.rdb" "$file"
+	docker rm -f "$name" >/dev/null
+	trap - EXIT
+	echo "$file: $image"
+}
+
+dump redis-8.0-hfe.rdb redis:8.0 yes
+# field TTLs came in Valkey 9, 8.1 saves the same hash without them
+dump valkey-8.1-hfe.rdb valkey/valkey:8.1 no
+dump valkey-9.0-hfe.rdb valkey/valkey:9.0 yes
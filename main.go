@@ -43,6 +43,84 @@ func main() {
 			Usage: "Port for rdr to listen",
 		},
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:      "project",
+			Usage:     "Project memory usage onto another Redis/Valkey version",
+			ArgsUsage: "[dump.rdb | appendonlydir]",
+			Action:    server.Project,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "target, t",
+					Usage: "Memory profile to project onto, e.g. redis-7.2 or valkey-8.0/libc/64",
+				},
+				cli.StringFlag{
+					Name:  "source, s",
+					Usage: "Memory profile of the input, selected from the RDB by default",
+				},
+				cli.StringFlag{
+					Name:  "analysis, a",
+					Usage: "ID of a stored analysis to project instead of an RDB file",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the projection as JSON",
+				},
+			},
+		},
+		{
+			Name:      "agent",
+			Usage:     "Analyse an RDB next to Redis and upload the analysis to a server",
+			ArgsUsage: "[dump.rdb | appendonlydir]",
+			Action:    server.Agent,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "server",
+					EnvVar: "RDR_SERVER",
+					Usage:  "URL of the analyzer server, e.g. http://redis-rdb-analyzer.tools:8080",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					EnvVar: "RDR_INGEST_TOKEN",
+					Usage:  "Ingest token of the server (its INGEST_TOKEN)",
+				},
+				cli.StringFlag{
+					Name:   "cluster",
+					EnvVar: "CLUSTER_NAME",
+					Usage:  "Cluster name of the analysis, the server's own by default",
+				},
+				cli.StringFlag{
+					Name:   "namespace",
+					EnvVar: "POD_NAMESPACE",
+					Usage:  "Namespace of the Redis pod",
+				},
+				cli.StringFlag{
+					Name:   "pod",
+					EnvVar: "POD_NAME",
+					Usage:  "Name of the Redis pod",
+				},
+				cli.StringFlag{
+					Name:  "profile",
+					Usage: "Memory profile, selected from the RDB by default",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Usage: "Run as a sidecar: check the RDB at this interval and upload it when it changes",
+				},
+			},
+		},
+		{
+			// started by the server to parse the RDB of a job
+			Name:      "worker",
+			Hidden:    true,
+			ArgsUsage: "<dump.rdb | appendonlydir>",
+			Action:    server.Worker,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "profile"},
+				cli.Int64Flag{Name: "memory-limit"},
+			},
+		},
+	}
 	app.CommandNotFound = func(c *cli.Context, command string) {
 		fmt.Fprintf(c.App.ErrWriter, "command %q can not be found.\n", command)
 		cli.ShowAppHelp(c)
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobBaseMemory is the memory a job needs besides the one it is estimated
+// to need for its RDB
+const jobBaseMemory = 64 << 20
+
+// admissionRecheck is how often a queued job checks the free disk space,
+// which other processes may release
+const admissionRecheck = 10 * time.Second
+
+// compressedRatio is how much larger a compressed RDB is estimated to be
+// once decompressed. RDBs are partly LZF compressed already, gzip and zstd
+// usually shrink them 2 to 4 times more.
+const compressedRatio = 4
+
+// admission reserves the disk space and memory of the running jobs, a job
+// that does not fit waits for others to finish
+type admission struct {
+	mu      sync.Mutex
+	disk    int64 // bytes of the temp directory reserved by running jobs
+	memory  int64
+	running int
+	changed chan struct{} // closed when a job releases its reservation
+	free    func(dir string) (int64, error)
+}
+
+var jobAdmission = &admission{changed: make(chan struct{}), free: diskFree}
+
+// estimateMemory is the memory a job analysing the file of size bytes at
+// path is estimated to need. The size of a gzip, zstd or LZ4 file, told by
+// its name, is scaled by compressedRatio: the worker decodes it decompressed.
+func estimateMemory(path string, size int64) int64 {
+	name := strings.ToLower(path)
+	for _, ext := range []string{".gz", ".tgz", ".zst", ".zstd", ".lz4"} {
+		if strings.HasSuffix(name, ext) {
+			size *= compressedRatio
+			break
+		}
+	}
+	return jobBaseMemory + int64(float64(size)*GetJobMemoryRatio())
+}
+
+// admit reserves the resources of a job copying size bytes to dir and
+// needing memory to analyse them. A job that does not fit yet waits up to
+// JOB_QUEUE_TIMEOUT, calling queued with the reason; one that would never
+// fit is refused. release ends the reservation.
+func (a *admission) admit(ctx context.Context, dir string, size, memory int64, queued func(reason string)) (release func(), err error) {
+	ctx, cancel := context.WithTimeout(ctx, GetJobQueueTimeout())
+	defer cancel()
+	for {
+		a.mu.Lock()
+		reason, err := a.check(dir, size, memory)
+		if err != nil {
+			a.mu.Unlock()
+			return nil, err
+		}
+		if reason == "" {
+			a.disk += size
+			a.memory += memory
+			a.running++
+			a.mu.Unlock()
+			return func() { a.release(size, memory) }, nil
+		}
+		changed := a.changed
+		a.mu.Unlock()
+
+		queued(reason)
+		select {
+		case <-changed:
+		case <-time.After(admissionRecheck):
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("queued for %s: %s", GetJobQueueTimeout(), reason)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (a *admission) release(disk, memory int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.disk -= disk
+	a.memory -= memory
+	a.running--
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// check returns why a job does not fit yet, or an error if it never will.
+// The disk reserved by running jobs counts in full although they may have
+// written part of it already.
+func (a *admission) check(dir string, disk, memory int64) (string, error) {
+	if free, err := a.free(dir); err == nil {
+		if disk > free+a.disk {
+			return "", fmt.Errorf("not enough disk space in %s: the copy needs %s, %s is free", dir, FormatSize(disk), FormatSize(free))
+		}
+		if disk > free-a.disk {
+			return fmt.Sprintf("waiting for %s of disk space in %s, the running jobs (%d) reserve %s of the %s free", FormatSize(disk), dir, a.running, FormatSize(a.disk), FormatSize(free)), nil
+		}
+	} else {
+		log.Printf("Disk space of %s not checked: %v", dir, err)
+	}
+
+	if limit := GetJobMemoryLimit(); limit > 0 {
+		if memory > limit {
+			return "", fmt.Errorf("not enough memory: the analysis needs about %s, the limit of jobs is %s (JOB_MEMORY_LIMIT)", FormatSize(memory), FormatSize(limit))
+		}
+		if a.memory+memory > limit {
+			return fmt.Sprintf("waiting for %s of memory, the running jobs (%d) use about %s of %s", FormatSize(memory), a.running, FormatSize(a.memory), FormatSize(limit)), nil
+		}
+	}
+	return "", nil
+}
+
+// jobTempDir is where jobs copy RDBs to, on disk rather than in a tmpfs
+func jobTempDir() string {
+	dir, _ := filepath.Abs("./tmp")
+	return dir
+}
+
+// SweepTempFiles removes the copies of jobs left in the temp directory by a
+// crash. Jobs do not outlive the server, so at startup all are orphans.
+func SweepTempFiles() {
+	dir := jobTempDir()
+	for _, pattern := range []string{"rdr_*.rdb", "rdr_*.aof"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		for _, m := range matches {
+			if err := os.RemoveAll(m); err != nil {
+				log.Printf("Failed to remove orphaned %s: %v", m, err)
+				continue
+			}
+			log.Printf("Removed orphaned %s", m)
+		}
+	}
+}
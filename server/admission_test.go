@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAdmit(t *testing.T) {
+	t.Setenv("JOB_MEMORY_LIMIT", "1000b")
+	t.Setenv("JOB_QUEUE_TIMEOUT", "100ms")
+	tests := []struct {
+		name    string
+		free    int64
+		running [2]int64 // disk and memory of a running job, 0 for none
+		disk    int64
+		memory  int64
+		release bool // the running job finishes once this one is queued
+		queued  bool
+		err     string
+	}{
+		{name: "fits", free: 1000, disk: 600, memory: 600},
+		{name: "fits next to a job", free: 1000, running: [2]int64{400, 400}, disk: 600, memory: 600},
+		{name: "queued for disk then released", free: 1000, running: [2]int64{500, 100}, disk: 600, memory: 100, release: true, queued: true},
+		{name: "queued for memory then released", free: 1000, running: [2]int64{100, 500}, disk: 100, memory: 600, release: true, queued: true},
+		{name: "never fits the disk", free: 1000, disk: 1001, memory: 100, err: "not enough disk space"},
+		// the free space does not count what the running job has written
+		{name: "never fits the disk of a job", free: 500, running: [2]int64{500, 100}, disk: 1001, memory: 100, err: "not enough disk space"},
+		{name: "never fits the memory", free: 1000, disk: 100, memory: 1001, err: "not enough memory"},
+		{name: "timeout", free: 1000, running: [2]int64{100, 500}, disk: 100, memory: 600, queued: true, err: "queued for 100ms"},
+	}
+	for _, tt := range tests {
+		a := &admission{changed: make(chan struct{}), free: func(string) (int64, error) { return tt.free, nil }}
+		var releaseRunning func()
+		if tt.running != [2]int64{} {
+			var err error
+			if releaseRunning, err = a.admit(context.Background(), "/tmp", tt.running[0], tt.running[1], nil); err != nil {
+				t.Fatalf("%s: running job: %v", tt.name, err)
+			}
+		}
+
+		var reasons []string
+		release, err := a.admit(context.Background(), "/tmp", tt.disk, tt.memory, func(reason string) {
+			reasons = append(reasons, reason)
+			if tt.release && len(reasons) == 1 {
+				go releaseRunning()
+			}
+		})
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+		if (len(reasons) > 0) != tt.queued {
+			t.Errorf("%s: queued %q, want queued: %v", tt.name, reasons, tt.queued)
+		}
+		if err != nil {
+			continue
+		}
+		release()
+		if tt.release {
+			if a.running != 0 || a.disk != 0 || a.memory != 0 {
+				t.Errorf("%s: %d jobs reserve %d bytes of disk and %d of memory after both released", tt.name, a.running, a.disk, a.memory)
+			}
+		} else if releaseRunning != nil {
+			releaseRunning()
+		}
+	}
+}
+
+// TestAdmitCancel checks that a queued job stops waiting when its context
+// is canceled
+func TestAdmitCancel(t *testing.T) {
+	a := &admission{changed: make(chan struct{}), free: func(string) (int64, error) { return 100, nil }}
+	if _, err := a.admit(context.Background(), "/tmp", 100, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := a.admit(ctx, "/tmp", 100, 0, func(string) { cancel() }); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	t.Setenv("JOB_MEMORY_RATIO", "2")
+	for path, want := range map[string]int64{
+		"/data/dump.rdb":        jobBaseMemory + 2000,
+		"/data/appendonlydir":   jobBaseMemory + 2000,
+		"/backup/dump.rdb.gz":   jobBaseMemory + 8000,
+		"/backup/dump.rdb.ZST":  jobBaseMemory + 8000,
+		"/backup/nightly.tgz":   jobBaseMemory + 8000,
+		"/backup/dump.rdb.lz4":  jobBaseMemory + 8000,
+		"/backup/dump.gz.rdb":   jobBaseMemory + 2000,
+		"/backup/dump.rdb.zstd": jobBaseMemory + 8000,
+	} {
+		if got := estimateMemory(path, 1000); got != want {
+			t.Errorf("estimateMemory(%q) = %d, want %d", path, got, want)
+		}
+	}
+}
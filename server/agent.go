@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+	"github.com/urfave/cli"
+)
+
+// AnalyzeFile analyses a local RDB file or appendonlydir, in the worker of
+// a job or in the agent. format is the input format, e.g. "gzip" for a
+// compressed RDB. progress, if not nil, is called with the bytes read.
+func AnalyzeFile(file string, profile *decoder.MemoryProfile, progress func(done, total int64)) (counter *Counter, format string, err error) {
+	d := decoder.NewDecoder()
+	if profile != nil {
+		d.SetProfile(*profile)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, "", err
+	}
+	var in *Input
+	if info.IsDir() {
+		if !decoder.IsAOFDir(file) {
+			return nil, "", fmt.Errorf("directory %s has no AOF manifest", file)
+		}
+		go d.DecodeAOFDir(file, progress)
+		format = "aof"
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, "", err
+		}
+		// progress counts the bytes read from the file, compressed or not
+		var src io.Reader = f
+		if progress != nil {
+			src = &progressReader{r: f, total: info.Size(), progress: progress}
+		}
+		if in, err = OpenInput(src, GetMaxRDBSize()); err != nil {
+			f.Close()
+			return nil, "", err
+		}
+		in.closers = append(in.closers, f)
+		defer in.Close()
+		go d.DecodeStream(in)
+		format = in.Format()
+	}
+	counter = countDecoder(d)
+	if in != nil && in.TooLarge() {
+		return nil, format, fmt.Errorf("decompressed RDB exceeds limit of %s", FormatSize(GetMaxRDBSize()))
+	}
+	if err := in.checkArchive(); err != nil {
+		return nil, format, err
+	}
+	if err := d.GetError(); err != nil {
+		if counter.TotalCount == 0 {
+			return nil, format, err
+		}
+		counter.decodeError = err.Error()
+	}
+	return counter, format, nil
+}
+
+// Agent is the agent command: it analyses an RDB next to Redis and uploads
+// the analysis to the ingest endpoint of a server, once as a Job or, with
+// --interval, as a sidecar each time the RDB changes
+func Agent(c *cli.Context) error {
+	server := strings.TrimSuffix(c.String("server"), "/")
+	if server == "" {
+		return cli.NewExitError("--server (or RDR_SERVER) is required", 1)
+	}
+	if c.String("namespace") == "" || c.String("pod") == "" {
+		return cli.NewExitError("--namespace and --pod (or POD_NAMESPACE and POD_NAME) are required", 1)
+	}
+	var profile *decoder.MemoryProfile
+	if c.String("profile") != "" {
+		p, err := decoder.ParseProfile(c.String("profile"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		profile = &p
+	}
+	file := c.Args().First()
+	if file == "" {
+		file = "/data/dump.rdb"
+	}
+
+	interval := c.Duration("interval")
+	var last os.FileInfo
+	for {
+		info, err := os.Stat(file)
+		// in a sidecar, an RDB unchanged since the last upload is skipped
+		if err == nil && (last == nil || info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime())) {
+			var id string
+			if id, err = runAgent(c, server, file, info, profile); err == nil {
+				log.Printf("Agent: uploaded %s as %s", file, id)
+				last = info
+			}
+		}
+		if interval == 0 {
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		}
+		if err != nil {
+			log.Printf("Agent: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func runAgent(c *cli.Context, server, file string, info os.FileInfo, profile *decoder.MemoryProfile) (string, error) {
+	log.Printf("Agent: analysing %s (%s)", file, FormatSize(info.Size()))
+	start := time.Now()
+	counter, format, err := AnalyzeFile(file, profile, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", file, err)
+	}
+	log.Printf("Agent: analysed %d keys in %s", counter.TotalCount, time.Since(start).Round(time.Millisecond))
+
+	analysis, err := json.Marshal(counter.ToDTO())
+	if err != nil {
+		return "", err
+	}
+	abs, _ := filepath.Abs(file)
+	req := IngestRequest{
+		SchemaVersion: IngestSchemaVersion,
+		AgentVersion:  c.App.Version,
+		Cluster:       c.String("cluster"),
+		Namespace:     c.String("namespace"),
+		Pod:           c.String("pod"),
+		Path:          abs,
+		Size:          info.Size(),
+		ModTime:       info.ModTime(),
+		Format:        format,
+		Analysis:      analysis,
+	}
+	if info.IsDir() {
+		req.Size = dirSize(file)
+	}
+	return upload(server+"/api/ingest", c.String("token"), &req)
+}
+
+// upload posts a gzipped ingest request and returns the ID of the analysis
+func upload(url, token string, req *IngestRequest) (string, error) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if err := json.NewEncoder(gz).Encode(req); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("upload failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("upload failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var res IngestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("upload failed: %v", err)
+	}
+	return res.ID, nil
+}
+
+// progressReader reports the bytes read through it out of total
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	p.progress(p.done, p.total)
+	return n, err
+}
+
+// dirSize is the size of the files of a directory
+func dirSize(dir string) int64 {
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -44,6 +45,171 @@ func GetMaxRDBSize() int64 {
 	return 10 * 1024 * 1024 * 1024 // 10GB default
 }
 
+// GetRDBStaleAfter returns the age from RDB_STALE_AFTER after which an
+// imported RDB is reported as stale
+// Default: 6 hours
+func GetRDBStaleAfter() time.Duration {
+	if dur := os.Getenv("RDB_STALE_AFTER"); dur != "" {
+		if d, err := time.ParseDuration(dur); err == nil {
+			return d
+		}
+		fmt.Printf("Warning: Invalid RDB_STALE_AFTER format '%s', using default 6h\n", dur)
+	}
+	return 6 * time.Hour
+}
+
+// GetTransferRetries returns from TRANSFER_RETRIES how many times a failed
+// copy from a pod is retried
+// Default: 5
+func GetTransferRetries() int {
+	if retries := os.Getenv("TRANSFER_RETRIES"); retries != "" {
+		if n, err := strconv.Atoi(retries); err == nil && n >= 0 {
+			return n
+		}
+		fmt.Printf("Warning: Invalid TRANSFER_RETRIES '%s', using default 5\n", retries)
+	}
+	return 5
+}
+
+// GetTransferRateLimit returns from TRANSFER_RATE_LIMIT the bytes per second
+// all copies from pods share
+// Default: 0, unlimited
+// Format: "50Mb", "1Gb"
+func GetTransferRateLimit() int64 {
+	return getRateLimit("TRANSFER_RATE_LIMIT")
+}
+
+// GetTransferJobRateLimit returns from TRANSFER_JOB_RATE_LIMIT the bytes per
+// second of a job that sets no limit of its own
+// Default: 0, unlimited
+func GetTransferJobRateLimit() int64 {
+	return getRateLimit("TRANSFER_JOB_RATE_LIMIT")
+}
+
+func getRateLimit(name string) int64 {
+	limit := strings.TrimSpace(os.Getenv(name))
+	if limit == "" || limit == "0" {
+		return 0
+	}
+	if l, err := parseSize(limit); err == nil && l >= 0 {
+		return l
+	}
+	fmt.Printf("Warning: Invalid %s format '%s', using no limit\n", name, limit)
+	return 0
+}
+
+// GetTransferCompression returns from TRANSFER_COMPRESSION how copies from
+// pods are compressed on the wire: auto (zstd, else gzip, if the pod has
+// them), zstd, gzip or none
+// Default: auto
+func GetTransferCompression() string {
+	switch c := strings.ToLower(strings.TrimSpace(os.Getenv("TRANSFER_COMPRESSION"))); c {
+	case "":
+		return "auto"
+	case "auto", "zstd", "gzip", "none":
+		return c
+	default:
+		fmt.Printf("Warning: Invalid TRANSFER_COMPRESSION '%s', using auto\n", c)
+		return "auto"
+	}
+}
+
+// GetJobMemoryLimit returns from JOB_MEMORY_LIMIT the memory all running
+// jobs may use together, "0" for no limit
+// Default: 80% of the container's cgroup memory limit, none outside a
+// container
+func GetJobMemoryLimit() int64 {
+	if limit := strings.TrimSpace(os.Getenv("JOB_MEMORY_LIMIT")); limit != "" {
+		if limit == "0" {
+			return 0
+		}
+		if l, err := parseSize(limit); err == nil && l > 0 {
+			return l
+		}
+		fmt.Printf("Warning: Invalid JOB_MEMORY_LIMIT format '%s', using the cgroup limit\n", limit)
+	}
+	return cgroupMemoryLimit() / 10 * 8
+}
+
+// cgroupMemoryLimit returns the memory limit of the cgroup of the process,
+// 0 if there is none
+func cgroupMemoryLimit() int64 {
+	for _, file := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		// "max" in v2, a huge number in v1
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil || limit <= 0 || limit >= 1<<60 {
+			return 0
+		}
+		return limit
+	}
+	return 0
+}
+
+// GetWorkerMemoryLimit returns from WORKER_MEMORY_LIMIT the memory of the
+// worker process a job parses in, "0" for no limit
+// Default: JOB_MEMORY_LIMIT
+func GetWorkerMemoryLimit() int64 {
+	if limit := strings.TrimSpace(os.Getenv("WORKER_MEMORY_LIMIT")); limit != "" {
+		if limit == "0" {
+			return 0
+		}
+		if l, err := parseSize(limit); err == nil && l > 0 {
+			return l
+		}
+		fmt.Printf("Warning: Invalid WORKER_MEMORY_LIMIT format '%s', using JOB_MEMORY_LIMIT\n", limit)
+	}
+	return GetJobMemoryLimit()
+}
+
+// GetJobMemoryRatio returns from JOB_MEMORY_RATIO the memory a job is
+// estimated to need per byte of RDB
+// Default: 1.0
+func GetJobMemoryRatio() float64 {
+	if ratio := os.Getenv("JOB_MEMORY_RATIO"); ratio != "" {
+		if r, err := strconv.ParseFloat(ratio, 64); err == nil && r >= 0 {
+			return r
+		}
+		fmt.Printf("Warning: Invalid JOB_MEMORY_RATIO '%s', using default 1.0\n", ratio)
+	}
+	return 1.0
+}
+
+// GetCountWorkers returns from COUNT_WORKERS the number of goroutines that
+// count the keys of a job, each in a shard of its own merged at the end
+// Default: the number of CPUs, at most 8
+func GetCountWorkers() int {
+	if workers := os.Getenv("COUNT_WORKERS"); workers != "" {
+		if n, err := strconv.Atoi(workers); err == nil && n > 0 {
+			return n
+		}
+		fmt.Printf("Warning: Invalid COUNT_WORKERS '%s', using the number of CPUs\n", workers)
+	}
+	if n := runtime.NumCPU(); n < 8 {
+		return n
+	}
+	return 8
+}
+
+// GetJobQueueTimeout returns from JOB_QUEUE_TIMEOUT how long a job waits
+// for disk space or memory before it fails
+// Default: 30 minutes
+func GetJobQueueTimeout() time.Duration {
+	if dur := os.Getenv("JOB_QUEUE_TIMEOUT"); dur != "" {
+		if d, err := time.ParseDuration(dur); err == nil {
+			return d
+		}
+		fmt.Printf("Warning: Invalid JOB_QUEUE_TIMEOUT format '%s', using default 30m\n", dur)
+	}
+	return 30 * time.Minute
+}
+
 // parseSize converts size string (e.g., "10Gb", "500Mb") to bytes
 func parseSize(s string) (int64, error) {
 	s = strings.TrimSpace(s)
@@ -103,5 +269,43 @@ func FormatSize(bytes int64) string {
 		div *= unit
 		exp++
 	}
-	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGT"[exp])
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// GetKubeconfigs returns the kubeconfig files from KUBECONFIGS, comma
+// separated. Default: none, the kubeconfig of $KUBECONFIG or ~/.kube/config
+func GetKubeconfigs() []string {
+	return splitList(os.Getenv("KUBECONFIGS"))
+}
+
+// GetKubeContexts returns the contexts to discover from KUBE_CONTEXTS, comma
+// separated. Default: every context of the kubeconfigs
+func GetKubeContexts() []string {
+	return splitList(os.Getenv("KUBE_CONTEXTS"))
+}
+
+// GetClusterName returns the name of the cluster the analyzer runs in from
+// CLUSTER_NAME. Default: in-cluster
+func GetClusterName() string {
+	if name := strings.TrimSpace(os.Getenv("CLUSTER_NAME")); name != "" {
+		return name
+	}
+	return "in-cluster"
+}
+
+// GetIngestToken returns the bearer token agents upload analyses with from
+// INGEST_TOKEN. Default: none, ingest is disabled
+func GetIngestToken() string {
+	return strings.TrimSpace(os.Getenv("INGEST_TOKEN"))
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -16,15 +16,19 @@ package server
 
 import (
 	"container/heap"
+	"fmt"
+	"os"
 	"sort"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
-    "fmt"
-    "os"
 )
 
+// defaultSeparators split key names into prefixes
+const defaultSeparators = ":;,_- "
+
 // NewCounter return a pointer of Counter
 func NewCounter() *Counter {
 	h := &entryHeap{}
@@ -33,6 +37,9 @@ func NewCounter() *Counter {
 	heap.Init(p)
 	return &Counter{
 		largestEntries:     h,
+		untrimmedZSets:     &entryHeap{},
+		flaggedStreams:     &entryHeap{},
+		fieldTTLHashes:     &entryHeap{},
 		largestKeyPrefixes: p,
 		lengthLevel0:       100,
 		lengthLevel1:       1000,
@@ -41,20 +48,26 @@ func NewCounter() *Counter {
 		lengthLevel4:       1000000,
 		lengthLevelBytes:   map[typeKey]uint64{},
 		lengthLevelNum:     map[typeKey]uint64{},
-		keyPrefixBytes:     map[typeKey]uint64{},
-		keyPrefixNum:       map[typeKey]uint64{},
+		keyPrefixes:        map[string]map[string]*prefixCount{},
 		typeBytes:          map[string]uint64{},
 		typeNum:            map[string]uint64{},
-		separators:         ":;,_- ",
+		separators:         defaultSeparators,
 		slotBytes:          map[int]uint64{},
 		slotNum:            map[int]uint64{},
 		keyPrefixDb:        map[typeKey]string{},
+		encodingBytes:      map[typeKey]uint64{},
+		encodingNum:        map[typeKey]uint64{},
+		encodingBuckets:    map[encodingBucketKey]*EncodingBucket{},
 	}
 }
 
 // Counter for redis memory usage
 type Counter struct {
 	largestEntries     *entryHeap
+	untrimmedZSets     *entryHeap
+	flaggedStreams     *entryHeap
+	fieldTTLHashes     *entryHeap
+	fieldTTL           FieldTTLSummary
 	largestKeyPrefixes *prefixHeap
 	lengthLevel0       uint64
 	lengthLevel1       uint64
@@ -63,43 +76,154 @@ type Counter struct {
 	lengthLevel4       uint64
 	lengthLevelBytes   map[typeKey]uint64
 	lengthLevelNum     map[typeKey]uint64
-	keyPrefixBytes     map[typeKey]uint64
-	keyPrefixNum       map[typeKey]uint64
+	keyPrefixes        map[string]map[string]*prefixCount // type, then prefix
 	separators         string
+	prefixScanner      *prefixScanner
 	typeBytes          map[string]uint64
 	typeNum            map[string]uint64
 	slotBytes          map[int]uint64
 	slotNum            map[int]uint64
 	keyPrefixDb        map[typeKey]string
+	encodingBytes      map[typeKey]uint64 // Key is the encoding
+	encodingNum        map[typeKey]uint64
+	encodingBuckets    map[encodingBucketKey]*EncodingBucket
+	redisVersion       string // redis-ver of the RDB, drives the encoding rules
+	profile            string // name of the memory profile used for sizing
+	skipped            []*decoder.SkipStats
+	decodeError        string // why decoding stopped early, empty if the whole RDB was read
+	meta               *decoder.RDBMeta
 	TotalCount         uint64 // Total number of keys processed
 }
 
-// Count by various dimensions
-func (c *Counter) Count(in <-chan *decoder.Entry) {
-    var count uint64
-	for e := range in {
-		c.count(e)
-        count++
-		c.TotalCount = count
-        if count % 50000 == 0 {
-             fmt.Fprintf(os.Stderr, "Processed %d keys... Last key: %s\n", count, e.Key)
-        }
+// Number of entries kept in the heaps of the largest keys
+const (
+	largestEntriesNum = 500
+	flaggedEntriesNum = 100
+)
+
+// Count by various dimensions. The batches are counted by GetCountWorkers
+// shards of the counter, each taking the next batch off in and splitting
+// its keys into prefixes itself. The shards are merged once they are all
+// counted.
+func (c *Counter) Count(in <-chan []*decoder.Entry) {
+	c.countShards(in, GetCountWorkers())
+}
+
+func (c *Counter) countShards(in <-chan []*decoder.Entry, workers int) {
+	shards := make([]*Counter, workers)
+	var total atomic.Uint64
+	var wg sync.WaitGroup
+	for i := range shards {
+		shard := c
+		if i > 0 {
+			shard = NewCounter()
+			shard.separators = c.separators
+		}
+		shards[i] = shard
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range in {
+				for _, e := range batch {
+					shard.count(e)
+				}
+				n := total.Add(uint64(len(batch)))
+				if n/50000 != (n-uint64(len(batch)))/50000 {
+					fmt.Fprintf(os.Stderr, "Processed %d keys... Last key: %s\n", n/50000*50000, batch[len(batch)-1].Key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, shard := range shards[1:] {
+		c.merge(shard)
 	}
-    fmt.Fprintf(os.Stderr, "Finished counting %d keys.\n", count)
+	c.TotalCount = total.Load()
+	fmt.Fprintf(os.Stderr, "Finished counting %d keys.\n", c.TotalCount)
 	// get largest prefixes
 	c.calcuLargestKeyPrefix(1000)
 }
 
 // Process a single entry through all counting metrics
 func (c *Counter) count(e *decoder.Entry) {
-	c.countLargestEntries(e, 500)
+	c.countLargestEntries(e, largestEntriesNum)
+	c.countUntrimmedZSets(e, flaggedEntriesNum)
+	c.countFlaggedStreams(e, flaggedEntriesNum)
+	c.countFieldTTLs(e, flaggedEntriesNum)
 	c.countByType(e)
 	c.countByLength(e)
-	c.countByKeyPrefix(e) 
+	c.countByKeyPrefix(e)
 	c.countBySlot(e)
+	c.countByEncoding(e)
 	//c.countByDb(e) // Method added by caiqing0204
 }
 
+// merge adds the counts of shard o, before the largest prefixes are computed
+func (c *Counter) merge(o *Counter) {
+	for _, e := range *o.largestEntries {
+		c.countLargestEntries(e, largestEntriesNum)
+	}
+	for _, e := range *o.untrimmedZSets {
+		pushTopEntry(c.untrimmedZSets, e, flaggedEntriesNum)
+	}
+	for _, e := range *o.flaggedStreams {
+		pushTopEntry(c.flaggedStreams, e, flaggedEntriesNum)
+	}
+	for _, e := range *o.fieldTTLHashes {
+		pushTopEntry(c.fieldTTLHashes, e, flaggedEntriesNum)
+	}
+	c.fieldTTL.Hashes += o.fieldTTL.Hashes
+	c.fieldTTL.Fields += o.fieldTTL.Fields
+	c.fieldTTL.Expired += o.fieldTTL.Expired
+	c.fieldTTL.MetaBytes += o.fieldTTL.MetaBytes
+	mergeCounts(c.lengthLevelBytes, o.lengthLevelBytes)
+	mergeCounts(c.lengthLevelNum, o.lengthLevelNum)
+	mergeCounts(c.typeBytes, o.typeBytes)
+	mergeCounts(c.typeNum, o.typeNum)
+	mergeCounts(c.slotBytes, o.slotBytes)
+	mergeCounts(c.slotNum, o.slotNum)
+	mergeCounts(c.encodingBytes, o.encodingBytes)
+	mergeCounts(c.encodingNum, o.encodingNum)
+	for k, b := range o.encodingBuckets {
+		mine := c.encodingBuckets[k]
+		if mine == nil {
+			c.encodingBuckets[k] = b
+			continue
+		}
+		mine.merge(b)
+	}
+	for typ, counts := range o.keyPrefixes {
+		mine := c.keyPrefixes[typ]
+		if mine == nil {
+			c.keyPrefixes[typ] = counts
+			continue
+		}
+		for prefix, p := range counts {
+			if m := mine[prefix]; m != nil {
+				m.merge(p)
+			} else {
+				mine[prefix] = p
+			}
+		}
+	}
+}
+
+// mergeCounts adds the counts of src to dst
+func mergeCounts[K comparable](dst, src map[K]uint64) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// SkippedKeys returns the number of keys left out of the analysis
+func (c *Counter) SkippedKeys() uint64 {
+	var n uint64
+	for _, s := range c.skipped {
+		n += s.Keys
+	}
+	return n
+}
+
 // Method added by caiqing0204. Not used anywhere, causes incorrect prefix-to-db mapping
 func (c *Counter) countByDb(e *decoder.Entry) {
 	key := typeKey{
@@ -132,6 +256,17 @@ func (c *Counter) GetLargestEntries(num int, sizeFilter int64) []*decoder.Entry
 	return res
 }
 
+// FindLargestEntry returns the entry of key if it is one of the largest
+// entries, db < 0 matches any db
+func (c *Counter) FindLargestEntry(key string, db int) *decoder.Entry {
+	for _, e := range *c.largestEntries {
+		if e.Key == key && (db < 0 || e.Db == db) {
+			return e
+		}
+	}
+	return nil
+}
+
 // GetLargestKeyPrefixes from heap
 func (c *Counter) GetLargestKeyPrefixes() []*PrefixEntry {
 	res := []*PrefixEntry{}
@@ -164,49 +299,103 @@ func (c *Counter) GetLenLevelCount() []*PrefixEntry {
 
 
 func (c *Counter) countLargestEntries(e *decoder.Entry, num int) {
+	pushTopEntry(c.largestEntries, e, num)
+}
+
+// countUntrimmedZSets keeps the largest time-indexed zsets that are never trimmed
+func (c *Counter) countUntrimmedZSets(e *decoder.Entry, num int) {
+	if e.Scores != nil && e.Scores.Untrimmed {
+		pushTopEntry(c.untrimmedZSets, e, num)
+	}
+}
+
+// countFlaggedStreams keeps the largest streams that need attention
+func (c *Counter) countFlaggedStreams(e *decoder.Entry, num int) {
+	if e.Stream.HasFlags() {
+		pushTopEntry(c.flaggedStreams, e, num)
+	}
+}
+
+// FieldTTLSummary totals the hash fields with a TTL (Redis 7.4+)
+type FieldTTLSummary struct {
+	Hashes    uint64 // hashes with at least one field TTL
+	Fields    uint64 // fields with a TTL
+	Expired   uint64 // fields already expired at the snapshot time
+	MetaBytes uint64 // memory the TTLs cost
+}
+
+// countFieldTTLs totals the field TTLs and keeps the largest hashes with them
+func (c *Counter) countFieldTTLs(e *decoder.Entry, num int) {
+	if e.FieldTTL == nil {
+		return
+	}
+	c.fieldTTL.Hashes++
+	c.fieldTTL.Fields += e.FieldTTL.Fields
+	c.fieldTTL.Expired += e.FieldTTL.Expired
+	c.fieldTTL.MetaBytes += e.FieldTTL.MetaBytes
+	pushTopEntry(c.fieldTTLHashes, e, num)
+}
+
+// GetFieldTTLHashes returns the hashes with field TTLs, largest first
+func (c *Counter) GetFieldTTLHashes() []*decoder.Entry {
+	res := append([]*decoder.Entry{}, *c.fieldTTLHashes...)
+	sort.Sort(sort.Reverse(entryHeap(res)))
+	return res
+}
+
+// pushTopEntry keeps the num largest entries in h
+func pushTopEntry(h *entryHeap, e *decoder.Entry, num int) {
 	// Only add to heap if it's in the top N or heap isn't full yet
-	l := c.largestEntries.Len()
+	l := h.Len()
 	if l < num {
 		// Heap not full, add entry
-		heap.Push(c.largestEntries, e)
+		heap.Push(h, e)
 	} else if l > 0 {
 		// Heap is full, only add if this entry is larger than the smallest
-		smallest := (*c.largestEntries)[0]
+		smallest := (*h)[0]
 		if e.Bytes > smallest.Bytes {
-			heap.Pop(c.largestEntries)  // Remove smallest
-			heap.Push(c.largestEntries, e)  // Add new larger entry
+			heap.Pop(h)  // Remove smallest
+			heap.Push(h, e)  // Add new larger entry
 		}
 	}
 }
 
-func (c *Counter) countByLength(e *decoder.Entry) {
-	key := typeKey{
-		Type: e.Type,
-		Key:  strconv.FormatUint(c.lengthLevel0, 10),
-	}
+// GetFlaggedStreams returns the flagged streams, largest first
+func (c *Counter) GetFlaggedStreams() []*decoder.Entry {
+	res := append([]*decoder.Entry{}, *c.flaggedStreams...)
+	sort.Sort(sort.Reverse(entryHeap(res)))
+	return res
+}
 
-	add := func(c *Counter, key typeKey, e *decoder.Entry) {
-		c.lengthLevelBytes[key] += e.Bytes
-		c.lengthLevelNum[key]++
-	}
+// GetUntrimmedZSets returns the flagged zsets, largest first
+func (c *Counter) GetUntrimmedZSets() []*decoder.Entry {
+	res := append([]*decoder.Entry{}, *c.untrimmedZSets...)
+	sort.Sort(sort.Reverse(entryHeap(res)))
+	return res
+}
 
+func (c *Counter) countByLength(e *decoder.Entry) {
+	var level uint64
 	// must lengthLevel4 > lengthLevel3 > lengthLevel2 ...
 	if e.NumOfElem > c.lengthLevel4 {
-		key.Key = strconv.FormatUint(c.lengthLevel4, 10)
-		add(c, key, e)
+		level = c.lengthLevel4
 	} else if e.NumOfElem > c.lengthLevel3 {
-		key.Key = strconv.FormatUint(c.lengthLevel3, 10)
-		add(c, key, e)
+		level = c.lengthLevel3
 	} else if e.NumOfElem > c.lengthLevel2 {
-		key.Key = strconv.FormatUint(c.lengthLevel2, 10)
-		add(c, key, e)
+		level = c.lengthLevel2
 	} else if e.NumOfElem > c.lengthLevel1 {
-		key.Key = strconv.FormatUint(c.lengthLevel1, 10)
-		add(c, key, e)
+		level = c.lengthLevel1
 	} else if e.NumOfElem > c.lengthLevel0 {
-		key.Key = strconv.FormatUint(c.lengthLevel0, 10)
-		add(c, key, e)
+		level = c.lengthLevel0
+	} else {
+		return
+	}
+	key := typeKey{
+		Type: e.Type,
+		Key:  strconv.FormatUint(level, 10),
 	}
+	c.lengthLevelBytes[key] += e.Bytes
+	c.lengthLevelNum[key]++
 }
 
 func (c *Counter) countByType(e *decoder.Entry) {
@@ -216,43 +405,65 @@ func (c *Counter) countByType(e *decoder.Entry) {
 
 // Process entry by extracting key prefixes using separators, then count each prefix
 func (c *Counter) countByKeyPrefix(e *decoder.Entry) {
-	// Reset all numbers to 0 - replace all digits in key name (usually IDs) with zeros
-	k := strings.Map(func(c rune) rune {
-		if c >= 48 && c <= 57 { //48 == "0" 57 == "9"
-			return '*'
+	if c.prefixScanner == nil {
+		c.prefixScanner = newPrefixScanner(c.separators)
+	}
+	counts := c.keyPrefixes[e.Type]
+	if counts == nil {
+		counts = map[string]*prefixCount{}
+		c.keyPrefixes[e.Type] = counts
+	}
+	// Iterate through prefixes and count them, the lookup of a prefix
+	// already counted does not allocate
+	c.prefixScanner.each(e.Key, func(prefix []byte) {
+		p := counts[string(prefix)]
+		if p == nil {
+			p = &prefixCount{}
+			counts[string(prefix)] = p
 		}
-		return c
-	}, e.Key)
+		p.add(e)
+	})
+	// 2025-12-25 liyanjing: If different DBs have keys with same prefix, assigning to any single DB is inappropriate
+	// Optimize Memory: Disable DB tracking for prefixes to avoid OOM on large datasets
+	// This saves one string allocation per unique prefix and avoids concatenation overhead.
+	/*
+	if c.keyPrefixDb[key] =="" {
+		c.keyPrefixDb[key] = strconv.Itoa(e.Db)
+	}else {
+		if !strings.Contains(c.keyPrefixDb[key], strconv.Itoa(e.Db)) {
+			c.keyPrefixDb[key] += ","+strconv.Itoa(e.Db)
+		}
+	}
+	*/
+}
 
+// prefixCount totals the keys under a prefix
+type prefixCount struct {
+	bytes     uint64
+	num       uint64
+	encodings map[string]uint64 // bytes per encoding
+}
 
-    // Split key name to extract all prefixes
-	prefixes := getPrefixes(k, c.separators)
-	key := typeKey{
-		Type: e.Type,
-	}
-	// Iterate through prefixes and count them
-	for _, prefix := range prefixes {
-		if len(prefix) == 0 {
-			continue
-		}
-		key.Key = prefix
-		c.keyPrefixBytes[key] += e.Bytes
-		c.keyPrefixNum[key]++
-		 // 2025-12-25 liyanjing: If different DBs have keys with same prefix, assigning to any single DB is inappropriate
-		// Optimize Memory: Disable DB tracking for prefixes to avoid OOM on large datasets
-		// This saves one string allocation per unique prefix and avoids concatenation overhead.
-		/*
-		if c.keyPrefixDb[key] =="" {
-			c.keyPrefixDb[key] = strconv.Itoa(e.Db)
-		}else {
-			if !strings.Contains(c.keyPrefixDb[key], strconv.Itoa(e.Db)) {
-				c.keyPrefixDb[key] += ","+strconv.Itoa(e.Db)
-			}
+func (p *prefixCount) add(e *decoder.Entry) {
+	p.bytes += e.Bytes
+	p.num++
+	if e.Encoding != "" {
+		if p.encodings == nil {
+			p.encodings = map[string]uint64{}
 		}
-		*/
+		p.encodings[e.Encoding] += e.Bytes
 	}
 }
 
+func (p *prefixCount) merge(o *prefixCount) {
+	p.bytes += o.bytes
+	p.num += o.num
+	if o.encodings != nil && p.encodings == nil {
+		p.encodings = map[string]uint64{}
+	}
+	mergeCounts(p.encodings, o.encodings)
+}
+
 func (c *Counter) countBySlot(e *decoder.Entry) {
 	if len(e.Key) > 0 {
 		slot := Slot(e.Key)
@@ -262,21 +473,24 @@ func (c *Counter) countBySlot(e *decoder.Entry) {
 }
 
 func (c *Counter) calcuLargestKeyPrefix(num int) {
-	for key := range c.keyPrefixBytes {
-		k := &PrefixEntry{}
-		k.Type = key.Type
-		k.Key = key.Key
-		k.Bytes = c.keyPrefixBytes[key]
-		k.Num = c.keyPrefixNum[key]
-		k.Db = c.keyPrefixDb[key]
-		delete(c.keyPrefixBytes, key)
-		delete(c.keyPrefixNum, key)
-
-		heap.Push(c.largestKeyPrefixes, k)
-		l := c.largestKeyPrefixes.Len()
-		if l > num {
-			heap.Pop(c.largestKeyPrefixes)
+	for typ, counts := range c.keyPrefixes {
+		for prefix, p := range counts {
+			k := &PrefixEntry{}
+			k.Type = typ
+			k.Key = prefix
+			k.Bytes = p.bytes
+			k.Num = p.num
+			k.Db = c.keyPrefixDb[k.typeKey]
+			k.Encodings = p.encodings
+			delete(counts, prefix)
+
+			heap.Push(c.largestKeyPrefixes, k)
+			l := c.largestKeyPrefixes.Len()
+			if l > num {
+				heap.Pop(c.largestKeyPrefixes)
+			}
 		}
+		delete(c.keyPrefixes, typ)
 	}
 }
 
@@ -317,6 +531,8 @@ type PrefixEntry struct {
 	Bytes uint64
 	Num   uint64
 	Db    string  // Previously was int
+	// Bytes per encoding of the keys under this prefix
+	Encodings map[string]uint64 `json:",omitempty"`
 }
 
 func (h prefixHeap) Len() int {
@@ -362,54 +578,55 @@ func appendIfMissing(slice []int, i int) []int {
 	return append(slice, i)
 }
 
-func removeDuplicatesUnordered(elements []string) []string {
-	encountered := map[string]bool{}
-
-	// Create a map of all unique elements.
-	for v := range elements {
-		encountered[elements[v]] = true
-	}
-
-	// Place all keys from the map into a slice.
-	result := []string{}
-	for key := range encountered {
-		result = append(result, key)
-	}
-	return result
+// prefixScanner splits key names into prefixes. It reuses its buffer, so
+// a key is split without allocating. Separators are ASCII.
+type prefixScanner struct {
+	sep    [256]bool
+	masked []byte
 }
 
-func getPrefixes(s, sep string) []string {
-	res := []string{}
-	sepIdx := strings.IndexAny(s, sep)
-	if sepIdx < 0 {
-		res = append(res, s)
+func newPrefixScanner(sep string) *prefixScanner {
+	p := &prefixScanner{}
+	for i := 0; i < len(sep); i++ {
+		p.sep[sep[i]] = true
 	}
-	for sepIdx > -1 {
-		r := s[:sepIdx+1]
-		if len(res) > 0 {
-			r = res[len(res)-1] + s[:sepIdx+1]
-		}
-		res = append(res, r)
-		s = s[sepIdx+1:]
-		sepIdx = strings.IndexAny(s, sep)
-	}
-	// Trim all suffix of separators
-	for i := range res {
-		for hasAnySuffix(res[i], sep) {
-			res[i] = res[i][:len(res[i])-1]
+	return p
+}
+
+// each masks the digits of a key (usually IDs) and calls fn with each of
+// its prefixes: the key up to every separator, without the trailing
+// separators, or the whole key if it has none. Empty prefixes are left
+// out. prefix is only valid during the call.
+func (p *prefixScanner) each(key string, fn func(prefix []byte)) {
+	// Reset all numbers - replace all digits in key name (usually IDs) with '*'
+	k := append(p.masked[:0], key...)
+	p.masked = k
+	for i, c := range k {
+		if c >= '0' && c <= '9' {
+			k[i] = '*'
 		}
 	}
-	res = removeDuplicatesUnordered(res)
-	return res
-}
 
-func hasAnySuffix(s, suffix string) bool {
-	for _, c := range suffix {
-		if strings.HasSuffix(s, string(c)) {
-			return true
+	// end of the last prefix, the prefixes of consecutive separators are the same
+	last := 0
+	split := false
+	for i, c := range k {
+		if !p.sep[c] {
+			continue
+		}
+		split = true
+		end := i
+		for end > 0 && p.sep[k[end-1]] {
+			end--
+		}
+		if end > last {
+			fn(k[:end])
+			last = end
 		}
 	}
-	return false
+	if !split && len(k) > 0 {
+		fn(k)
+	}
 }
 
 // support for sorting of slots
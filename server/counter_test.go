@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+)
+
+// benchKeys is the number of keys of the generated RDBs
+const benchKeys = 200000
+
+// writeBenchRDB writes an RDB of keys small keys with the names and mix of
+// types of a typical cache: sessions, user hashes, carts, tags and scores
+func writeBenchRDB(tb testing.TB, keys int) string {
+	path := filepath.Join(tb.TempDir(), "bench.rdb")
+	f, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	enc := encoder.NewEncoder(f)
+	check := func(err error) {
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	check(enc.WriteHeader())
+	check(enc.WriteAux("redis-ver", "7.2.4"))
+	check(enc.WriteAux("redis-bits", "64"))
+	check(enc.WriteDBHeader(0, uint64(keys), 0))
+	for i := 0; i < keys; i++ {
+		switch i % 5 {
+		case 0:
+			check(enc.WriteStringObject(fmt.Sprintf("session:%x:token", i*7919), []byte(fmt.Sprintf("token-%d", i)),
+				encoder.WithTTL(1900000000000)))
+		case 1:
+			check(enc.WriteHashMapObject(fmt.Sprintf("user:%d:profile", i), map[string][]byte{
+				"name":  []byte(fmt.Sprintf("user %d", i)),
+				"email": []byte(fmt.Sprintf("user%d@example.com", i)),
+				"age":   []byte(fmt.Sprint(i % 90)),
+			}))
+		case 2:
+			check(enc.WriteListObject(fmt.Sprintf("cart:%d:items", i), [][]byte{[]byte("sku-1"), []byte("sku-2"), []byte(fmt.Sprint(i))}))
+		case 3:
+			check(enc.WriteSetObject(fmt.Sprintf("tags_post_%d", i), [][]byte{[]byte("go"), []byte("redis"), []byte(fmt.Sprint(i % 100))}))
+		default:
+			check(enc.WriteZSetObject(fmt.Sprintf("leaderboard:game-%d:daily", i%1000), []*model.ZSetEntry{
+				{Member: fmt.Sprintf("player:%d", i), Score: float64(i)},
+				{Member: "player:0", Score: 0},
+			}))
+		}
+	}
+	check(enc.WriteEnd())
+	return path
+}
+
+// decodeBenchEntries decodes the generated RDB once, for the benchmarks of
+// the counting alone
+func decodeBenchEntries(tb testing.TB, keys int) []*decoder.Entry {
+	f, err := os.Open(writeBenchRDB(tb, keys))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	d := decoder.NewDecoder()
+	go d.DecodeStream(f)
+	var entries []*decoder.Entry
+	for batch := range d.Entries {
+		entries = append(entries, batch...)
+	}
+	return entries
+}
+
+// reportKeys reports the throughput of a benchmark that handles keys per op
+func reportKeys(b *testing.B, keys int) {
+	b.ReportMetric(float64(keys)*float64(b.N)/b.Elapsed().Seconds(), "keys/s")
+}
+
+// BenchmarkAnalyzeFile decodes and counts a generated RDB, as a job does
+func BenchmarkAnalyzeFile(b *testing.B) {
+	path := writeBenchRDB(b, benchKeys)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		counter, _, err := AnalyzeFile(path, nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if counter.TotalCount != benchKeys {
+			b.Fatalf("counted %d keys, want %d", counter.TotalCount, benchKeys)
+		}
+	}
+	reportKeys(b, benchKeys)
+}
+
+// batches splits entries the way the decoder sends them
+func batches(entries []*decoder.Entry, size int) <-chan []*decoder.Entry {
+	in := make(chan []*decoder.Entry, len(entries)/size+1)
+	for i := 0; i < len(entries); i += size {
+		in <- entries[i:min(i+size, len(entries))]
+	}
+	close(in)
+	return in
+}
+
+// BenchmarkCount counts decoded entries with 1 to 4 shards, without the
+// decoding
+func BenchmarkCount(b *testing.B) {
+	entries := decodeBenchEntries(b, benchKeys)
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				in := batches(entries, 256)
+				b.StartTimer()
+				NewCounter().countShards(in, workers)
+			}
+			reportKeys(b, benchKeys)
+		})
+	}
+}
+
+// BenchmarkCountByKeyPrefix counts the prefixes of decoded entries
+func BenchmarkCountByKeyPrefix(b *testing.B) {
+	entries := decodeBenchEntries(b, benchKeys)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := NewCounter()
+		for _, e := range entries {
+			c.countByKeyPrefix(e)
+		}
+	}
+	reportKeys(b, benchKeys)
+}
+
+func TestPrefixScanner(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{"user:1000:profile", []string{"user", "user:****"}},
+		{"session:ab12cd", []string{"session"}},
+		{"plain", []string{"plain"}},
+		{"order_2024-01-05", []string{"order", "order_****", "order_****-**"}},
+		{"a::b:", []string{"a", "a::b"}},
+		{":leading", nil},
+		{"", nil},
+	}
+	s := newPrefixScanner(defaultSeparators)
+	for _, tt := range tests {
+		var got []string
+		s.each(tt.key, func(prefix []byte) {
+			got = append(got, string(prefix))
+		})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("prefixes of %q = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		s.each("user:1000:profile:settings", func([]byte) {})
+	})
+	if allocs != 0 {
+		t.Errorf("each allocates %.0f times per key", allocs)
+	}
+}
+
+// TestCountShards checks that counting in shards gives the counts of a
+// single counter
+func TestCountShards(t *testing.T) {
+	entries := decodeBenchEntries(t, 5000)
+	one := NewCounter()
+	one.countShards(batches(entries, 256), 1)
+	four := NewCounter()
+	four.countShards(batches(entries, 7), 4)
+
+	if four.TotalCount != 5000 || one.TotalCount != 5000 {
+		t.Fatalf("counted %d and %d keys, want 5000", one.TotalCount, four.TotalCount)
+	}
+	for _, m := range []struct {
+		name      string
+		one, four interface{}
+	}{
+		{"typeBytes", one.typeBytes, four.typeBytes},
+		{"typeNum", one.typeNum, four.typeNum},
+		{"lengthLevelBytes", one.lengthLevelBytes, four.lengthLevelBytes},
+		{"slotBytes", one.slotBytes, four.slotBytes},
+		{"encodingBytes", one.encodingBytes, four.encodingBytes},
+		{"encodingBuckets", one.GetEncodingBuckets(), four.GetEncodingBuckets()},
+		{"fieldTTL", one.fieldTTL, four.fieldTTL},
+		{"largestKeyPrefixes", one.GetLargestKeyPrefixes(), four.GetLargestKeyPrefixes()},
+	} {
+		if !reflect.DeepEqual(m.one, m.four) {
+			t.Errorf("%s differs:\n1 shard:  %v\n4 shards: %v", m.name, m.one, m.four)
+		}
+	}
+
+	// the largest keys are the same sizes, ties may be other keys
+	sizes := func(c *Counter) []uint64 {
+		var res []uint64
+		for _, e := range c.GetLargestEntries(largestEntriesNum, 0) {
+			res = append(res, e.Bytes)
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i] > res[j] })
+		return res
+	}
+	if got, want := sizes(four), sizes(one); !reflect.DeepEqual(got, want) {
+		t.Errorf("largest entries = %v, want %v", got, want)
+	}
+}
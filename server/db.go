@@ -5,6 +5,7 @@ import (
     "encoding/json"
     "fmt"
     "log"
+    "strings"
     "time"
 
     _ "github.com/mattn/go-sqlite3"
@@ -13,15 +14,21 @@ import (
 var db *sql.DB
 
 func InitDB() {
+    initDB("./data/rdr.db")
+}
+
+// initDB opens the database at path, creating its tables
+func initDB(path string) {
     var err error
-    log.Println("Initializing SQLite database at ./data/rdr.db...")
-    db, err = sql.Open("sqlite3", "./data/rdr.db")
+    log.Printf("Initializing SQLite database at %s...", path)
+    db, err = sql.Open("sqlite3", path)
     if err != nil {
         log.Fatal(err)
     }
 
     createTableSQL := `CREATE TABLE IF NOT EXISTS history (
         "id" TEXT PRIMARY KEY,
+        "cluster" TEXT DEFAULT '',
         "namespace" TEXT,
         "pod" TEXT,
         "path" TEXT,
@@ -45,18 +52,22 @@ func InitDB() {
     if err != nil {
         log.Fatal(err)
     }
+    // databases from before multi-cluster support, their rows keep an empty cluster
+    if _, err := db.Exec(`ALTER TABLE history ADD COLUMN "cluster" TEXT DEFAULT ''`); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+        log.Fatal(err)
+    }
     log.Println("Database initialized successfully.")
 }
 
-func SaveAnalysis(id string, ns, pod, path string, counter *Counter) error {
-    log.Printf("Saving analysis to DB: %s (ns=%s, pod=%s, path=%s)", id, ns, pod, path)
+func SaveAnalysis(id string, cluster, ns, pod, path string, counter *Counter) error {
+    log.Printf("Saving analysis to DB: %s (cluster=%s, ns=%s, pod=%s, path=%s)", id, cluster, ns, pod, path)
     dto := counter.ToDTO()
     data, err := json.Marshal(dto)
     if err != nil {
         return err
     }
 
-    stmt, err := db.Prepare("INSERT OR REPLACE INTO history(id, namespace, pod, path, data, date) values(?,?,?,?,?,?)")
+    stmt, err := db.Prepare("INSERT OR REPLACE INTO history(id, cluster, namespace, pod, path, data, date) values(?,?,?,?,?,?,?)")
     if err != nil {
         return err
     }
@@ -64,7 +75,7 @@ func SaveAnalysis(id string, ns, pod, path string, counter *Counter) error {
     
     dateStr := time.Now().Format("2006-0102")
 
-    _, err = stmt.Exec(id, ns, pod, path, data, dateStr)
+    _, err = stmt.Exec(id, cluster, ns, pod, path, data, dateStr)
     if err == nil {
         log.Println("Analysis saved to DB successfully.")
     }
@@ -73,7 +84,7 @@ func SaveAnalysis(id string, ns, pod, path string, counter *Counter) error {
 
 func LoadHistory() {
     log.Println("Loading history from DB...")
-    rows, err := db.Query("SELECT id, data FROM history")
+    rows, err := db.Query("SELECT id, cluster, namespace, pod, data FROM history")
     if err != nil {
         log.Println("Error loading history:", err)
         return
@@ -83,8 +94,9 @@ func LoadHistory() {
     count := 0
     for rows.Next() {
         var id string
+        var cluster, ns, pod sql.NullString
         var data []byte
-        err = rows.Scan(&id, &data)
+        err = rows.Scan(&id, &cluster, &ns, &pod, &data)
         if err != nil {
             log.Println(err)
             continue
@@ -98,15 +110,35 @@ func LoadHistory() {
 
         counter := dto.ToCounter()
         counters.Set(id, counter)
+        instanceInfo.Set(id, InstanceInfo{ID: id, Cluster: cluster.String, Namespace: ns.String, Pod: pod.String})
         count++
     }
     log.Printf("Loaded %d analysis records from history.", count)
 }
 
-func GetNextID(ns, pod string) string {
+// LoadAnalysis reads a single stored analysis
+func LoadAnalysis(id string) (*Counter, error) {
+    var data []byte
+    err := db.QueryRow("SELECT data FROM history WHERE id = ?", id).Scan(&data)
+    if err == sql.ErrNoRows {
+        return nil, fmt.Errorf("analysis %q not found", id)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var dto CounterDTO
+    if err := json.Unmarshal(data, &dto); err != nil {
+        return nil, fmt.Errorf("failed to unmarshal data for %s: %v", id, err)
+    }
+    return dto.ToCounter(), nil
+}
+
+// GetNextID returns the next ID of an analysis: cluster_ns_pod_date_NN
+func GetNextID(cluster, ns, pod string) string {
     dateStr := time.Now().Format("2006-0102")
-    // Pattern: ns_pod_date_%
-    prefix := fmt.Sprintf("%s_%s_%s", ns, pod, dateStr)
+    // Pattern: cluster_ns_pod_date_%
+    prefix := fmt.Sprintf("%s_%s_%s_%s", clusterID(cluster), ns, pod, dateStr)
     
     // We want to find max number for this prefix.
     // Querying by ID LIKE prefix + '_' + '%'
@@ -140,11 +172,24 @@ func GetNextID(ns, pod string) string {
     return fmt.Sprintf("%s_%02d", prefix, maxN+1)
 }
 
-func GetDiscoveryCache() ([]byte, error) {
+// clusterID is the cluster name as used in analysis IDs: characters other
+// than letters, digits, '-' and '.' (e.g. in EKS ARNs or GKE names) become '-'
+func clusterID(cluster string) string {
+    return strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+            return r
+        }
+        return '-'
+    }, cluster)
+}
+
+// GetDiscoveryCache returns the discovery result cached under key, e.g.
+// k8s_resources:<cluster>
+func GetDiscoveryCache(key string) ([]byte, error) {
     var data []byte
     var updatedAt time.Time
     // check if data exists
-    row := db.QueryRow("SELECT data, updated_at FROM discovery_cache WHERE key = 'k8s_resources'")
+    row := db.QueryRow("SELECT data, updated_at FROM discovery_cache WHERE key = ?", key)
     if err := row.Scan(&data, &updatedAt); err != nil {
         return nil, err
     }
@@ -156,12 +201,12 @@ func GetDiscoveryCache() ([]byte, error) {
     return data, nil
 }
 
-func SaveDiscoveryCache(data []byte) error {
-    stmt, err := db.Prepare("INSERT OR REPLACE INTO discovery_cache(key, data, updated_at) values('k8s_resources', ?, CURRENT_TIMESTAMP)")
+func SaveDiscoveryCache(key string, data []byte) error {
+    stmt, err := db.Prepare("INSERT OR REPLACE INTO discovery_cache(key, data, updated_at) values(?, ?, CURRENT_TIMESTAMP)")
     if err != nil {
          return err
     }
     defer stmt.Close()
-    _, err = stmt.Exec(data)
+    _, err = stmt.Exec(key, data)
     return err
 }
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package server
+
+import "errors"
+
+// diskFree is not supported on this platform, the disk check is skipped
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
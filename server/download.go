@@ -0,0 +1,313 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+	"golang.org/x/time/rate"
+)
+
+// maxBackoff caps the wait between two attempts of a download
+const maxBackoff = 30 * time.Second
+
+// codecScript prints the first of the compressors "$@" the container has
+const codecScript = `for c in "$@"; do command -v "$c" >/dev/null 2>&1 && echo "$c" && exit 0; done; true`
+
+// compressScript runs a command, compressing its output with compressor $1
+const compressScript = `c=$1; shift; "$@" | "$c" -1 -c`
+
+// DownloadOptions tune Download, zero values are the defaults
+type DownloadOptions struct {
+	Retries     int           // attempts after the first, default GetTransferRetries()
+	Backoff     time.Duration // wait before the first retry, doubled after each, default 1s
+	RateLimit   int64         // bytes per second of this download, 0 for none; TRANSFER_RATE_LIMIT applies as well
+	Compression string        // auto, zstd, gzip or none, default GetTransferCompression()
+	Status      func(msg string)
+	Progress    func(done, total int64) // bytes of the file written locally
+}
+
+// errCorrupt is a copy that does not match the file in the pod
+var errCorrupt = errors.New("corrupt copy")
+
+// transfer runs the commands of a download in a container
+type transfer struct {
+	ctx                       context.Context
+	kube                      KubeClient
+	namespace, pod, container string
+	codec                     string // the compressor of the container, empty for none
+	limiter                   *rate.Limiter
+	progress                  func(done, total int64)
+}
+
+// Download copies a file out of a container like CopyFromPod, with retries.
+// An interrupted copy resumes at the end of the local file, unless the file
+// in the pod changed meanwhile. The copy is verified against the sha256sum
+// of the pod if available, and the CRC64 of the RDB. It returns warnings
+// about checks that could not be made.
+func Download(ctx context.Context, kube KubeClient, namespace, pod, container string, rf *RemoteFile, localPath string, opts DownloadOptions) ([]string, error) {
+	if opts.Retries == 0 {
+		opts.Retries = GetTransferRetries()
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Compression == "" {
+		opts.Compression = GetTransferCompression()
+	}
+	status := func(format string, args ...interface{}) {
+		if opts.Status != nil {
+			opts.Status(fmt.Sprintf(format, args...))
+		}
+	}
+	t := &transfer{ctx: ctx, kube: kube, namespace: namespace, pod: pod, container: container, limiter: newLimiter(opts.RateLimit), progress: opts.Progress}
+	if t.codec = t.negotiate(opts.Compression); t.codec != "" {
+		status("Copying %s (%s on the wire)...", rf.Path, t.codec)
+	}
+
+	backoff := opts.Backoff
+	for attempt := 0; ; attempt++ {
+		var warnings []string
+		var err error
+		if rf.IsDir {
+			// an appendonlydir is small next to its base RDB, it is copied again
+			os.RemoveAll(localPath)
+			err = copyDirFromPod(func(command []string, w io.Writer) error {
+				return t.stream(command, t.progressWriter(w, 0, rf.Size))
+			}, rf.Path, localPath)
+		} else {
+			warnings, err = t.downloadFile(rf, localPath)
+		}
+		if err == nil {
+			return warnings, nil
+		}
+		if attempt >= opts.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		// The file in the pod may have been rewritten by a BGSAVE: a partial
+		// copy of the old one cannot be resumed
+		current, statErr := StatRemote(ctx, kube, namespace, pod, container, rf.Path)
+		if statErr == nil && (current.Size != rf.Size || !current.ModTime.Equal(rf.ModTime)) {
+			*rf = *current
+			os.Remove(localPath)
+			status("%s changed in the pod, restarting the copy (attempt %d/%d)", rf.Path, attempt+2, opts.Retries+1)
+		} else if errors.Is(err, errCorrupt) {
+			os.Remove(localPath)
+			status("Copy failed verification, restarting (attempt %d/%d): %v", attempt+2, opts.Retries+1, err)
+		} else if done := localSize(localPath); done > 0 && !rf.IsDir {
+			status("Copy interrupted at %s of %s, resuming (attempt %d/%d): %v", formatBytes(done), formatBytes(rf.Size), attempt+2, opts.Retries+1, err)
+		} else {
+			status("Copy failed, retrying (attempt %d/%d): %v", attempt+2, opts.Retries+1, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// negotiate returns the compressor of mode the container has, empty for none
+func (t *transfer) negotiate(mode string) string {
+	candidates := []string{mode}
+	switch mode {
+	case "none":
+		return ""
+	case "auto":
+		candidates = []string{"zstd", "gzip"}
+	}
+	var out bytes.Buffer
+	command := append([]string{"sh", "-c", codecScript, "sh"}, candidates...)
+	if err := t.kube.Exec(t.ctx, t.namespace, t.pod, t.container, command, nil, &out); err != nil {
+		return ""
+	}
+	codec := strings.TrimSpace(out.String())
+	for _, c := range candidates {
+		if c == codec {
+			return codec
+		}
+	}
+	return ""
+}
+
+// stream runs a command in the container, writing its output to w. The
+// output is compressed on the wire with the codec of the transfer, and
+// throttled to its rate limits.
+func (t *transfer) stream(command []string, w io.Writer) error {
+	if t.codec == "" {
+		return t.kube.Exec(t.ctx, t.namespace, t.pod, t.container, command, nil, throttle(t.ctx, w, t.limiter, transferLimiter()))
+	}
+	command = append([]string{"sh", "-c", compressScript, "sh", t.codec}, command...)
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := decompress(t.codec, pr, w)
+		// unblock the exec if decompression stopped early
+		pr.CloseWithError(io.ErrClosedPipe)
+		errc <- err
+	}()
+	err := t.kube.Exec(t.ctx, t.namespace, t.pod, t.container, command, nil, throttle(t.ctx, pw, t.limiter, transferLimiter()))
+	pw.CloseWithError(err)
+	if decompressErr := <-errc; err == nil {
+		err = decompressErr
+	}
+	return err
+}
+
+func decompress(codec string, r io.Reader, w io.Writer) error {
+	var dec io.Reader
+	switch codec {
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("gzip: %w", err)
+		}
+		defer gz.Close()
+		dec = gz
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+		defer zr.Close()
+		dec = zr
+	default:
+		return fmt.Errorf("unknown compression %q", codec)
+	}
+	if _, err := io.Copy(w, dec); err != nil {
+		return fmt.Errorf("%s: %w", codec, err)
+	}
+	return nil
+}
+
+// progressWriter reports the progress of a transfer of total bytes through
+// w, after done bytes
+func (t *transfer) progressWriter(w io.Writer, done, total int64) io.Writer {
+	if t.progress == nil {
+		return w
+	}
+	return &progressWriter{w: w, done: done, progress: func(done int64) { t.progress(done, total) }}
+}
+
+// downloadFile copies the rest of a file after the local part, then
+// verifies the whole
+func (t *transfer) downloadFile(rf *RemoteFile, localPath string) ([]string, error) {
+	offset := localSize(localPath)
+	if offset > rf.Size {
+		os.Remove(localPath)
+		offset = 0
+	}
+	if offset < rf.Size {
+		f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		// tail -c, which busybox and coreutils both have, resumes a copy
+		command := []string{"cat", rf.Path}
+		if offset > 0 {
+			command = []string{"tail", "-c", "+" + strconv.FormatInt(offset+1, 10), rf.Path}
+		}
+		err = t.stream(command, t.progressWriter(f, offset, rf.Size))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// an empty file in the pod still creates the local one
+		f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	if size := localSize(localPath); size != rf.Size {
+		return nil, fmt.Errorf("copied %d of %d bytes", size, rf.Size)
+	}
+	return verifyFile(t.ctx, t.kube, t.namespace, t.pod, t.container, rf.Path, localPath)
+}
+
+// verifyFile compares a copy with the sha256sum of the pod, and checks the
+// CRC64 trailer of an RDB. An RDB that fails only the CRC64 is corrupt in
+// the pod as well, which is a warning.
+func verifyFile(ctx context.Context, kube KubeClient, namespace, pod, container, path, localPath string) ([]string, error) {
+	var warnings []string
+	remote, err := remoteSHA256(ctx, kube, namespace, pod, container, path)
+	verified := err == nil
+	if err != nil {
+		var execErr *ExecError
+		if !errors.As(err, &execErr) || execErr.Code < 0 {
+			return nil, err
+		}
+		warnings = append(warnings, fmt.Sprintf("sha256sum is not available in the pod (%v), the copy was checked by size only", err))
+	} else {
+		local, err := fileSHA256(localPath)
+		if err != nil {
+			return nil, err
+		}
+		if local != remote {
+			return nil, fmt.Errorf("%w: sha256 %s, the pod has %s", errCorrupt, local, remote)
+		}
+	}
+
+	switch checksum, err := decoder.FileChecksum(localPath); {
+	case err != nil:
+		return nil, err
+	case checksum == decoder.ChecksumMismatch && verified:
+		warnings = append(warnings, "The RDB in the pod fails its CRC64 check, the analysis may be partial")
+	case checksum == decoder.ChecksumMismatch:
+		return nil, fmt.Errorf("%w: RDB CRC64 mismatch", errCorrupt)
+	}
+	return warnings, nil
+}
+
+func remoteSHA256(ctx context.Context, kube KubeClient, namespace, pod, container, path string) (string, error) {
+	var out bytes.Buffer
+	if err := kube.Exec(ctx, namespace, pod, container, []string{"sha256sum", path}, nil, &out); err != nil {
+		return "", err
+	}
+	sum, _, _ := strings.Cut(strings.TrimSpace(out.String()), " ")
+	if len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid sha256sum output: %q", out.String())
+	}
+	return strings.ToLower(sum), nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localSize is the size of a local file, 0 if it does not exist
+func localSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+)
+
+// encodingBucketKey groups keys of the same type and encoding with a
+// similar shape, see bucketCeil
+type encodingBucketKey struct {
+	Type     string
+	Encoding string
+	Elems    uint64
+	Len      uint64
+	AllInts  bool
+}
+
+// EncodingBucket is a histogram bucket of key shapes. The what-if
+// simulator re-evaluates every bucket under other thresholds, splitting
+// the keys of a bucket whose shapes fall on both sides of one.
+type EncodingBucket struct {
+	Type      string
+	Encoding  string
+	MinElems  uint64 // smallest element count of the keys
+	MaxElems  uint64 // largest element count of the keys
+	MinLen    uint64 // smallest longest element of the keys
+	MaxLen    uint64 // largest longest element of the keys
+	AllInts   bool
+	Keys      uint64
+	Bytes     uint64
+	Elems     uint64
+	ElemBytes uint64
+	FieldTTLs uint64 `json:",omitempty"` // hash fields with a TTL
+}
+
+// bucketCeil rounds n up to the bound of its bucket: n itself up to 16,
+// then a quarter of a power of two (20, 24, 28, 32, 40, ...), so a bucket
+// spans at most 25% of its values
+func bucketCeil(n uint64) uint64 {
+	if n <= 16 {
+		return n
+	}
+	w := uint64(1) << uint(bits.Len64(n-1)-3)
+	return (n + w - 1) / w * w
+}
+
+func (k encodingBucketKey) bucket() *EncodingBucket {
+	return &EncodingBucket{
+		Type:     k.Type,
+		Encoding: k.Encoding,
+		AllInts:  k.AllInts,
+	}
+}
+
+// key is the key of the bucket in a Counter
+func (b *EncodingBucket) key() encodingBucketKey {
+	return encodingBucketKey{
+		Type:     b.Type,
+		Encoding: b.Encoding,
+		Elems:    bucketCeil(b.MaxElems),
+		Len:      bucketCeil(b.MaxLen),
+		AllInts:  b.AllInts,
+	}
+}
+
+// add counts the key of e in the bucket
+func (b *EncodingBucket) add(e *decoder.Entry) {
+	if b.Keys == 0 || e.NumOfElem < b.MinElems {
+		b.MinElems = e.NumOfElem
+	}
+	if b.Keys == 0 || e.MaxElemLen < b.MinLen {
+		b.MinLen = e.MaxElemLen
+	}
+	b.MaxElems = max(b.MaxElems, e.NumOfElem)
+	b.MaxLen = max(b.MaxLen, e.MaxElemLen)
+	b.Keys++
+	b.Bytes += e.Bytes
+	b.Elems += e.NumOfElem
+	b.ElemBytes += e.ElemBytes
+	b.FieldTTLs += e.Shape().FieldTTLs
+}
+
+// merge adds the keys of o, a bucket of the same key
+func (b *EncodingBucket) merge(o *EncodingBucket) {
+	b.MinElems = min(b.MinElems, o.MinElems)
+	b.MaxElems = max(b.MaxElems, o.MaxElems)
+	b.MinLen = min(b.MinLen, o.MinLen)
+	b.MaxLen = max(b.MaxLen, o.MaxLen)
+	b.Keys += o.Keys
+	b.Bytes += o.Bytes
+	b.Elems += o.Elems
+	b.ElemBytes += o.ElemBytes
+	b.FieldTTLs += o.FieldTTLs
+}
+
+// shapeAt is the shape of a key of the bucket a fraction t of the way from
+// its smallest shape to its largest
+func (b *EncodingBucket) shapeAt(t float64) decoder.Shape {
+	lerp := func(lo, hi uint64) uint64 {
+		if hi <= lo {
+			return hi
+		}
+		return lo + uint64(t*float64(hi-lo)+0.5)
+	}
+	s := decoder.Shape{
+		Type:       b.Type,
+		Elems:      lerp(b.MinElems, b.MaxElems),
+		MaxElemLen: lerp(b.MinLen, b.MaxLen),
+		AllInts:    b.AllInts,
+		FieldTTLs:  b.FieldTTLs / b.Keys,
+	}
+	if b.Elems > 0 {
+		s.ElemBytes = uint64(float64(s.Elems) * float64(b.ElemBytes) / float64(b.Elems))
+	}
+	return s
+}
+
+// thresholds returns where, from 0 to 1 as in shapeAt, the encoding the
+// rules infer changes within the bucket
+func (b *EncodingBucket) thresholds(rules decoder.EncodingRules) []float64 {
+	var ts []float64
+	from, enc, last := 0.0, rules.Infer(b.shapeAt(0)), rules.Infer(b.shapeAt(1))
+	// a key converts at most twice, from intset to listpack to hashtable
+	for enc != last && len(ts) < 2 {
+		lo, hi := from, 1.0
+		for i := 0; i < 40; i++ {
+			mid := (lo + hi) / 2
+			if rules.Infer(b.shapeAt(mid)) == enc {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		ts = append(ts, hi)
+		from, enc = hi, rules.Infer(b.shapeAt(hi))
+	}
+	return ts
+}
+
+// bucketPart is a share of the keys of a bucket that have one encoding
+// under each of the rules a bucket is split with
+type bucketPart struct {
+	Keys      uint64
+	Bytes     uint64
+	Shape     decoder.Shape // average shape of the keys, for the estimates
+	Encodings []string      // inferred by each of the rules
+}
+
+// split splits the keys of the bucket at the thresholds of the rules. The
+// keys are taken as spread evenly between the smallest and the largest
+// shape of the bucket, which the bucket bounds to 25% of its values.
+func (b *EncodingBucket) split(rules ...decoder.EncodingRules) []bucketPart {
+	ts := []float64{0, 1}
+	for _, r := range rules {
+		ts = append(ts, b.thresholds(r)...)
+	}
+	sort.Float64s(ts)
+
+	var parts []bucketPart
+	var keys, bytes uint64
+	for i := 1; i < len(ts); i++ {
+		if ts[i] == ts[i-1] {
+			continue
+		}
+		// rounded on the running total, so the parts add up to the bucket
+		p := bucketPart{
+			Keys:  uint64(ts[i]*float64(b.Keys)+0.5) - keys,
+			Bytes: uint64(ts[i]*float64(b.Bytes)+0.5) - bytes,
+			Shape: b.shapeAt((ts[i-1] + ts[i]) / 2),
+		}
+		keys += p.Keys
+		bytes += p.Bytes
+		if p.Keys == 0 {
+			continue
+		}
+		for _, r := range rules {
+			p.Encodings = append(p.Encodings, r.Infer(p.Shape))
+		}
+		parts = append(parts, p)
+	}
+	if len(parts) == 1 {
+		parts[0].Shape.Elems = b.Elems / b.Keys
+		parts[0].Shape.ElemBytes = b.ElemBytes / b.Keys
+	}
+	return parts
+}
+
+func (c *Counter) countByEncoding(e *decoder.Entry) {
+	if e.Encoding == "" {
+		return
+	}
+	key := typeKey{Type: e.Type, Key: e.Encoding}
+	c.encodingNum[key]++
+	c.encodingBytes[key] += e.Bytes
+
+	bk := encodingBucketKey{
+		Type:     e.Type,
+		Encoding: e.Encoding,
+		Elems:    bucketCeil(e.NumOfElem),
+		Len:      bucketCeil(e.MaxElemLen),
+		AllInts:  e.AllInts,
+	}
+	b := c.encodingBuckets[bk]
+	if b == nil {
+		b = bk.bucket()
+		c.encodingBuckets[bk] = b
+	}
+	b.add(e)
+}
+
+// GetEncodingBuckets returns the shape histogram sorted by type and encoding
+func (c *Counter) GetEncodingBuckets() []*EncodingBucket {
+	res := make([]*EncodingBucket, 0, len(c.encodingBuckets))
+	for _, b := range c.encodingBuckets {
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Type != res[j].Type {
+			return res[i].Type < res[j].Type
+		}
+		if res[i].Encoding != res[j].Encoding {
+			return res[i].Encoding < res[j].Encoding
+		}
+		if res[i].MaxElems != res[j].MaxElems {
+			return res[i].MaxElems < res[j].MaxElems
+		}
+		return res[i].MaxLen < res[j].MaxLen
+	})
+	return res
+}
+
+// GetEncodingCount returns keys and bytes per type and encoding
+func (c *Counter) GetEncodingCount() (map[string]map[string]uint64, map[string]map[string]uint64) {
+	num := map[string]map[string]uint64{}
+	size := map[string]map[string]uint64{}
+	for k, v := range c.encodingNum {
+		if num[k.Type] == nil {
+			num[k.Type] = map[string]uint64{}
+			size[k.Type] = map[string]uint64{}
+		}
+		num[k.Type][k.Key] = v
+		size[k.Type][k.Key] = c.encodingBytes[k]
+	}
+	return num, size
+}
+
+// Profile returns the memory profile the keys were sized with. Analyses
+// stored before profiles existed fall back to the one matching the RDB.
+func (c *Counter) Profile() decoder.MemoryProfile {
+	if p, err := decoder.ParseProfile(c.profile); err == nil {
+		return p
+	}
+	if c.meta != nil {
+		return decoder.SelectProfile(c.meta)
+	}
+	return decoder.LookupProfile("redis", decoder.ParseRedisVersion(c.redisVersion))
+}
+
+// EncodingRules returns the default rules of the Redis version that wrote the RDB
+func (c *Counter) EncodingRules() decoder.EncodingRules {
+	return c.Profile().EncodingRules()
+}
+
+// WhatIfType is the simulated outcome for one key type
+type WhatIfType struct {
+	Keys          uint64
+	Bytes         uint64
+	ConvertedKeys uint64
+	Delta         int64             // estimated change in bytes, negative is a saving
+	Conversions   map[string]uint64 // "from->to" to number of keys
+}
+
+// WhatIfResult is the outcome of re-encoding the dataset under other rules
+type WhatIfResult struct {
+	RedisVersion  string
+	Rules         decoder.EncodingRules
+	Types         map[string]*WhatIfType
+	TotalBytes    uint64
+	ConvertedKeys uint64
+	Delta         int64
+}
+
+// SimulateEncoding estimates the memory change if the keys were loaded with
+// the given thresholds. A bucket whose keys fall on both sides of a
+// threshold is split at it, see EncodingBucket.split.
+func (c *Counter) SimulateEncoding(rules decoder.EncodingRules) *WhatIfResult {
+	m := decoder.NewMemProfiler(c.Profile())
+	baseline := c.EncodingRules()
+	res := &WhatIfResult{
+		RedisVersion: c.redisVersion,
+		Rules:        rules,
+		Types:        map[string]*WhatIfType{},
+	}
+	for _, b := range c.encodingBuckets {
+		t := res.Types[b.Type]
+		if t == nil {
+			t = &WhatIfType{Conversions: map[string]uint64{}}
+			res.Types[b.Type] = t
+		}
+		t.Keys += b.Keys
+		t.Bytes += b.Bytes
+		res.TotalBytes += b.Bytes
+
+		for _, p := range b.split(rules, baseline) {
+			to := p.Encodings[0]
+			if to == "" || to == p.Encodings[1] || to == b.Encoding {
+				continue
+			}
+			before := m.EstimateEncodingBytes(p.Shape, b.Encoding, baseline)
+			after := m.EstimateEncodingBytes(p.Shape, to, rules)
+			delta := (int64(after) - int64(before)) * int64(p.Keys)
+
+			t.ConvertedKeys += p.Keys
+			t.Delta += delta
+			t.Conversions[b.Encoding+"->"+to] += p.Keys
+			res.ConvertedKeys += p.Keys
+			res.Delta += delta
+		}
+	}
+	return res
+}
+
+// parseEncodingRules overrides the thresholds in r with the query parameters
+// named after the redis.conf settings
+func parseEncodingRules(r *http.Request, rules decoder.EncodingRules) (decoder.EncodingRules, error) {
+	q := r.URL.Query()
+	uints := map[string]*uint64{
+		"hash-max-listpack-entries": &rules.HashMaxListpackEntries,
+		"hash-max-listpack-value":   &rules.HashMaxListpackValue,
+		"zset-max-listpack-entries": &rules.ZSetMaxListpackEntries,
+		"zset-max-listpack-value":   &rules.ZSetMaxListpackValue,
+		"set-max-intset-entries":    &rules.SetMaxIntsetEntries,
+		"set-max-listpack-entries":  &rules.SetMaxListpackEntries,
+		"set-max-listpack-value":    &rules.SetMaxListpackValue,
+	}
+	for name, dst := range uints {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return rules, err
+			}
+			*dst = n
+		}
+	}
+	if v := q.Get("list-max-listpack-size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return rules, err
+		}
+		rules.ListMaxListpackSize = n
+	}
+	return rules, nil
+}
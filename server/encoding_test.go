@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+)
+
+// hashCounter counts a hash of each element count from lo to hi
+func hashCounter(encoding string, lo, hi uint64) *Counter {
+	c := NewCounter()
+	c.redisVersion = "7.2.4"
+	for n := lo; n <= hi; n++ {
+		c.countByEncoding(&decoder.Entry{
+			Key:        "h",
+			Type:       "hash",
+			Encoding:   encoding,
+			Bytes:      n * 40,
+			NumOfElem:  n,
+			ElemBytes:  n * 20,
+			MaxElemLen: 10,
+		})
+	}
+	return c
+}
+
+func TestBucketCeil(t *testing.T) {
+	for n, want := range map[uint64]uint64{
+		0: 0, 1: 1, 16: 16, 17: 20, 20: 20, 33: 40, 70: 80, 600: 640, 1000: 1024, 1025: 1280,
+	} {
+		if got := bucketCeil(n); got != want {
+			t.Errorf("bucketCeil(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+// TestSimulateEncodingThreshold checks thresholds that are not powers of
+// two, within and across buckets
+func TestSimulateEncodingThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		counter   *Counter
+		entries   uint64 // hash-max-listpack-entries
+		converted uint64
+		to        string
+	}{
+		{"600 elements under 1000", hashCounter("hashtable", 600, 600), 1000, 1, "hashtable->listpack"},
+		{"70 elements under 100", hashCounter("listpack", 70, 70), 100, 0, ""},
+		{"70 elements over 50", hashCounter("listpack", 70, 70), 50, 1, "listpack->hashtable"},
+		// the 7.2 default of 128 already makes them hashtables
+		{"200 elements over 150", hashCounter("hashtable", 200, 200), 150, 0, ""},
+		// 900 to 1000 of 900 to 1100
+		{"threshold inside a bucket", hashCounter("hashtable", 900, 1100), 1000, 101, "hashtable->listpack"},
+	}
+	for _, tt := range tests {
+		rules := tt.counter.EncodingRules()
+		rules.HashMaxListpackEntries = tt.entries
+		res := tt.counter.SimulateEncoding(rules)
+		if res.ConvertedKeys != tt.converted {
+			t.Errorf("%s: %d keys converted, want %d", tt.name, res.ConvertedKeys, tt.converted)
+		}
+		if tt.to != "" && res.Types["hash"].Conversions[tt.to] != tt.converted {
+			t.Errorf("%s: conversions %v, want %d %s", tt.name, res.Types["hash"].Conversions, tt.converted, tt.to)
+		}
+	}
+}
+
+// TestEncodingBucketSplit checks that the parts of a bucket add up to it
+func TestEncodingBucketSplit(t *testing.T) {
+	c := hashCounter("hashtable", 900, 1020)
+	if len(c.encodingBuckets) != 1 {
+		t.Fatalf("%d buckets, want 1", len(c.encodingBuckets))
+	}
+	rules := c.EncodingRules()
+	rules.HashMaxListpackEntries = 950
+	for _, b := range c.encodingBuckets {
+		parts := b.split(rules)
+		if len(parts) != 2 {
+			t.Fatalf("%d parts, want 2: %+v", len(parts), parts)
+		}
+		if parts[0].Keys != 51 || parts[0].Encodings[0] != "listpack" || parts[1].Encodings[0] != "hashtable" {
+			t.Errorf("parts = %+v, want 51 listpack keys first", parts)
+		}
+		if parts[0].Keys+parts[1].Keys != b.Keys || parts[0].Bytes+parts[1].Bytes != b.Bytes {
+			t.Errorf("parts = %+v, do not add up to %d keys and %d bytes", parts, b.Keys, b.Bytes)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// IngestSchemaVersion is the version of IngestRequest and CounterDTO, bumped
+// when either changes in a way an older server or agent cannot read
+const IngestSchemaVersion = 1
+
+// maxIngestSize is the largest decompressed ingest request
+const maxIngestSize = 256 << 20
+
+// IngestRequest is an analysis made by an agent next to Redis
+type IngestRequest struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	AgentVersion  string    `json:"agentVersion,omitempty"`
+	Cluster       string    `json:"cluster"` // empty for the cluster of the server
+	Namespace     string    `json:"namespace"`
+	Pod           string    `json:"pod"`
+	Path          string    `json:"path"`
+	Size          int64     `json:"size"`    // of the RDB file or appendonlydir
+	ModTime       time.Time `json:"modTime"` // of the RDB file
+	Format        string    `json:"format,omitempty"`
+	// Analysis is a CounterDTO, decoded once the schema version is checked
+	Analysis json.RawMessage `json:"analysis"`
+}
+
+// IngestResponse is the ID the analysis is stored under
+type IngestResponse struct {
+	ID string `json:"id"`
+}
+
+// ingestHandler serves POST /api/ingest, authenticated with the INGEST_TOKEN
+// bearer token. The body may be gzipped.
+func ingestHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token := GetIngestToken()
+	if token == "" {
+		http.Error(w, "Ingest is disabled, set INGEST_TOKEN on the server", http.StatusNotFound)
+		return
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Invalid ingest token", http.StatusUnauthorized)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	var req IngestRequest
+	if err := json.NewDecoder(io.LimitReader(body, maxIngestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid ingest request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.SchemaVersion != IngestSchemaVersion {
+		http.Error(w, fmt.Sprintf("Schema version %d is not supported, this server accepts %d: upgrade the agent or the server", req.SchemaVersion, IngestSchemaVersion), http.StatusConflict)
+		return
+	}
+	if req.Namespace == "" || req.Pod == "" || len(req.Analysis) == 0 {
+		http.Error(w, "namespace, pod and analysis are required", http.StatusBadRequest)
+		return
+	}
+	var dto CounterDTO
+	if err := json.Unmarshal(req.Analysis, &dto); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid analysis: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	id, err := ingest(&req, &dto)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(IngestResponse{ID: id})
+}
+
+// ingest stores the analysis of an agent like the one of a job
+func ingest(req *IngestRequest, dto *CounterDTO) (string, error) {
+	cluster := req.Cluster
+	if cluster == "" {
+		cluster = GetClusterName()
+	}
+	id := GetNextID(cluster, req.Namespace, req.Pod)
+	log.Printf("[Ingest %s] %s from agent %s (%s, written %s)", id, req.Path, req.AgentVersion, FormatSize(req.Size), req.ModTime.Format(time.RFC3339))
+
+	counter := dto.ToCounter()
+	if err := SaveAnalysis(id, cluster, req.Namespace, req.Pod, req.Path, counter); err != nil {
+		return "", fmt.Errorf("failed to save result: %v", err)
+	}
+	counters.Set(id, counter)
+	instanceInfo.Set(id, InstanceInfo{ID: id, Cluster: cluster, Namespace: req.Namespace, Pod: req.Pod})
+	return id, nil
+}
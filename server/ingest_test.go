@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+)
+
+// ingestServer serves /api/ingest with a database of its own
+func ingestServer(t *testing.T, token string) *httptest.Server {
+	t.Setenv("INGEST_TOKEN", token)
+	t.Setenv("CLUSTER_NAME", "prod eu")
+	initDB(filepath.Join(t.TempDir(), "rdr.db"))
+	t.Cleanup(func() { db.Close() })
+	router := httprouter.New()
+	router.POST("/api/ingest", ingestHandler)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// ingestRequest is an analysis of a key of each type
+func ingestRequest(t *testing.T, schemaVersion int) *IngestRequest {
+	c := NewCounter()
+	for _, typ := range []string{"string", "hash", "list"} {
+		c.count(&decoder.Entry{Key: "user:" + typ, Type: typ, Bytes: 100, NumOfElem: 2})
+	}
+	analysis, err := json.Marshal(c.ToDTO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &IngestRequest{
+		SchemaVersion: schemaVersion,
+		AgentVersion:  "test",
+		Namespace:     "cache",
+		Pod:           "redis-0",
+		Path:          "/data/dump.rdb",
+		Size:          1 << 20,
+		ModTime:       time.Unix(1750000000, 0),
+		Analysis:      analysis,
+	}
+}
+
+func TestIngestHandler(t *testing.T) {
+	srv := ingestServer(t, "s3cret")
+	body := func(req *IngestRequest) []byte {
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := []struct {
+		name   string
+		auth   string
+		gzip   bool
+		body   []byte
+		status int
+	}{
+		{name: "no token", body: body(ingestRequest(t, IngestSchemaVersion)), status: http.StatusUnauthorized},
+		{name: "wrong token", auth: "Bearer guess", body: body(ingestRequest(t, IngestSchemaVersion)), status: http.StatusUnauthorized},
+		{name: "not a bearer token", auth: "s3cret", body: body(ingestRequest(t, IngestSchemaVersion)), status: http.StatusUnauthorized},
+		{name: "newer schema", auth: "Bearer s3cret", body: body(ingestRequest(t, IngestSchemaVersion+1)), status: http.StatusConflict},
+		{name: "not JSON", auth: "Bearer s3cret", body: []byte("dump.rdb"), status: http.StatusBadRequest},
+		{name: "not gzipped", auth: "Bearer s3cret", gzip: true, body: body(ingestRequest(t, IngestSchemaVersion)), status: http.StatusBadRequest},
+		{name: "valid", auth: "Bearer s3cret", body: body(ingestRequest(t, IngestSchemaVersion)), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/ingest", bytes.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		if tt.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestIngestDisabled(t *testing.T) {
+	srv := ingestServer(t, "")
+	_, err := upload(srv.URL+"/api/ingest", "s3cret", ingestRequest(t, IngestSchemaVersion))
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("err = %v, want a 404", err)
+	}
+}
+
+// TestUpload uploads a gzipped analysis like the agent, and checks it is
+// stored under an ID of the cluster of the server
+func TestUpload(t *testing.T) {
+	srv := ingestServer(t, "s3cret")
+	req := ingestRequest(t, IngestSchemaVersion)
+	id, err := upload(srv.URL+"/api/ingest", "s3cret", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("prod-eu_cache_redis-0_%s_", time.Now().Format("2006-0102"))
+	if id != prefix+"01" {
+		t.Errorf("id = %q, want %q", id, prefix+"01")
+	}
+	stored, err := LoadAnalysis(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored.typeNum; got["string"] != 1 || got["hash"] != 1 || got["list"] != 1 {
+		t.Errorf("stored type counts %v, want a key of each type", got)
+	}
+	info, ok := instanceInfo.Get(id).(InstanceInfo)
+	if !ok || info.Cluster != "prod eu" || info.Namespace != "cache" || info.Pod != "redis-0" {
+		t.Errorf("instance info %+v", instanceInfo.Get(id))
+	}
+	if counters.Get(id) == nil {
+		t.Error("analysis not served")
+	}
+
+	// an agent of another cluster names it
+	req.Cluster = "staging"
+	if id, err = upload(srv.URL+"/api/ingest", "s3cret", req); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, "staging_cache_redis-0_") {
+		t.Errorf("id = %q, want it in the staging cluster", id)
+	}
+	if _, err := upload(srv.URL+"/api/ingest", "guess", req); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("wrong token: err = %v, want a 401", err)
+	}
+}
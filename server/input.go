@@ -0,0 +1,304 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Input formats, detected by their magic bytes
+const (
+	FormatRDB  = "rdb"
+	FormatGzip = "gzip"
+	FormatZstd = "zstd"
+	FormatLZ4  = "lz4"
+	FormatTar  = "tar"
+)
+
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicLZ4  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// ErrInputTooLarge is returned once the decompressed RDB grows past the size limit
+var ErrInputTooLarge = errors.New("decompressed RDB exceeds the size limit")
+
+// maxInputLayers bounds nested compression, e.g. a .tar.gz holding a .rdb.zst
+const maxInputLayers = 4
+
+// Input is the RDB inside a possibly compressed or archived file
+type Input struct {
+	io.Reader
+	Layers  []string // formats unwrapped to reach the RDB, outermost first
+	Member  string   // name of the RDB in a tar archive
+	tar     *tarMember
+	limit   *limitReader
+	closers []io.Closer
+}
+
+// OpenInput unwraps gzip, zstd, lz4 and tar layers of r until the RDB.
+// limit caps the decompressed size, 0 means no limit.
+func OpenInput(r io.Reader, limit int64) (*Input, error) {
+	in := &Input{}
+	br := bufio.NewReader(r)
+	for depth := 0; ; depth++ {
+		format := detectFormat(br)
+		if format == FormatRDB || depth == maxInputLayers {
+			break
+		}
+		var next io.Reader
+		if format == FormatTar {
+			member, err := findTarRDB(tar.NewReader(br))
+			if err != nil {
+				in.Close()
+				return nil, err
+			}
+			in.Member = member.name
+			in.tar = member
+			next = member
+		} else {
+			zr, closer, err := newDecompressor(format, br)
+			if err != nil {
+				in.Close()
+				return nil, err
+			}
+			if closer != nil {
+				in.closers = append(in.closers, closer)
+			}
+			next = zr
+		}
+		in.Layers = append(in.Layers, format)
+		br = bufio.NewReader(next)
+	}
+	in.Reader = br
+	if limit > 0 {
+		in.limit = &limitReader{r: br, n: limit}
+		in.Reader = in.limit
+	}
+	return in, nil
+}
+
+// OpenInputFile opens a local file with OpenInput
+func OpenInputFile(path string, limit int64) (*Input, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	in, err := OpenInput(f, limit)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	in.closers = append(in.closers, f)
+	return in, nil
+}
+
+// Format describes the layers, e.g. "gzip+tar", or "rdb" for a plain RDB
+func (in *Input) Format() string {
+	if len(in.Layers) == 0 {
+		return FormatRDB
+	}
+	return strings.Join(in.Layers, "+")
+}
+
+// checkArchive reads the rest of a tar archive once the RDB is decoded, it
+// fails if the archive holds another RDB
+func (in *Input) checkArchive() error {
+	if in == nil || in.tar == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, in.tar)
+	return err
+}
+
+// TooLarge reports whether reading stopped at the size limit
+func (in *Input) TooLarge() bool {
+	return in.limit != nil && in.limit.exceeded
+}
+
+// Close closes the decompressors, innermost first
+func (in *Input) Close() error {
+	var first error
+	for i := len(in.closers) - 1; i >= 0; i-- {
+		if err := in.closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	in.closers = nil
+	return first
+}
+
+// detectFormat peeks at the magic bytes, anything unknown is left to the
+// RDB parser to reject
+func detectFormat(br *bufio.Reader) string {
+	head, _ := br.Peek(262)
+	return formatOf(head)
+}
+
+// formatOf detects the format of the first bytes of a file
+func formatOf(head []byte) string {
+	switch {
+	case decoder.IsRDBHeader(head):
+		return FormatRDB
+	case bytes.HasPrefix(head, magicGzip):
+		return FormatGzip
+	case bytes.HasPrefix(head, magicZstd):
+		return FormatZstd
+	case bytes.HasPrefix(head, magicLZ4):
+		return FormatLZ4
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return FormatTar
+	}
+	return FormatRDB
+}
+
+// newDecompressor reads the stream of a compression format from r
+func newDecompressor(format string, r io.Reader) (io.Reader, io.Closer, error) {
+	switch format {
+	case FormatGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("gzip: %w", err)
+		}
+		return zr, zr, nil
+	case FormatZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("zstd: %w", err)
+		}
+		return zr, zr.IOReadCloser(), nil
+	case FormatLZ4:
+		return lz4.NewReader(r), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown compression %s", format)
+}
+
+// tarPeekSize is how much of a compressed tar member is decompressed to
+// look for an RDB header
+const tarPeekSize = 1 << 20
+
+// tarMember is the RDB of a tar archive. Once it is read, the members after
+// it are checked for another RDB.
+type tarMember struct {
+	name string
+	tr   *tar.Reader
+	r    *bufio.Reader
+	err  error // the end of the member, io.EOF or another RDB
+}
+
+func (m *tarMember) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	n, err := m.r.Read(p)
+	if err == io.EOF {
+		other, nerr := nextTarRDB(m.tr)
+		switch {
+		case nerr != nil:
+			err = nerr
+		case other != nil:
+			err = fmt.Errorf("tar: archive holds several RDB files, %s and %s", m.name, other.name)
+		}
+		m.err = err
+	}
+	return n, err
+}
+
+// findTarRDB picks the RDB of a tar archive, see nextTarRDB
+func findTarRDB(tr *tar.Reader) (*tarMember, error) {
+	m, err := nextTarRDB(tr)
+	if m == nil && err == nil {
+		return nil, errors.New("tar: no RDB file in archive")
+	}
+	return m, err
+}
+
+// nextTarRDB returns the next regular file named *.rdb, compressed or not,
+// or whose content starts like an RDB once decompressed. It returns nil at
+// the end of the archive.
+func nextTarRDB(tr *tar.Reader) (*tarMember, error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tar: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		br := bufio.NewReaderSize(tr, tarPeekSize)
+		if isRDBName(hdr.Name) || startsWithRDB(br) {
+			return &tarMember{name: hdr.Name, tr: tr, r: br}, nil
+		}
+	}
+}
+
+// isRDBName reports whether name is *.rdb, possibly with a compression suffix
+func isRDBName(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".gz", ".zst", ".lz4"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return strings.HasSuffix(name, ".rdb")
+}
+
+// startsWithRDB peeks at the RDB header, decompressing the start of br if
+// it is compressed
+func startsWithRDB(br *bufio.Reader) bool {
+	head, _ := br.Peek(tarPeekSize)
+	for depth := 0; depth < maxInputLayers; depth++ {
+		format := formatOf(head)
+		if format == FormatRDB || format == FormatTar {
+			return decoder.IsRDBHeader(head)
+		}
+		zr, closer, err := newDecompressor(format, bytes.NewReader(head))
+		if err != nil {
+			return false
+		}
+		head = make([]byte, 512)
+		n, _ := io.ReadFull(zr, head)
+		head = head[:n]
+		if closer != nil {
+			closer.Close()
+		}
+	}
+	return false
+}
+
+// limitReader fails with ErrInputTooLarge after n bytes
+type limitReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// the limit is only exceeded if there is more to read
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			l.exceeded = true
+			return 0, ErrInputTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+	"github.com/pierrec/lz4/v4"
+)
+
+// inputRDB is the start of an RDB, which is all OpenInput looks at
+var inputRDB = append([]byte("REDIS0011"), bytes.Repeat([]byte{0xfa, 0x01, 'x'}, 2000)...)
+
+type wrapper func(t *testing.T, b []byte) []byte
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstded(t *testing.T, b []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.EncodeAll(b, nil)
+}
+
+func lz4ed(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type tarFile struct {
+	name string
+	body []byte
+}
+
+// archive tars the files in order, a name ending in / is a directory
+func archive(t *testing.T, files ...tarFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(f.body))}
+		if strings.HasSuffix(f.name, "/") {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0o755
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(f.body)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarred archives b as name after a README and a directory
+func tarred(name string) wrapper {
+	return func(t *testing.T, b []byte) []byte {
+		return archive(t, tarFile{"backup/", nil}, tarFile{"backup/README", []byte("nightly backup")}, tarFile{name, b})
+	}
+}
+
+func TestOpenInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		wrap   []wrapper // innermost first
+		layers []string
+		member string
+		limit  int64
+		err    error
+		rdb    bool // the result is the RDB
+	}{
+		{name: "rdb", rdb: true},
+		{name: "gzip", wrap: []wrapper{gzipped}, layers: []string{FormatGzip}, rdb: true},
+		{name: "zstd", wrap: []wrapper{zstded}, layers: []string{FormatZstd}, rdb: true},
+		{name: "lz4", wrap: []wrapper{lz4ed}, layers: []string{FormatLZ4}, rdb: true},
+		{name: "tar.gz", wrap: []wrapper{tarred("backup/dump.rdb"), gzipped}, layers: []string{FormatGzip, FormatTar},
+			member: "backup/dump.rdb", rdb: true},
+		// found by its magic bytes rather than its name
+		{name: "tar of a zstd", wrap: []wrapper{zstded, tarred("backup/snapshot"), gzipped},
+			layers: []string{FormatGzip, FormatTar, FormatZstd}, member: "backup/snapshot", rdb: true},
+		{name: "4 layers", wrap: []wrapper{lz4ed, zstded, gzipped, gzipped},
+			layers: []string{FormatGzip, FormatGzip, FormatZstd, FormatLZ4}, rdb: true},
+		// the fifth layer is left to the RDB parser to reject
+		{name: "5 layers", wrap: []wrapper{gzipped, lz4ed, zstded, gzipped, gzipped},
+			layers: []string{FormatGzip, FormatGzip, FormatZstd, FormatLZ4}},
+		{name: "limit", wrap: []wrapper{gzipped}, layers: []string{FormatGzip}, limit: int64(len(inputRDB)), rdb: true},
+		{name: "over the limit", wrap: []wrapper{gzipped}, layers: []string{FormatGzip}, limit: int64(len(inputRDB)) - 1,
+			err: ErrInputTooLarge},
+	}
+	for _, tt := range tests {
+		b := inputRDB
+		for _, w := range tt.wrap {
+			b = w(t, b)
+		}
+		in, err := OpenInput(bytes.NewReader(b), tt.limit)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, err := io.ReadAll(in)
+		in.Close()
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: read error %v, want %v", tt.name, err, tt.err)
+		}
+		if in.TooLarge() != (tt.err == ErrInputTooLarge) {
+			t.Errorf("%s: TooLarge() = %v", tt.name, in.TooLarge())
+		}
+		if !reflect.DeepEqual(in.Layers, tt.layers) {
+			t.Errorf("%s: layers %v, want %v", tt.name, in.Layers, tt.layers)
+		}
+		if in.Member != tt.member {
+			t.Errorf("%s: member %q, want %q", tt.name, in.Member, tt.member)
+		}
+		if tt.rdb != bytes.Equal(got, inputRDB) {
+			t.Errorf("%s: read %d bytes starting %q, RDB wanted: %v", tt.name, len(got), got[:min(len(got), 9)], tt.rdb)
+		}
+	}
+}
+
+func TestOpenInputErrors(t *testing.T) {
+	noRDB := tarred("backup/notes.txt")(t, []byte("not an RDB"))
+	if _, err := OpenInput(bytes.NewReader(gzipped(t, noRDB)), 0); err == nil {
+		t.Error("tar without an RDB: no error")
+	}
+	corrupt := gzipped(t, inputRDB)
+	corrupt[3] = 0xff // reserved flag bits
+	if _, err := OpenInput(bytes.NewReader(corrupt), 0); err == nil {
+		t.Error("corrupt gzip header: no error")
+	}
+}
+
+// TestTarMembers checks which member of a tar archive is read as the RDB
+func TestTarMembers(t *testing.T) {
+	logs := gzipped(t, []byte("12:00 backup started"))
+	tests := []struct {
+		name   string
+		files  []tarFile
+		member string
+		err    string
+	}{
+		// a compressed file that is not an RDB is passed over
+		{name: "decoy", files: []tarFile{{"backup/logs.gz", logs}, {"backup/snapshot", zstded(t, inputRDB)}},
+			member: "backup/snapshot"},
+		{name: "decoy after", files: []tarFile{{"backup/dump.rdb.gz", gzipped(t, inputRDB)}, {"backup/logs.gz", logs}},
+			member: "backup/dump.rdb.gz"},
+		{name: "valkey", files: []tarFile{{"backup/snapshot", append([]byte("VALKEY080"), inputRDB[9:]...)}},
+			member: "backup/snapshot"},
+		{name: "two RDBs", files: []tarFile{{"backup/dump.rdb", inputRDB}, {"backup/logs.gz", logs}, {"backup/old", gzipped(t, inputRDB)}},
+			member: "backup/dump.rdb", err: "tar: archive holds several RDB files, backup/dump.rdb and backup/old"},
+		{name: "no RDB", files: []tarFile{{"backup/logs.gz", logs}}, err: "tar: no RDB file in archive"},
+	}
+	for _, tt := range tests {
+		in, err := OpenInput(bytes.NewReader(archive(t, tt.files...)), 0)
+		if err == nil {
+			if in.Member != tt.member {
+				t.Errorf("%s: member %q, want %q", tt.name, in.Member, tt.member)
+			}
+			// the decoder stops at the end of the RDB, the rest is read after
+			head := make([]byte, 9)
+			if _, err := io.ReadFull(in, head); err != nil || !decoder.IsRDBHeader(head) {
+				t.Errorf("%s: read %q, %v", tt.name, head, err)
+			}
+			err = in.checkArchive()
+			in.Close()
+		}
+		var got string
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: error %q, want %q", tt.name, got, tt.err)
+		}
+	}
+}
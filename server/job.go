@@ -1,24 +1,23 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
-	"github.com/schollz/progressbar/v3"
 )
 
 type JobState string
 
 const (
 	StateChecking    JobState = "checking"
+	StateQueued      JobState = "queued"
 	StateDownloading JobState = "downloading"
 	StateParsing     JobState = "parsing"
 	StateDone        JobState = "done"
@@ -27,11 +26,19 @@ const (
 
 type Job struct {
 	ID        string   `json:"id"`
+	Cluster   string   `json:"cluster"`
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container,omitempty"`
+	Path      string   `json:"path,omitempty"`
 	Status    string   `json:"status"`
 	State     JobState `json:"state"`
 	Error     string   `json:"error,omitempty"`
 	Instance  string   `json:"instance,omitempty"`
 	Progress  float64  `json:"progress,omitempty"`
+	Profile   string   `json:"profile,omitempty"` // memory profile override
+	Warnings  []string `json:"warnings,omitempty"`
+	RateLimit int64    `json:"rateLimit,omitempty"` // bytes per second of the copy, 0 for none
 	StartTime time.Time
 }
 
@@ -41,19 +48,32 @@ type JobManager struct {
 
 var GlobalJobManager = &JobManager{}
 
-func (jm *JobManager) StartJob(namespace, pod, path string) string {
-	// Generate ID: namespace_redis_pod_name_2026-0205_01
-	id := GetNextID(namespace, pod)
+// StartJob starts analysing an RDB of a pod in a cluster. An empty container
+// or path is found by a pre-flight of the pod. A nil profile selects the
+// memory profile from the RDB itself. rateLimit is the bytes per second of
+// the copy, 0 for none.
+func (jm *JobManager) StartJob(cluster, namespace, pod, container, path string, profile *decoder.MemoryProfile, rateLimit int64) string {
+	// Generate ID: cluster_namespace_redis_pod_name_2026-0205_01
+	id := GetNextID(cluster, namespace, pod)
 	
 	job := &Job{
 		ID:        id,
+		Cluster:   cluster,
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		Path:      path,
+		RateLimit: rateLimit,
 		Status:    "Initializing...",
 		State:     StateChecking,
 		StartTime: time.Now(),
 	}
+	if profile != nil {
+		job.Profile = profile.Name()
+	}
 	jm.jobs.Store(id, job)
 
-	go jm.runJob(job, namespace, pod, path)
+	go jm.runJob(job, profile)
 
 	return id
 }
@@ -65,7 +85,8 @@ func (jm *JobManager) GetStatus(id string) *Job {
 	return nil
 }
 
-func (jm *JobManager) runJob(job *Job, namespace, pod, path string) {
+func (jm *JobManager) runJob(job *Job, profile *decoder.MemoryProfile) {
+	namespace, pod := job.Namespace, job.Pod
 	// ... (helper update function) ...
 	update := func(state JobState, status string, errStr string) {
 		job.State = state
@@ -82,113 +103,163 @@ func (jm *JobManager) runJob(job *Job, namespace, pod, path string) {
 
 	// 1. Check Size
 	update(StateChecking, "Checking RDB size...", "")
-	// kubectl exec -n <ns> <pod> -- stat -c %s <path>
-	cmdCheck := exec.Command("kubectl", "exec", "-n", namespace, pod, "--", "stat", "-c", "%s", path)
-	out, err := cmdCheck.Output() // Use Output() to get only stdout
+	ctx := context.Background()
+	kube, err := GetKubeClient(job.Cluster)
 	if err != nil {
-		errMsg := err.Error()
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			errMsg = fmt.Sprintf("%v, stderr: %s", err, string(exitErr.Stderr))
-		}
-		update(StateError, "Check failed", fmt.Sprintf("Failed to check size: %s", errMsg))
+		update(StateError, "Check failed", err.Error())
 		return
 	}
-	sizeStr := strings.TrimSpace(string(out))
-	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if job.Container == "" || job.Path == "" {
+		update(StateChecking, "Inspecting pod...", "")
+		pf, err := RunPreflight(ctx, kube, namespace, pod)
+		if err != nil {
+			update(StateError, "Check failed", fmt.Sprintf("Pre-flight failed: %v", err))
+			return
+		}
+		if job.Container == "" {
+			job.Container = pf.Container
+		}
+		if job.Path == "" {
+			if pf.Path == "" {
+				update(StateError, "Check failed", strings.Join(pf.Warnings, "; "))
+				return
+			}
+			job.Path = pf.Path
+		}
+		update(StateChecking, "Checking RDB size...", "")
+	}
+	path := job.Path
+	remote, err := StatRemote(ctx, kube, namespace, pod, job.Container, path)
 	if err != nil {
-		update(StateError, "Check failed", fmt.Sprintf("Invalid size output: %q", sizeStr))
+		update(StateError, "Check failed", fmt.Sprintf("Failed to check size: %v", err))
 		return
 	}
+	// A directory is an appendonlydir
+	size, isAOF := remote.Size, remote.IsDir
+	if age := time.Since(remote.ModTime); !isAOF && age > GetRDBStaleAfter() {
+		job.Warnings = append(job.Warnings, fmt.Sprintf("RDB was last written %s ago (%s), it may not reflect the current data", formatAge(age), remote.ModTime.UTC().Format(time.RFC3339)))
+		log.Printf("[Job %s] stale RDB: last written %s", job.ID, remote.ModTime)
+	}
 
-	// Check against max size from env var
+	// Check against max size from env var. A compressed RDB is checked
+	// again while it is decompressed.
 	maxSize := GetMaxRDBSize()
 	if size > maxSize {
 		update(StateError, "File too large", fmt.Sprintf("File size %s exceeds limit of %s", FormatSize(size), FormatSize(maxSize)))
 		return
 	}
 
+	// Use local tmp directory to avoid filling up RAM (tmpfs)
+	tmpDir := jobTempDir()
+	os.MkdirAll(tmpDir, 0755)
+
+	// Wait for the disk space and memory of the job
+	release, err := jobAdmission.admit(ctx, tmpDir, size, estimateMemory(path, size), func(reason string) {
+		update(StateQueued, "Queued: "+reason, "")
+	})
+	if err != nil {
+		update(StateError, "Not admitted", err.Error())
+		return
+	}
+	defer release()
+
 	// 2. Download
-	update(StateDownloading, fmt.Sprintf("Copying RDB from Redis %s...", formatBytes(size)), "")
-    
-    // Use local tmp directory to avoid filling up RAM (tmpfs)
-    tmpDir, _ := filepath.Abs("./tmp")
-    os.MkdirAll(tmpDir, 0755)
-    
+	what := "RDB"
+	if isAOF {
+		what = "AOF directory"
+	}
+	update(StateDownloading, fmt.Sprintf("Copying %s from Redis %s...", what, formatBytes(size)), "")
+
 	localPath := filepath.Join(tmpDir, fmt.Sprintf("rdr_%s.rdb", job.ID))
-	defer os.Remove(localPath) // Cleanup
+	if isAOF {
+		localPath = filepath.Join(tmpDir, fmt.Sprintf("rdr_%s.aof", job.ID))
+	}
+	defer os.RemoveAll(localPath) // Cleanup
 
-	cmdCp := exec.Command("kubectl", "cp", fmt.Sprintf("%s/%s:%s", namespace, pod, path), localPath)
-	if out, err := cmdCp.CombinedOutput(); err != nil {
-		update(StateError, "Download failed", fmt.Sprintf("Copy failed: %v, output: %s", err, string(out)))
+	warnings, err := Download(ctx, kube, namespace, pod, job.Container, remote, localPath, DownloadOptions{
+		RateLimit: job.RateLimit,
+		Status:    func(msg string) { update(StateDownloading, msg, "") },
+		Progress: func(done, total int64) {
+			if total > 0 {
+				job.Progress = min(float64(done)/float64(total)*100, 100)
+			}
+		},
+	})
+	if err != nil {
+		update(StateError, "Download failed", fmt.Sprintf("Copy failed: %v", err))
 		return
 	}
+	job.Warnings = append(job.Warnings, warnings...)
+	job.Progress = 0
 
-	// 3. Parse
-	update(StateParsing, "Parsing RDB file...", "")
-	
-	f, err := os.Open(localPath)
+	// 3. Parse, in a worker process a pathological RDB cannot take the
+	// server down with
+	if isAOF {
+		update(StateParsing, "Replaying AOF directory...", "")
+	} else {
+		update(StateParsing, "Parsing RDB file...", "")
+	}
+	counter, format, err := runWorker(ctx, localPath, profile, GetWorkerMemoryLimit(), func(percent float64) {
+		job.Progress = percent
+	})
 	if err != nil {
-		update(StateError, "Open failed", fmt.Sprintf("Failed to open file: %v", err))
+		update(StateError, "Parse failed", err.Error())
 		return
 	}
-	defer f.Close()
-
-	decoder := decoder.NewDecoder()
-	go func() {
-		// Get file size for progress bar
-		fInfo, err := f.Stat()
-		if err != nil {
-			log.Printf("Failed to stat file for progress bar: %v", err)
-		} else {
-			bar := progressbar.DefaultBytes(
-				fInfo.Size(),
-				"parsing rdb",
-			)
-			// Wrap reader
-			barReader := progressbar.NewReader(f, bar)
-			
-			// Updates job progress
-			go func() {
-				// Poll progress bar state and update job
-				for {
-					if bar.IsFinished() {
-						return
-					}
-					current := bar.State().CurrentBytes
-					total := bar.State().Max
-					if total > 0 {
-						job.Progress = float64(current) / float64(total) * 100
-					}
-					time.Sleep(500 * time.Millisecond)
-				}
-			}()
-			
-			decoder.DecodeWithHDT(&barReader)
-			bar.Finish()
-			job.Progress = 100 // Ensure 100% on finish
-			fmt.Println()
-			return
-		}
-		
-		// Fallback if stat failed
-		decoder.DecodeWithHDT(f)
-	}()
+	log.Printf("[Job %s] parsed %s input", job.ID, format)
+	jm.finishJob(job, counter, path, update)
+}
 
-	counter := NewCounter()
-	counter.Count(decoder.Entries)
+// finishJob saves the analysis of a job
+func (jm *JobManager) finishJob(job *Job, counter *Counter, path string, update func(JobState, string, string)) {
+	if counter.decodeError != "" {
+		log.Printf("[Job %s] partial analysis: %s", job.ID, counter.decodeError)
+	}
 
 	// Store result
 	instanceName := job.ID // Use ID as instance name
 	
 	// Save to DB and Memory
 	counters.Set(instanceName, counter)
-	err = SaveAnalysis(instanceName, namespace, pod, path, counter)
+	instanceInfo.Set(instanceName, InstanceInfo{ID: instanceName, Cluster: job.Cluster, Namespace: job.Namespace, Pod: job.Pod})
+	err := SaveAnalysis(instanceName, job.Cluster, job.Namespace, job.Pod, path, counter)
 	if err != nil {
 		update(StateError, "Save failed", fmt.Sprintf("Failed to save result: %v", err))
 		return
 	}
 
-	update(StateDone, "Analysis Complete", "")
+	status := "Analysis Complete"
+	if n := counter.SkippedKeys(); n > 0 {
+		status = fmt.Sprintf("Analysis Complete, %d keys skipped", n)
+	}
+	if counter.decodeError != "" {
+		status = "Analysis Incomplete: " + counter.decodeError
+	}
+	update(StateDone, status, "")
+}
+
+// countDecoder counts the entries of a running decoder, its error is left to
+// the caller
+func countDecoder(d *decoder.Decoder) *Counter {
+	counter := NewCounter()
+	counter.Count(d.Entries)
+	counter.redisVersion = d.GetRedisVersion()
+	counter.meta = d.GetMeta()
+	counter.profile = d.GetProfile().Name()
+	counter.skipped = d.GetSkipped()
+	return counter
+}
+
+// formatAge formats a duration in its largest unit: 3d, 5h, 12m
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
 }
 
 func formatBytes(bytes int64) string {
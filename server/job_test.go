@@ -0,0 +1,76 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+)
+
+// TestFinishJobStatus checks the status of a job whose analysis left keys
+// out or stopped early
+func TestFinishJobStatus(t *testing.T) {
+	initDB(filepath.Join(t.TempDir(), "rdr.db"))
+	t.Cleanup(func() { db.Close() })
+
+	path := writeBenchRDB(t, 100)
+	rdb, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(t.TempDir(), "truncated.rdb")
+	if err := os.WriteFile(truncated, rdb[:len(rdb)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	analyze := func(file string) *Counter {
+		c, _, err := AnalyzeFile(file, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	skipped := analyze(path)
+	skipped.skipped = []*decoder.SkipStats{
+		{Type: "hash", Reason: "decoder panic: x", Keys: 2, Samples: []decoder.SkippedKey{{Key: "a", Offset: 120}, {Key: "b", Offset: 480}}},
+		{Type: "list", Reason: "unexpected encoding: x", Keys: 1, Samples: []decoder.SkippedKey{{Key: "c", Offset: -1}}},
+	}
+
+	tests := []struct {
+		name    string
+		counter *Counter
+		status  string
+	}{
+		{"complete", analyze(path), "Analysis Complete"},
+		{"keys skipped", skipped, "Analysis Complete, 3 keys skipped"},
+		{"truncated", analyze(truncated), "Analysis Incomplete: decoding stopped at byte "},
+	}
+	jm := &JobManager{}
+	for _, tt := range tests {
+		job := &Job{ID: "test-job-" + strings.ReplaceAll(tt.name, " ", "-"), Cluster: "local", Namespace: "cache", Pod: "redis-0"}
+		var state JobState
+		var status string
+		jm.finishJob(job, tt.counter, path, func(s JobState, st, _ string) {
+			state, status = s, st
+		})
+		counters.Delete(job.ID)
+		instanceInfo.Delete(job.ID)
+		if state != StateDone || !strings.HasPrefix(status, tt.status) {
+			t.Errorf("%s: %s %q, want done %q", tt.name, state, status, tt.status)
+		}
+
+		// the skipped keys are kept with the analysis
+		loaded, err := LoadAnalysis(job.ID)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if loaded.SkippedKeys() != tt.counter.SkippedKeys() || loaded.decodeError != tt.counter.decodeError {
+			t.Errorf("%s: loaded %d skipped keys and error %q, want %d and %q", tt.name,
+				loaded.SkippedKeys(), loaded.decodeError, tt.counter.SkippedKeys(), tt.counter.decodeError)
+		}
+		if len(loaded.skipped) > 0 && loaded.skipped[0].Samples[1].Offset != 480 {
+			t.Errorf("%s: loaded samples %+v", tt.name, loaded.skipped[0].Samples)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// KubeClient is everything the analyzer does on a cluster, so that tests
+// can run on a fake clientset
+type KubeClient interface {
+	// ListStatefulSets lists the StatefulSets of all namespaces
+	ListStatefulSets(ctx context.Context) ([]appsv1.StatefulSet, error)
+	// ListDeployments lists the Deployments of all namespaces
+	ListDeployments(ctx context.Context) ([]appsv1.Deployment, error)
+	// ListPods lists the pods of a namespace matching selector
+	ListPods(ctx context.Context, namespace string, selector labels.Selector) ([]corev1.Pod, error)
+	// GetPod returns a pod
+	GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error)
+	// Exec runs a command in a container of a pod, the default one if
+	// container is empty, and streams its stdout. stdin, if not nil, is
+	// sent to the command. A command that fails returns an *ExecError.
+	Exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout io.Writer) error
+}
+
+// ExecError is a command that failed in a pod
+type ExecError struct {
+	Command []string
+	Code    int // exit code, -1 if the command did not run
+	Stderr  string
+	Err     error
+}
+
+func (e *ExecError) Error() string {
+	msg := fmt.Sprintf("%q", strings.Join(e.Command, " "))
+	if e.Code >= 0 {
+		msg += fmt.Sprintf(" exited with %d", e.Code)
+	} else {
+		msg += fmt.Sprintf(" failed: %v", e.Err)
+	}
+	if e.Stderr != "" {
+		msg += ": " + strings.TrimSpace(e.Stderr)
+	}
+	return msg
+}
+
+func (e *ExecError) Unwrap() error { return e.Err }
+
+// execFunc runs a command in a pod, stderr is collected for the ExecError
+type execFunc func(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error
+
+// kubeClient implements KubeClient with client-go
+type kubeClient struct {
+	clientset kubernetes.Interface
+	exec      execFunc
+}
+
+// Cluster is a Kubernetes cluster Redis can be imported from
+type Cluster struct {
+	Name       string `json:"name"`    // context name, or CLUSTER_NAME in-cluster
+	Current    bool   `json:"current"` // the default cluster
+	InCluster  bool   `json:"inCluster"`
+	Kubeconfig string `json:"-"` // empty for the default loading rules
+	Context    string `json:"-"`
+}
+
+// restConfig loads the client config of the cluster
+func (c Cluster) restConfig() (*rest.Config, error) {
+	if c.InCluster {
+		return rest.InClusterConfig()
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if c.Kubeconfig != "" {
+		rules = &clientcmd.ClientConfigLoadingRules{ExplicitPath: c.Kubeconfig}
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: c.Context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+// Clusters lists the clusters the analyzer can reach: the one it runs in,
+// then every context of the kubeconfigs (KUBECONFIGS, else $KUBECONFIG or
+// ~/.kube/config), limited to KUBE_CONTEXTS if set. A context found in
+// several kubeconfigs is taken from the first.
+func Clusters() ([]Cluster, error) {
+	var clusters []Cluster
+	seen := map[string]bool{}
+	if _, err := rest.InClusterConfig(); err == nil {
+		clusters = append(clusters, Cluster{Name: GetClusterName(), InCluster: true, Current: true})
+		seen[GetClusterName()] = true
+	}
+
+	type kubeconfig struct {
+		path   string
+		config *clientcmdapi.Config
+	}
+	var configs []kubeconfig
+	if paths := GetKubeconfigs(); len(paths) > 0 {
+		for _, path := range paths {
+			config, err := clientcmd.LoadFromFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+			}
+			configs = append(configs, kubeconfig{path, config})
+		}
+	} else if config, err := clientcmd.NewDefaultClientConfigLoadingRules().Load(); err == nil {
+		configs = append(configs, kubeconfig{"", config})
+	} else if len(clusters) == 0 {
+		return nil, fmt.Errorf("kubeconfig: %w", err)
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range GetKubeContexts() {
+		wanted[name] = true
+	}
+	hasCurrent := len(clusters) > 0
+	for _, kc := range configs {
+		names := make([]string, 0, len(kc.config.Contexts))
+		for name := range kc.config.Contexts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if seen[name] || (len(wanted) > 0 && !wanted[name]) {
+				continue
+			}
+			seen[name] = true
+			c := Cluster{Name: name, Kubeconfig: kc.path, Context: name}
+			if !hasCurrent && name == kc.config.CurrentContext {
+				c.Current, hasCurrent = true, true
+			}
+			clusters = append(clusters, c)
+		}
+	}
+	if len(clusters) == 0 {
+		return nil, errors.New("no Kubernetes cluster configured")
+	}
+	if !hasCurrent {
+		clusters[0].Current = true
+	}
+	return clusters, nil
+}
+
+// FindCluster returns the cluster called name, the current one if name is empty
+func FindCluster(name string) (Cluster, error) {
+	clusters, err := Clusters()
+	if err != nil {
+		return Cluster{}, err
+	}
+	for _, c := range clusters {
+		if c.Name == name || (name == "" && c.Current) {
+			return c, nil
+		}
+	}
+	return Cluster{}, fmt.Errorf("unknown cluster %q", name)
+}
+
+var (
+	kubeMu      sync.Mutex
+	kubeClients = map[string]KubeClient{}
+)
+
+// GetKubeClient returns the client of a cluster, created on first use. An
+// empty name is the current cluster.
+func GetKubeClient(cluster string) (KubeClient, error) {
+	kubeMu.Lock()
+	defer kubeMu.Unlock()
+	if k := kubeClients[cluster]; k != nil && cluster != "" {
+		return k, nil
+	}
+	c, err := FindCluster(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if k := kubeClients[c.Name]; k != nil {
+		return k, nil
+	}
+	config, err := c.restConfig()
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes config of %s: %w", c.Name, err)
+	}
+	k, err := newKubeClient(config)
+	if err != nil {
+		return nil, err
+	}
+	kubeClients[c.Name] = k
+	return k, nil
+}
+
+func newKubeClient(config *rest.Config) (*kubeClient, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes client: %w", err)
+	}
+	return &kubeClient{clientset: clientset, exec: streamExec(clientset, config)}, nil
+}
+
+// streamExec runs commands over WebSocket, falling back to SPDY on API
+// servers older than 1.30
+func streamExec(clientset kubernetes.Interface, config *rest.Config) execFunc {
+	return func(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+		req := clientset.CoreV1().RESTClient().Post().
+			Resource("pods").Namespace(namespace).Name(pod).SubResource("exec").
+			VersionedParams(&corev1.PodExecOptions{Container: container, Command: command, Stdin: stdin != nil, Stdout: true, Stderr: true}, scheme.ParameterCodec)
+		ws, err := remotecommand.NewWebSocketExecutor(config, "GET", req.URL().String())
+		if err != nil {
+			return err
+		}
+		spdy, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+		if err != nil {
+			return err
+		}
+		executor, err := remotecommand.NewFallbackExecutor(ws, spdy, func(err error) bool {
+			return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+		})
+		if err != nil {
+			return err
+		}
+		return executor.StreamWithContext(ctx, remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+	}
+}
+
+func (k *kubeClient) ListStatefulSets(ctx context.Context) ([]appsv1.StatefulSet, error) {
+	list, err := k.clientset.AppsV1().StatefulSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeClient) ListDeployments(ctx context.Context) ([]appsv1.Deployment, error) {
+	list, err := k.clientset.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeClient) ListPods(ctx context.Context, namespace string, selector labels.Selector) ([]corev1.Pod, error) {
+	list, err := k.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeClient) GetPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	return k.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (k *kubeClient) Exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	err := k.exec(ctx, namespace, pod, container, command, stdin, stdout, &stderr)
+	if err == nil {
+		return nil
+	}
+	execErr := &ExecError{Command: command, Code: -1, Stderr: stderr.String(), Err: err}
+	var exit utilexec.ExitError
+	if errors.As(err, &exit) {
+		execErr.Code = exit.ExitStatus()
+	}
+	return execErr
+}
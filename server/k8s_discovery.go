@@ -1,20 +1,43 @@
 package server
 
 import (
+    "context"
     "encoding/json"
     "fmt"
-    "os/exec"
+    "os"
+    "strconv"
     "strings"
+
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type DiscoveredRedis struct {
-    Namespace string   `json:"namespace"`
-    Pods      []string `json:"pods"`
+    Cluster   string               `json:"cluster"`
+    Namespace string               `json:"namespace"`
+    Pods      []string             `json:"pods"`
+    Workloads []DiscoveredWorkload `json:"workloads"`
+    Shards    []DiscoveredShard    `json:"shards"`
+}
+
+// DiscoveredWorkload is a StatefulSet, Deployment or operator resource running Redis
+type DiscoveredWorkload struct {
+    Kind string   `json:"kind"`
+    Name string   `json:"name"`
+    Pods []string `json:"pods"`
 }
 
-func DiscoverRedisResources() ([]DiscoveredRedis, error) {
+// DiscoverRedisResources discovers Redis in a cluster, the current one if
+// cluster is empty
+func DiscoverRedisResources(cluster string) ([]DiscoveredRedis, error) {
+    c, err := FindCluster(cluster)
+    if err != nil {
+        return nil, err
+    }
+    cacheKey := "k8s_resources:" + c.Name
+
     // 0. Check Cache
-    if cachedBytes, err := GetDiscoveryCache(); err == nil {
+    if cachedBytes, err := GetDiscoveryCache(cacheKey); err == nil {
          fmt.Println("Serving Redis resources from Cache (SQLite)...")
          var cachedRes []DiscoveredRedis
          if err := json.Unmarshal(cachedBytes, &cachedRes); err == nil {
@@ -22,114 +45,268 @@ func DiscoverRedisResources() ([]DiscoveredRedis, error) {
          }
     }
 
-    fmt.Println("Discovering Redis resources via kubectl (Optimized)...")
-    
-    // 1. Get all StatefulSets
-    cmdSts := exec.Command("kubectl", "get", "sts", "-A", "-o", "json")
-    outSts, err := cmdSts.Output()
+    kube, err := GetKubeClient(c.Name)
     if err != nil {
-        return nil, fmt.Errorf("failed to get sts: %v", err)
+        return nil, err
+    }
+    results, err := discoverRedis(context.Background(), kube, GetDiscoveryRules())
+    if err != nil {
+        return nil, err
+    }
+    for i := range results {
+        results[i].Cluster = c.Name
     }
 
-    // We need a struct to parse the Label Selector
-    type StsItem struct {
-        Metadata struct {
-            Name      string `json:"name"`
-            Namespace string `json:"namespace"`
-        } `json:"metadata"`
-        Spec struct {
-            Selector struct {
-                MatchLabels map[string]string `json:"matchLabels"`
-            } `json:"selector"`
-        } `json:"spec"`
+    // Save to Cache
+    if jsonBytes, err := json.Marshal(results); err == nil {
+        SaveDiscoveryCache(cacheKey, jsonBytes)
     }
-    
-    type StsList struct {
-        Items []StsItem `json:"items"`
+
+    return results, nil
+}
+
+// DiscoveryRules decide which workloads run Redis: a pod template with a
+// known image or label, or a workload owned by a known operator. Templates
+// that declare container ports must expose one of Ports, which leaves out
+// Sentinels. With Info, the role of each pod is asked with redis-cli.
+type DiscoveryRules struct {
+    Images   []string // image names without registry, path, tag or digest
+    Labels   []string // key=value, or key for any value
+    Ports    []int32
+    Info     bool   // run INFO replication in the pods
+    Password string // for INFO, if empty the REDIS_PASSWORD of each pod
+}
+
+// operatorKinds are the custom resources of Redis operators, their
+// StatefulSets are reported under the resource
+var operatorKinds = map[string]bool{
+    "RedisFailover":    true, // spotahome/redis-operator
+    "RedisCluster":     true, // OT-CONTAINER-KIT/redis-operator
+    "RedisReplication": true,
+    "Redis":            true,
+}
+
+// GetDiscoveryRules returns the rules from DISCOVERY_IMAGES, DISCOVERY_LABELS
+// and DISCOVERY_PORTS, comma separated. DISCOVERY_INFO=true asks the pods
+// for their role, authenticated with DISCOVERY_PASSWORD, or else with the
+// REDIS_PASSWORD of each pod. The REDIS_PASSWORD of the analyzer is not used,
+// it may be meant for another server.
+func GetDiscoveryRules() DiscoveryRules {
+    rules := DiscoveryRules{
+        Images: []string{"redis", "redis-stack", "redis-stack-server", "redis-cluster", "valkey", "valkey-cluster", "keydb"},
+        Labels: []string{"app.kubernetes.io/name=redis", "app.kubernetes.io/name=valkey", "app.kubernetes.io/name=keydb", "app=redis"},
+        Ports:  []int32{6379},
     }
+    if images := splitList(os.Getenv("DISCOVERY_IMAGES")); len(images) > 0 {
+        rules.Images = images
+    }
+    if labels := splitList(os.Getenv("DISCOVERY_LABELS")); len(labels) > 0 {
+        rules.Labels = labels
+    }
+    if ports := splitList(os.Getenv("DISCOVERY_PORTS")); len(ports) > 0 {
+        rules.Ports = nil
+        for _, p := range ports {
+            if n, err := strconv.ParseInt(p, 10, 32); err == nil {
+                rules.Ports = append(rules.Ports, int32(n))
+            } else {
+                fmt.Printf("Warning: Invalid port '%s' in DISCOVERY_PORTS\n", p)
+            }
+        }
+    }
+    rules.Info, _ = strconv.ParseBool(os.Getenv("DISCOVERY_INFO"))
+    rules.Password = os.Getenv("DISCOVERY_PASSWORD")
+    return rules
+}
 
-    var stsList StsList
-    if err := json.Unmarshal(outSts, &stsList); err != nil {
-        return nil, err
+// imageName strips the registry, path, tag and digest of an image:
+// docker.io/bitnami/redis:7.2@sha256:... is redis
+func imageName(image string) string {
+    if i := strings.IndexByte(image, '@'); i >= 0 {
+        image = image[:i]
+    }
+    if i := strings.LastIndexByte(image, '/'); i >= 0 {
+        image = image[i+1:]
+    }
+    if i := strings.IndexByte(image, ':'); i >= 0 {
+        image = image[:i]
     }
+    return image
+}
 
-    results := []DiscoveredRedis{}
-    namespaces := make(map[string]bool) // just for logging count
-    
-    // 2. Iterate each Redis STS and fetch its pods directly using Selector
-    for _, sts := range stsList.Items {
-        if !strings.Contains(sts.Metadata.Name, "redis") {
-            continue
+// matchTemplate reports whether a pod template runs Redis
+func (r DiscoveryRules) matchTemplate(tmpl corev1.PodTemplateSpec) bool {
+    return r.matchLabels(tmpl.Labels) || r.matchImages(tmpl.Spec.Containers)
+}
+
+func (r DiscoveryRules) matchLabels(set map[string]string) bool {
+    for _, rule := range r.Labels {
+        key, value, hasValue := strings.Cut(rule, "=")
+        if v, ok := set[key]; ok && (!hasValue || v == value) {
+            return true
         }
-        namespaces[sts.Metadata.Namespace] = true
+    }
+    return false
+}
 
-        // Build Label Selector string
-        var selectors []string
-        for k, v := range sts.Spec.Selector.MatchLabels {
-            selectors = append(selectors, fmt.Sprintf("%s=%s", k, v))
+func (r DiscoveryRules) matchImages(containers []corev1.Container) bool {
+    for _, c := range containers {
+        name := imageName(c.Image)
+        for _, image := range r.Images {
+            if name == image {
+                return true
+            }
         }
-        selectorStr := strings.Join(selectors, ",")
-        
-        if selectorStr == "" {
-            continue 
+    }
+    return false
+}
+
+// redisContainer picks the Redis container of a pod: the only one, else the
+// first with a Redis image and port, a Redis image, or a Redis port. Empty
+// if none is, for the pod's default container.
+func (r DiscoveryRules) redisContainer(spec corev1.PodSpec) string {
+    if len(spec.Containers) == 1 {
+        return spec.Containers[0].Name
+    }
+    image := func(c corev1.Container) bool { return r.matchImages([]corev1.Container{c}) }
+    port := func(c corev1.Container) bool {
+        return r.matchPorts(corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{c}}})
+    }
+    for _, match := range []func(corev1.Container) bool{
+        func(c corev1.Container) bool { return image(c) && port(c) },
+        image,
+        func(c corev1.Container) bool { return len(c.Ports) > 0 && port(c) },
+    } {
+        for _, c := range spec.Containers {
+            if match(c) {
+                return c.Name
+            }
         }
+    }
+    return ""
+}
 
-        // Get pods for this specific STS
-        cmdPods := exec.Command("kubectl", "get", "pods", "-n", sts.Metadata.Namespace, "-l", selectorStr, "-o", "json")
-        outPods, err := cmdPods.Output()
-        if err != nil {
-            fmt.Printf("Error getting pods for STS %s: %v\n", sts.Metadata.Name, err)
-            continue
+// matchPorts reports whether the template exposes a Redis port, templates
+// without declared ports pass
+func (r DiscoveryRules) matchPorts(tmpl corev1.PodTemplateSpec) bool {
+    declared := false
+    for _, c := range tmpl.Spec.Containers {
+        for _, p := range c.Ports {
+            declared = true
+            for _, port := range r.Ports {
+                if p.ContainerPort == port {
+                    return true
+                }
+            }
         }
+    }
+    return !declared || len(r.Ports) == 0
+}
 
-        // Parse pods (reusing a simple struct)
-        type PodItem struct {
-            Metadata struct {
-                Name string `json:"name"`
-            } `json:"metadata"`
+// workload is a StatefulSet or Deployment that may run Redis
+type workload struct {
+    kind     string
+    meta     metav1.ObjectMeta
+    selector *metav1.LabelSelector
+    template corev1.PodTemplateSpec
+}
+
+// discoverRedis finds the pods of the workloads matching rules, grouped by
+// namespace, workload and shard
+func discoverRedis(ctx context.Context, kube KubeClient, rules DiscoveryRules) ([]DiscoveredRedis, error) {
+    fmt.Println("Discovering Redis resources via the Kubernetes API...")
+
+    // 1. Get all StatefulSets and Deployments
+    statefulSets, err := kube.ListStatefulSets(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get sts: %w", err)
+    }
+    deployments, err := kube.ListDeployments(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get deployments: %w", err)
+    }
+    var workloads []workload
+    for _, sts := range statefulSets {
+        workloads = append(workloads, workload{"StatefulSet", sts.ObjectMeta, sts.Spec.Selector, sts.Spec.Template})
+    }
+    for _, d := range deployments {
+        workloads = append(workloads, workload{"Deployment", d.ObjectMeta, d.Spec.Selector, d.Spec.Template})
+    }
+
+    results := []DiscoveredRedis{}
+    members := map[string][]redisPod{}
+    // 2. Fetch the pods of each Redis workload using its selector
+    for _, w := range workloads {
+        kind, name := w.kind, w.meta.Name
+        owned := false
+        for _, owner := range w.meta.OwnerReferences {
+            if operatorKinds[owner.Kind] {
+                kind, name, owned = owner.Kind, owner.Name, true
+                break
+            }
         }
-        type PodList struct {
-            Items []PodItem `json:"items"`
+        if (!owned && !rules.matchTemplate(w.template)) || !rules.matchPorts(w.template) {
+            continue
         }
 
-        var podList PodList 
-        if err := json.Unmarshal(outPods, &podList); err != nil {
+        if w.selector == nil {
+            continue
+        }
+        selector, err := metav1.LabelSelectorAsSelector(w.selector)
+        if err != nil || selector.Empty() {
+            continue
+        }
+        podList, err := kube.ListPods(ctx, w.meta.Namespace, selector)
+        if err != nil {
+            fmt.Printf("Error getting pods for %s %s: %v\n", w.kind, w.meta.Name, err)
             continue
         }
-
         pods := []string{}
-        for _, pod := range podList.Items {
-             pods = append(pods, pod.Metadata.Name)
-        }
-        fmt.Printf("STS %s/%s: Found %d pods.\n", sts.Metadata.Namespace, sts.Metadata.Name, len(pods))
-
-        if len(pods) > 0 {
-            // Check if we already have an entry for this namespace in results?
-            // The existing structure is []DiscoveredRedis{ Namespace, Pods[] }.
-            // Accessing/Merging is O(N).
-            // Let's optimize: map keys first.
-            found := false
-            for i := range results {
-                if results[i].Namespace == sts.Metadata.Namespace {
-                    results[i].Pods = append(results[i].Pods, pods...)
-                    found = true
-                    break
-                }
+        for _, pod := range podList {
+            pods = append(pods, pod.Name)
+        }
+        fmt.Printf("%s %s/%s: Found %d pods.\n", w.kind, w.meta.Namespace, w.meta.Name, len(pods))
+        if len(pods) == 0 {
+            continue
+        }
+
+        var ns *DiscoveredRedis
+        for i := range results {
+            if results[i].Namespace == w.meta.Namespace {
+                ns = &results[i]
+                break
             }
-            if !found {
-               results = append(results, DiscoveredRedis{
-                   Namespace: sts.Metadata.Namespace,
-                   Pods:      pods,
-               }) 
+        }
+        if ns == nil {
+            results = append(results, DiscoveredRedis{Namespace: w.meta.Namespace, Pods: []string{}})
+            ns = &results[len(results)-1]
+        }
+        ns.Pods = append(ns.Pods, pods...)
+        for _, pod := range podList {
+            members[w.meta.Namespace] = append(members[w.meta.Namespace], redisPod{pod, name})
+        }
+        // the leader and follower StatefulSets of an operator's cluster are one workload
+        found := false
+        for i := range ns.Workloads {
+            if ns.Workloads[i].Kind == kind && ns.Workloads[i].Name == name {
+                ns.Workloads[i].Pods = append(ns.Workloads[i].Pods, pods...)
+                found = true
+                break
             }
         }
+        if !found {
+            ns.Workloads = append(ns.Workloads, DiscoveredWorkload{Kind: kind, Name: name, Pods: pods})
+        }
     }
-    fmt.Printf("Total unique namespaces with Redis: %d\n", len(namespaces))
 
-    // Save to Cache
-    if jsonBytes, err := json.Marshal(results); err == nil {
-        SaveDiscoveryCache(jsonBytes)
+    // 3. Group the pods into master/replica sets
+    for i := range results {
+        ns := &results[i]
+        var infos map[string]*replicationInfo
+        if rules.Info {
+            infos = replicationInfos(ctx, kube, ns.Namespace, members[ns.Namespace], rules)
+        }
+        ns.Shards = groupShards(members[ns.Namespace], infos)
     }
-
+    fmt.Printf("Total unique namespaces with Redis: %d\n", len(results))
     return results, nil
 }
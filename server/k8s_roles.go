@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	RoleMaster  = "master"
+	RoleReplica = "replica"
+)
+
+// DiscoveredShard is a master and its replicas
+type DiscoveredShard struct {
+	Name      string          `json:"name"`
+	Pods      []DiscoveredPod `json:"pods"`      // masters first
+	Preferred string          `json:"preferred"` // the pod to import from
+}
+
+// DiscoveredPod is a Redis pod and its replication role
+type DiscoveredPod struct {
+	Name    string `json:"name"`
+	Role    string `json:"role,omitempty"`   // master or replica, empty if unknown
+	Source  string `json:"source,omitempty"` // where the role comes from: label or info
+	Healthy bool   `json:"healthy"`          // ready, and in sync with its master for a replica
+	Lag     int64  `json:"lag,omitempty"`    // bytes of replication stream behind the master
+}
+
+// roleLabels are the pod labels charts and operators keep the role in
+var roleLabels = []string{
+	"redisfailovers-role",         // spotahome/redis-operator: master, slave
+	"redis-role",                  // OT-CONTAINER-KIT/redis-operator: master, slave
+	"role",                        // OT-CONTAINER-KIT RedisCluster: leader, follower
+	"app.kubernetes.io/component", // Bitnami: master, replica
+}
+
+// roleFromLabels returns the role of a pod from its labels, empty if unknown
+func roleFromLabels(labels map[string]string) string {
+	for _, key := range roleLabels {
+		switch strings.ToLower(labels[key]) {
+		case "master", "primary", "leader":
+			return RoleMaster
+		case "replica", "slave", "follower", "secondary":
+			return RoleReplica
+		}
+	}
+	return ""
+}
+
+// replicationInfo is the output of INFO replication
+type replicationInfo struct {
+	role       string
+	masterHost string // of a replica
+	linkUp     bool
+	syncing    bool
+	offset     int64 // master_repl_offset of a master, slave_repl_offset of a replica
+}
+
+func parseReplicationInfo(out []byte) (*replicationInfo, error) {
+	info := &replicationInfo{}
+	fields := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":"); ok {
+			fields[key] = value
+		}
+	}
+	switch fields["role"] {
+	case "master":
+		info.role = RoleMaster
+		info.offset, _ = strconv.ParseInt(fields["master_repl_offset"], 10, 64)
+	case "slave":
+		info.role = RoleReplica
+		info.masterHost = fields["master_host"]
+		info.linkUp = fields["master_link_status"] == "up"
+		info.syncing = fields["master_sync_in_progress"] == "1"
+		info.offset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	default:
+		return nil, fmt.Errorf("no role in INFO replication: %q", strings.TrimSpace(string(out)))
+	}
+	return info, nil
+}
+
+// infoCommand runs INFO replication with password, or the REDIS_PASSWORD of
+// the pod (set by the Bitnami chart and others) if password is empty. The
+// password is sent on stdin: exec arguments are query parameters of the
+// request the API server may log, and would show in the process list.
+// redis-cli gets it through REDISCLI_AUTH.
+func infoCommand(password string) ([]string, io.Reader) {
+	if password == "" {
+		return []string{"sh", "-c", `[ -n "$REDIS_PASSWORD" ] && export REDISCLI_AUTH="$REDIS_PASSWORD"; exec redis-cli INFO replication`}, nil
+	}
+	return []string{"sh", "-c", infoAuthScript}, strings.NewReader(password + "\n")
+}
+
+// infoAuthScript reads the password of INFO replication from stdin
+const infoAuthScript = `IFS= read -r REDISCLI_AUTH; export REDISCLI_AUTH; exec redis-cli INFO replication`
+
+// replicationInfos runs INFO replication in the Redis container of each pod,
+// pods where it fails are left out
+func replicationInfos(ctx context.Context, kube KubeClient, namespace string, pods []redisPod, rules DiscoveryRules) map[string]*replicationInfo {
+	infos := map[string]*replicationInfo{}
+	for _, p := range pods {
+		var out bytes.Buffer
+		podCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		command, stdin := infoCommand(rules.Password)
+		err := kube.Exec(podCtx, namespace, p.pod.Name, rules.redisContainer(p.pod.Spec), command, stdin, &out)
+		cancel()
+		if err == nil {
+			var info *replicationInfo
+			if info, err = parseReplicationInfo(out.Bytes()); err == nil {
+				infos[p.pod.Name] = info
+				continue
+			}
+		}
+		fmt.Printf("INFO replication in %s/%s: %v\n", namespace, p.pod.Name, err)
+	}
+	return infos
+}
+
+// redisPod is a pod of a discovered workload
+type redisPod struct {
+	pod      corev1.Pod
+	workload string
+}
+
+func podReady(pod corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// groupShards groups the pods of a namespace into shards. A replica that
+// reported its master in INFO joins the master's shard, other pods are
+// grouped by their app.kubernetes.io/instance label, else their workload.
+// Labels cannot pair the masters and replicas of a Redis Cluster, which is
+// then one shard per workload.
+func groupShards(pods []redisPod, infos map[string]*replicationInfo) []DiscoveredShard {
+	// the pod a replica's master_host names: its IP, name or DNS name
+	masterPod := func(host string) string {
+		for _, p := range pods {
+			if host != "" && (host == p.pod.Status.PodIP || host == p.pod.Name || strings.HasPrefix(host, p.pod.Name+".")) {
+				return p.pod.Name
+			}
+		}
+		return ""
+	}
+
+	var shards []DiscoveredShard
+	index := map[string]int{}
+	masterOf := map[string]string{}
+	for _, p := range pods {
+		dp := DiscoveredPod{Name: p.pod.Name, Healthy: podReady(p.pod)}
+		key, name := "workload/"+p.workload, p.workload
+		if instance := p.pod.Labels["app.kubernetes.io/instance"]; instance != "" {
+			key, name = "instance/"+instance, instance
+		}
+		if info := infos[p.pod.Name]; info != nil {
+			dp.Role, dp.Source = info.role, "info"
+			if info.role == RoleMaster {
+				key, name = "master/"+p.pod.Name, p.pod.Name
+			} else if m := masterPod(info.masterHost); m != "" {
+				key, name = "master/"+m, m
+				masterOf[p.pod.Name] = m
+			} else if info.masterHost != "" {
+				key, name = "host/"+info.masterHost, info.masterHost
+			}
+			if info.role == RoleReplica && (!info.linkUp || info.syncing) {
+				dp.Healthy = false
+			}
+		} else if role := roleFromLabels(p.pod.Labels); role != "" {
+			dp.Role, dp.Source = role, "label"
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(shards)
+			index[key] = i
+			shards = append(shards, DiscoveredShard{Name: name})
+		}
+		shards[i].Pods = append(shards[i].Pods, dp)
+	}
+
+	for i := range shards {
+		s := &shards[i]
+		for j := range s.Pods {
+			dp := &s.Pods[j]
+			if m := masterOf[dp.Name]; m != "" && infos[m] != nil {
+				if lag := infos[m].offset - infos[dp.Name].offset; lag > 0 {
+					dp.Lag = lag
+				}
+			}
+		}
+		rank := map[string]int{RoleMaster: 0, RoleReplica: 1, "": 2}
+		sort.SliceStable(s.Pods, func(a, b int) bool {
+			return rank[s.Pods[a].Role] < rank[s.Pods[b].Role]
+		})
+		s.Preferred = preferredPod(s.Pods)
+	}
+	return shards
+}
+
+// preferredPod is the healthy replica with the least lag, else a healthy
+// master, else the first healthy pod
+func preferredPod(pods []DiscoveredPod) string {
+	best := -1
+	for i, p := range pods {
+		if p.Role == RoleReplica && p.Healthy && (best < 0 || p.Lag < pods[best].Lag) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return pods[best].Name
+	}
+	for _, role := range []string{RoleMaster, ""} {
+		for _, p := range pods {
+			if p.Healthy && (p.Role == role || role == "") {
+				return p.Name
+			}
+		}
+	}
+	if len(pods) > 0 {
+		return pods[0].Name
+	}
+	return ""
+}
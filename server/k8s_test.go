@@ -0,0 +1,899 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hdt3213/rdb/crc64jones"
+	"github.com/klauspost/compress/zstd"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+func podTemplate(image string, labels map[string]string, ports ...int32) corev1.PodTemplateSpec {
+	c := corev1.Container{Name: "main", Image: image}
+	for _, p := range ports {
+		c.Ports = append(c.Ports, corev1.ContainerPort{ContainerPort: p})
+	}
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{c}},
+	}
+}
+
+func ownedBy(kind, name string) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{Kind: kind, Name: name}}
+}
+
+// statefulSet selects the pods labelled app=name
+func statefulSet(namespace, name string, tmpl corev1.PodTemplateSpec, owners []metav1.OwnerReference) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, OwnerReferences: owners},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			Template: tmpl,
+		},
+	}
+}
+
+// deployment selects the pods labelled app=name
+func deployment(namespace, name string, tmpl corev1.PodTemplateSpec, owners []metav1.OwnerReference) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, OwnerReferences: owners},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			Template: tmpl,
+		},
+	}
+}
+
+// pod is labelled app=app
+func pod(namespace, name, app string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"app": app}}}
+}
+
+// remoteFS is the file system of a fake pod, exec runs stat, du, cat, tail,
+// sha256sum, tar, pwd, listRDBScript, codecScript and compressScript on it.
+// The compressors of the pod are the files /usr/bin/zstd and /usr/bin/gzip.
+type remoteFS map[string][]byte
+
+// remoteModTime is the modification time of the files of a remoteFS
+var remoteModTime = time.Now().Add(-time.Minute).Truncate(time.Second)
+
+func (fs remoteFS) exec(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fail := func(msg string) error {
+		fmt.Fprintln(stderr, msg)
+		return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 1"), Code: 1}
+	}
+	path := command[len(command)-1]
+	switch command[0] {
+	case "stat":
+		if data, ok := fs[path]; ok {
+			fmt.Fprintf(stdout, "%d %d regular file\n", len(data), remoteModTime.Unix())
+			return nil
+		}
+		if files := fs.dir(path); len(files) > 0 {
+			fmt.Fprintf(stdout, "4096 %d directory\n", remoteModTime.Unix())
+			return nil
+		}
+		return fail("stat: can't stat '" + path + "': No such file or directory")
+	case "du":
+		var size int
+		for _, data := range fs.dir(path) {
+			size += len(data)
+		}
+		fmt.Fprintf(stdout, "%d\t%s\n", size, path)
+	case "cat":
+		data, ok := fs[path]
+		if !ok {
+			return fail("cat: can't open '" + path + "': No such file or directory")
+		}
+		stdout.Write(data)
+	case "tail":
+		data, ok := fs[path]
+		offset, err := strconv.Atoi(strings.TrimPrefix(command[2], "+"))
+		if !ok || err != nil || offset < 1 {
+			return fail("tail: invalid arguments")
+		}
+		stdout.Write(data[min(offset-1, len(data)):])
+	case "sha256sum":
+		data, ok := fs[path]
+		if !ok {
+			return fail("sha256sum: " + path + ": No such file or directory")
+		}
+		fmt.Fprintf(stdout, "%x  %s\n", sha256.Sum256(data), path)
+	case "tar":
+		tw := tar.NewWriter(stdout)
+		for name, data := range fs.dir(command[4]) {
+			tw.WriteHeader(&tar.Header{Name: "./" + name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+			tw.Write(data)
+		}
+		tw.Close()
+		// tar pads the archive to a 10 KiB record
+		stdout.Write(make([]byte, 10240))
+	case "pwd":
+		fmt.Fprintln(stdout, "/data")
+	case "sh":
+		switch command[2] {
+		case codecScript:
+			for _, c := range command[4:] {
+				if _, ok := fs["/usr/bin/"+c]; ok {
+					fmt.Fprintln(stdout, c)
+					break
+				}
+			}
+			return nil
+		case compressScript:
+			var zw io.WriteCloser
+			switch command[4] {
+			case "gzip":
+				zw = gzip.NewWriter(stdout)
+			case "zstd":
+				zw, _ = zstd.NewWriter(stdout)
+			}
+			err := fs.exec(ctx, namespace, pod, container, command[5:], stdin, zw, stderr)
+			zw.Close()
+			return err
+		case listRDBScript:
+		default:
+			return fail("sh: unexpected script")
+		}
+		dir, dbfilename := command[4], command[5]
+		for _, name := range fs.entries(dir) {
+			match := name == dbfilename
+			for _, pattern := range []string{"*.rdb", "*.rdb.*", "appendonlydir*"} {
+				if ok, _ := filepath.Match(pattern, name); ok {
+					match = true
+				}
+			}
+			if !match {
+				continue
+			}
+			if data, ok := fs[dir+"/"+name]; ok {
+				fmt.Fprintf(stdout, "%d %d regular file %s/%s\n", len(data), remoteModTime.Unix(), dir, name)
+			} else {
+				fmt.Fprintf(stdout, "4096 %d directory %s/%s\n", remoteModTime.Unix(), dir, name)
+			}
+		}
+	default:
+		return fail(command[0] + ": not found")
+	}
+	return nil
+}
+
+func (fs remoteFS) dir(path string) map[string][]byte {
+	files := map[string][]byte{}
+	for name, data := range fs {
+		if filepath.Dir(name) == path {
+			files[filepath.Base(name)] = data
+		}
+	}
+	return files
+}
+
+// entries lists the files and subdirectories of a directory
+func (fs remoteFS) entries(path string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for name := range fs {
+		for ; name != "/" && name != "."; name = filepath.Dir(name) {
+			if filepath.Dir(name) == path && !seen[name] {
+				seen[name] = true
+				names = append(names, filepath.Base(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fakeKube(fs remoteFS, objects ...runtime.Object) *kubeClient {
+	return &kubeClient{clientset: fake.NewSimpleClientset(objects...), exec: fs.exec}
+}
+
+func TestDiscoverRedis(t *testing.T) {
+	redis := podTemplate("redis:7.2", nil, 6379)
+	kube := fakeKube(nil,
+		statefulSet("cache", "redis-main", redis, nil),
+		pod("cache", "redis-main-0", "redis-main"),
+		pod("cache", "redis-main-1", "redis-main"),
+		// same labels in another namespace
+		pod("other", "redis-main-0", "redis-main"),
+		statefulSet("cache", "postgres", podTemplate("postgres:16", nil, 5432), nil),
+		pod("cache", "postgres-0", "postgres"),
+		// named redis-* but not Redis
+		deployment("cache", "redis-commander", podTemplate("rediscommander/redis-commander:latest", nil, 8081), nil),
+		pod("cache", "redis-commander-abc12", "redis-commander"),
+		// Bitnami chart with a custom name
+		statefulSet("queue", "sessions", podTemplate("docker.io/bitnami/redis:7.2.4-debian-12-r0", nil, 6379), nil),
+		pod("queue", "sessions-0", "sessions"),
+		deployment("queue", "kv", podTemplate("valkey/valkey:8.0@sha256:0123", nil), nil),
+		pod("queue", "kv-7d9f-x1", "kv"),
+		// custom image, known label
+		statefulSet("queue", "store", podTemplate("mycorp/store:1", map[string]string{"app.kubernetes.io/name": "redis"}), nil),
+		pod("queue", "store-0", "store"),
+		// spotahome RedisFailover: Redis StatefulSet and Sentinel Deployment
+		statefulSet("ha", "rfr-main", redis, ownedBy("RedisFailover", "main")),
+		pod("ha", "rfr-main-0", "rfr-main"),
+		deployment("ha", "rfs-main", podTemplate("redis:7.2", nil, 26379), ownedBy("RedisFailover", "main")),
+		pod("ha", "rfs-main-abc12", "rfs-main"),
+		// OT RedisCluster: leader and follower StatefulSets
+		statefulSet("ot", "shards-leader", podTemplate("quay.io/opstree/redis:v7.0.12", nil, 6379), ownedBy("RedisCluster", "shards")),
+		pod("ot", "shards-leader-0", "shards-leader"),
+		statefulSet("ot", "shards-follower", podTemplate("quay.io/opstree/redis:v7.0.12", nil, 6379), ownedBy("RedisCluster", "shards")),
+		pod("ot", "shards-follower-0", "shards-follower"),
+	)
+	got, err := discoverRedis(context.Background(), kube, GetDiscoveryRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]DiscoveredWorkload{
+		"cache": {{"StatefulSet", "redis-main", []string{"redis-main-0", "redis-main-1"}}},
+		"queue": {
+			{"StatefulSet", "sessions", []string{"sessions-0"}},
+			{"StatefulSet", "store", []string{"store-0"}},
+			{"Deployment", "kv", []string{"kv-7d9f-x1"}},
+		},
+		"ha": {{"RedisFailover", "main", []string{"rfr-main-0"}}},
+		"ot": {{"RedisCluster", "shards", []string{"shards-follower-0", "shards-leader-0"}}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %v", got, want)
+	}
+	for _, d := range got {
+		if !reflect.DeepEqual(d.Workloads, want[d.Namespace]) {
+			t.Errorf("%s: workloads %+v, want %+v", d.Namespace, d.Workloads, want[d.Namespace])
+		}
+		var pods []string
+		for _, w := range want[d.Namespace] {
+			pods = append(pods, w.Pods...)
+		}
+		if !reflect.DeepEqual(d.Pods, pods) {
+			t.Errorf("%s: pods %v, want %v", d.Namespace, d.Pods, pods)
+		}
+	}
+}
+
+func TestDiscoveryRules(t *testing.T) {
+	t.Setenv("DISCOVERY_IMAGES", "store, dragonfly")
+	t.Setenv("DISCOVERY_LABELS", "tier=cache")
+	t.Setenv("DISCOVERY_PORTS", "6379,6380")
+	rules := GetDiscoveryRules()
+	tests := []struct {
+		name string
+		tmpl corev1.PodTemplateSpec
+		want bool
+	}{
+		{"image", podTemplate("registry.local:5000/team/store:1.0", nil, 6380), true},
+		{"label", podTemplate("mycorp/app:1", map[string]string{"tier": "cache"}), true},
+		{"default image no longer matches", podTemplate("redis:7.2", nil, 6379), false},
+		{"no redis port", podTemplate("dragonfly:1", nil, 26379), false},
+	}
+	for _, tt := range tests {
+		if got := rules.matchTemplate(tt.tmpl) && rules.matchPorts(tt.tmpl); got != tt.want {
+			t.Errorf("%s: match %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the REDIS_PASSWORD of the analyzer is not sent to the pods
+	t.Setenv("REDIS_PASSWORD", "analyzer")
+	if got := GetDiscoveryRules().Password; got != "" {
+		t.Errorf("password %q from REDIS_PASSWORD, want the pod's", got)
+	}
+	t.Setenv("DISCOVERY_PASSWORD", "pods")
+	if got := GetDiscoveryRules().Password; got != "pods" {
+		t.Errorf("password %q, want DISCOVERY_PASSWORD", got)
+	}
+}
+
+// replicaInfo is the INFO replication of a replica of master
+func replicaInfo(master, link string, offset int64) string {
+	return fmt.Sprintf("# Replication\r\nrole:slave\r\nmaster_host:%s\r\nmaster_port:6379\r\nmaster_link_status:%s\r\nmaster_sync_in_progress:0\r\nslave_repl_offset:%d\r\n", master, link, offset)
+}
+
+func TestGroupShards(t *testing.T) {
+	member := func(name, workload, ip string, ready bool, labels map[string]string) redisPod {
+		p := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}, Status: corev1.PodStatus{PodIP: ip}}
+		status := corev1.ConditionFalse
+		if ready {
+			status = corev1.ConditionTrue
+		}
+		p.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}
+		return redisPod{p, workload}
+	}
+	bitnami := func(component string) map[string]string {
+		return map[string]string{"app.kubernetes.io/instance": "sessions", "app.kubernetes.io/component": component}
+	}
+	tests := []struct {
+		name  string
+		pods  []redisPod
+		infos map[string]string // INFO replication output per pod
+		want  []DiscoveredShard
+	}{
+		{
+			name: "Bitnami labels",
+			pods: []redisPod{
+				member("sessions-master-0", "sessions-master", "", true, bitnami("master")),
+				member("sessions-replicas-0", "sessions-replicas", "", false, bitnami("replica")),
+				member("sessions-replicas-1", "sessions-replicas", "", true, bitnami("replica")),
+			},
+			want: []DiscoveredShard{{Name: "sessions", Preferred: "sessions-replicas-1", Pods: []DiscoveredPod{
+				{Name: "sessions-master-0", Role: RoleMaster, Source: "label", Healthy: true},
+				{Name: "sessions-replicas-0", Role: RoleReplica, Source: "label"},
+				{Name: "sessions-replicas-1", Role: RoleReplica, Source: "label", Healthy: true},
+			}}},
+		},
+		{
+			name: "no replica",
+			pods: []redisPod{member("cache-0", "cache", "", true, nil)},
+			want: []DiscoveredShard{{Name: "cache", Preferred: "cache-0", Pods: []DiscoveredPod{{Name: "cache-0", Healthy: true}}}},
+		},
+		{
+			// the labels still name rfr-main-0 master from before a failover
+			name: "INFO after a failover",
+			pods: []redisPod{
+				member("rfr-main-0", "main", "10.0.0.1", true, map[string]string{"redisfailovers-role": "master"}),
+				member("rfr-main-1", "main", "10.0.0.2", true, map[string]string{"redisfailovers-role": "slave"}),
+				member("rfr-main-2", "main", "10.0.0.3", true, map[string]string{"redisfailovers-role": "slave"}),
+				member("rfr-main-3", "main", "10.0.0.4", true, nil),
+			},
+			infos: map[string]string{
+				"rfr-main-0": replicaInfo("10.0.0.2", "up", 900),
+				"rfr-main-1": "# Replication\r\nrole:master\r\nconnected_slaves:2\r\nmaster_repl_offset:1000\r\n",
+				"rfr-main-2": replicaInfo("10.0.0.2", "up", 1000),
+				"rfr-main-3": replicaInfo("rfr-main-1.rfr-main.ha.svc.cluster.local", "down", 0),
+			},
+			want: []DiscoveredShard{{Name: "rfr-main-1", Preferred: "rfr-main-2", Pods: []DiscoveredPod{
+				{Name: "rfr-main-1", Role: RoleMaster, Source: "info", Healthy: true},
+				{Name: "rfr-main-0", Role: RoleReplica, Source: "info", Healthy: true, Lag: 100},
+				{Name: "rfr-main-2", Role: RoleReplica, Source: "info", Healthy: true},
+				{Name: "rfr-main-3", Role: RoleReplica, Source: "info", Lag: 1000},
+			}}},
+		},
+		{
+			name: "INFO of two shards",
+			pods: []redisPod{
+				member("shards-leader-0", "shards", "10.0.1.1", true, map[string]string{"role": "leader"}),
+				member("shards-leader-1", "shards", "10.0.1.2", true, map[string]string{"role": "leader"}),
+				member("shards-follower-0", "shards", "10.0.1.3", true, map[string]string{"role": "follower"}),
+				member("shards-follower-1", "shards", "10.0.1.4", true, map[string]string{"role": "follower"}),
+			},
+			infos: map[string]string{
+				"shards-leader-0":   "role:master\nmaster_repl_offset:10\n",
+				"shards-leader-1":   "role:master\nmaster_repl_offset:10\n",
+				"shards-follower-0": replicaInfo("10.0.1.2", "up", 10),
+				"shards-follower-1": replicaInfo("10.0.1.1", "up", 10),
+			},
+			want: []DiscoveredShard{
+				{Name: "shards-leader-0", Preferred: "shards-follower-1", Pods: []DiscoveredPod{
+					{Name: "shards-leader-0", Role: RoleMaster, Source: "info", Healthy: true},
+					{Name: "shards-follower-1", Role: RoleReplica, Source: "info", Healthy: true},
+				}},
+				{Name: "shards-leader-1", Preferred: "shards-follower-0", Pods: []DiscoveredPod{
+					{Name: "shards-leader-1", Role: RoleMaster, Source: "info", Healthy: true},
+					{Name: "shards-follower-0", Role: RoleReplica, Source: "info", Healthy: true},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		infos := map[string]*replicationInfo{}
+		for pod, out := range tt.infos {
+			info, err := parseReplicationInfo([]byte(out))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			infos[pod] = info
+		}
+		if got := groupShards(tt.pods, infos); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseReplicationInfo([]byte("NOAUTH Authentication required.")); err == nil {
+		t.Error("parsed an error reply")
+	}
+}
+
+func TestDiscoverRoles(t *testing.T) {
+	var commands [][]string
+	var stdins []string
+	kube := fakeKube(nil,
+		statefulSet("cache", "redis", podTemplate("redis:7.2", nil), nil),
+		pod("cache", "redis-0", "redis"),
+	)
+	kube.exec = func(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+		commands = append(commands, command)
+		if stdin != nil {
+			in, _ := io.ReadAll(stdin)
+			stdins = append(stdins, string(in))
+		}
+		fmt.Fprint(stdout, "role:master\nmaster_repl_offset:0\n")
+		return nil
+	}
+	rules := GetDiscoveryRules()
+	for _, info := range []bool{false, true} {
+		rules.Info, rules.Password = info, "it's secret"
+		got, err := discoverRedis(context.Background(), kube, rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []DiscoveredShard{{Name: "redis", Preferred: "redis-0", Pods: []DiscoveredPod{{Name: "redis-0"}}}}
+		if info {
+			// a shard found by INFO is named after its master
+			want[0].Name = "redis-0"
+			want[0].Pods[0].Role, want[0].Pods[0].Source = RoleMaster, "info"
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0].Shards, want) {
+			t.Errorf("info %v: shards %+v, want %+v", info, got, want)
+		}
+	}
+	// the password is only on stdin, never in the exec request
+	want := [][]string{{"sh", "-c", infoAuthScript}}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands %q, want %q", commands, want)
+	}
+	if !reflect.DeepEqual(stdins, []string{"it's secret\n"}) {
+		t.Errorf("stdin %q, want the password", stdins)
+	}
+}
+
+func TestStatRemote(t *testing.T) {
+	kube := fakeKube(remoteFS{
+		"/data/dump.rdb": make([]byte, 1234),
+		"/data/appendonlydir/appendonly.aof.1.base.rdb": make([]byte, 100),
+		"/data/appendonlydir/appendonly.aof.1.incr.aof": make([]byte, 20),
+		"/data/appendonlydir/appendonly.aof.manifest":   make([]byte, 3),
+	})
+	tests := []struct {
+		path  string
+		size  int64
+		isDir bool
+		code  int // exit code of the failing command, 0 on success
+	}{
+		{path: "/data/dump.rdb", size: 1234},
+		{path: "/data/appendonlydir", size: 123, isDir: true},
+		{path: "/data/missing.rdb", code: 1},
+	}
+	for _, tt := range tests {
+		rf, err := StatRemote(context.Background(), kube, "cache", "redis-0", "", tt.path)
+		if tt.code != 0 {
+			var execErr *ExecError
+			if !errors.As(err, &execErr) || execErr.Code != tt.code || execErr.Stderr == "" {
+				t.Errorf("%s: error %v, want exit code %d with stderr", tt.path, err, tt.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if rf.Size != tt.size || rf.IsDir != tt.isDir || !rf.ModTime.Equal(remoteModTime) {
+			t.Errorf("%s: size %d dir %v mtime %v, want %d %v %v", tt.path, rf.Size, rf.IsDir, rf.ModTime, tt.size, tt.isDir, remoteModTime)
+		}
+	}
+}
+
+func TestCopyFromPod(t *testing.T) {
+	fs := remoteFS{
+		"/data/dump.rdb": []byte("REDIS0011 rdb content"),
+		"/data/appendonlydir/appendonly.aof.1.base.rdb": []byte("REDIS0011 base"),
+		"/data/appendonlydir/appendonly.aof.1.incr.aof": []byte("*1\r\n$4\r\nPING\r\n"),
+		"/data/appendonlydir/appendonly.aof.manifest":   []byte("file appendonly.aof.1.base.rdb seq 1 type b\n"),
+	}
+	kube := fakeKube(fs)
+	ctx := context.Background()
+	tmp := t.TempDir()
+
+	rf, err := StatRemote(ctx, kube, "cache", "redis-0", "", "/data/dump.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(tmp, "dump.rdb")
+	if err := CopyFromPod(ctx, kube, "cache", "redis-0", "", rf, local); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(local); !bytes.Equal(data, fs["/data/dump.rdb"]) {
+		t.Errorf("copied %q", data)
+	}
+
+	rf, err = StatRemote(ctx, kube, "cache", "redis-0", "", "/data/appendonlydir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localDir := filepath.Join(tmp, "aof")
+	if err := CopyFromPod(ctx, kube, "cache", "redis-0", "", rf, localDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range fs.dir("/data/appendonlydir") {
+		if got, _ := os.ReadFile(filepath.Join(localDir, name)); !bytes.Equal(got, data) {
+			t.Errorf("%s: copied %q, want %q", name, got, data)
+		}
+	}
+
+	missing := &RemoteFile{Path: "/data/missing.rdb"}
+	if err := CopyFromPod(ctx, kube, "cache", "redis-0", "", missing, filepath.Join(tmp, "missing.rdb")); err == nil {
+		t.Error("copying a missing file succeeded")
+	}
+}
+
+// testRDB is an RDB with body and a valid CRC64 trailer, unless badCRC
+func testRDB(body string, badCRC bool) []byte {
+	data := append([]byte("REDIS0011"), body...)
+	data = append(data, 0xFF)
+	crc := crc64jones.New()
+	crc.Write(data)
+	sum := crc.Sum64()
+	if badCRC {
+		sum++
+	}
+	return binary.LittleEndian.AppendUint64(data, sum)
+}
+
+// cutStreams makes the first n copies of exec stop after 16 bytes
+func cutStreams(exec execFunc, n int) execFunc {
+	return func(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+		copying := command[0] == "cat" || command[0] == "tail" || command[0] == "sh" && command[2] == compressScript
+		if !copying || n == 0 {
+			return exec(ctx, namespace, pod, container, command, stdin, stdout, stderr)
+		}
+		n--
+		var buf bytes.Buffer
+		exec(ctx, namespace, pod, container, command, stdin, &buf, stderr)
+		stdout.Write(buf.Bytes()[:min(16, buf.Len())])
+		return errors.New("stream error: connection reset by peer")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	rdb := testRDB(strings.Repeat("payload-", 10), false)
+	tests := []struct {
+		name        string
+		fs          remoteFS
+		wrap        func(execFunc) execFunc
+		retries     int
+		rateLimit   int64
+		compression string
+		minTime     time.Duration
+		err         bool
+		warnings    int
+		statuses    []string // substrings of the status messages, in order
+	}{
+		{name: "first attempt", fs: remoteFS{"/data/dump.rdb": rdb}},
+		{
+			name:     "zstd",
+			fs:       remoteFS{"/data/dump.rdb": rdb, "/usr/bin/zstd": nil, "/usr/bin/gzip": nil},
+			statuses: []string{"zstd on the wire"},
+		},
+		{
+			name:     "gzip",
+			fs:       remoteFS{"/data/dump.rdb": rdb, "/usr/bin/gzip": nil},
+			statuses: []string{"gzip on the wire"},
+		},
+		{
+			name:        "compression disabled",
+			fs:          remoteFS{"/data/dump.rdb": rdb, "/usr/bin/gzip": nil},
+			compression: "none",
+		},
+		{
+			name:     "resumed with gzip",
+			fs:       remoteFS{"/data/dump.rdb": rdb, "/usr/bin/gzip": nil},
+			wrap:     func(exec execFunc) execFunc { return cutStreams(exec, 1) },
+			statuses: []string{"gzip on the wire", "resuming"},
+		},
+		{
+			// a burst of 64 bytes, then 64 bytes per second
+			name:      "rate limited",
+			fs:        remoteFS{"/data/dump.rdb": rdb},
+			rateLimit: 64,
+			minTime:   200 * time.Millisecond,
+		},
+		{
+			name:     "resumed",
+			fs:       remoteFS{"/data/dump.rdb": rdb},
+			wrap:     func(exec execFunc) execFunc { return cutStreams(exec, 2) },
+			statuses: []string{"interrupted at 16 B", "interrupted at 32 B"},
+		},
+		{
+			name: "corrupted in transit",
+			fs:   remoteFS{"/data/dump.rdb": rdb},
+			wrap: func(exec execFunc) execFunc {
+				corrupt := true
+				return func(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+					if command[0] != "cat" || !corrupt {
+						return exec(ctx, namespace, pod, container, command, stdin, stdout, stderr)
+					}
+					corrupt = false
+					var buf bytes.Buffer
+					err := exec(ctx, namespace, pod, container, command, stdin, &buf, stderr)
+					buf.Bytes()[20] ^= 1
+					stdout.Write(buf.Bytes())
+					return err
+				}
+			},
+			statuses: []string{"failed verification"},
+		},
+		{
+			name: "no sha256sum",
+			fs:   remoteFS{"/data/dump.rdb": rdb},
+			wrap: func(exec execFunc) execFunc {
+				return func(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+					if command[0] == "sha256sum" {
+						command = append([]string{"missing"}, command[1:]...)
+					}
+					return exec(ctx, namespace, pod, container, command, stdin, stdout, stderr)
+				}
+			},
+			warnings: 1,
+		},
+		{
+			name: "bad CRC64 without sha256sum",
+			fs:   remoteFS{"/data/dump.rdb": testRDB("payload", true)},
+			wrap: func(exec execFunc) execFunc {
+				return func(ctx context.Context, namespace, pod, container string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+					if command[0] == "sha256sum" {
+						command = append([]string{"missing"}, command[1:]...)
+					}
+					return exec(ctx, namespace, pod, container, command, stdin, stdout, stderr)
+				}
+			},
+			retries: 1,
+			err:     true,
+		},
+		{name: "bad CRC64 in the pod", fs: remoteFS{"/data/dump.rdb": testRDB("payload", true)}, warnings: 1},
+		{
+			name:    "retries exhausted",
+			fs:      remoteFS{"/data/dump.rdb": rdb},
+			wrap:    func(exec execFunc) execFunc { return cutStreams(exec, 10) },
+			retries: 2,
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kube := fakeKube(tt.fs)
+			if tt.wrap != nil {
+				kube.exec = tt.wrap(kube.exec)
+			}
+			ctx := context.Background()
+			rf, err := StatRemote(ctx, kube, "cache", "redis-0", "", "/data/dump.rdb")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statuses []string
+			var done, total int64
+			opts := DownloadOptions{
+				Retries:     tt.retries,
+				Backoff:     time.Millisecond,
+				RateLimit:   tt.rateLimit,
+				Compression: tt.compression,
+				Status:      func(msg string) { statuses = append(statuses, msg) },
+				Progress:    func(d, t int64) { done, total = d, t },
+			}
+			if opts.Retries == 0 {
+				opts.Retries = 3
+			}
+			local := filepath.Join(t.TempDir(), "dump.rdb")
+			start := time.Now()
+			warnings, err := Download(ctx, kube, "cache", "redis-0", "", rf, local, opts)
+			if tt.err {
+				if err == nil {
+					t.Fatal("download succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(local); !bytes.Equal(data, tt.fs["/data/dump.rdb"]) {
+				t.Errorf("copied %q", data)
+			}
+			if len(warnings) != tt.warnings {
+				t.Errorf("warnings %q, want %d", warnings, tt.warnings)
+			}
+			if size := int64(len(tt.fs["/data/dump.rdb"])); done != size || total != size {
+				t.Errorf("progress %d/%d, want %d/%d", done, total, size, size)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minTime {
+				t.Errorf("took %s, want at least %s", elapsed, tt.minTime)
+			}
+			if len(statuses) != len(tt.statuses) {
+				t.Fatalf("statuses %q, want %q", statuses, tt.statuses)
+			}
+			for i, want := range tt.statuses {
+				if !strings.Contains(statuses[i], want) {
+					t.Errorf("status %q, want %q", statuses[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunPreflight(t *testing.T) {
+	redisPod := func(containers ...corev1.Container) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "cache", Name: "redis-0"}, Spec: corev1.PodSpec{Containers: containers}}
+	}
+	volume := func(c corev1.Container, mountPath string) corev1.Container {
+		c.VolumeMounts = append(c.VolumeMounts,
+			corev1.VolumeMount{Name: "token", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"},
+			corev1.VolumeMount{Name: "data", MountPath: mountPath})
+		return c
+	}
+	exporter := corev1.Container{Name: "metrics", Image: "oliver006/redis_exporter:v1.58.0", Ports: []corev1.ContainerPort{{ContainerPort: 9121}}}
+	tests := []struct {
+		name      string
+		pod       *corev1.Pod
+		fs        remoteFS
+		container string
+		dir       string
+		path      string
+		conf      string
+		warnings  int
+	}{
+		{
+			name:      "official image defaults",
+			pod:       redisPod(corev1.Container{Name: "redis", Image: "redis:7.2"}),
+			fs:        remoteFS{"/data/dump.rdb": make([]byte, 10)},
+			container: "redis", dir: "/data", path: "/data/dump.rdb",
+		},
+		{
+			name: "config file in the args of a sidecar pod",
+			pod: redisPod(exporter, volume(corev1.Container{
+				Name: "server", Image: "registry.local/redis:7.2", Args: []string{"redis-server", "/etc/redis/redis.conf", "--dbfilename", "cache.rdb"},
+				Ports: []corev1.ContainerPort{{ContainerPort: 6379}},
+			}, "/var/lib/redis")),
+			fs: remoteFS{
+				"/etc/redis/redis.conf":     []byte("# persistence\ndir /var/lib/redis\ndbfilename \"dump.rdb\"\nsave 3600 1\n"),
+				"/var/lib/redis/cache.rdb":  make([]byte, 10),
+				"/var/lib/redis/backup.rdb": make([]byte, 5),
+			},
+			container: "server", dir: "/var/lib/redis", path: "/var/lib/redis/cache.rdb", conf: "/etc/redis/redis.conf",
+		},
+		{
+			name: "Bitnami start script, data on the volume",
+			pod: redisPod(volume(corev1.Container{
+				Name: "redis", Image: "docker.io/bitnami/redis:7.2.4", Command: []string{"/bin/bash", "-c"},
+				Args: []string{"/opt/bitnami/scripts/start-scripts/start-master.sh"},
+			}, "/data"), exporter),
+			fs: remoteFS{
+				"/proc/1/cmdline":                             []byte("redis-server *:6379\x00"),
+				"/opt/bitnami/redis/etc/redis.conf":           []byte("dir /opt/bitnami/redis/data\ninclude /opt/bitnami/redis/mounted-etc/replica.conf\n"),
+				"/opt/bitnami/redis/mounted-etc/replica.conf": []byte("appendonly no\n"),
+				"/data/dump.rdb":                              make([]byte, 10),
+			},
+			container: "redis", dir: "/opt/bitnami/redis/data", path: "/data/dump.rdb", conf: "/opt/bitnami/redis/etc/redis.conf", warnings: 1,
+		},
+		{
+			name: "AOF only, options in a shell wrapper",
+			pod:  redisPod(corev1.Container{Name: "valkey", Image: "valkey/valkey:8.0", Command: []string{"sh", "-c", "exec valkey-server --dir /store --appendonly yes"}}),
+			fs: remoteFS{
+				"/store/appendonlydir/appendonly.aof.manifest": make([]byte, 3),
+			},
+			container: "valkey", dir: "/store", path: "/store/appendonlydir",
+		},
+		{
+			name:      "no RDB",
+			pod:       redisPod(corev1.Container{Name: "redis", Image: "redis:7.2", Args: []string{"--save", "''"}}),
+			container: "redis", dir: "/data", warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		kube := fakeKube(tt.fs, tt.pod)
+		pf, err := RunPreflight(context.Background(), kube, "cache", "redis-0")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if pf.Container != tt.container || pf.Dir != tt.dir || pf.Path != tt.path || pf.ConfigFile != tt.conf || len(pf.Warnings) != tt.warnings {
+			t.Errorf("%s: got %+v, want container %s dir %s path %s conf %s and %d warnings", tt.name, pf, tt.container, tt.dir, tt.path, tt.conf, tt.warnings)
+		}
+		if pf.Path != "" && (pf.Age < 60 || pf.Age > 120) {
+			t.Errorf("%s: snapshot age %ds, want a minute", tt.name, pf.Age)
+		}
+	}
+}
+
+// writeKubeconfig writes a kubeconfig with one context per name
+func writeKubeconfig(t *testing.T, current string, contexts ...string) string {
+	config := clientcmdapi.NewConfig()
+	for _, name := range contexts {
+		config.Clusters[name] = &clientcmdapi.Cluster{Server: "https://" + name + ".example:6443"}
+		config.AuthInfos[name] = &clientcmdapi.AuthInfo{Token: "token"}
+		config.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+	}
+	config.CurrentContext = current
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := clientcmd.WriteToFile(*config, path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClusters(t *testing.T) {
+	prod := writeKubeconfig(t, "prod-us", "prod-eu", "prod-us")
+	staging := writeKubeconfig(t, "", "staging", "prod-eu")
+	tests := []struct {
+		name        string
+		kubeconfigs string
+		contexts    string
+		want        []string
+		current     string
+	}{
+		{"all contexts", prod, "", []string{"prod-eu", "prod-us"}, "prod-us"},
+		{"several kubeconfigs, first context wins", prod + "," + staging, "", []string{"prod-eu", "prod-us", "staging"}, "prod-us"},
+		{"selected contexts", prod + "," + staging, "staging, prod-eu", []string{"prod-eu", "staging"}, "prod-eu"},
+	}
+	for _, tt := range tests {
+		t.Setenv("KUBECONFIGS", tt.kubeconfigs)
+		t.Setenv("KUBE_CONTEXTS", tt.contexts)
+		clusters, err := Clusters()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var names []string
+		current := ""
+		for _, c := range clusters {
+			names = append(names, c.Name)
+			if c.Current {
+				current = c.Name
+			}
+		}
+		if !reflect.DeepEqual(names, tt.want) || current != tt.current {
+			t.Errorf("%s: clusters %v current %s, want %v current %s", tt.name, names, current, tt.want, tt.current)
+		}
+		c, err := FindCluster("")
+		if err != nil || c.Name != tt.current {
+			t.Errorf("%s: default cluster %s (%v), want %s", tt.name, c.Name, err, tt.current)
+		}
+	}
+
+	t.Setenv("KUBECONFIGS", prod)
+	t.Setenv("KUBE_CONTEXTS", "")
+	if _, err := FindCluster("staging"); err == nil {
+		t.Error("found a cluster of another kubeconfig")
+	}
+	config, err := mustFindCluster(t, "prod-eu").restConfig()
+	if err != nil || config.Host != "https://prod-eu.example:6443" {
+		t.Errorf("prod-eu: host %v (%v)", config, err)
+	}
+}
+
+func mustFindCluster(t *testing.T, name string) Cluster {
+	c, err := FindCluster(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClusterID(t *testing.T) {
+	tests := []struct{ cluster, want string }{
+		{"prod-eu", "prod-eu"},
+		{"gke_my-project_europe-west1_prod", "gke-my-project-europe-west1-prod"},
+		{"arn:aws:eks:eu-west-1:123456789012:cluster/prod", "arn-aws-eks-eu-west-1-123456789012-cluster-prod"},
+	}
+	for _, tt := range tests {
+		if got := clusterID(tt.cluster); got != tt.want {
+			t.Errorf("clusterID(%q) = %q, want %q", tt.cluster, got, tt.want)
+		}
+	}
+}
@@ -22,6 +22,18 @@ type CounterDTO struct {
 	TypeNum            map[string]uint64      `json:"TypeNum"`
 	SlotBytes          map[int]uint64         `json:"SlotBytes"`
 	SlotNum            map[int]uint64         `json:"SlotNum"`
+	EncodingBytes      map[string]uint64      `json:"EncodingBytes"` // keys as Type|Encoding
+	EncodingNum        map[string]uint64      `json:"EncodingNum"`
+	EncodingBuckets    []*EncodingBucket      `json:"EncodingBuckets"`
+	RedisVersion       string                 `json:"RedisVersion"`
+	Profile            string                 `json:"Profile"`
+	Skipped            []*decoder.SkipStats   `json:"Skipped"`
+	DecodeError        string                 `json:"DecodeError"`
+	UntrimmedZSets     []*decoder.Entry       `json:"UntrimmedZSets"`
+	FlaggedStreams     []*decoder.Entry       `json:"FlaggedStreams"`
+	FieldTTL           FieldTTLSummary        `json:"FieldTTL"`
+	FieldTTLHashes     []*decoder.Entry       `json:"FieldTTLHashes"`
+	RDBMeta            *decoder.RDBMeta       `json:"RDBMeta"`
 }
 
 // Helper to convert complex map keys to string for JSON
@@ -70,11 +82,23 @@ func (c *Counter) ToDTO() *CounterDTO {
         KeyPrefixBytes:   make(map[string]uint64),
         KeyPrefixNum:     make(map[string]uint64),
         KeyPrefixDb:      make(map[string]string),
+        EncodingBytes:    make(map[string]uint64),
+        EncodingNum:      make(map[string]uint64),
+        EncodingBuckets:  c.GetEncodingBuckets(),
+        RedisVersion:     c.redisVersion,
+        Profile:          c.profile,
+        Skipped:          c.skipped,
+        DecodeError:      c.decodeError,
+        FieldTTL:         c.fieldTTL,
+        RDBMeta:          c.meta,
     }
 
     // Convert heaps to slices
     dto.LargestEntries = c.GetLargestEntries(500, 0)
     dto.LargestKeyPrefixes = c.GetLargestKeyPrefixes()
+    dto.UntrimmedZSets = c.GetUntrimmedZSets()
+    dto.FlaggedStreams = c.GetFlaggedStreams()
+    dto.FieldTTLHashes = c.GetFieldTTLHashes()
 
     // Convert maps with struct keys
     for k, v := range c.lengthLevelBytes {
@@ -83,15 +107,21 @@ func (c *Counter) ToDTO() *CounterDTO {
     for k, v := range c.lengthLevelNum {
         dto.LengthLevelNum[k.Type+"|"+k.Key] = v
     }
-    for k, v := range c.keyPrefixBytes {
-        dto.KeyPrefixBytes[k.Type+"|"+k.Key] = v
-    }
-    for k, v := range c.keyPrefixNum {
-        dto.KeyPrefixNum[k.Type+"|"+k.Key] = v
+    for t, counts := range c.keyPrefixes {
+        for k, p := range counts {
+            dto.KeyPrefixBytes[t+"|"+k] = p.bytes
+            dto.KeyPrefixNum[t+"|"+k] = p.num
+        }
     }
     for k, v := range c.keyPrefixDb {
         dto.KeyPrefixDb[k.Type+"|"+k.Key] = v
     }
+    for k, v := range c.encodingBytes {
+        dto.EncodingBytes[k.Type+"|"+k.Key] = v
+    }
+    for k, v := range c.encodingNum {
+        dto.EncodingNum[k.Type+"|"+k.Key] = v
+    }
 
     return dto
 }
@@ -114,6 +144,16 @@ func (dto *CounterDTO) ToCounter() *Counter {
     for _, e := range dto.LargestEntries {
         c.countLargestEntries(e, 500)
     }
+    for _, e := range dto.UntrimmedZSets {
+        c.countUntrimmedZSets(e, 100)
+    }
+    for _, e := range dto.FlaggedStreams {
+        c.countFlaggedStreams(e, 100)
+    }
+    for _, e := range dto.FieldTTLHashes {
+        pushTopEntry(c.fieldTTLHashes, e, 100)
+    }
+    c.fieldTTL = dto.FieldTTL
     // Note: largestKeyPrefixes is derived, but can be restored.
     // However, heap logic usually rebuilds. 
     // Actually Counter.count() builds heaps incrementally.
@@ -141,8 +181,25 @@ func (dto *CounterDTO) ToCounter() *Counter {
     // Restore Maps
     restoreMap(dto.LengthLevelBytes, c.lengthLevelBytes)
     restoreMap(dto.LengthLevelNum, c.lengthLevelNum)
-    restoreMap(dto.KeyPrefixBytes, c.keyPrefixBytes)
-    restoreMap(dto.KeyPrefixNum, c.keyPrefixNum)
+    restorePrefixes(dto.KeyPrefixBytes, dto.KeyPrefixNum, c.keyPrefixes)
+    restoreMap(dto.EncodingBytes, c.encodingBytes)
+    restoreMap(dto.EncodingNum, c.encodingNum)
+    c.redisVersion = dto.RedisVersion
+    c.profile = dto.Profile
+    c.skipped = dto.Skipped
+    c.decodeError = dto.DecodeError
+    c.meta = dto.RDBMeta
+    for _, b := range dto.EncodingBuckets {
+        if b.MinElems == 0 && b.MaxElems > 0 {
+            // stored before the buckets kept their smallest shape, when
+            // they spanned a power of two
+            b.MinElems, b.MinLen = b.MaxElems/2+1, b.MaxLen
+            if b.MaxLen > 1 {
+                b.MinLen = b.MaxLen/2 + 1
+            }
+        }
+        c.encodingBuckets[b.key()] = b
+    }
     
     // KeyPrefixDb
     for kStr, v := range dto.KeyPrefixDb {
@@ -160,6 +217,16 @@ func restoreMap(src map[string]uint64, dst map[typeKey]uint64) {
     }
 }
 
+func restorePrefixes(bytes, num map[string]uint64, dst map[string]map[string]*prefixCount) {
+    for kStr, v := range bytes {
+        t, k := parseTypeKey(kStr)
+        if dst[t] == nil {
+            dst[t] = map[string]*prefixCount{}
+        }
+        dst[t][k] = &prefixCount{bytes: v, num: num[kStr]}
+    }
+}
+
 func parseTypeKey(s string) (string, string) {
     // Split by first |
     // If key contains |, this is risky. 
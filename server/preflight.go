@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Preflight is what an import of a pod would copy, found before copying
+type Preflight struct {
+	Container  string         `json:"container"`
+	ConfigFile string         `json:"configFile,omitempty"` // the redis.conf read, if any
+	Dir        string         `json:"dir"`
+	DBFilename string         `json:"dbfilename"`
+	Path       string         `json:"path"` // the verified RDB or appendonlydir, empty if none
+	Age        int64          `json:"age"`  // seconds since Path was written
+	Candidates []RDBCandidate `json:"candidates"`
+	Warnings   []string       `json:"warnings,omitempty"`
+}
+
+// RDBCandidate is an RDB file or appendonlydir found in the pod
+type RDBCandidate struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"` // 0 for a directory
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// confPaths are where images and charts keep redis.conf, read when the
+// process arguments name none
+var confPaths = []string{
+	"/etc/redis/redis.conf",
+	"/usr/local/etc/redis/redis.conf",
+	"/opt/bitnami/redis/etc/redis.conf",
+	"/etc/redis.conf",
+	"/data/redis.conf",
+}
+
+// listRDBScript prints the stat of the RDB files and appendonlydirs of
+// directory $1, and of the file $2
+const listRDBScript = `cd "$1" 2>/dev/null || exit 0
+for f in "$2" *.rdb *.rdb.* appendonlydir*; do [ -e "$f" ] && stat -c "%s %Y %F %n" "$1/$f"; done
+true`
+
+// RunPreflight inspects a pod before an import: it picks the Redis container,
+// reads dir and dbfilename from the process arguments and redis.conf, and
+// lists the RDB files of the data directories.
+func RunPreflight(ctx context.Context, kube KubeClient, namespace, podName string) (*Preflight, error) {
+	pod, err := kube.GetPod(ctx, namespace, podName)
+	if err != nil {
+		return nil, err
+	}
+	pf := &Preflight{Container: GetDiscoveryRules().redisContainer(pod.Spec)}
+	var container corev1.Container
+	if len(pod.Spec.Containers) > 0 {
+		container = pod.Spec.Containers[0]
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == pf.Container {
+			container = c
+		}
+	}
+	exec := func(command ...string) ([]byte, error) {
+		var out bytes.Buffer
+		err := kube.Exec(ctx, namespace, podName, pf.Container, command, nil, &out)
+		return out.Bytes(), err
+	}
+
+	// The arguments of the spec, then those of the running process: a
+	// wrapper shell keeps them, redis-server replaces its own with a title
+	args := append(append([]string{}, container.Command...), container.Args...)
+	if out, err := exec("cat", "/proc/1/cmdline"); err == nil {
+		args = append(args, strings.Split(strings.TrimRight(string(out), "\x00"), "\x00")...)
+	}
+	conf, options := serverArgs(args)
+
+	cfg := redisConfig{dbfilename: "dump.rdb", appenddirname: "appendonlydir"}
+	paths := confPaths
+	if conf != "" {
+		paths = []string{conf}
+	}
+	for _, p := range paths {
+		data, err := exec("cat", p)
+		if err != nil {
+			continue
+		}
+		pf.ConfigFile = p
+		for _, include := range cfg.parseConf(data) {
+			if data, err := exec("cat", include); err == nil {
+				cfg.parseConf(data)
+			}
+		}
+		break
+	}
+	if conf != "" && pf.ConfigFile == "" {
+		pf.Warnings = append(pf.Warnings, fmt.Sprintf("Config file %s is not readable", conf))
+	}
+	// command line options override the file, the Bitnami chart passes
+	// its config with --include
+	for _, o := range options {
+		if o[0] != "include" {
+			continue
+		}
+		if data, err := exec("cat", o[1]); err == nil {
+			cfg.parseConf(data)
+		} else {
+			pf.Warnings = append(pf.Warnings, fmt.Sprintf("Config file %s is not readable", o[1]))
+		}
+	}
+	for _, o := range options {
+		cfg.set(o[0], o[1])
+	}
+
+	// A relative dir is relative to the working directory of the server
+	if !path.IsAbs(cfg.dir) {
+		wd := container.WorkingDir
+		if wd == "" {
+			if out, err := exec("pwd"); err == nil {
+				wd = strings.TrimSpace(string(out))
+			}
+		}
+		if wd == "" {
+			wd = "/data"
+		}
+		cfg.dir = path.Join(wd, cfg.dir)
+	}
+	pf.Dir, pf.DBFilename = cfg.dir, cfg.dbfilename
+
+	// The configured dir, then the volumes, where a mismatched config may
+	// have put the data
+	dirs := []string{cfg.dir}
+	for _, m := range container.VolumeMounts {
+		if !strings.HasPrefix(m.MountPath, "/var/run/secrets/") {
+			dirs = append(dirs, path.Clean(m.MountPath))
+		}
+	}
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		out, err := exec("sh", "-c", listRDBScript, "sh", dir, cfg.dbfilename)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range parseCandidates(out) {
+			if !seen[c.Path] {
+				seen[c.Path] = true
+				pf.Candidates = append(pf.Candidates, c)
+			}
+		}
+	}
+	sort.SliceStable(pf.Candidates, func(i, j int) bool {
+		return pf.Candidates[i].ModTime.After(pf.Candidates[j].ModTime)
+	})
+
+	pf.pick(cfg)
+	return pf, nil
+}
+
+// pick verifies the configured RDB, else the appendonlydir of an AOF
+// server, else the newest candidate
+func (pf *Preflight) pick(cfg redisConfig) {
+	find := func(p string) *RDBCandidate {
+		for i := range pf.Candidates {
+			if pf.Candidates[i].Path == p {
+				return &pf.Candidates[i]
+			}
+		}
+		return nil
+	}
+	rdb := path.Join(cfg.dir, cfg.dbfilename)
+	chosen := find(rdb)
+	aof := find(path.Join(cfg.dir, cfg.appenddirname))
+	if aof != nil && (chosen == nil || cfg.appendonly && aof.ModTime.After(chosen.ModTime)) {
+		chosen = aof
+	}
+	if chosen == nil {
+		for i := range pf.Candidates {
+			if !pf.Candidates[i].IsDir {
+				chosen = &pf.Candidates[i]
+				break
+			}
+		}
+		if chosen == nil {
+			pf.Warnings = append(pf.Warnings, fmt.Sprintf("No RDB found at %s or in the volumes of the container, persistence may be disabled", rdb))
+			return
+		}
+		pf.Warnings = append(pf.Warnings, fmt.Sprintf("%s not found, using the newest RDB %s", rdb, chosen.Path))
+	}
+	pf.Path = chosen.Path
+	age := time.Since(chosen.ModTime)
+	pf.Age = int64(age.Seconds())
+	if age > GetRDBStaleAfter() {
+		pf.Warnings = append(pf.Warnings, fmt.Sprintf("Snapshot is %s old", formatAge(age)))
+	}
+}
+
+// parseCandidates parses the output of listRDBScript
+func parseCandidates(out []byte) []RDBCandidate {
+	var candidates []RDBCandidate
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		// size mtime type name, the type may be "regular file"
+		fields := strings.SplitN(sc.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err1 := strconv.ParseInt(fields[0], 10, 64)
+		mtime, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		c := RDBCandidate{ModTime: time.Unix(mtime, 0)}
+		switch {
+		case strings.HasPrefix(fields[2], "directory "):
+			c.IsDir, c.Path = true, strings.TrimPrefix(fields[2], "directory ")
+		case strings.HasPrefix(fields[2], "regular file "):
+			c.Size, c.Path = size, strings.TrimPrefix(fields[2], "regular file ")
+		case strings.HasPrefix(fields[2], "regular empty file "):
+			c.Path = strings.TrimPrefix(fields[2], "regular empty file ")
+		default:
+			continue
+		}
+		c.Path = path.Clean(c.Path)
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// redisConfig is the persistence settings of a Redis server
+type redisConfig struct {
+	dir           string
+	dbfilename    string
+	appendonly    bool
+	appenddirname string
+}
+
+func (c *redisConfig) set(name, value string) {
+	switch strings.ToLower(name) {
+	case "dir":
+		c.dir = value
+	case "dbfilename":
+		c.dbfilename = value
+	case "appendonly":
+		c.appendonly = strings.EqualFold(value, "yes")
+	case "appenddirname":
+		c.appenddirname = value
+	}
+}
+
+// parseConf applies the directives of a redis.conf and returns its includes
+func (c *redisConfig) parseConf(data []byte) (includes []string) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		value = unquote(strings.TrimSpace(value))
+		if strings.EqualFold(name, "include") {
+			includes = append(includes, value)
+			continue
+		}
+		c.set(name, value)
+	}
+	return includes
+}
+
+// serverArgs finds the redis-server (or valkey/keydb) command in args,
+// splitting shell scripts into words, and returns its config file and
+// --name value options
+func serverArgs(args []string) (conf string, options [][2]string) {
+	var words []string
+	for _, a := range args {
+		words = append(words, strings.Fields(a)...)
+	}
+	start := -1
+	for i, w := range words {
+		switch path.Base(unquote(w)) {
+		case "redis-server", "valkey-server", "keydb-server":
+			start = i + 1
+		}
+	}
+	if start < 0 {
+		return "", nil
+	}
+	for i := start; i < len(words); i++ {
+		w := unquote(words[i])
+		switch {
+		case strings.HasPrefix(w, "--") && i+1 < len(words):
+			options = append(options, [2]string{w[2:], unquote(words[i+1])})
+			i++
+		case conf == "" && strings.HasSuffix(w, ".conf"):
+			conf = w
+		case w == ";" || w == "&&" || w == "|":
+			return conf, options
+		}
+	}
+	return conf, options
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
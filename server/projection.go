@@ -0,0 +1,354 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+	"github.com/urfave/cli"
+)
+
+const (
+	// projectionTopPrefixes is the number of prefixes a projection reports
+	projectionTopPrefixes = 100
+	// projectionKeyLen is the key length assumed for the keyspace overhead
+	// when projecting a stored analysis, which keeps no key names
+	projectionKeyLen = 24
+)
+
+// ProjectionDelta is the projected memory change of a group of keys
+type ProjectionDelta struct {
+	Keys        uint64
+	Bytes       uint64 // under the source profile
+	Projected   uint64 // under the target profile
+	Delta       int64
+	Conversions map[string]uint64 `json:",omitempty"` // "from->to" to number of keys
+}
+
+func (d *ProjectionDelta) add(from, to string, keys, bytes, projected uint64) {
+	d.Keys += keys
+	d.Bytes += bytes
+	d.Projected += projected
+	d.Delta += int64(projected) - int64(bytes)
+	if from != to && from != "" && to != "" {
+		if d.Conversions == nil {
+			d.Conversions = map[string]uint64{}
+		}
+		d.Conversions[from+"->"+to] += keys
+	}
+}
+
+// PrefixProjection is the projected change of the keys under a prefix
+type PrefixProjection struct {
+	Type   string
+	Prefix string
+	ProjectionDelta
+}
+
+// Projection re-estimates a dataset under the memory profile and encoding
+// rules of another server version
+type Projection struct {
+	Source   string
+	Target   string
+	Exact    bool // sized key by key from an RDB rather than from the histogram
+	Total    ProjectionDelta
+	Types    map[string]*ProjectionDelta
+	Prefixes []*PrefixProjection // largest changes first
+}
+
+func newProjection(target decoder.MemoryProfile, exact bool) *Projection {
+	return &Projection{
+		Target: target.Name(),
+		Exact:  exact,
+		Types:  map[string]*ProjectionDelta{},
+	}
+}
+
+func (p *Projection) add(typ, from, to string, keys, bytes, projected uint64) {
+	t := p.Types[typ]
+	if t == nil {
+		t = &ProjectionDelta{}
+		p.Types[typ] = t
+	}
+	t.add(from, to, keys, bytes, projected)
+	p.Total.add(from, to, keys, bytes, projected)
+}
+
+// setPrefixes keeps the prefixes with the largest changes
+func (p *Projection) setPrefixes(prefixes map[typeKey]*ProjectionDelta) {
+	p.Prefixes = make([]*PrefixProjection, 0, len(prefixes))
+	for k, d := range prefixes {
+		p.Prefixes = append(p.Prefixes, &PrefixProjection{Type: k.Type, Prefix: k.Key, ProjectionDelta: *d})
+	}
+	abs := func(n int64) int64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	sort.Slice(p.Prefixes, func(i, j int) bool {
+		a, b := p.Prefixes[i], p.Prefixes[j]
+		if abs(a.Delta) != abs(b.Delta) {
+			return abs(a.Delta) > abs(b.Delta)
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Prefix < b.Prefix
+	})
+	if len(p.Prefixes) > projectionTopPrefixes {
+		p.Prefixes = p.Prefixes[:projectionTopPrefixes]
+	}
+}
+
+// Project re-estimates a stored analysis under the target profile. Each
+// histogram bucket is re-encoded at its average shape, split where the
+// target's thresholds fall inside it, and prefixes are scaled by the change
+// of the encodings they hold.
+func (c *Counter) Project(target decoder.MemoryProfile) *Projection {
+	source := c.Profile()
+	ms, mt := decoder.NewMemProfiler(source), decoder.NewMemProfiler(target)
+	rs, rt := source.EncodingRules(), target.EncodingRules()
+	key := make([]byte, projectionKeyLen)
+	topLevel := int64(mt.TopLevelObjOverhead(key, 0)) - int64(ms.TopLevelObjOverhead(key, 0))
+
+	res := newProjection(target, false)
+	res.Source = source.Name()
+	// bytes before and after per type and encoding, to scale the prefixes
+	before := map[typeKey]uint64{}
+	after := map[typeKey]uint64{}
+	typeBefore := map[string]uint64{}
+	typeAfter := map[string]uint64{}
+	typeKeys := map[string]uint64{}
+	for _, b := range c.encodingBuckets {
+		for _, p := range b.split(rt) {
+			to := p.Encodings[0]
+			if to == "" {
+				to = b.Encoding
+			}
+			delta := int64(mt.EstimateEncodingBytes(p.Shape, to, rt)) - int64(ms.EstimateEncodingBytes(p.Shape, b.Encoding, rs))
+			projected := int64(p.Bytes) + (delta+topLevel)*int64(p.Keys)
+			if projected < 0 {
+				projected = 0
+			}
+			res.add(b.Type, b.Encoding, to, p.Keys, p.Bytes, uint64(projected))
+
+			k := typeKey{Type: b.Type, Key: b.Encoding}
+			before[k] += p.Bytes
+			after[k] += uint64(projected)
+			typeBefore[b.Type] += p.Bytes
+			typeAfter[b.Type] += uint64(projected)
+			typeKeys[b.Type] += p.Keys
+		}
+	}
+	// keys without an encoding (module types) keep their size
+	for typ, bytes := range c.typeBytes {
+		if bytes > typeBefore[typ] && c.typeNum[typ] > typeKeys[typ] {
+			res.add(typ, "", "", c.typeNum[typ]-typeKeys[typ], bytes-typeBefore[typ], bytes-typeBefore[typ])
+		}
+	}
+
+	scale := func(bytes, from, to uint64) uint64 {
+		if from == 0 {
+			return bytes
+		}
+		return uint64(float64(bytes) * float64(to) / float64(from))
+	}
+	prefixes := map[typeKey]*ProjectionDelta{}
+	for _, p := range c.GetLargestKeyPrefixes() {
+		var projected uint64
+		if len(p.Encodings) == 0 {
+			projected = scale(p.Bytes, typeBefore[p.Type], typeAfter[p.Type])
+		} else {
+			rest := p.Bytes
+			for enc, bytes := range p.Encodings {
+				k := typeKey{Type: p.Type, Key: enc}
+				projected += scale(bytes, before[k], after[k])
+				if bytes <= rest {
+					rest -= bytes
+				}
+			}
+			projected += rest
+		}
+		d := &ProjectionDelta{}
+		d.add("", "", p.Num, p.Bytes, projected)
+		prefixes[p.typeKey] = d
+	}
+	res.setPrefixes(prefixes)
+	return res
+}
+
+// ProjectRDB sizes every key of an RDB under its own profile, or source if
+// given, and under the target profile. The RDB may be compressed or archived,
+// or file may be a multi-part AOF directory.
+func ProjectRDB(file string, source *decoder.MemoryProfile, target decoder.MemoryProfile) (*Projection, error) {
+	d := decoder.NewDecoder()
+	if source != nil {
+		d.SetProfile(*source)
+	}
+	d.SetProjection(target)
+	errc := make(chan error, 1)
+	var in *Input
+	if decoder.IsAOFDir(file) {
+		go func() {
+			errc <- d.DecodeAOFDir(file, nil)
+		}()
+	} else {
+		var err error
+		if in, err = OpenInputFile(file, GetMaxRDBSize()); err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		go func() {
+			errc <- d.DecodeStream(in)
+		}()
+	}
+
+	res := newProjection(target, true)
+	prefixes := map[typeKey]*ProjectionDelta{}
+	scanner := newPrefixScanner(defaultSeparators)
+	for batch := range d.Entries {
+		for _, e := range batch {
+			res.add(e.Type, e.Encoding, e.ProjectedEncoding, 1, e.Bytes, e.ProjectedBytes)
+			scanner.each(e.Key, func(prefix []byte) {
+				k := typeKey{Type: e.Type, Key: string(prefix)}
+				p := prefixes[k]
+				if p == nil {
+					p = &ProjectionDelta{}
+					prefixes[k] = p
+				}
+				p.add(e.Encoding, e.ProjectedEncoding, 1, e.Bytes, e.ProjectedBytes)
+			})
+		}
+	}
+	err := <-errc
+	if in != nil && in.TooLarge() {
+		return nil, fmt.Errorf("decompressed RDB exceeds limit of %s", FormatSize(GetMaxRDBSize()))
+	}
+	if err := in.checkArchive(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Source = d.GetProfile().Name()
+	res.setPrefixes(prefixes)
+	return res, nil
+}
+
+// projectionHandler serves GET /api/projection?path=<instance>&target=<profile>
+func projectionHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing path parameter", 400)
+		return
+	}
+	c := counters.Get(path)
+	if c == nil {
+		http.Error(w, "Instance not found", 404)
+		return
+	}
+	target, err := decoder.ParseProfile(r.URL.Query().Get("target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.(*Counter).Project(target))
+}
+
+// Project is the project command: it projects a stored analysis or an RDB
+// file onto another server version
+func Project(c *cli.Context) error {
+	target, err := decoder.ParseProfile(c.String("target"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	var source *decoder.MemoryProfile
+	if c.IsSet("source") {
+		p, err := decoder.ParseProfile(c.String("source"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		source = &p
+	}
+
+	var res *Projection
+	switch {
+	case c.String("analysis") != "":
+		InitDB()
+		counter, err := LoadAnalysis(c.String("analysis"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if source != nil {
+			counter.profile = source.Name()
+		}
+		res = counter.Project(target)
+	case c.NArg() == 1:
+		res, err = ProjectRDB(c.Args().First(), source, target)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("failed to decode %s: %v", c.Args().First(), err), 1)
+		}
+	default:
+		return cli.NewExitError("give either an RDB file, an appendonlydir or --analysis <id>", 1)
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(c.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	printProjection(c, res)
+	return nil
+}
+
+func formatDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + FormatSize(-delta)
+	}
+	return "+" + FormatSize(delta)
+}
+
+func printProjection(c *cli.Context, res *Projection) {
+	fmt.Fprintf(c.App.Writer, "Projection %s -> %s", res.Source, res.Target)
+	if !res.Exact {
+		fmt.Fprint(c.App.Writer, " (estimated from the stored histogram)")
+	}
+	fmt.Fprintln(c.App.Writer)
+	fmt.Fprintln(c.App.Writer)
+
+	tw := tabwriter.NewWriter(c.App.Writer, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "TYPE\tKEYS\tBYTES\tPROJECTED\tDELTA\t")
+	types := make([]string, 0, len(res.Types))
+	for t := range res.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	row := func(name string, d *ProjectionDelta) {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t\n", name, d.Keys, FormatSize(int64(d.Bytes)), FormatSize(int64(d.Projected)), formatDelta(d.Delta))
+	}
+	for _, t := range types {
+		row(t, res.Types[t])
+	}
+	row("total", &res.Total)
+	tw.Flush()
+
+	if len(res.Prefixes) == 0 {
+		return
+	}
+	fmt.Fprintln(c.App.Writer)
+	tw = tabwriter.NewWriter(c.App.Writer, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "PREFIX\tTYPE\tKEYS\tBYTES\tPROJECTED\tDELTA\t")
+	for i, p := range res.Prefixes {
+		if i == 20 {
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t\n", p.Prefix, p.Type, p.Keys, FormatSize(int64(p.Bytes)), FormatSize(int64(p.Projected)), formatDelta(p.Delta))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+)
+
+// projectionKeys is the number of keys of each type in projectionRDB
+const projectionKeys = 50
+
+// writeProjectionRDB writes an RDB saved by Redis 6.2 whose hashes of 200
+// fields are ziplists, hashtables from 7.0 on, and whose sets of 100
+// strings are hashtables, listpacks from 7.2 on
+func writeProjectionRDB(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	enc := encoder.NewEncoder(f)
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(enc.WriteHeader())
+	check(enc.WriteAux("redis-ver", "6.2.14"))
+	check(enc.WriteAux("redis-bits", "64"))
+	check(enc.WriteDBHeader(0, 3*projectionKeys, 0))
+	for i := 0; i < projectionKeys; i++ {
+		fields := map[string][]byte{}
+		for j := 0; j < 200; j++ {
+			fields[fmt.Sprintf("f%d", j)] = []byte(fmt.Sprint(j))
+		}
+		check(enc.WriteHashMapObject(fmt.Sprintf("user:%d", i), fields))
+		var members [][]byte
+		for j := 0; j < 100; j++ {
+			members = append(members, []byte(fmt.Sprintf("tag-%d", j)))
+		}
+		check(enc.WriteSetObject(fmt.Sprintf("tags:%d", i), members))
+		check(enc.WriteStringObject(fmt.Sprintf("token:%d", i), []byte("0123456789abcdef")))
+	}
+	check(enc.WriteEnd())
+	return path
+}
+
+func TestProjection(t *testing.T) {
+	path := writeProjectionRDB(t)
+	target, err := decoder.ParseProfile("redis-7.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact, err := ProjectRDB(path, nil, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, _, err := AnalyzeFile(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimated := counter.Project(target)
+
+	tests := []struct {
+		typ, prefix, conversion string
+		grows                   int // sign of the delta
+	}{
+		{"hash", "user", "ziplist->hashtable", 1},
+		{"set", "tags", "hashtable->listpack", -1},
+		{"string", "token", "", 0},
+	}
+	for _, res := range []*Projection{exact, estimated} {
+		name := "ProjectRDB"
+		if !res.Exact {
+			name = "Project"
+		}
+		if res.Source != "redis-6.2/jemalloc/64" || res.Target != "redis-7.2/jemalloc/64" {
+			t.Errorf("%s: projected %s -> %s", name, res.Source, res.Target)
+		}
+		var delta int64
+		for _, tt := range tests {
+			d := res.Types[tt.typ]
+			if d == nil {
+				t.Errorf("%s: no %s keys", name, tt.typ)
+				continue
+			}
+			delta += d.Delta
+			if d.Keys != projectionKeys || d.Delta != int64(d.Projected)-int64(d.Bytes) {
+				t.Errorf("%s/%s: %+v", name, tt.typ, *d)
+			}
+			if sign(d.Delta) != tt.grows {
+				t.Errorf("%s/%s: delta %d, want a sign of %d", name, tt.typ, d.Delta, tt.grows)
+			}
+			if tt.conversion != "" && d.Conversions[tt.conversion] != projectionKeys {
+				t.Errorf("%s/%s: conversions %v, want %d %s", name, tt.typ, d.Conversions, projectionKeys, tt.conversion)
+			}
+			// the estimate from the histogram is close to sizing each key, an
+			// average shape may fall in another allocator size class
+			if e := exact.Types[tt.typ]; !res.Exact && absDiff(d.Projected, e.Projected) > e.Projected/8 {
+				t.Errorf("%s/%s: projected %d bytes, %d key by key", name, tt.typ, d.Projected, e.Projected)
+			}
+			// each type has a single prefix holding all its keys
+			var p *PrefixProjection
+			for _, pp := range res.Prefixes {
+				if pp.Type == tt.typ && pp.Prefix == tt.prefix {
+					p = pp
+				}
+			}
+			if p == nil || p.Keys != d.Keys || p.Bytes != d.Bytes || p.Delta != d.Delta {
+				t.Errorf("%s/%s: prefix %s %+v, want the type's delta %d", name, tt.typ, tt.prefix, p, d.Delta)
+			}
+		}
+		if res.Total.Keys != 3*projectionKeys || res.Total.Delta != delta {
+			t.Errorf("%s: total %+v, want a delta of %d", name, res.Total, delta)
+		}
+		// the largest change first
+		if len(res.Prefixes) != 3 || res.Prefixes[0].Prefix != "user" {
+			t.Errorf("%s: %d prefixes, first %+v", name, len(res.Prefixes), res.Prefixes[0])
+		}
+	}
+
+	// onto its own profile nothing changes
+	same := counter.Project(counter.Profile())
+	if same.Total.Delta != 0 || same.Total.Conversions != nil {
+		t.Errorf("projected onto its own profile: %+v", same.Total)
+	}
+	for _, p := range same.Prefixes {
+		if p.Delta != 0 {
+			t.Errorf("projected onto its own profile: prefix %s changes by %d", p.Prefix, p.Delta)
+		}
+	}
+
+	// the decompressed size limit of an analysis applies
+	t.Setenv("MAX_RDB_SIZE", "1Kb")
+	if _, err := ProjectRDB(path, nil, target); err == nil {
+		t.Error("RDB over MAX_RDB_SIZE projected")
+	}
+}
+
+func sign(n int64) int {
+	switch {
+	case n > 0:
+		return 1
+	case n < 0:
+		return -1
+	}
+	return 0
+}
+
+func absDiff(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -1,18 +1,41 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
 	"github.com/urfave/cli"
 )
 
 var counters = NewSafeMap()
 
+// InstanceInfo is where an analysis comes from, by analysis ID
+type InstanceInfo struct {
+	ID        string `json:"id"`
+	Cluster   string `json:"cluster"` // empty for analyses from before multi-cluster support
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+}
+
+var instanceInfo = NewSafeMap()
+
+// getInstanceInfo returns the origin of the analyses, by ID
+func getInstanceInfo() map[string]InstanceInfo {
+	info := map[string]InstanceInfo{}
+	for k, v := range instanceInfo.Items() {
+		info[k.(string)] = v.(InstanceInfo)
+	}
+	return info
+}
+
 func getInstances() []string {
 	keys := []string{}
 	for k := range counters.Items() {
@@ -35,6 +58,7 @@ func Show(c *cli.Context) {
 	// Initialize DB
 	InitDB()
 	LoadHistory()
+	SweepTempFiles()
 
 	// Init templates
 	InitHTMLTmpl(false, []string{"views"})
@@ -56,6 +80,13 @@ func Show(c *cli.Context) {
 	router.POST("/api/job/start", startJobHandler)
 	router.GET("/api/job/status", statusJobHandler)
     router.GET("/api/discovery", discoveryHandler)
+	router.GET("/api/clusters", clustersHandler)
+	router.GET("/api/preflight", preflightHandler)
+	router.POST("/api/ingest", ingestHandler)
+	router.GET("/api/encoding/whatif", encodingWhatIfHandler)
+	router.GET("/api/profiles", profilesHandler)
+	router.GET("/api/projection", projectionHandler)
+	router.GET("/api/keys/*keypath", keyElementsHandler)
 
 	// Get port from env var (RDR_PORT) or CLI flag or default
 	port := GetPort()
@@ -74,6 +105,7 @@ func Show(c *cli.Context) {
 func index(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	data := map[string]interface{}{}
 	data["Instances"] = getInstances()
+	data["InstanceInfo"] = getInstanceInfo()
 	
 	// Serve layout.html which includes other components
 	err := tmpl.ExecuteTemplate(w, "layout.html", data)
@@ -118,6 +150,10 @@ func apiAnalysis(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	data := map[string]interface{}{}
 	data["CurrentInstance"] = path
 	data["LargestKeys"] = counter.GetLargestEntries(topN, sizeFilter)
+	data["UntrimmedZSets"] = counter.GetUntrimmedZSets()
+	data["FlaggedStreams"] = counter.GetFlaggedStreams()
+	data["FieldTTL"] = counter.fieldTTL
+	data["FieldTTLHashes"] = counter.GetFieldTTLHashes()
 	
 	// Prefixes logic
 	largestKeyPrefixesByType := map[string][]*PrefixEntry{}
@@ -143,6 +179,12 @@ func apiAnalysis(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	data["TotalNum"] = totalNum
 	data["TotalBytes"] = totalBytes
 
+	// How far the estimate is from the used-mem Redis reported at save time
+	data["RDBMeta"] = counter.meta
+	if counter.meta != nil && counter.meta.UsedMem > 0 {
+		data["Calibration"] = float64(totalBytes) / float64(counter.meta.UsedMem)
+	}
+
 	// LenLevelCount
 	lenLevelCount := map[string][]*PrefixEntry{}
 	for _, entry := range counter.GetLenLevelCount() {
@@ -150,15 +192,29 @@ func apiAnalysis(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 	data["LenLevelCount"] = lenLevelCount
 
+	encodingNum, encodingBytes := counter.GetEncodingCount()
+	data["EncodingNum"] = encodingNum
+	data["EncodingBytes"] = encodingBytes
+	data["RedisVersion"] = counter.redisVersion
+	data["EncodingRules"] = counter.EncodingRules()
+	data["Profile"] = counter.Profile().Name()
+	data["Skipped"] = counter.skipped
+	data["SkippedKeys"] = counter.SkippedKeys()
+	data["DecodeError"] = counter.decodeError
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
 
 func startJobHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	type Request struct {
+		Cluster   string `json:"cluster"` // empty for the current cluster
 		Namespace string `json:"namespace"`
 		Pod       string `json:"pod"`
-		Path      string `json:"path"`
+		Container string `json:"container"` // empty to pick the Redis container
+		Path      string `json:"path"`      // empty to use the RDB found by a pre-flight
+		Profile   string `json:"profile"` // memory profile override, e.g. redis-7.2/jemalloc/64
+		RateLimit string `json:"rateLimit"` // bytes per second of the copy, e.g. 20Mb; empty for TRANSFER_JOB_RATE_LIMIT
 	}
 	var req Request
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -166,10 +222,52 @@ func startJobHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
-	id := GlobalJobManager.StartJob(req.Namespace, req.Pod, req.Path)
+	var profile *decoder.MemoryProfile
+	if req.Profile != "" {
+		p, err := decoder.ParseProfile(req.Profile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		profile = &p
+	}
+
+	rateLimit := GetTransferJobRateLimit()
+	switch req.RateLimit {
+	case "":
+	case "0":
+		rateLimit = 0
+	default:
+		l, err := parseSize(req.RateLimit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid rate limit %q: %v", req.RateLimit, err), http.StatusBadRequest)
+			return
+		}
+		rateLimit = l
+	}
+
+	cluster, err := FindCluster(req.Cluster)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := GlobalJobManager.StartJob(cluster.Name, req.Namespace, req.Pod, req.Container, req.Path, profile, rateLimit)
 	json.NewEncoder(w).Encode(map[string]string{"job_id": id})
 }
 
+// profilesHandler lists the memory profiles a job can be started with
+func profilesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	names := []string{}
+	for _, p := range decoder.Profiles() {
+		names = append(names, p.Name())
+		p.Allocator = decoder.AllocatorLibc
+		names = append(names, p.Name())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
 func statusJobHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	id := r.URL.Query().Get("id")
 	job := GlobalJobManager.GetStatus(id)
@@ -182,7 +280,7 @@ func statusJobHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 
 func discoveryHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
     fmt.Println("DEBUG: discoveryHandler reached")
-    res, err := DiscoverRedisResources()
+    res, err := DiscoverRedisResources(r.URL.Query().Get("cluster"))
     if err != nil {
         fmt.Printf("DEBUG: Discovery failed: %v\n", err)
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -192,4 +290,115 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Param
     json.NewEncoder(w).Encode(res)
 }
 
+// clustersHandler lists the clusters Redis can be discovered in
+func clustersHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	clusters, err := Clusters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clusters)
+}
+
+// preflightHandler inspects a pod for the RDB to import,
+// e.g. /api/preflight?cluster=prod&namespace=cache&pod=redis-replicas-0
+func preflightHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	if q.Get("namespace") == "" || q.Get("pod") == "" {
+		http.Error(w, "namespace and pod are required", http.StatusBadRequest)
+		return
+	}
+	kube, err := GetKubeClient(q.Get("cluster"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	pf, err := RunPreflight(ctx, kube, q.Get("namespace"), q.Get("pod"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pf)
+}
+
+// encodingWhatIfHandler simulates the memory change of other listpack/intset
+// thresholds, e.g. /api/encoding/whatif?path=<instance>&hash-max-listpack-entries=512
+func encodingWhatIfHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing path parameter", 400)
+		return
+	}
+	c := counters.Get(path)
+	if c == nil {
+		http.Error(w, "Instance not found", 404)
+		return
+	}
+	counter := c.(*Counter)
+
+	rules, err := parseEncodingRules(r, counter.EncodingRules())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counter.SimulateEncoding(rules))
+}
+
+// keyElementsHandler serves GET /api/keys/<key>/elements?path=<instance>[&db=N].
+// Only the largest keys of an analysis are kept, so other keys return 404.
+func keyElementsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	keyPath := strings.TrimPrefix(p.ByName("keypath"), "/")
+	if !strings.HasSuffix(keyPath, "/elements") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimSuffix(keyPath, "/elements")
 
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing path parameter", 400)
+		return
+	}
+	c := counters.Get(path)
+	if c == nil {
+		http.Error(w, "Instance not found", 404)
+		return
+	}
+	counter := c.(*Counter)
+
+	db := -1
+	if v := r.URL.Query().Get("db"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid db parameter", 400)
+			return
+		}
+		db = n
+	}
+
+	e := counter.FindLargestEntry(key, db)
+	if e == nil {
+		http.Error(w, "Key not found among the largest keys", 404)
+		return
+	}
+	if e.Elements == nil {
+		http.Error(w, "Key is too small for an element drill-down", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Key":       e.Key,
+		"Db":        e.Db,
+		"Type":      e.Type,
+		"Encoding":  e.Encoding,
+		"Bytes":     e.Bytes,
+		"NumOfElem": e.NumOfElem,
+		"Elements":  e.Elements,
+		"Scores":    e.Scores,
+	})
+}
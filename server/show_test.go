@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+)
+
+func TestKeyElementsHandler(t *testing.T) {
+	c := NewCounter()
+	elements := &decoder.ElementStats{
+		TopElements: []decoder.ElementSize{{Name: "big", Size: 4096}},
+		SizeDist:    []decoder.SizeBucket{{UpTo: 4096, Count: 1}},
+	}
+	for _, e := range []*decoder.Entry{
+		{Key: "queue:jobs", Type: "list", Db: 2, Bytes: 1 << 20, NumOfElem: 5000, Elements: elements},
+		{Key: "cache/page:1", Type: "hash", Bytes: 1 << 19, NumOfElem: 300, Elements: elements},
+		{Key: "small", Type: "set", Bytes: 100, NumOfElem: 3},
+	} {
+		c.count(e)
+	}
+	counters.Set("test-elements", c)
+	defer counters.Delete("test-elements")
+
+	router := httprouter.New()
+	router.GET("/api/keys/*keypath", keyElementsHandler)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		key    string
+		query  string
+		status int
+	}{
+		{"list", "queue:jobs/elements", "path=test-elements", http.StatusOK},
+		{"in its db", "queue:jobs/elements", "path=test-elements&db=2", http.StatusOK},
+		{"in another db", "queue:jobs/elements", "path=test-elements&db=0", http.StatusNotFound},
+		{"key with a slash", "cache/page:1/elements", "path=test-elements", http.StatusOK},
+		{"too small", "small/elements", "path=test-elements", http.StatusNotFound},
+		{"not among the largest", "other/elements", "path=test-elements", http.StatusNotFound},
+		{"not elements", "queue:jobs", "path=test-elements", http.StatusNotFound},
+		{"no path", "queue:jobs/elements", "", http.StatusBadRequest},
+		{"unknown instance", "queue:jobs/elements", "path=missing", http.StatusNotFound},
+		{"invalid db", "queue:jobs/elements", "path=test-elements&db=x", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + "/api/keys/" + (&url.URL{Path: tt.key}).EscapedPath() + "?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Key      string
+			Db       int
+			Elements *decoder.ElementStats
+		}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+			continue
+		}
+		if resp.StatusCode == http.StatusOK && (body.Elements == nil || len(body.Elements.TopElements) != 1 || body.Key+"/elements" != tt.key) {
+			t.Errorf("%s: %+v", tt.name, body)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	globalLimiterOnce sync.Once
+	globalLimiter     *rate.Limiter
+)
+
+// transferLimiter is the limiter of TRANSFER_RATE_LIMIT all copies share,
+// nil if unlimited
+func transferLimiter() *rate.Limiter {
+	globalLimiterOnce.Do(func() {
+		globalLimiter = newLimiter(GetTransferRateLimit())
+	})
+	return globalLimiter
+}
+
+// newLimiter limits to bytesPerSec with a burst of up to a second, nil if
+// bytesPerSec is 0
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(min(bytesPerSec, 1<<20)))
+}
+
+// throttledWriter writes to w no faster than each of its limiters allows
+type throttledWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+// throttle wraps w with the non-nil limiters, w itself if there are none
+func throttle(ctx context.Context, w io.Writer, limiters ...*rate.Limiter) io.Writer {
+	t := &throttledWriter{ctx: ctx, w: w}
+	for _, l := range limiters {
+		if l != nil {
+			t.limiters = append(t.limiters, l)
+		}
+	}
+	if len(t.limiters) == 0 {
+		return w
+	}
+	return t
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a wait cannot exceed the burst of a limiter
+		n := len(p)
+		for _, l := range t.limiters {
+			n = min(n, l.Burst())
+		}
+		for _, l := range t.limiters {
+			if err := l.WaitN(t.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// progressWriter reports the bytes written through it, after done bytes
+type progressWriter struct {
+	w        io.Writer
+	done     int64
+	progress func(done int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if p.progress != nil {
+		p.progress(p.done)
+	}
+	return n, err
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemoteFile is a file or an appendonlydir in a pod
+type RemoteFile struct {
+	Path    string
+	Size    int64 // for a directory, the size of all its files
+	ModTime time.Time
+	IsDir   bool
+}
+
+// StatRemote returns the size, modification time and type of path in a
+// container, the default one if container is empty
+func StatRemote(ctx context.Context, kube KubeClient, namespace, pod, container, path string) (*RemoteFile, error) {
+	var out bytes.Buffer
+	if err := kube.Exec(ctx, namespace, pod, container, []string{"stat", "-c", "%s %Y %F", path}, nil, &out); err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(strings.TrimSpace(out.String()), " ", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid stat output: %q", out.String())
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size output: %q", out.String())
+	}
+	mtime, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stat output: %q", out.String())
+	}
+	rf := &RemoteFile{Path: path, Size: size, ModTime: time.Unix(mtime, 0), IsDir: fields[2] == "directory"}
+	if !rf.IsDir {
+		return rf, nil
+	}
+
+	out.Reset()
+	if err := kube.Exec(ctx, namespace, pod, container, []string{"du", "-sb", path}, nil, &out); err != nil {
+		return nil, err
+	}
+	fields = strings.Fields(out.String())
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid size output: %q", out.String())
+	}
+	if rf.Size, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid size output: %q", fields[0])
+	}
+	return rf, nil
+}
+
+// CopyFromPod copies a file out of a container to localPath. A directory is
+// copied as a tar stream into the directory localPath.
+func CopyFromPod(ctx context.Context, kube KubeClient, namespace, pod, container string, rf *RemoteFile, localPath string) error {
+	exec := func(command []string, w io.Writer) error {
+		return kube.Exec(ctx, namespace, pod, container, command, nil, w)
+	}
+	if rf.IsDir {
+		return copyDirFromPod(exec, rf.Path, localPath)
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if err := exec([]string{"cat", rf.Path}, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copyDirFromPod extracts the tar stream of a directory, exec runs a command
+// in the container
+func copyDirFromPod(exec func(command []string, w io.Writer) error, path, localDir string) error {
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := untar(pr, localDir)
+		if err == nil {
+			// the padding after the end of the archive
+			io.Copy(io.Discard, pr)
+		}
+		// unblock the exec if extraction stopped early
+		pr.CloseWithError(io.ErrClosedPipe)
+		errc <- err
+	}()
+	err := exec([]string{"tar", "cf", "-", "-C", path, "."}, pw)
+	pw.CloseWithError(err)
+	if untarErr := <-errc; err == nil {
+		err = untarErr
+	}
+	return err
+}
+
+// untar extracts the regular files of a tar stream, subdirectories are
+// flattened as an appendonlydir has none
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Base(filepath.Clean("/" + hdr.Name))
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+}
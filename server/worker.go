@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/naufaruuu/redis-rdb-analyzer/decoder"
+	"github.com/urfave/cli"
+)
+
+// workerResultsFD is the file descriptor a worker writes its messages to,
+// its stdout and stderr are the server's log
+const workerResultsFD = 3
+
+// workerMessage is a line of the output of a worker: progress, then the
+// analysis or an error
+type workerMessage struct {
+	Progress float64     `json:"progress,omitempty"` // percent of the input read
+	Format   string      `json:"format,omitempty"`
+	Result   *CounterDTO `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// ErrWorkerMemory is a worker killed for exceeding its memory limit
+var ErrWorkerMemory = errors.New("worker exceeded memory")
+
+// Worker is the hidden worker command: it analyses a local RDB file or
+// appendonlydir for a job of the server, which started it, and streams the
+// analysis back
+func Worker(c *cli.Context) error {
+	out := os.NewFile(workerResultsFD, "results")
+	if _, err := out.Stat(); err != nil {
+		return cli.NewExitError("the worker command is run by the server for its jobs", 1)
+	}
+	defer out.Close()
+	var mu sync.Mutex
+	enc := json.NewEncoder(out)
+	send := func(m workerMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(m)
+	}
+
+	// The GC works harder before the server kills the worker
+	if limit := c.Int64("memory-limit"); limit > 0 {
+		debug.SetMemoryLimit(limit / 10 * 9)
+	}
+	var profile *decoder.MemoryProfile
+	if c.String("profile") != "" {
+		p, err := decoder.ParseProfile(c.String("profile"))
+		if err != nil {
+			send(workerMessage{Error: err.Error()})
+			return cli.NewExitError(err.Error(), 1)
+		}
+		profile = &p
+	}
+
+	var last time.Time
+	counter, format, err := AnalyzeFile(c.Args().First(), profile, func(done, total int64) {
+		if total > 0 && time.Since(last) >= 500*time.Millisecond {
+			last = time.Now()
+			send(workerMessage{Progress: float64(done) / float64(total) * 100})
+		}
+	})
+	if err != nil {
+		send(workerMessage{Format: format, Error: err.Error()})
+		return cli.NewExitError(err.Error(), 1)
+	}
+	send(workerMessage{Progress: 100, Format: format, Result: counter.ToDTO()})
+	return nil
+}
+
+// runWorker analyses a local RDB file or appendonlydir in a worker process,
+// killed if its memory exceeds memoryLimit bytes (0 for no limit), so a
+// pathological RDB cannot take the server down. progress is called with the
+// percent of the input read.
+func runWorker(ctx context.Context, file string, profile *decoder.MemoryProfile, memoryLimit int64, progress func(percent float64)) (*Counter, string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, "", fmt.Errorf("worker: %v", err)
+	}
+	args := []string{"worker", "--memory-limit", strconv.FormatInt(memoryLimit, 10)}
+	if profile != nil {
+		args = append(args, "--profile", profile.Name())
+	}
+	args = append(args, file)
+
+	results, w, err := os.Pipe()
+	if err != nil {
+		return nil, "", fmt.Errorf("worker: %v", err)
+	}
+	defer results.Close()
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{w} // fd 3
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("worker: %v", err)
+	}
+
+	// The kernel may not limit the worker, the server watches it
+	var exceeded atomic.Int64
+	done := make(chan struct{})
+	defer close(done)
+	if memoryLimit > 0 {
+		go func() {
+			ticker := time.NewTicker(200 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if rss := processRSS(cmd.Process.Pid); rss > memoryLimit {
+						exceeded.Store(rss)
+						cmd.Process.Kill()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var result workerMessage
+	dec := json.NewDecoder(results)
+	for {
+		var m workerMessage
+		if err := dec.Decode(&m); err != nil {
+			break
+		}
+		if m.Progress > 0 && progress != nil {
+			progress(m.Progress)
+		}
+		if m.Result != nil || m.Error != "" {
+			result = m
+		}
+	}
+	waitErr := cmd.Wait()
+
+	if rss := exceeded.Load(); rss > 0 {
+		return nil, result.Format, fmt.Errorf("%w: %s used, the limit is %s (WORKER_MEMORY_LIMIT)", ErrWorkerMemory, FormatSize(rss), FormatSize(memoryLimit))
+	}
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) && ctx.Err() == nil {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGKILL {
+			return nil, result.Format, fmt.Errorf("%w: killed, likely by the kernel out of memory", ErrWorkerMemory)
+		}
+	}
+	if result.Error != "" {
+		return nil, result.Format, errors.New(result.Error)
+	}
+	if result.Result == nil {
+		if waitErr == nil {
+			waitErr = io.ErrUnexpectedEOF
+		}
+		return nil, result.Format, fmt.Errorf("worker failed: %v", waitErr)
+	}
+	return result.Result.ToCounter(), result.Format, nil
+}
+
+// processRSS returns the resident memory of a process, 0 if unknown. Only
+// Linux has /proc.
+func processRSS(pid int) int64 {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		// VmRSS:	  123456 kB
+		if value, ok := bytes.CutPrefix(sc.Bytes(), []byte("VmRSS:")); ok {
+			var kb int64
+			fmt.Sscanf(string(value), "%d", &kb)
+			return kb << 10
+		}
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRunWorkerMemoryLimit checks that a worker over its memory limit is
+// killed, which needs the /proc of Linux to watch it
+func TestRunWorkerMemoryLimit(t *testing.T) {
+	// a FIFO nothing writes to keeps the worker running until it is killed
+	fifo := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, _, err := runWorker(ctx, fifo, nil, 1<<10, nil)
+	if !errors.Is(err, ErrWorkerMemory) {
+		t.Errorf("err = %v, want %v", err, ErrWorkerMemory)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// TestMain runs the worker command when runWorker starts the test binary
+// as a worker
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		app := cli.NewApp()
+		app.Commands = []cli.Command{{
+			Name:   "worker",
+			Action: Worker,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "profile"},
+				cli.Int64Flag{Name: "memory-limit"},
+			},
+		}}
+		if err := app.Run(os.Args); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRunWorker(t *testing.T) {
+	var progress []float64
+	counter, format, err := runWorker(context.Background(), "../decoder/testdata/redis-7.4-hfe.rdb", nil, 0, func(p float64) {
+		progress = append(progress, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != FormatRDB {
+		t.Errorf("format = %q, want %q", format, FormatRDB)
+	}
+	if len(counter.typeNum) == 0 {
+		t.Error("worker counted no keys")
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 100 {
+		t.Errorf("progress = %v, want it to end at 100", progress)
+	}
+
+	// Errors of the worker are errors of the job
+	if _, _, err := runWorker(context.Background(), "../decoder/testdata", nil, 0, nil); err == nil || !strings.Contains(err.Error(), "no AOF manifest") {
+		t.Errorf("directory without manifest: err = %v", err)
+	}
+	if _, _, err := runWorker(context.Background(), "missing.rdb", nil, 0, nil); err == nil {
+		t.Error("missing file: want an error")
+	}
+}